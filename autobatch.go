@@ -0,0 +1,150 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// autoBatcher accumulates the calls made to every peer for a short window
+// and sends them together over a single stream (see WithAutoBatch).
+type autoBatcher struct {
+	c        *Client
+	window   time.Duration
+	maxBatch int // zero means no limit
+
+	mu      sync.Mutex
+	pending map[peer.ID]*autoBatch
+}
+
+// autoBatch holds the calls waiting to be sent to a peer.
+type autoBatch struct {
+	calls    []*Call
+	answered sync.WaitGroup // the callers which are done waiting
+	timer    *time.Timer
+}
+
+func newAutoBatcher(c *Client, window time.Duration, maxBatch int) *autoBatcher {
+	return &autoBatcher{
+		c:        c,
+		window:   window,
+		maxBatch: maxBatch,
+		pending:  make(map[peer.ID]*autoBatch),
+	}
+}
+
+// batchable reports whether the call can be sent in a batch. Calls with a
+// trace are timed on a stream of their own, and the server is only told
+// why calls are cancelled when they have a stream of their own too (see
+// WithCancelReasons). Batches use the protocol negotiated for the peer, so
+// calls overriding it (see WithProtocol) are not batched either.
+func (b *autoBatcher) batchable(call *Call) bool {
+	return call.opts.trace == nil && !b.c.cancelReasons && call.opts.protocol == ""
+}
+
+// send adds the call to the batch for its peer and waits for it to
+// complete, or for its context to be done.
+func (b *autoBatcher) send(call *Call) {
+	// The call delivered by the session is a copy, since the session
+	// does not know when the original one is done, and so is the
+	// reply, which the caller may not be waiting for anymore by the
+	// time it is decoded.
+	batched := &Call{
+		Dest:  call.Dest,
+		SvcID: call.SvcID,
+		Args:  call.Args,
+		Reply: privateReply(call.Reply),
+		Done:  make(chan *Call, 1),
+		ctx:   call.ctx,
+		opts:  call.opts,
+	}
+
+	b.mu.Lock()
+	batch, ok := b.pending[call.Dest]
+	if !ok {
+		batch = &autoBatch{}
+		b.pending[call.Dest] = batch
+		dest := call.Dest
+		batch.timer = time.AfterFunc(b.window, func() {
+			b.flush(dest, batch)
+		})
+	}
+	batch.calls = append(batch.calls, batched)
+	batch.answered.Add(1)
+	full := b.maxBatch > 0 && len(batch.calls) >= b.maxBatch
+	if full {
+		delete(b.pending, call.Dest)
+	}
+	b.mu.Unlock()
+	defer batch.answered.Done()
+	if full && batch.timer.Stop() {
+		go b.flush(call.Dest, batch)
+	}
+
+	select {
+	case <-batched.Done:
+		call.Error = batched.Error
+		call.transport = batched.transport
+		if call.Error == nil {
+			setReply(call.Reply, batched.Reply)
+		}
+	case <-call.ctx.Done():
+		call.Error = call.ctx.Err()
+	}
+}
+
+// flush sends the calls in the batch over a new session, and closes it
+// once all of them are answered or given up on.
+func (b *autoBatcher) flush(dest peer.ID, batch *autoBatch) {
+	b.mu.Lock()
+	if b.pending[dest] == batch {
+		delete(b.pending, dest)
+	}
+	calls := batch.calls
+	b.mu.Unlock()
+
+	s, err := b.c.Session(b.c.closing, dest)
+	if err != nil {
+		for _, call := range calls {
+			call.Error = err
+			call.transport = true
+			call.done()
+		}
+		return
+	}
+	defer s.Close()
+
+	s.wmu.Lock()
+	sent := 0 // the calls done with or handed to the session
+	for _, call := range calls {
+		if err := call.ctx.Err(); err != nil {
+			call.Error = err
+			call.done()
+			sent++
+			continue
+		}
+		var id uint64
+		if id, err = s.add(call); err != nil {
+			break
+		}
+		sent++
+		if err = s.writeRequest(id, call); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = s.sw.w.Flush()
+	}
+	s.wmu.Unlock()
+	if err != nil {
+		// This fails the calls handed to the session too.
+		s.fail(err)
+		for _, call := range calls[sent:] {
+			call.Error = err
+			call.transport = true
+			call.done()
+		}
+	}
+	batch.answered.Wait()
+}
@@ -0,0 +1,116 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// BatchResult holds the outcome of a call in a Batch.
+type BatchResult struct {
+	Error error
+	// Transient is set when the call failed because of a transport
+	// error, or because the server was temporarily unable to run it
+	// (ErrOverloaded, ErrShuttingDown, ErrPaused, ErrQueueFull,
+	// ErrTooManyStreams). Such calls are retried by RetryFailed. Errors
+	// returned by methods are never transient.
+	Transient bool
+}
+
+// Batch groups calls, possibly to different peers, which are performed
+// concurrently. Calls are added with Add and performed with Run. A Batch
+// must not be used concurrently.
+type Batch struct {
+	c       *Client
+	calls   []*Call
+	results []BatchResult
+}
+
+// NewBatch returns an empty Batch of calls to be performed by the client.
+func (c *Client) NewBatch() *Batch {
+	return &Batch{c: c}
+}
+
+// Add adds a call to the batch and returns its index, which identifies
+// it among the results.
+func (b *Batch) Add(dest peer.ID, svcName, svcMethod string, args, reply interface{}, opts ...CallOption) int {
+	call := &Call{
+		Dest:  dest,
+		SvcID: ServiceID{svcName, svcMethod},
+		Args:  args,
+		Reply: reply,
+	}
+	for _, opt := range opts {
+		opt(&call.opts)
+	}
+	b.calls = append(b.calls, call)
+	b.results = append(b.results, BatchResult{})
+	return len(b.calls) - 1
+}
+
+// Run performs all the calls in the batch, concurrently and bound to the
+// given context, and waits for them to finish. It returns their results,
+// in the order in which they were added.
+func (b *Batch) Run(ctx context.Context) []BatchResult {
+	all := make([]int, len(b.calls))
+	for i := range all {
+		all[i] = i
+	}
+	b.run(ctx, all)
+	return b.Results()
+}
+
+// RetryFailed performs again only the calls which failed transiently the
+// last time that they were performed, and returns the updated results for
+// all the calls. Calls which succeeded or failed with an application
+// error are not performed again.
+func (b *Batch) RetryFailed(ctx context.Context) []BatchResult {
+	b.run(ctx, b.Failed())
+	return b.Results()
+}
+
+// Results returns the current results of the calls in the batch. Calls
+// which have not been performed yet have empty results.
+func (b *Batch) Results() []BatchResult {
+	results := make([]BatchResult, len(b.results))
+	copy(results, b.results)
+	return results
+}
+
+// Failed returns the indexes of the calls which failed transiently in
+// their last attempt.
+func (b *Batch) Failed() []int {
+	var failed []int
+	for i, res := range b.results {
+		if res.Transient {
+			failed = append(failed, i)
+		}
+	}
+	return failed
+}
+
+// run performs the calls with the given indexes concurrently.
+func (b *Batch) run(ctx context.Context, indexes []int) {
+	var wg sync.WaitGroup
+	for _, i := range indexes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.results[i] = b.perform(ctx, b.calls[i])
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (b *Batch) perform(ctx context.Context, template *Call) BatchResult {
+	done := make(chan *Call, 1)
+	opts := []CallOption{func(o *callOptions) { *o = template.opts }}
+	b.c.GoContext(ctx, template.Dest, template.SvcID.Name, template.SvcID.Method,
+		template.Args, template.Reply, done, opts...)
+	call := <-done
+	return BatchResult{
+		Error:     call.Error,
+		Transient: ctx.Err() == nil && isTransient(call),
+	}
+}
@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// BenchmarkOptions configures Client.Benchmark.
+type BenchmarkOptions struct {
+	// Concurrency is the number of calls kept in progress at the same
+	// time. It defaults to 1.
+	Concurrency int
+	// Duration is how long calls are made for. It defaults to 10
+	// seconds.
+	Duration time.Duration
+	// Calls, when positive, stops the benchmark once that many calls
+	// have been made, even if the duration has not passed.
+	Calls int
+	// CallOptions are passed to every call.
+	CallOptions []CallOption
+}
+
+// BenchmarkResult holds the measurements made by Client.Benchmark.
+type BenchmarkResult struct {
+	// Calls is the number of calls completed, including failed ones.
+	Calls int
+	// Errors is the number of calls which failed.
+	Errors int
+	// Elapsed is how long the benchmark took.
+	Elapsed time.Duration
+	// Throughput is the number of calls completed per second.
+	Throughput float64
+	// ErrorRate is the fraction of calls which failed.
+	ErrorRate float64
+	// Latency percentiles and maximum, over all the calls.
+	P50, P90, P99, Max time.Duration
+}
+
+// Benchmark measures the capacity of a peer by calling the given method
+// with the given arguments repeatedly, keeping the configured number of
+// calls in progress, until the duration passes, the number of calls is
+// reached or the context is cancelled. Replies are discarded. Calls
+// aborted by the end of the benchmark are not counted.
+func (c *Client) Benchmark(ctx context.Context, dest peer.ID, svcName, svcMethod string, args interface{}, opts BenchmarkOptions) BenchmarkResult {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	failed := 0
+	started := 0
+	// next reports whether another call should be made.
+	next := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if ctx.Err() != nil || (opts.Calls > 0 && started >= opts.Calls) {
+			return false
+		}
+		started++
+		return true
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(opts.Concurrency)
+	for i := 0; i < opts.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for next() {
+				callStart := time.Now()
+				err := c.CallContext(ctx, dest, svcName, svcMethod, args, nil, opts.CallOptions...)
+				latency := time.Since(callStart)
+				if err != nil && ctx.Err() != nil {
+					// Aborted by the end of the benchmark.
+					return
+				}
+				mu.Lock()
+				latencies = append(latencies, latency)
+				if err != nil {
+					failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	res := BenchmarkResult{
+		Calls:   len(latencies),
+		Errors:  failed,
+		Elapsed: time.Since(start),
+	}
+	if res.Calls == 0 {
+		return res
+	}
+	res.Throughput = float64(res.Calls) / res.Elapsed.Seconds()
+	res.ErrorRate = float64(res.Errors) / float64(res.Calls)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+	res.P50, res.P90, res.P99 = percentile(50), percentile(90), percentile(99)
+	res.Max = latencies[len(latencies)-1]
+	return res
+}
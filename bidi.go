@@ -0,0 +1,42 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+)
+
+// Peer bundles a Server and a Client sharing a host and a protocol. It
+// lets a peer serve calls and make them too, so that two peers running a
+// Peer each can call each other in either direction, including from
+// within the handlers of the calls they receive (see Callback).
+type Peer struct {
+	Server *Server
+	Client *Client
+}
+
+// NewPeer returns a Peer built around the given server. The client is
+// created with the given options and uses the server directly for calls
+// to the local peer (see NewClientWithServer).
+func NewPeer(s *Server, opts ...ClientOption) *Peer {
+	return &Peer{
+		Server: s,
+		Client: NewClientWithServer(s.host, s.protocol, s, opts...),
+	}
+}
+
+// Callback performs a call to the peer which made the call whose handler
+// received the given context, which the call inherits. The caller must be
+// running a Server for the same protocol, usually as part of a Peer.
+func (p *Peer) Callback(ctx context.Context, svcName, svcMethod string, args, reply interface{}) error {
+	caller, ok := CallerFromContext(ctx)
+	if !ok {
+		return errors.New("rpc: callbacks can only be made from call handlers")
+	}
+	return p.Client.CallContext(ctx, caller, svcName, svcMethod, args, reply)
+}
+
+// Shutdown closes the client and then shuts the server down. See the
+// Shutdown function.
+func (p *Peer) Shutdown(ctx context.Context) error {
+	return Shutdown(ctx, p.Server, p.Client)
+}
@@ -0,0 +1,194 @@
+package rpc
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// replyCache holds the replies of the calls to cacheable methods, by the
+// hash of their parameters, evicting the least recently used ones beyond
+// the maximum number of entries (see WithClientCache).
+type replyCache struct {
+	ttl        time.Duration
+	maxEntries int
+	methods    map[ServiceID]bool
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+// cacheEntry is a reply held by a replyCache.
+type cacheEntry struct {
+	key     [sha256.Size]byte
+	dest    peer.ID
+	svcID   ServiceID
+	reply   []byte // the encoded reply
+	expires time.Time
+}
+
+func newReplyCache(ttl time.Duration, maxEntries int, methods []ServiceID) *replyCache {
+	rc := &replyCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		methods:    make(map[ServiceID]bool, len(methods)),
+		lru:        list.New(),
+		entries:    make(map[[sha256.Size]byte]*list.Element),
+	}
+	for _, svcID := range methods {
+		rc.methods[svcID] = true
+	}
+	return rc
+}
+
+// get returns the encoded reply cached for the given key, if any and not
+// expired.
+func (rc *replyCache) get(key [sha256.Size]byte) ([]byte, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	el, ok := rc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		rc.remove(el)
+		return nil, false
+	}
+	rc.lru.MoveToFront(el)
+	return entry.reply, true
+}
+
+func (rc *replyCache) put(entry *cacheEntry) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if el, ok := rc.entries[entry.key]; ok {
+		rc.remove(el)
+	}
+	rc.entries[entry.key] = rc.lru.PushFront(entry)
+	for rc.maxEntries > 0 && rc.lru.Len() > rc.maxEntries {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// remove drops an entry. The mutex must be held.
+func (rc *replyCache) remove(el *list.Element) {
+	rc.lru.Remove(el)
+	delete(rc.entries, el.Value.(*cacheEntry).key)
+}
+
+// invalidate drops the entries matching the given function.
+func (rc *replyCache) invalidate(match func(*cacheEntry) bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for el := rc.lru.Front(); el != nil; {
+		next := el.Next()
+		if match(el.Value.(*cacheEntry)) {
+			rc.remove(el)
+		}
+		el = next
+	}
+}
+
+// callCached performs a call to a cacheable method, returning the cached
+// reply, if any, without performing it. Otherwise, the reply is cached
+// once the call succeeds. Replies are cached encoded, so that callers
+// modifying them do not modify the cache.
+func (c *Client) callCached(ctx context.Context, dest peer.ID, svcID ServiceID, args, reply interface{}, o callOptions, opts []CallOption) error {
+	// Replies fetched with some credentials must not be served to
+	// callers sending other ones, or none.
+	key, err := c.flightKey(dest, svcID, args, o.fieldMask, outgoingMetadata(ctx), string(o.protocol))
+	if err != nil {
+		return err
+	}
+	if cached, ok := c.cache.get(key); ok {
+		return c.callFromCache(ctx, dest, svcID, reply, cached)
+	}
+
+	target := reply
+	if target == nil {
+		var discard interface{}
+		target = &discard
+	}
+	if o.singleflight && o.trace == nil {
+		err = c.callShared(ctx, dest, svcID, args, target, opts)
+	} else {
+		err = c.call(ctx, dest, svcID, args, target, opts)
+	}
+	if err != nil {
+		return err
+	}
+	encoded, err := marshalPayload(c.msgpackHandle, nil, target, nil)
+	if err != nil {
+		return err
+	}
+	c.cache.put(&cacheEntry{
+		key:     key,
+		dest:    dest,
+		svcID:   svcID,
+		reply:   encoded,
+		expires: time.Now().Add(c.cache.ttl),
+	})
+	return nil
+}
+
+// callFromCache completes a call with a cached reply. Like any other
+// call, it fails once the client is closed or draining, and it goes
+// through the client interceptors and call stats.
+func (c *Client) callFromCache(ctx context.Context, dest peer.ID, svcID ServiceID, reply interface{}, cached []byte) error {
+	if err := checkReply(svcID, reply); err != nil {
+		return err
+	}
+	if c.closing.Err() != nil {
+		return ErrClientClosed
+	}
+	if !c.outstanding.begin() {
+		return ErrClientDraining
+	}
+	defer c.outstanding.end()
+
+	ctx, requestID := c.requestContext(ctx)
+	info := CallInfo{
+		Peer:      dest,
+		Service:   svcID.Name,
+		Method:    svcID.Method,
+		Start:     time.Now(),
+		RequestID: requestID,
+	}
+	err := c.intercept(ctx, info, func(ctx context.Context) error {
+		if reply == nil {
+			return nil
+		}
+		return unmarshalPayload(c.msgpackHandle, nil, cached, reply, nil)
+	})
+	c.callStats.record(info, err)
+	return err
+}
+
+// InvalidateCache drops the replies cached for calls to the given method
+// of the given peer, or of all the peers when dest is empty, so that the
+// next calls are performed again (see WithClientCache). It is typically
+// called after calls which modify what the method returns.
+func (c *Client) InvalidateCache(dest peer.ID, svcName, svcMethod string) {
+	if c.cache == nil {
+		return
+	}
+	svcID := ServiceID{svcName, svcMethod}
+	c.cache.invalidate(func(entry *cacheEntry) bool {
+		return entry.svcID == svcID && (dest == "" || entry.dest == dest)
+	})
+}
+
+// ClearCache drops all the replies cached by the client (see
+// WithClientCache).
+func (c *Client) ClearCache() {
+	if c.cache == nil {
+		return
+	}
+	c.cache.invalidate(func(*cacheEntry) bool { return true })
+}
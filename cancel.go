@@ -0,0 +1,110 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// cancelReasonTimeout bounds the time spent sending a cancellation
+// reason before giving up and resetting the stream.
+const cancelReasonTimeout = time.Second
+
+// CancelError is the cause, obtained with context.Cause, of the
+// cancellation of the context of a method when the client aborted the
+// call and reported why (see WithCancelReasons). It matches
+// context.DeadlineExceeded, when the client gave up because of its
+// deadline, or context.Canceled otherwise, with errors.Is.
+type CancelError struct {
+	// Reason describes why the client aborted the call.
+	Reason string
+	// DeadlineExceeded is set when the client gave up because the
+	// deadline of the call expired.
+	DeadlineExceeded bool
+}
+
+func (e *CancelError) Error() string {
+	return "rpc: call cancelled by the client: " + e.Reason
+}
+
+// Unwrap returns context.DeadlineExceeded or context.Canceled.
+func (e *CancelError) Unwrap() error {
+	if e.DeadlineExceeded {
+		return context.DeadlineExceeded
+	}
+	return context.Canceled
+}
+
+// cancelError returns the CancelError describing why the given context
+// is done.
+func cancelError(ctx context.Context) *CancelError {
+	cause := context.Cause(ctx)
+	return &CancelError{
+		Reason:           cause.Error(),
+		DeadlineExceeded: errors.Is(cause, context.DeadlineExceeded),
+	}
+}
+
+// sendCancelReason tells the server why the call on the given stream was
+// aborted, when the client reports it (see WithCancelReasons). The
+// stream is closed, rather than reset, so that the server gets to read
+// it, and the pending read of the response is interrupted. It returns
+// false when nothing could be sent, in which case the stream should be
+// reset as usual.
+func (c *Client) sendCancelReason(sw *streamWrap, ctx context.Context) bool {
+	// Do not wait for the request to be written, nor send
+	// anything in the middle of it.
+	if !c.cancelReasons || !sw.wmu.TryLock() {
+		return false
+	}
+	defer sw.wmu.Unlock()
+	if !sw.requestSent {
+		return false
+	}
+	sw.stream.SetWriteDeadline(time.Now().Add(cancelReasonTimeout))
+	trailer := RequestHeader{Cancel: cancelError(ctx)}
+	if err := sw.enc.Encode(trailer); err != nil {
+		return false
+	}
+	if err := sw.w.Flush(); err != nil {
+		return false
+	}
+	sw.cancelSent = true
+	sw.stream.Close()
+	sw.stream.SetReadDeadline(time.Now())
+	return true
+}
+
+// headerAhead is a request header read while a method was running.
+type headerAhead struct {
+	header RequestHeader
+	err    error
+}
+
+// watchCancel keeps reading the stream while the method of a request
+// runs, so that a cancellation reason sent by the client cancels the
+// given context with a CancelError as cause. Anything else read is left
+// for the next call to nextHeader, since clients only send a request
+// once the previous one has been answered.
+func (server *Server) watchCancel(s *streamWrap, cancel context.CancelCauseFunc) {
+	ahead := make(chan headerAhead, 1)
+	s.ahead = ahead
+	go func() {
+		header, err := server.readHeader(s)
+		if err == nil && header.Cancel != nil {
+			cancel(header.Cancel)
+		}
+		ahead <- headerAhead{header, err}
+	}()
+}
+
+// nextHeader returns the header of the next request on the stream, which
+// may have been read already by watchCancel.
+func (server *Server) nextHeader(s *streamWrap) (RequestHeader, error) {
+	if s.ahead == nil {
+		return server.readHeader(s)
+	}
+	ahead := <-s.ahead
+	s.ahead = nil
+	return ahead.header, ahead.err
+}
@@ -3,13 +3,32 @@ package rpc
 import (
 	"context"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"reflect"
+	"sync/atomic"
+	"time"
 
 	host "github.com/libp2p/go-libp2p-host"
 	peer "github.com/libp2p/go-libp2p-peer"
 	protocol "github.com/libp2p/go-libp2p-protocol"
+	codec "github.com/ugorji/go/codec"
 )
 
+// DefaultDeadlinePropagationMargin is the default time by which the
+// deadlines sent to servers are brought forward. See
+// WithDeadlinePropagationMargin.
+const DefaultDeadlinePropagationMargin = 10 * time.Millisecond
+
+// DefaultActivePeersWindow is the default time for which a peer counts as
+// active after a call to it. See WithActivePeersWindow.
+const DefaultActivePeersWindow = time.Minute
+
+// DefaultMaxDecompressedSize is the default limit for the size of
+// compressed replies once decompressed. See WithMaxDecompressedSize.
+const DefaultMaxDecompressedSize = 64 << 20
+
 // Call represents an active RPC. Calls are used to indicate completion
 // of RPC requests and are returned within the provided channel in
 // the Go() and Call() functions.
@@ -20,6 +39,22 @@ type Call struct {
 	Reply interface{} // The reply from the function (*struct).
 	Error error       // After completion, the error status.
 	Done  chan *Call  // Strobes when call is complete.
+
+	ctx       context.Context
+	opts      callOptions
+	cancel    context.CancelCauseFunc // aborts the call
+	release   func()                  // called when the call is done
+	transport bool                    // the error happened in the transport
+}
+
+// Cancel aborts a call started with Client.Start, as if its context had
+// been cancelled. The stream used by the call is reset and the call is
+// sent to its Done channel with context.Canceled as error. Cancelling a
+// call which has completed already does nothing.
+func (call *Call) Cancel() {
+	if call.cancel != nil {
+		call.cancel(context.Canceled)
+	}
 }
 
 // Client represents an RPC client which can perform calls to a remote
@@ -28,6 +63,79 @@ type Client struct {
 	host     host.Host
 	protocol protocol.ID
 	server   *Server
+
+	inflight inFlight
+
+	ordered bool
+	queue   callQueue
+
+	pool *streamPool
+
+	streams limitCounter
+
+	bufferPool bool
+
+	closing context.Context // cancelled on Close
+	close   context.CancelFunc
+
+	interceptors []ClientInterceptor
+
+	batcher *autoBatcher // see WithAutoBatch
+
+	deadlineMargin time.Duration // see WithDeadlinePropagationMargin
+	activeWindow   time.Duration // see WithActivePeersWindow
+	maxDecompress  int64         // see WithMaxDecompressedSize
+	fallback       protocol.ID   // see WithProtocolFallback
+	cache          *replyCache   // see WithClientCache
+
+	keys     KeyProvider
+	checksum func() hash.Hash // see WithClientPayloadChecksum
+
+	hooks streamHooks
+
+	msgpackHandle  *codec.MsgpackHandle
+	strictDecoding *bool                // see WithClientStrictDecoding
+	payloadHandle  *codec.MsgpackHandle // for replies, strict or not
+
+	streamIdleTimeout time.Duration
+
+	replyDecodeTimeout time.Duration
+
+	requestIDs func() string
+
+	peers peerStatuses
+
+	streamWindow int
+
+	recorder *recorder
+
+	requireAddrs bool
+
+	resolver ResolverFunc
+
+	maxStreamAge time.Duration // see WithMaxStreamAge
+
+	signRequests bool
+
+	peerSlots peerSlots // see WithMaxStreamsPerConn
+
+	outstanding outstanding // see Drain
+
+	streamOpenAttempts int
+	streamOpenBackoff  time.Duration
+
+	cancelReasons bool // see WithCancelReasons
+
+	flights flightGroup // see WithSingleflight
+
+	codecName string // see WithClientCodec
+	codec     Codec
+
+	streamServices map[protocol.ID]string // see WithClientStreamService
+
+	callStats callStatsHook // see WithClientCallStats
+
+	emptyPeerLocal bool // see WithEmptyPeerIDLocal
 }
 
 // NewClient returns a new Client which uses the given LibP2P host
@@ -38,18 +146,42 @@ type Client struct {
 // The client returned will not be able to run any local requests
 // if the Server is sharing the same LibP2P host. See NewClientWithServer
 // if this is a usecase.
-func NewClient(h host.Host, p protocol.ID) *Client {
-	return &Client{
+//
+// The client behaviour can be customized with the given options.
+func NewClient(h host.Host, p protocol.ID, opts ...ClientOption) *Client {
+	c := &Client{
 		host:     h,
 		protocol: p,
+
+		deadlineMargin: DefaultDeadlinePropagationMargin,
+		activeWindow:   DefaultActivePeersWindow,
+		maxDecompress:  DefaultMaxDecompressedSize,
+	}
+	c.closing, c.close = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(c)
 	}
+	c.payloadHandle = strictHandle(c.msgpackHandle, c.strictDecoding)
+	if c.pool != nil {
+		c.pool.maxAge = c.maxStreamAge
+	}
+	return c
 }
 
 // NewClientWithServer takes an additional RPC Server and returns a Client
 // which will perform any requests to itself by using the given Server.Call()
 // directly. It is assumed that Client and Server share the same LibP2P host.
-func NewClientWithServer(h host.Host, p protocol.ID, s *Server) *Client {
-	c := NewClient(h, p)
+//
+// Local calls made by the methods of the server, with the context they
+// received, are re-entrant: they are considered part of the call which
+// made them, so they never wait for it to finish. They run right away, on
+// the same goroutine, even on serial services and pinned workers (see
+// RegisterSerial and WithPinnedWorkers), and do not count against
+// WithMaxConcurrentCalls. Methods passing their context on to goroutines
+// which make local calls concurrently lose the serial guarantee for them.
+func NewClientWithServer(h host.Host, p protocol.ID, s *Server, opts ...ClientOption) *Client {
+	c := NewClient(h, p, opts...)
 	c.server = s
 	return c
 }
@@ -63,11 +195,61 @@ func (c *Client) ID() peer.ID {
 }
 
 // Call performs an RPC call to a registered Server service and blocks until
-// completed. If dest is empty ("") or matches the Client's host ID, it will
-// attempt to use the local configured Server when possible.
+// completed. If dest matches the Client's host ID, it will attempt to use
+// the local configured Server when possible. Calls to an empty dest ("")
+// fail with ErrEmptyPeerID unless using WithEmptyPeerIDLocal: see
+// CallLocal.
+//
+// Args may be nil, in which case the method receives the zero value of its
+// argument type. Reply may be nil when the caller is not interested in
+// it, in which case it is discarded. Otherwise, it must be a non-nil
+// pointer, or the call fails right away.
 func (c *Client) Call(dest peer.ID, svcName string, svcMethod string, args interface{}, reply interface{}) error {
+	return c.CallContext(context.Background(), dest, svcName, svcMethod, args, reply)
+}
+
+// CallContext performs a Call which is bound to the given context. When
+// the context is cancelled, the call is aborted and returns the context
+// error. When the context has a deadline, it is sent to the server so
+// that it can give up on the call as well. Since the deadline is sent as
+// an absolute time, the clocks of both peers should be reasonably in
+// sync. The call can be further customized with the given options.
+func (c *Client) CallContext(ctx context.Context, dest peer.ID, svcName string, svcMethod string, args interface{}, reply interface{}, opts ...CallOption) error {
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	svcID := ServiceID{svcName, svcMethod}
+	if c.cache != nil && c.cache.methods[svcID] {
+		return c.callCached(ctx, dest, svcID, args, reply, o, opts)
+	}
+	if o.singleflight && o.trace == nil {
+		return c.callShared(ctx, dest, svcID, args, reply, opts)
+	}
+	return c.call(ctx, dest, svcID, args, reply, opts)
+}
+
+// CallLocal performs a call to the local Server, which must have been
+// given to NewClientWithServer, and blocks until completed.
+func (c *Client) CallLocal(svcName string, svcMethod string, args interface{}, reply interface{}) error {
+	return c.CallLocalContext(context.Background(), svcName, svcMethod, args, reply)
+}
+
+// CallLocalContext performs a CallLocal which is bound to the given
+// context. See CallContext for the details.
+func (c *Client) CallLocalContext(ctx context.Context, svcName string, svcMethod string, args interface{}, reply interface{}, opts ...CallOption) error {
+	opts = append([]CallOption{localCall}, opts...)
+	return c.CallContext(ctx, "", svcName, svcMethod, args, reply, opts...)
+}
+
+// localCall makes a call to the empty peer ID go to the local server.
+func localCall(o *callOptions) {
+	o.local = true
+}
+
+func (c *Client) call(ctx context.Context, dest peer.ID, svcID ServiceID, args, reply interface{}, opts []CallOption) error {
 	done := make(chan *Call, 1)
-	c.Go(dest, svcName, svcMethod, args, reply, done)
+	c.GoContext(ctx, dest, svcID.Name, svcID.Method, args, reply, done, opts...)
 	call := <-done
 	return call.Error
 }
@@ -78,9 +260,29 @@ func (c *Client) Call(dest peer.ID, svcName string, svcMethod string, args inter
 // The provided done channel must be nil, or have capacity for 1 element
 // at least, or a panic will be triggered.
 //
-// If dest is empty ("") or matches the Client's host ID, it will
-// attempt to use the local configured Server when possible.
+// If dest matches the Client's host ID, it will attempt to use the local
+// configured Server when possible. See Call.
 func (c *Client) Go(dest peer.ID, svcName string, svcMethod string, args interface{}, reply interface{}, done chan *Call) error {
+	return c.GoContext(context.Background(), dest, svcName, svcMethod, args, reply, done)
+}
+
+// GoContext performs a Go call which is bound to the given context. See
+// CallContext for the details.
+func (c *Client) GoContext(ctx context.Context, dest peer.ID, svcName string, svcMethod string, args interface{}, reply interface{}, done chan *Call, opts ...CallOption) error {
+	_, err := c.start(ctx, dest, svcName, svcMethod, args, reply, done, opts...)
+	return err
+}
+
+// Start is like GoContext but returns the Call, which can be aborted with
+// Call.Cancel. If done is nil, a new channel is allocated. Errors which
+// prevent the call from being performed are set in the Call, which is
+// sent to the done channel right away in that case.
+func (c *Client) Start(ctx context.Context, dest peer.ID, svcName string, svcMethod string, args interface{}, reply interface{}, done chan *Call, opts ...CallOption) *Call {
+	call, _ := c.start(ctx, dest, svcName, svcMethod, args, reply, done, opts...)
+	return call
+}
+
+func (c *Client) start(ctx context.Context, dest peer.ID, svcName string, svcMethod string, args interface{}, reply interface{}, done chan *Call, opts ...CallOption) (*Call, error) {
 	if done == nil {
 		done = make(chan *Call, 1)
 	} else {
@@ -96,19 +298,128 @@ func (c *Client) Go(dest peer.ID, svcName string, svcMethod string, args interfa
 		Error: nil,
 		Done:  done,
 	}
+	for _, opt := range opts {
+		opt(&call.opts)
+	}
+
+	if err := checkReply(call.SvcID, reply); err != nil {
+		call.Error = err
+		call.done()
+		return call, err
+	}
+	if dest == "" && !call.opts.local && !c.emptyPeerLocal {
+		call.Error = ErrEmptyPeerID
+		call.done()
+		return call, ErrEmptyPeerID
+	}
+	if c.closing.Err() != nil {
+		call.Error = ErrClientClosed
+		call.done()
+		return call, ErrClientClosed
+	}
+	if !c.outstanding.begin() {
+		call.Error = ErrClientDraining
+		call.done()
+		return call, ErrClientDraining
+	}
+	ctx, cancel, release := c.callContext(ctx)
+	call.ctx, call.cancel = ctx, cancel
+	call.release = func() {
+		release()
+		c.outstanding.end()
+	}
+
+	if c.ordered {
+		// The turn is taken here so calls keep the order
+		// in which Go() was called.
+		wait, release := c.queue.enqueue(dest)
+		go func() {
+			select {
+			case <-wait:
+				c.makeCall(call)
+				release()
+			case <-ctx.Done():
+				call.Error = ctx.Err()
+				call.done()
+				// Hold the turn until the previous call is
+				// done, so that the next one keeps waiting.
+				<-wait
+				release()
+			}
+		}()
+		return call, nil
+	}
+
 	go c.makeCall(call)
-	return nil
+	return call, nil
 }
 
 // makeCall decides if a call can be performed. If it's a local
 // call it will use the configured server if set.
 func (c *Client) makeCall(call *Call) {
-	logger.Debugf("makeCall: %s.%s",
+	var requestID string
+	call.ctx, requestID = c.requestContext(call.ctx)
+	logger.Debugf("%smakeCall: %s.%s",
+		requestLogPrefix(requestID),
 		call.SvcID.Name,
 		call.SvcID.Method)
 
+	info := CallInfo{
+		Peer:      call.Dest,
+		Service:   call.SvcID.Name,
+		Method:    call.SvcID.Method,
+		Start:     time.Now(),
+		RequestID: requestID,
+	}
+	id := c.inflight.add(info)
+	defer c.inflight.remove(id)
+
+	call.Error = c.intercept(call.ctx, info, func(ctx context.Context) error {
+		call.ctx = ctx
+		call.Error = nil
+		call.transport = false
+		c.invoke(call)
+		return call.Error
+	})
+	if !c.isLocal(call.Dest) {
+		c.peers.update(call.Dest, info.Start, call.Error, call.transport)
+	}
+	c.callStats.record(info, call.Error)
+	call.done()
+}
+
+// requestContext returns the context to perform a call with, which carries
+// the request ID of the given context or, if none, a new one when the
+// client generates them (see WithRequestIDGenerator).
+func (c *Client) requestContext(ctx context.Context) (context.Context, string) {
+	id := RequestIDFromContext(ctx)
+	if id == "" && c.requestIDs != nil {
+		id = c.requestIDs()
+		ctx = WithRequestID(ctx, id)
+	}
+	return ctx, id
+}
+
+// isLocal reports whether calls to the given peer are local.
+func (c *Client) isLocal(dest peer.ID) bool {
+	return dest == "" || dest == c.host.ID()
+}
+
+// remoteHeader returns the header for a request to the given service
+// sent to a server, whose deadline, if any, is brought forward by the
+// propagation margin.
+func (c *Client) remoteHeader(ctx context.Context, svcID ServiceID) RequestHeader {
+	header := requestHeader(ctx, svcID)
+	if header.Deadline != 0 {
+		header.Deadline -= int64(c.deadlineMargin)
+	}
+	return header
+}
+
+// invoke performs the call, leaving any error in call.Error.
+func (c *Client) invoke(call *Call) {
 	// Handle local RPC calls
-	if call.Dest == "" || call.Dest == c.host.ID() {
+	if c.isLocal(call.Dest) {
 		logger.Debugf("local call: %s.%s",
 			call.SvcID.Name, call.SvcID.Method)
 		if c.server == nil {
@@ -116,7 +427,6 @@ func (c *Client) makeCall(call *Call) {
 				"Cannot make local calls: server not set")
 			logger.Error(err)
 			call.Error = err
-			call.done()
 			return
 		}
 		err := c.server.Call(call)
@@ -124,7 +434,6 @@ func (c *Client) makeCall(call *Call) {
 		if err != nil {
 			logger.Error(err)
 		}
-		call.done()
 		return
 	}
 
@@ -135,70 +444,407 @@ func (c *Client) makeCall(call *Call) {
 	if c.protocol == "" {
 		panic("no protocol set: cannot perform remote call")
 	}
+	if c.batcher != nil && c.batcher.batchable(call) {
+		c.batcher.send(call)
+		return
+	}
 	c.send(call)
 }
 
+// WaitForProtocol blocks until the given peer supports the protocol used
+// by this client, or until the context is done, in which case the context
+// error is returned. This is useful right after connecting to a peer, which
+// may not be ready to handle requests yet. The peer's protocols, as known
+// to the peerstore, are checked first. Otherwise a stream is opened to the
+// peer to negotiate the protocol, retrying with increasing delays.
+func (c *Client) WaitForProtocol(ctx context.Context, pid peer.ID) error {
+	delay := 50 * time.Millisecond
+	for {
+		protos, err := c.host.Peerstore().SupportsProtocols(pid, string(c.protocol))
+		if err == nil && len(protos) > 0 {
+			return nil
+		}
+
+		s, err := c.host.NewStream(ctx, pid, c.protocol)
+		if err == nil {
+			s.Close()
+			return nil
+		}
+		logger.Debugf("%s not ready for %s: %s", pid.Pretty(), c.protocol, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay < time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// NegotiateVersion finds out which of the candidate protocols, given in
+// order of preference, is the best one supported by the given peer. The
+// result is cached in the peerstore and used by all subsequent remote calls
+// to that peer, instead of the protocol the client was created with, until
+// NegotiateVersion is called again, except for those overriding it with
+// WithProtocol.
+func (c *Client) NegotiateVersion(ctx context.Context, pid peer.ID, candidates []protocol.ID) (protocol.ID, error) {
+	if len(candidates) == 0 {
+		return "", errors.New("no candidate protocols given")
+	}
+	s, err := c.host.NewStream(ctx, pid, candidates...)
+	if err != nil {
+		return "", err
+	}
+	// The server ignores streams closed without sending anything.
+	defer s.Close()
+
+	proto := s.Protocol()
+	err = c.host.Peerstore().Put(pid, c.negotiatedKey(), proto)
+	if err != nil {
+		return "", err
+	}
+	logger.Debugf("negotiated %s with %s", proto, pid.Pretty())
+	return proto, nil
+}
+
+// negotiatedKey is the peerstore key holding the protocol negotiated
+// by this client with a peer.
+func (c *Client) negotiatedKey() string {
+	return "p2p-gorpc/negotiated/" + string(c.protocol)
+}
+
+// fellBack records that the given peer does not support the protocol of
+// the client but its fallback, which is used for all subsequent calls to
+// the peer (see WithProtocolFallback).
+func (c *Client) fellBack(pid peer.ID) {
+	logger.Infof("%s does not support %s: falling back to %s", pid.Pretty(), c.protocol, c.fallback)
+	if err := c.host.Peerstore().Put(pid, c.negotiatedKey(), c.fallback); err != nil {
+		logger.Errorf("error recording the protocol of %s: %s", pid.Pretty(), err)
+	}
+}
+
+// protocolFor returns the protocol to use for calls to the given peer.
+func (c *Client) protocolFor(pid peer.ID) protocol.ID {
+	v, err := c.host.Peerstore().Get(pid, c.negotiatedKey())
+	if err != nil {
+		return c.protocol
+	}
+	if proto, ok := v.(protocol.ID); ok && proto != "" {
+		return proto
+	}
+	return c.protocol
+}
+
+// InFlight returns a snapshot of the calls which have been issued by
+// this client and have not completed yet, oldest first.
+func (c *Client) InFlight() []CallInfo {
+	return c.inflight.snapshot()
+}
+
 // send makes a REMOTE RPC call by initiating a libP2P stream to the
 // destination and waiting for a response.
 func (c *Client) send(call *Call) {
 	logger.Debug("sending remote call")
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	s, err := c.host.NewStream(ctx, call.Dest, c.protocol)
+
+	ctx := call.ctx
+	sl, err := c.sealer(call.Dest)
 	if err != nil {
 		call.Error = err
-		call.Done <- call
 		return
 	}
-	defer s.Close()
-	sWrap := wrapStream(s)
+	trace := call.opts.trace
+	opening := time.Now()
+	proto := c.protocolFor(call.Dest)
+	if call.opts.protocol != "" {
+		proto = call.opts.protocol
+	}
+	sWrap, reused, err := c.openStream(ctx, call.Dest, proto)
+	if trace != nil {
+		trace.StreamOpen = time.Since(opening)
+		trace.Reused = reused
+	}
+	if err != nil {
+		call.Error = err
+		call.transport = true
+		return
+	}
+
+	unanswered, err := c.sendOnStream(sWrap, call, sl)
+	if err != nil && unanswered && reused && ctx.Err() == nil {
+		// The pooled stream was closed or reset by the server
+		// before the request could be processed. It is safe to
+		// retry with a new one.
+		logger.Debugf("pooled stream to %s failed: %s. Retrying",
+			call.Dest.Pretty(), err)
+		c.releaseStream(call.Dest, sWrap, err)
+		sWrap, err = c.newStream(ctx, call.Dest, proto)
+		if trace != nil {
+			trace.StreamOpen = time.Since(opening)
+			trace.Reused = false
+		}
+		if err != nil {
+			call.Error = err
+			call.transport = true
+			return
+		}
+		call.Error = nil
+		_, err = c.sendOnStream(sWrap, call, sl)
+	}
+	if trace != nil {
+		trace.Conn = streamConnInfo(sWrap.stream)
+	}
+	if ctx.Err() != nil {
+		// The stream was reset because of it.
+		err = ctx.Err()
+	}
+	call.transport = err != nil && ctx.Err() == nil
+	c.releaseStream(call.Dest, sWrap, err)
+
+	// Any error is likely a consequence of the stream reset.
+	if call.Error != nil && ctx.Err() != nil {
+		call.Error = ctx.Err()
+	}
+}
+
+// sendOnStream sends the request for a call on the given stream and reads
+// the response, using the given sealer, if any, for the payloads. It
+// returns any error affecting the stream itself (as opposed to errors
+// returned by the remote method) and whether the error happened before
+// the server could have processed the request.
+func (c *Client) sendOnStream(sWrap *streamWrap, call *Call, sl *sealer) (unanswered bool, err error) {
+	// Abort the call by resetting the stream when the
+	// context is cancelled.
+	ctx := call.ctx
+	sWrap.requestSent = false
+	if ctx.Done() != nil {
+		finished := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				if !c.sendCancelReason(sWrap, ctx) {
+					sWrap.stream.Reset()
+				}
+			case <-finished:
+			}
+		}()
+		defer func() {
+			close(finished)
+			<-stopped
+		}()
+	}
+
+	header := c.callHeader(call, sl)
 
 	logger.Debugf("sending RPC %s.%s to %s", call.SvcID.Name,
 		call.SvcID.Method, call.Dest)
-	if err := sWrap.enc.Encode(call.SvcID); err != nil {
-		call.Error = err
-		call.done()
-		return
+	writing := time.Now()
+	sWrap.wmu.Lock()
+	err = c.writeRequest(sWrap, header, call.Args, sl)
+	if err == nil {
+		err = sWrap.w.Flush()
 	}
-	if err := sWrap.enc.Encode(call.Args); err != nil {
+	sWrap.requestSent = err == nil
+	sWrap.wmu.Unlock()
+	if err != nil {
 		call.Error = err
-		call.done()
-		return
+		return true, err
 	}
+	if call.opts.trace != nil {
+		call.opts.trace.WriteRequest = time.Since(writing)
+	}
+	return c.receiveResponse(sWrap, call, sl)
+}
 
-	if err := sWrap.w.Flush(); err != nil {
-		call.Error = err
-		call.done()
-		return
+// callHeader returns the header for the request of the given call, with
+// the options it was made with.
+func (c *Client) callHeader(call *Call, sl *sealer) RequestHeader {
+	header := c.remoteHeader(call.ctx, call.SvcID)
+	header.Critical = call.opts.critical
+	header.Encrypted = sl.encrypts()
+	header.Checksummed = sl.checksums()
+	header.CancelReasons = c.cancelReasons
+	header.Codec = c.codecName
+	header.Trace = call.opts.trace != nil
+	header.FieldMask = call.opts.fieldMask
+	if seq := call.opts.sequence; seq != nil {
+		header.SeqSession, header.Seq = seq.session, seq.seq
 	}
-	receiveResponse(sWrap, call)
+	return header
 }
 
-// receiveResponse reads a response to an RPC call
-func receiveResponse(s *streamWrap, call *Call) {
+// receiveResponse reads a response to an RPC call. It returns the same
+// values as sendOnStream.
+func (c *Client) receiveResponse(s *streamWrap, call *Call, sl *sealer) (bool, error) {
 	logger.Debugf("waiting response for %s.%s to %s", call.SvcID.Name,
 		call.SvcID.Method, call.Dest)
 	var resp Response
-	defer call.done()
+	waiting := time.Now()
+	timer, err := awaitResponse(s, c.replyDecodeTimeout)
+	if err != nil {
+		call.Error = err
+		// Nothing was received at all.
+		return err == io.EOF, err
+	}
 	if err := s.dec.Decode(&resp); err != nil {
+		err = timer.stop(err)
 		call.Error = err
-		return
+		return false, err
+	}
+	if trace := call.opts.trace; trace != nil {
+		trace.ReadResponse = time.Since(waiting)
+		if resp.Trace != nil {
+			trace.Server = *resp.Trace
+		}
+		decoding := time.Now()
+		defer func() {
+			trace.Decode = time.Since(decoding)
+		}()
 	}
 
 	if e := resp.Error; e != "" {
-		call.Error = errors.New(e)
+		call.Error = responseError(e, resp.ServerError)
 	}
 
 	// Even on error we sent the reply so it needs to be
 	// read
-	if err := s.dec.Decode(call.Reply); err != nil && err != io.EOF {
+	reply := replyTarget(call.Reply)
+	err = timer.stop(decodeWith(c.codec, func(v interface{}) error {
+		return c.decodeReply(s, &resp, v, sl, call.SvcID)
+	}, reply))
+	if err != nil {
 		call.Error = err
+		return false, err
+	}
+	return false, nil
+}
+
+// awaitResponse waits for the server to start sending a response on the
+// stream, and then starts the timer bounding how long reading it can
+// take, if any (see WithReplyDecodeTimeout). The timer must be stopped
+// once the response is read.
+func awaitResponse(s *streamWrap, timeout time.Duration) (*decodeTimer, error) {
+	if _, err := s.r.Peek(1); err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, nil
+	}
+	t := &decodeTimer{}
+	t.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&t.expired, 1)
+		s.stream.Reset()
+	})
+	return t, nil
+}
+
+// decodeTimer resets a stream when reading a response takes too long.
+// A nil decodeTimer does nothing.
+type decodeTimer struct {
+	timer   *time.Timer
+	expired int32
+}
+
+// stop stops the timer, given the error reading the response, if any.
+// It returns ErrReplyDecodeTimeout in place of the error if the timer
+// caused it by resetting the stream. Responses read successfully are
+// kept even if the timer fires right after.
+func (t *decodeTimer) stop(err error) error {
+	if t == nil {
+		return err
 	}
-	return
+	if !t.timer.Stop() && err != nil && atomic.LoadInt32(&t.expired) == 1 {
+		return ErrReplyDecodeTimeout
+	}
+	return err
+}
+
+// decodeReply reads the body of a response into the given reply.
+func (c *Client) decodeReply(s *streamWrap, resp *Response, reply interface{}, sl *sealer, svcID ServiceID) error {
+	switch {
+	case resp.Encrypted && !sl.encrypts():
+		return errors.New("rpc: unexpected encrypted reply")
+	case resp.Checksummed && !sl.checksums():
+		return errors.New("rpc: unexpected checksummed reply")
+	case resp.Encrypted || resp.Checksummed:
+		return sl.decode(s.payloadDecoder(), reply, responseAD(svcID, resp.ID, resp.Error))
+	case sl != nil && resp.Error == "":
+		return errors.New("rpc: unexpected unencrypted reply")
+	case sl != nil:
+		// Only errors for requests which the server could not
+		// seal a response for come unsealed.
+		var discard interface{}
+		if err := s.dec.Decode(&discard); err != nil && err != io.EOF {
+			return err
+		}
+		return unauthenticated(resp.Error)
+	case resp.Compressed:
+		return decodeCompressed(s.dec, s.payloadHandle(), reply, c.maxDecompress)
+	}
+	if err := s.payloadDecoder().Decode(reply); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// checkReply returns an error if the given reply cannot hold the reply of
+// a call to the given method, which happens when it is not a pointer or is
+// a nil pointer. A nil interface is fine, since it discards the reply.
+func checkReply(svcID ServiceID, reply interface{}) error {
+	if reply == nil {
+		return nil
+	}
+	v := reflect.ValueOf(reply)
+	if v.Kind() != reflect.Ptr {
+		return fmt.Errorf("rpc: the reply for %s.%s must be a pointer, not a %T",
+			svcID.Name, svcID.Method, reply)
+	}
+	if v.IsNil() {
+		return fmt.Errorf("rpc: the reply for %s.%s is a nil %T: pass a pointer to a value, or nil to discard the reply",
+			svcID.Name, svcID.Method, reply)
+	}
+	return nil
+}
+
+// replyTarget returns the value to decode a reply into. Nil replies are
+// decoded into a throwaway value, since they still need to be read.
+func replyTarget(reply interface{}) interface{} {
+	if reply == nil {
+		var discard interface{}
+		return &discard
+	}
+	return reply
+}
+
+// privateReply returns a new value to decode the reply of a call into, in
+// place of the given reply, when the caller may give up on the call while
+// the reply is decoded. It is copied to the reply with setReply.
+func privateReply(reply interface{}) interface{} {
+	if reply == nil {
+		return nil
+	}
+	return reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+}
+
+// setReply copies a reply decoded into a value from privateReply.
+func setReply(reply, private interface{}) {
+	if reply == nil {
+		return
+	}
+	reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(private).Elem())
 }
 
 // done places the completed call in the done channel.
 func (call *Call) done() {
+	if call.release != nil {
+		if call.Error != nil && context.Cause(call.ctx) == ErrClientClosed {
+			call.Error = ErrClientClosed
+		}
+		defer call.release()
+	}
 	select {
 	case call.Done <- call:
 		// ok
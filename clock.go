@@ -0,0 +1,62 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// clockServiceName is the name of the service which servers provide to
+// answer ClockSync calls, unless disabled with WithClockService.
+const clockServiceName = "gorpc.Clock"
+
+// clockService reports the time of the server.
+type clockService struct{}
+
+// stampSent sets the time at which the response to a clock call is sent,
+// in Unix nanoseconds, in its reply, right before encoding it. Replies of
+// other calls are left alone.
+func stampSent(svcID ServiceID, reply interface{}) {
+	if times, ok := reply.(*[2]int64); ok && svcID.Name == clockServiceName {
+		times[1] = time.Now().UnixNano()
+	}
+}
+
+// Now sets the reply to the times, in Unix nanoseconds, at which the
+// request was received, when its header was read, and at which the
+// response is sent (see stampSent). Local calls use the time at which the
+// method runs.
+func (clockService) Now(ctx context.Context, args struct{}, reply *[2]int64) error {
+	received, ok := ctx.Value(receivedKey).(time.Time)
+	if !ok {
+		received = time.Now()
+	}
+	reply[0] = received.UnixNano()
+	reply[1] = reply[0]
+	return nil
+}
+
+// ClockSync measures the round-trip time to the given peer and estimates
+// the offset of its clock with respect to the local one, which is
+// positive when the peer's clock is ahead. It uses the four timestamps of
+// a call: sent and received by the client, received and answered by the
+// server. The round-trip time does not include the time spent by the
+// server, and the offset assumes that requests and responses take the
+// same time to travel, so it is only accurate within half the round-trip
+// time. It fails for servers which do not provide the clock service (see
+// WithClockService).
+func (c *Client) ClockSync(ctx context.Context, pid peer.ID) (rtt, offset time.Duration, err error) {
+	var times [2]int64
+	sent := time.Now()
+	err = c.CallContext(ctx, pid, clockServiceName, "Now", struct{}{}, &times)
+	received := time.Now()
+	if err != nil {
+		return 0, 0, err
+	}
+	serverRecv := time.Unix(0, times[0])
+	serverSend := time.Unix(0, times[1])
+	rtt = received.Sub(sent) - serverSend.Sub(serverRecv)
+	offset = (serverRecv.Sub(sent) + serverSend.Sub(received)) / 2
+	return rtt, offset, nil
+}
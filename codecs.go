@@ -0,0 +1,54 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Codec encodes the arguments and replies of calls in a format other than
+// the default msgpack encoding, which allows a server to bridge clients
+// using different formats (see WithCodec and WithClientCodec). Payloads
+// encoded with a codec are sent as byte strings, while headers always use
+// the default encoding.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is a Codec encoding payloads as JSON.
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// codecFor returns the codec with the given name, enabled with WithCodec,
+// or nil for the default encoding.
+func (server *Server) codecFor(name string) (Codec, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if c, ok := server.codecs[name]; ok {
+		return c, nil
+	}
+	return nil, errors.New("rpc: unsupported codec " + name)
+}
+
+// decodeWith reads a payload encoded with the given codec, if not nil,
+// using decode, and unmarshals it into v. Otherwise, it decodes v.
+func decodeWith(c Codec, decode func(interface{}) error, v interface{}) error {
+	if c == nil {
+		return decode(v)
+	}
+	var payload []byte
+	if err := decode(&payload); err != nil {
+		return err
+	}
+	return c.Unmarshal(payload, v)
+}
@@ -0,0 +1,49 @@
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	multicodec "github.com/multiformats/go-multicodec"
+	codec "github.com/ugorji/go/codec"
+)
+
+// compress gzips the given data.
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeCompressed reads a compressed blob from dec, decompresses it
+// and decodes the result into v using the given msgpack handle. It
+// returns ErrReplyTooLarge when the result is larger than max bytes,
+// unless max is zero or less.
+func decodeCompressed(dec multicodec.Decoder, h *codec.MsgpackHandle, v interface{}, max int64) error {
+	var compressed []byte
+	if err := dec.Decode(&compressed); err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	if max <= 0 {
+		return newDecoder(h, gz).Decode(v)
+	}
+	// Reading one byte past the limit tells larger results apart.
+	lr := &io.LimitedReader{R: gz, N: max + 1}
+	err = newDecoder(h, lr).Decode(v)
+	if lr.N == 0 {
+		return ErrReplyTooLarge
+	}
+	return err
+}
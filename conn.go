@@ -0,0 +1,102 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-crypto"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var errNoConnSupport = errors.New("rpc: not supported on plain connections")
+
+// connStream makes an io.ReadWriteCloser look like a libp2p stream, so
+// that RPCs can be served and performed over any kind of connection. The
+// remote peer is unknown, so it is the empty peer ID.
+type connStream struct {
+	rwc   io.ReadWriteCloser
+	proto protocol.ID
+}
+
+func (s *connStream) Read(p []byte) (int, error)  { return s.rwc.Read(p) }
+func (s *connStream) Write(p []byte) (int, error) { return s.rwc.Write(p) }
+func (s *connStream) Close() error                { return s.rwc.Close() }
+func (s *connStream) Reset() error                { return s.rwc.Close() }
+func (s *connStream) Protocol() protocol.ID       { return s.proto }
+func (s *connStream) SetProtocol(p protocol.ID)   { s.proto = p }
+func (s *connStream) Conn() inet.Conn             { return plainConn{} }
+
+func (s *connStream) SetDeadline(t time.Time) error {
+	if d, ok := s.rwc.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	return errNoConnSupport
+}
+
+func (s *connStream) SetReadDeadline(t time.Time) error {
+	if d, ok := s.rwc.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return errNoConnSupport
+}
+
+func (s *connStream) SetWriteDeadline(t time.Time) error {
+	if d, ok := s.rwc.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return errNoConnSupport
+}
+
+// plainConn is the connection of a connStream, which knows nothing about
+// the peers at either end.
+type plainConn struct{}
+
+func (plainConn) LocalPeer() peer.ID              { return "" }
+func (plainConn) LocalPrivateKey() ic.PrivKey     { return nil }
+func (plainConn) RemotePeer() peer.ID             { return "" }
+func (plainConn) RemotePublicKey() ic.PubKey      { return nil }
+func (plainConn) LocalMultiaddr() ma.Multiaddr    { return nil }
+func (plainConn) RemoteMultiaddr() ma.Multiaddr   { return nil }
+func (plainConn) NewStream() (inet.Stream, error) { return nil, errNoConnSupport }
+func (plainConn) GetStreams() []inet.Stream       { return nil }
+func (plainConn) Close() error                    { return nil }
+
+// ServeConn handles the requests received on the given connection, just
+// like it does for libp2p streams, until the client closes its end. The
+// connection is closed when ServeConn returns. This allows to use RPCs
+// over any transport, or over in-memory pipes in tests. The caller is
+// always the empty peer ID, both for Policies and for
+// CallerFromContext, and payload encryption keys are requested for it.
+func (server *Server) ServeConn(rwc io.ReadWriteCloser) {
+	server.streamHandler(server.policy)(&connStream{rwc: rwc, proto: server.protocol})
+}
+
+// CallConn performs a call over the given connection, which must be served
+// by Server.ServeConn on the other end. It can be used for several calls,
+// one after the other, and it is not closed unless the call is aborted
+// because the context is cancelled. Client options concerning streams do
+// not apply.
+func (c *Client) CallConn(ctx context.Context, rwc io.ReadWriteCloser, svcName, svcMethod string, args, reply interface{}) error {
+	sl, err := c.sealer("")
+	if err != nil {
+		return err
+	}
+	call := &Call{
+		SvcID: ServiceID{svcName, svcMethod},
+		Args:  args,
+		Reply: reply,
+		ctx:   ctx,
+	}
+	sw := wrapStream(&connStream{rwc: rwc, proto: c.protocol}, c.msgpackHandle)
+	sw.usePayloadHandle(c.payloadHandle)
+	if _, err := c.sendOnStream(sw, call, sl); err != nil && ctx.Err() != nil {
+		// Any error is likely a consequence of the reset.
+		return ctx.Err()
+	}
+	return call.Error
+}
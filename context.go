@@ -0,0 +1,120 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+type contextKey int
+
+const (
+	deadlineKey contextKey = iota
+	outgoingMetadataKey
+	metadataKey
+	callerKey
+	requestIDKey
+	loggerKey
+	signedRequestKey
+	stateKey
+	traceKey
+	httpCallerKey
+	fieldMaskKey
+	handlerScopeKey
+	receivedKey
+)
+
+// DeadlineFromContext returns the deadline that the client set for
+// the call whose handler received the given context, brought forward by
+// the margin of the client (see WithDeadlinePropagationMargin). It returns
+// false when the client did not set a deadline. Handlers doing long-running
+// work should check ctx.Err(), or compare the deadline with the current
+// time, periodically and abort once the client is no longer waiting.
+//
+// The context of a handler expires at that deadline, and calls made with
+// it send it along, so handlers passing their context on to the calls
+// they make propagate the deadline end to end: the deadline of the first
+// caller bounds the whole chain of calls. Critical calls (see
+// WithCritical) are the exception, since their context does not expire
+// and so the calls they make have no deadline unless one is set.
+func DeadlineFromContext(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(deadlineKey).(time.Time)
+	return deadline, ok
+}
+
+// CallerFromContext returns the peer which made the call whose handler
+// received the given context. It returns false for contexts which do not
+// belong to a call handler.
+func CallerFromContext(ctx context.Context) (peer.ID, bool) {
+	pid, ok := ctx.Value(callerKey).(peer.ID)
+	return pid, ok
+}
+
+// WithRequestID returns a context which makes the calls performed with it
+// carry the given request ID, which servers echo back and pass on to the
+// handlers. Request IDs identify logical operations spanning several
+// calls, possibly across several peers, and are included in logs and in
+// CallInfos. Handlers making calls with the context they received
+// propagate the ID of the call being handled.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestIDFromContext returns the request ID carried by the given
+// context, or an empty string if none. In handlers, it is the ID sent by
+// the client.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestLogPrefix returns the prefix for the log messages about a call
+// with the given request ID.
+func requestLogPrefix(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "[" + id + "] "
+}
+
+// StateFromContext returns the application state attached with WithState
+// to the server running the handler which received the given context. It
+// returns nil when there is none or outside handlers.
+func StateFromContext(ctx context.Context) interface{} {
+	return ctx.Value(stateKey)
+}
+
+// Metadata holds key-value pairs sent along with a call, in the request
+// header. It is meant for cross-cutting information, such as auth tokens
+// or trace context, rather than for method arguments.
+type Metadata map[string]string
+
+// WithMetadata returns a context which makes the calls performed with it
+// send the given metadata, in addition to any metadata carried by ctx
+// already. Values given here override existing ones with the same key.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	merged := make(Metadata)
+	for k, v := range outgoingMetadata(ctx) {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, outgoingMetadataKey, merged)
+}
+
+// MetadataFromContext returns the metadata sent by the client for the
+// call whose handler received the given context. It returns nil if the
+// client sent none. The metadata must not be modified.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey).(Metadata)
+	return md
+}
+
+// outgoingMetadata returns the metadata to be sent by calls performed
+// with the given context.
+func outgoingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingMetadataKey).(Metadata)
+	return md
+}
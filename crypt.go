@@ -0,0 +1,214 @@
+package rpc
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	multicodec "github.com/multiformats/go-multicodec"
+	codec "github.com/ugorji/go/codec"
+)
+
+// errEncryptionRequired is returned for unencrypted requests received by
+// a server using payload encryption.
+var errEncryptionRequired = errors.New("rpc: payload encryption required")
+
+// errChecksumRequired is returned for requests without a checksum
+// received by a server using payload checksums.
+var errChecksumRequired = errors.New("rpc: payload checksum required")
+
+// KeyProvider returns the AEAD, initialized with the key to use with the
+// given peer, to encrypt and decrypt the payloads exchanged with it. It
+// is called for every call, so it should cache the AEADs if creating them
+// is expensive.
+type KeyProvider func(pid peer.ID) (cipher.AEAD, error)
+
+// Additional data for every kind of payload, so that a payload cannot be
+// passed off as a different one.
+const (
+	adRequest  = "request:"
+	adResponse = "response:"
+	adItem     = "item:"
+	adTrailer  = "trailer:"
+)
+
+// sealer encrypts and decrypts the payloads exchanged with a peer, and
+// checksums them, either or both. Every payload is sealed with a new
+// random nonce, which is sent before it. The checksum is appended to the
+// encoded payload, before sealing it.
+type sealer struct {
+	aead   cipher.AEAD          // nil unless encrypting
+	sum    func() hash.Hash     // nil unless checksumming
+	handle *codec.MsgpackHandle // to encode and decode the plaintexts
+}
+
+func newSealer(keys KeyProvider, sum func() hash.Hash, pid peer.ID, h *codec.MsgpackHandle) (*sealer, error) {
+	s := &sealer{sum: sum, handle: h}
+	if keys != nil {
+		aead, err := keys(pid)
+		if err != nil {
+			return nil, err
+		}
+		s.aead = aead
+	}
+	return s, nil
+}
+
+// encrypts returns whether the payloads are encrypted.
+func (s *sealer) encrypts() bool {
+	return s != nil && s.aead != nil
+}
+
+// checksums returns whether the payloads carry a checksum.
+func (s *sealer) checksums() bool {
+	return s != nil && s.sum != nil
+}
+
+// additionalData binds a payload to its kind and to the method called.
+func additionalData(kind string, svcID ServiceID) []byte {
+	return []byte(kind + svcID.Name + "." + svcID.Method)
+}
+
+// responseAD binds the body of a response to the ID of the request it
+// answers and to the error in the header, so that a sealed reply cannot
+// be swapped for another one or passed off as an error.
+func responseAD(svcID ServiceID, id uint64, errMsg string) []byte {
+	return append(additionalData(adResponse, svcID), fmt.Sprintf("#%d:%s", id, errMsg)...)
+}
+
+// itemAD binds a stream item to its position in the stream, counting from
+// 1, and to its cursor, so that items cannot be dropped, reordered or
+// replayed.
+func itemAD(svcID ServiceID, seq uint64, cursor string) []byte {
+	return append(additionalData(adItem, svcID), fmt.Sprintf("#%d:%s", seq, cursor)...)
+}
+
+// trailerAD binds the trailer of a stream to the number of items sent
+// before it and to the error it carries, so that a stream cannot be cut
+// short or made to fail.
+func trailerAD(svcID ServiceID, items uint64, errMsg string) []byte {
+	return append(additionalData(adTrailer, svcID), fmt.Sprintf("#%d:%s", items, errMsg)...)
+}
+
+// unauthenticated returns the error for an error message which came
+// unsealed from a peer whose replies are sealed. Peers send them when
+// they cannot seal them, but they may be forged on the way too, so they
+// are not taken at face value. Only ErrDecryption and ErrChecksum are,
+// since servers failing to open a request cannot seal the response, and
+// forging them makes the call fail, as resetting the stream would.
+func unauthenticated(msg string) error {
+	switch msg {
+	case ErrDecryption.Error(), ErrChecksum.Error():
+		return responseError(msg, true)
+	}
+	return fmt.Errorf("rpc: unauthenticated error from the server: %q", msg)
+}
+
+// seal encodes v, appends its checksum and encrypts the result, as
+// needed.
+func (s *sealer) seal(v interface{}, ad []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := newEncoder(s.handle, &buf).Encode(v); err != nil {
+		return nil, err
+	}
+	if s.sum != nil {
+		h := s.sum()
+		h.Write(buf.Bytes())
+		buf.Write(h.Sum(nil))
+	}
+	if s.aead == nil {
+		return buf.Bytes(), nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, buf.Bytes(), ad), nil
+}
+
+// encode writes v sealed into enc, or as is if the sealer is nil.
+func (s *sealer) encode(enc multicodec.Encoder, v interface{}, ad []byte) error {
+	if s == nil {
+		return enc.Encode(v)
+	}
+	sealed, err := s.seal(v, ad)
+	if err != nil {
+		return err
+	}
+	return enc.Encode(sealed)
+}
+
+// decode reads a sealed payload from dec, decrypts it and decodes the
+// result into v. If the sealer is nil, v is read from dec directly.
+func (s *sealer) decode(dec multicodec.Decoder, v interface{}, ad []byte) error {
+	if s == nil {
+		return dec.Decode(v)
+	}
+	var sealed []byte
+	if err := dec.Decode(&sealed); err != nil {
+		return err
+	}
+	return s.open(sealed, v, ad)
+}
+
+// open decrypts a sealed payload, verifies its checksum, as needed, and
+// decodes the result into v.
+func (s *sealer) open(sealed []byte, v interface{}, ad []byte) error {
+	plain := sealed
+	if s.aead != nil {
+		n := s.aead.NonceSize()
+		if len(sealed) < n {
+			return ErrDecryption
+		}
+		var err error
+		plain, err = s.aead.Open(nil, sealed[:n], sealed[n:], ad)
+		if err != nil {
+			return ErrDecryption
+		}
+	}
+	if s.sum != nil {
+		h := s.sum()
+		n := len(plain) - h.Size()
+		if n < 0 {
+			return ErrChecksum
+		}
+		h.Write(plain[:n])
+		if !bytes.Equal(h.Sum(nil), plain[n:]) {
+			return ErrChecksum
+		}
+		plain = plain[:n]
+	}
+	return newDecoder(s.handle, bytes.NewReader(plain)).Decode(v)
+}
+
+// requestSealer returns the sealer to read the payload of a request
+// with the given header, which is nil for unencrypted requests without
+// a checksum.
+func (server *Server) requestSealer(remote peer.ID, header RequestHeader) (*sealer, error) {
+	switch {
+	case server.keys == nil && header.Encrypted:
+		return nil, errors.New("rpc: payload encryption not supported")
+	case server.keys != nil && !header.Encrypted:
+		return nil, errEncryptionRequired
+	case server.checksum == nil && header.Checksummed:
+		return nil, errors.New("rpc: payload checksums not supported")
+	case server.checksum != nil && !header.Checksummed:
+		return nil, errChecksumRequired
+	case server.keys == nil && server.checksum == nil:
+		return nil, nil
+	}
+	return newSealer(server.keys, server.checksum, remote, server.payloadHandle)
+}
+
+// sealer returns the sealer to use for calls to the given peer, which is
+// nil when neither payload encryption nor checksums are used.
+func (c *Client) sealer(pid peer.ID) (*sealer, error) {
+	if c.keys == nil && c.checksum == nil {
+		return nil, nil
+	}
+	return newSealer(c.keys, c.checksum, pid, c.payloadHandle)
+}
@@ -0,0 +1,160 @@
+package rpc
+
+import "errors"
+
+// ErrOverloaded is returned when a server rejects a call because it is
+// overloaded. Clients may back off or try with a different peer.
+var ErrOverloaded = errors.New("rpc: server overloaded")
+
+// ErrUnauthorized is returned when a server rejects a call because the
+// AuthorizeFunc of the Policy in place did not allow it.
+var ErrUnauthorized = errors.New("rpc: unauthorized")
+
+// ErrTooManyStreams is returned when a call would need a stream beyond
+// the limit set with WithMaxOpenStreams, in the server, or
+// WithClientMaxOpenStreams, in the client.
+var ErrTooManyStreams = errors.New("rpc: too many open streams")
+
+// ErrShuttingDown is returned when a server rejects a call because it is
+// shutting down (see Server.Shutdown).
+var ErrShuttingDown = errors.New("rpc: server shutting down")
+
+// ErrQueueFull is returned when a server rejects a call because too many
+// calls to the same method are waiting for a worker already (see
+// WithMethodQueueLimit).
+var ErrQueueFull = errors.New("rpc: method queue full")
+
+// ErrPaused is returned when a server rejects a call because it is paused
+// (see Server.Pause).
+var ErrPaused = errors.New("rpc: server temporarily unavailable")
+
+// ErrClientClosed is returned by calls made with a Client which has been
+// closed, including those aborted by Close.
+var ErrClientClosed = errors.New("rpc: client closed")
+
+// ErrClientDraining is returned by calls made with a Client which is
+// being drained (see Client.Drain).
+var ErrClientDraining = errors.New("rpc: client draining")
+
+// ErrEmptyPeerID is returned by calls made to an empty peer ID, which is
+// most likely unset by mistake. Calls to the local server are made with
+// Client.CallLocal, unless the client takes the empty peer ID to mean the
+// local server (see WithEmptyPeerIDLocal).
+var ErrEmptyPeerID = errors.New("rpc: empty peer ID")
+
+// ErrSessionClosed is returned by calls made on a Session which has been
+// closed.
+var ErrSessionClosed = errors.New("rpc: session closed")
+
+// ErrStreamIdle is returned by ClientStream.Recv when nothing has been
+// received for longer than the timeout set with WithStreamIdleTimeout.
+var ErrStreamIdle = errors.New("rpc: stream idle for too long")
+
+// ErrSlowConsumer is returned by ServerStream.Send, and then by
+// ClientStream.Recv, when the server aborts a stream because the client
+// has not taken more items for longer than the timeout set with
+// WithSlowConsumerTimeout.
+var ErrSlowConsumer = errors.New("rpc: slow stream consumer")
+
+// ErrReplyDecodeTimeout is returned when reading and decoding a reply
+// takes longer than the timeout set with WithReplyDecodeTimeout.
+var ErrReplyDecodeTimeout = errors.New("rpc: reply decode timeout")
+
+// ErrDecryption is returned when an encrypted payload cannot be
+// decrypted, which happens when the keys used by both ends do not match
+// or when the payload was tampered with.
+var ErrDecryption = errors.New("rpc: payload decryption failed")
+
+// ErrChecksum is returned when the checksum of a payload does not match
+// its contents (see WithPayloadChecksum).
+var ErrChecksum = errors.New("rpc: integrity check failed")
+
+// ErrNoAddresses is returned, when enabled with WithRequireAddresses, by
+// calls to peers which the client is not connected to and has no known
+// addresses for.
+var ErrNoAddresses = errors.New("rpc: no addresses known for peer")
+
+// ErrHeaderTooLarge is returned when a server rejects a request because
+// its header is larger than the limit set with WithMaxHeaderSize.
+var ErrHeaderTooLarge = errors.New("rpc: request header too large")
+
+// ErrReplyTooLarge is returned by calls whose reply came compressed and is
+// larger than the limit set with WithMaxDecompressedSize once
+// decompressed.
+var ErrReplyTooLarge = errors.New("rpc: decompressed reply too large")
+
+// ErrBadSignature is returned when a server rejects a request because its
+// signature is invalid, does not belong to the caller or is missing while
+// required (see WithRequestSigning).
+var ErrBadSignature = errors.New("rpc: bad request signature")
+
+// ErrMethodDisabled is returned when a server rejects a call because the
+// method has been disabled with Server.SetMethodEnabled.
+var ErrMethodDisabled = errors.New("rpc: method disabled")
+
+// ErrAlreadyApplied is returned by calls made on a SequencedSession when
+// the server had run the command already, so it was not run again and its
+// reply is not available.
+var ErrAlreadyApplied = errors.New("rpc: command already applied")
+
+// ErrSequenceGap is returned by calls made on a SequencedSession when the
+// server has not received the preceding commands in the session, which
+// happens when it lost track of the session (see WithSequencedSessions).
+// The session cannot be used anymore.
+var ErrSequenceGap = errors.New("rpc: gap in command sequence")
+
+// ErrGroupCancelled is the cause of the context of a CallGroup once
+// CallGroup.CancelAll is called.
+var ErrGroupCancelled = errors.New("rpc: call group cancelled")
+
+// wireErrors holds errors which keep their identity when a server sends
+// them back to a client, so that they can be compared against. Only the
+// errors flagged as such by the server are mapped back, so that method
+// errors with the same message are left alone.
+var wireErrors = map[string]error{
+	ErrOverloaded.Error():     ErrOverloaded,
+	ErrUnauthorized.Error():   ErrUnauthorized,
+	ErrTooManyStreams.Error(): ErrTooManyStreams,
+	ErrShuttingDown.Error():   ErrShuttingDown,
+	ErrPaused.Error():         ErrPaused,
+	ErrQueueFull.Error():      ErrQueueFull,
+	ErrDecryption.Error():     ErrDecryption,
+	ErrChecksum.Error():       ErrChecksum,
+	ErrHeaderTooLarge.Error(): ErrHeaderTooLarge,
+	ErrBadSignature.Error():   ErrBadSignature,
+	ErrMethodDisabled.Error(): ErrMethodDisabled,
+	ErrAlreadyApplied.Error(): ErrAlreadyApplied,
+	ErrSequenceGap.Error():    ErrSequenceGap,
+	ErrSlowConsumer.Error():   ErrSlowConsumer,
+}
+
+// responseError returns the error for the given error message received
+// in a Response, which is one of wireErrors when serverError is set.
+func responseError(msg string, serverError bool) error {
+	if err, ok := wireErrors[msg]; ok && serverError {
+		return err
+	}
+	return errors.New(msg)
+}
+
+// isWireError reports whether the given error is one of wireErrors, as
+// opposed to an error with the same message.
+func isWireError(err error) bool {
+	return err != nil && wireErrors[err.Error()] == err
+}
+
+// isTransient reports whether a completed call failed because of a
+// transport error or because the server was temporarily unable to run it,
+// in which case it makes sense to retry. Errors returned by methods are
+// never transient. Callers must check whether they gave up on the call, in
+// which case retrying makes no sense either.
+func isTransient(call *Call) bool {
+	if call.Error == nil {
+		return false
+	}
+	switch call.Error {
+	case ErrOverloaded, ErrTooManyStreams, ErrShuttingDown, ErrPaused, ErrQueueFull:
+		return true
+	}
+	return call.transport
+}
@@ -0,0 +1,107 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// FailoverPolicy configures how CallWithFailover retries a call.
+type FailoverPolicy struct {
+	// Attempts is the maximum number of attempts. Zero means one
+	// attempt per peer.
+	Attempts int
+	// AttemptTimeout bounds every attempt, if not zero. Attempts
+	// timing out are retried.
+	AttemptTimeout time.Duration
+	// Backoff is the delay before the first retry, which doubles
+	// with every retry up to MaxBackoff, if not zero. Every delay is
+	// randomized between half and the whole of it.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Rotate makes every retry go to the next peer. Otherwise, the
+	// attempts are split evenly among the peers, in order, so that
+	// every peer is retried before moving on to the next one.
+	Rotate bool
+}
+
+// peerFor returns the index of the peer to use in the given attempt.
+func (p FailoverPolicy) peerFor(attempt, attempts, peers int) int {
+	if p.Rotate {
+		return attempt % peers
+	}
+	return attempt * peers / attempts
+}
+
+// delay returns the jittered delay to wait before the given retry.
+func (p FailoverPolicy) delay(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && (p.MaxBackoff == 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// CallWithFailover performs a call to the first of the given peers, and
+// retries it, with the same or other peers as set by the policy, when it
+// fails because of a transport error or because the peer was temporarily
+// unable to run it (see ErrOverloaded, for example). Calls failing with
+// errors returned by the method are not retried. It returns the peer that
+// answered the last attempt, if any, along with its error.
+func (c *Client) CallWithFailover(ctx context.Context, pids []peer.ID, policy FailoverPolicy, svcName, svcMethod string, args, reply interface{}) (peer.ID, error) {
+	if len(pids) == 0 {
+		return "", errors.New("rpc: no peers to call")
+	}
+	attempts := policy.Attempts
+	if attempts <= 0 {
+		attempts = len(pids)
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(policy.delay(attempt)):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		pid := pids[policy.peerFor(attempt, attempts, len(pids))]
+		var retry bool
+		retry, err = c.failoverAttempt(ctx, pid, policy, svcName, svcMethod, args, reply)
+		if !retry {
+			return pid, err
+		}
+		logger.Debugf("failover call to %s failed: %s", pid.Pretty(), err)
+	}
+	return "", err
+}
+
+// failoverAttempt performs an attempt of CallWithFailover and reports
+// whether it should be retried.
+func (c *Client) failoverAttempt(ctx context.Context, pid peer.ID, policy FailoverPolicy, svcName, svcMethod string, args, reply interface{}) (bool, error) {
+	actx := ctx
+	if policy.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		actx, cancel = context.WithTimeout(ctx, policy.AttemptTimeout)
+		defer cancel()
+	}
+	done := make(chan *Call, 1)
+	c.GoContext(actx, pid, svcName, svcMethod, args, reply, done)
+	call := <-done
+	if ctx.Err() != nil {
+		return false, call.Error
+	}
+	timedOut := call.Error != nil && actx.Err() != nil
+	return timedOut || isTransient(call), call.Error
+}
@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+
+	codec "github.com/ugorji/go/codec"
+)
+
+// typeOfInterface is the type of the replies of fallback methods.
+var typeOfInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// typeOfRaw is the type of the arguments of fallback methods.
+var typeOfRaw = reflect.TypeOf(codec.Raw(nil))
+
+// FallbackFunc handles requests for methods which are not registered in
+// the server (see Server.SetFallback). It receives the arguments encoded
+// as sent by the client, with msgpack or with the codec named in the
+// header, and returns the reply encoded likewise, or an error, which is
+// sent back to the client.
+type FallbackFunc func(ctx context.Context, header RequestHeader, args []byte) (reply []byte, err error)
+
+// SetFallback sets the function handling remote requests for services or
+// methods which are not registered in the server, which allows to proxy
+// or route them dynamically without registering every method. Registered
+// methods always take precedence, and disabled ones (see
+// SetMethodEnabled) are still rejected. Fallback requests go through the
+// policy in place like any other, though streaming and pipe calls are not
+// supported. A nil function removes the fallback.
+func (server *Server) SetFallback(fn FallbackFunc) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.fallback = fn
+}
+
+// fallbackMethod returns a method calling the fallback for the request
+// with the given header, for the given service and method, or nil if
+// there is no fallback. The arguments are passed to the fallback as they
+// were read, without decoding them, while the reply is decoded so that it
+// can be sent like any other.
+func (server *Server) fallbackMethod(header RequestHeader, svcID ServiceID) (*service, *methodType) {
+	server.mu.RLock()
+	fn := server.fallback
+	server.mu.RUnlock()
+	if fn == nil {
+		return nil, nil
+	}
+	mtype := &methodType{
+		method:     reflect.Method{Name: svcID.Method},
+		ArgType:    typeOfRaw,
+		ReplyType:  reflect.PtrTo(typeOfInterface),
+		hasContext: true,
+		rawArgs:    true,
+		fn: func(ctx context.Context, argv, replyv reflect.Value) error {
+			reply, err := fn(ctx, header, argv.Interface().(codec.Raw))
+			if err != nil || len(reply) == 0 {
+				return err
+			}
+			payloadCodec, err := server.codecFor(header.Codec)
+			if err != nil {
+				return err
+			}
+			if payloadCodec != nil {
+				return payloadCodec.Unmarshal(reply, replyv.Interface())
+			}
+			return unmarshalPayload(server.msgpackHandle, nil, reply, replyv.Interface(), nil)
+		},
+	}
+	return &service{name: svcID.Name}, mtype
+}
@@ -0,0 +1,47 @@
+package rpc
+
+import (
+	"context"
+	"strings"
+)
+
+// FieldMask lists the fields of the reply which the client needs, as set
+// with WithFieldMask. Fields are named by the client and the server
+// alike, usually after the fields of the reply type, with dots separating
+// the names of nested fields, as in "Stats.Latency". The nil mask means
+// that all fields are needed.
+type FieldMask []string
+
+// Has reports whether the given field, or any field nested in it, is
+// needed, so that the handler must compute it. It is always true for the
+// nil mask.
+func (m FieldMask) Has(field string) bool {
+	if m == nil {
+		return true
+	}
+	for _, f := range m {
+		if f == field || strings.HasPrefix(field, f+".") || strings.HasPrefix(f, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// WithFieldMask makes the call ask the server for the given fields of
+// the reply only, so that handlers computing expensive replies can skip
+// the rest (see FieldMaskFromContext). Handlers are free to ignore the
+// mask, in which case the whole reply is sent, so callers must not rely
+// on the other fields being left empty.
+func WithFieldMask(fields ...string) CallOption {
+	return func(o *callOptions) {
+		o.fieldMask = append(FieldMask{}, fields...)
+	}
+}
+
+// FieldMaskFromContext returns the mask of the fields of the reply needed
+// by the client of the call whose handler received the given context. It
+// returns nil, meaning all fields, when the client did not set one.
+func FieldMaskFromContext(ctx context.Context) FieldMask {
+	m, _ := ctx.Value(fieldMaskKey).(FieldMask)
+	return m
+}
@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errStreamAbandoned is returned by ServerStream.Send when the client went
+// away, and is the cause of the context of the method then.
+var errStreamAbandoned = errors.New("rpc: stream abandoned by the client")
+
+// streamCredit is sent by clients using flow control in streaming calls
+// (see WithStreamWindow) to let the server send more items.
+type streamCredit struct {
+	Credits int
+}
+
+// credits holds the number of items that a ServerStream may send before
+// the client grants more.
+type credits struct {
+	mu    sync.Mutex
+	avail int
+
+	more chan struct{} // signalled when credits arrive
+	gone chan struct{} // closed when the client stops sending credits
+
+	abort context.CancelCauseFunc // cancels the method context
+}
+
+// startFlowControl limits the items sent to the given window, and starts
+// reading the credits sent by the client. Abandon is called if the client
+// goes away.
+func (s *ServerStream) startFlowControl(window int, abandon context.CancelCauseFunc) {
+	s.credits = &credits{
+		avail: window,
+		more:  make(chan struct{}, 1),
+		gone:  make(chan struct{}),
+		abort: abandon,
+	}
+	go s.readCredits(abandon)
+}
+
+// readCredits reads the credits sent by the client until it closes the
+// stream, which it does once the call is over.
+func (s *ServerStream) readCredits(abandon context.CancelCauseFunc) {
+	defer abandon(errStreamAbandoned)
+	defer close(s.credits.gone)
+	for {
+		var credit streamCredit
+		if err := s.sw.dec.Decode(&credit); err != nil {
+			return
+		}
+		s.credits.mu.Lock()
+		s.credits.avail += credit.Credits
+		s.credits.mu.Unlock()
+		select {
+		case s.credits.more <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// acquireCredit waits until an item can be sent, aborting the stream
+// when that takes longer than the slow consumer timeout.
+func (s *ServerStream) acquireCredit(ctx context.Context) error {
+	if s.credits == nil {
+		return nil
+	}
+	var slow <-chan time.Time
+	for {
+		s.credits.mu.Lock()
+		if s.credits.avail > 0 {
+			s.credits.avail--
+			s.credits.mu.Unlock()
+			return nil
+		}
+		s.credits.mu.Unlock()
+		if slow == nil && s.slowTimeout > 0 {
+			t := time.NewTimer(s.slowTimeout)
+			defer t.Stop()
+			slow = t.C
+		}
+		select {
+		case <-s.credits.more:
+		case <-s.credits.gone:
+			return errStreamAbandoned
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-slow:
+			s.credits.abort(ErrSlowConsumer)
+			return ErrSlowConsumer
+		}
+	}
+}
+
+// consumed accounts for an item received, and grants more credits to the
+// server once half of the window has been consumed.
+func (cs *ClientStream) consumed() error {
+	if cs.window <= 0 {
+		return nil
+	}
+	cs.pending++
+	if cs.pending < (cs.window+1)/2 {
+		return nil
+	}
+	credit := streamCredit{Credits: cs.pending}
+	cs.pending = 0
+	if err := cs.sw.enc.Encode(credit); err != nil {
+		return err
+	}
+	return cs.sw.w.Flush()
+}
@@ -0,0 +1,287 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	multicodec "github.com/multiformats/go-multicodec"
+)
+
+// FrameKind identifies the kind of message held by a Frame.
+type FrameKind int
+
+// Kinds of frames.
+const (
+	RequestFrame FrameKind = iota
+	ResponseFrame
+	StreamItemFrame
+	StreamTrailerFrame
+	StreamKeepaliveFrame
+	StreamCreditFrame
+	PipeChunkFrame
+	CancelFrame
+)
+
+// ResponseHeader is the header of responses, which is followed by the
+// reply (see Frame). It is the same type as Response.
+type ResponseHeader = Response
+
+// Frame is a message read from a stream by a FrameReader or DumpFrame.
+//
+// Every message exchanged on a stream is a header optionally followed by
+// a body, each encoded separately with msgpack:
+//
+//   - Requests are a RequestHeader followed by the arguments.
+//   - Responses are a ResponseHeader followed by the reply, which is
+//     sent even when the call failed. When ResponseHeader.Compressed is
+//     set, the body is a byte string holding the gzipped, encoded reply.
+//   - When a header has Encrypted set, its body is a byte string holding
+//     a random nonce followed by the sealed, encoded payload.
+//   - When a header has Checksummed set, its body is a byte string
+//     holding the encoded payload followed by its checksum. When also
+//     encrypted, the checksummed payload is sealed.
+//   - Streaming calls are answered with a sequence of stream frames,
+//     which hold a Type and an Error. Item frames are followed by the
+//     item. The stream ends with a trailer frame, carrying the error
+//     returned by the method, if any. Keepalive frames carry nothing
+//     and only keep the stream busy.
+//   - Sealed payloads are bound to what they belong to with the
+//     additional data of the AEAD: responses to the request ID and the
+//     error in the header, items to their position in the stream and
+//     their cursor. Trailers of sealed streams have Sealed set and are
+//     followed by a sealed body, bound to the error and the number of
+//     items sent.
+//   - When RequestHeader.Window is set in a streaming call, the client
+//     sends credit messages, holding the number of additional items the
+//     server may send, as it consumes them.
+//   - Pipe calls are accepted with a response without error. Then the
+//     client sends the body and the server the reply, as raw chunks
+//     made of their length, as a uvarint, followed by the bytes, and
+//     ended by an empty chunk. The server sends the final response after
+//     the reply.
+//   - When RequestHeader.CancelReasons is set, the client may send a
+//     RequestHeader with only Cancel set, and no body, while the call
+//     runs, to abort it.
+//
+// Clients may send several requests on a stream, one after the other, or
+// multiplexed when they carry an ID, in which case responses carry the
+// same ID and may come in any order. Since headers carry no type, what a
+// message is depends on the direction it was sent in and on the state of
+// the stream, which FrameReader keeps track of.
+type Frame struct {
+	Kind FrameKind
+	// Request is set for request and cancel frames.
+	Request *RequestHeader
+	// Response is set for response frames.
+	Response *ResponseHeader
+	// Error is the error carried by stream trailers, if any.
+	Error string
+	// Credits is the number of items granted by credit frames.
+	Credits int
+	// Body is the arguments, reply or item following the header,
+	// decoded into generic values since their types are unknown.
+	// It is a byte string when the body is compressed, encrypted or
+	// checksummed, and holds the bytes of pipe chunks, which are empty
+	// for those ending the body or the reply.
+	Body interface{}
+}
+
+// FrameDirection tells which end of a stream sent the frames read by a
+// FrameReader.
+type FrameDirection int
+
+// Directions of a stream.
+const (
+	// FromClient is the direction of requests.
+	FromClient FrameDirection = iota
+	// FromServer is the direction of responses.
+	FromServer
+)
+
+// frameState is what a FrameReader expects next.
+type frameState int
+
+const (
+	expectHeader     frameState = iota // a request or a response
+	expectCredits                      // credits for a streaming call
+	expectStream                       // frames of a streaming call
+	expectPipeChunks                   // chunks of a pipe body or reply
+	expectPipeEnd                      // the final response of a pipe
+)
+
+// FrameReader reads the frames sent in one direction of a stream, as
+// captured from the wire. It is meant for debugging and for tools
+// inspecting RPC traffic. It keeps track of the state of the stream to
+// tell what every message is.
+//
+// What the server sends depends on the requests it answers, so the
+// requests read from the client direction of the same stream must be
+// given to the reader of the server direction with Answer, in order,
+// before reading the frames answering them. Multiplexed requests, which
+// carry an ID, are always answered with a response and need not be
+// given.
+type FrameReader struct {
+	r     io.Reader
+	br    io.ByteReader
+	dec   multicodec.Decoder
+	dir   FrameDirection
+	state frameState
+	calls []RequestHeader // see Answer
+}
+
+// NewFrameReader returns a FrameReader reading the frames sent in the
+// given direction from r. When r does not implement io.ByteReader, it is
+// buffered, so it may be read beyond the frames returned.
+func NewFrameReader(r io.Reader, dir FrameDirection) *FrameReader {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		b := bufio.NewReader(r)
+		r, br = b, b
+	}
+	return &FrameReader{r: r, br: br, dec: newDecoder(nil, r), dir: dir}
+}
+
+// Answer tells a reader of the server direction about a request sent
+// on the stream, as read from the client direction.
+func (fr *FrameReader) Answer(req RequestHeader) {
+	if req.ID == 0 && req.Cancel == nil {
+		fr.calls = append(fr.calls, req)
+	}
+}
+
+// DumpFrame reads the request which starts what a client sent on a
+// stream, from r, which should implement io.ByteReader, such as a
+// bufio.Reader, so that nothing is read beyond it. The frames which
+// follow, and those sent by the server, are read with a FrameReader.
+func DumpFrame(r io.Reader) (Frame, error) {
+	return NewFrameReader(r, FromClient).Next()
+}
+
+// Next reads the next frame. It returns io.EOF when there are no more
+// frames.
+func (fr *FrameReader) Next() (Frame, error) {
+	var f Frame
+	var body bool
+	var err error
+	switch fr.state {
+	case expectPipeChunks:
+		return fr.pipeChunk()
+	case expectCredits:
+		var credit streamCredit
+		if err := fr.dec.Decode(&credit); err != nil {
+			return Frame{}, err
+		}
+		return Frame{Kind: StreamCreditFrame, Credits: credit.Credits}, nil
+	case expectStream:
+		f, body, err = fr.streamFrame()
+	default:
+		if fr.dir == FromClient {
+			f, body, err = fr.request()
+		} else {
+			f, body, err = fr.response()
+		}
+	}
+	if err != nil || !body {
+		return f, err
+	}
+
+	if err := fr.dec.Decode(&f.Body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	return f, nil
+}
+
+// request reads a request header, or a cancel header, which has no body.
+// It reports whether a body follows.
+func (fr *FrameReader) request() (Frame, bool, error) {
+	var h RequestHeader
+	if err := fr.dec.Decode(&h); err != nil {
+		return Frame{}, false, err
+	}
+	if h.Cancel != nil {
+		return Frame{Kind: CancelFrame, Request: &h}, false, nil
+	}
+	switch {
+	case h.Pipe:
+		fr.state = expectPipeChunks
+	case h.Stream && h.Window > 0:
+		fr.state = expectCredits
+	}
+	return Frame{Kind: RequestFrame, Request: &h}, true, nil
+}
+
+// response reads the header answering the next request given with
+// Answer, which is a stream frame for streaming calls. It reports
+// whether a body follows.
+func (fr *FrameReader) response() (Frame, bool, error) {
+	var call RequestHeader
+	if fr.state == expectHeader && len(fr.calls) > 0 {
+		call = fr.calls[0]
+		fr.calls = fr.calls[1:]
+	}
+	if call.Stream {
+		fr.state = expectStream
+		return fr.streamFrame()
+	}
+
+	var h ResponseHeader
+	if err := fr.dec.Decode(&h); err != nil {
+		return Frame{}, false, err
+	}
+	switch {
+	case fr.state == expectPipeEnd:
+		fr.state = expectHeader
+	case call.Pipe && h.Error == "":
+		fr.state = expectPipeChunks
+	}
+	return Frame{Kind: ResponseFrame, Response: &h}, true, nil
+}
+
+// streamFrame reads a frame sent by the server in a streaming call. It
+// reports whether a body follows, which items and sealed trailers have.
+func (fr *FrameReader) streamFrame() (Frame, bool, error) {
+	var h streamFrame
+	if err := fr.dec.Decode(&h); err != nil {
+		return Frame{}, false, err
+	}
+	switch h.Type {
+	case frameItem:
+		return Frame{Kind: StreamItemFrame}, true, nil
+	case frameTrailer:
+		fr.state = expectHeader
+		return Frame{Kind: StreamTrailerFrame, Error: h.Error}, h.Sealed, nil
+	case frameKeepalive:
+		return Frame{Kind: StreamKeepaliveFrame}, false, nil
+	}
+	return Frame{}, false, errors.New("rpc: unknown stream frame type")
+}
+
+// pipeChunk reads a chunk of the body or the reply of a pipe call.
+func (fr *FrameReader) pipeChunk() (Frame, error) {
+	n, err := binary.ReadUvarint(fr.br)
+	if err != nil {
+		return Frame{}, err
+	}
+	if n > pipeChunkSize {
+		return Frame{}, errors.New("rpc: pipe chunk too large")
+	}
+	chunk := make([]byte, n)
+	if _, err := io.ReadFull(fr.r, chunk); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	if n == 0 {
+		fr.state = expectHeader
+		if fr.dir == FromServer {
+			fr.state = expectPipeEnd
+		}
+	}
+	return Frame{Kind: PipeChunkFrame, Body: chunk}, nil
+}
@@ -0,0 +1,91 @@
+package rpc
+
+import (
+	"sort"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// topGoroutinePeers is the number of peers reported in
+// ServerStats.TopGoroutinePeers.
+const topGoroutinePeers = 10
+
+// PeerGoroutines holds the number of handler goroutines running for a peer.
+type PeerGoroutines struct {
+	Peer       peer.ID
+	Goroutines int
+}
+
+// peerGoroutines counts the handler goroutines running for every peer, so
+// that peers triggering handlers which never return stand out.
+type peerGoroutines struct {
+	max int // zero means no limit
+
+	mu sync.Mutex
+	n  map[peer.ID]int
+}
+
+// acquire accounts for a new handler goroutine for the given peer. It
+// returns false when the peer has reached the limit, in which case the
+// handler must not run.
+func (g *peerGoroutines) acquire(pid peer.ID) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.max > 0 && g.n[pid] >= g.max {
+		return false
+	}
+	if g.n == nil {
+		g.n = make(map[peer.ID]int)
+	}
+	g.n[pid]++
+	return true
+}
+
+func (g *peerGoroutines) release(pid peer.ID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.n[pid] <= 1 {
+		delete(g.n, pid)
+		return
+	}
+	g.n[pid]--
+}
+
+func (g *peerGoroutines) count(pid peer.ID) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.n[pid]
+}
+
+// top returns the n peers with the most handler goroutines, most first.
+func (g *peerGoroutines) top(n int) []PeerGoroutines {
+	g.mu.Lock()
+	peers := make([]PeerGoroutines, 0, len(g.n))
+	for pid, count := range g.n {
+		peers = append(peers, PeerGoroutines{pid, count})
+	}
+	g.mu.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Goroutines != peers[j].Goroutines {
+			return peers[i].Goroutines > peers[j].Goroutines
+		}
+		return peers[i].Peer < peers[j].Peer
+	})
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// Goroutines returns the number of handler goroutines currently running
+// for calls from the given peer: those running methods, including
+// streaming and pipe ones, and those waiting to. A number which keeps
+// growing points to handlers which never return, triggered by that peer.
+// Handlers keep counting until they return, even when the peer gave up on
+// the call. Local calls count for the ID of the server, and calls received
+// over HTTP for the empty peer ID. See WithMaxGoroutinesPerPeer.
+func (server *Server) Goroutines(pid peer.ID) int {
+	return server.goroutines.count(pid)
+}
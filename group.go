@@ -0,0 +1,72 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// CallGroup tracks the calls made on behalf of an operation, possibly to
+// many peers and with different clients, so that they can be aborted as
+// a unit with CancelAll when the operation is given up. It can be used
+// concurrently.
+type CallGroup struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	wg sync.WaitGroup
+	mu sync.Mutex
+	n  int // calls in progress
+}
+
+// NewCallGroup returns a CallGroup whose calls are bound to the given
+// context, so that cancelling it aborts them too.
+func NewCallGroup(ctx context.Context) *CallGroup {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &CallGroup{ctx: ctx, cancel: cancel}
+}
+
+// Context returns the context of the group. Calls and streams made with
+// it, or with contexts derived from it, are aborted by CancelAll as well,
+// although they are not tracked by the group.
+func (g *CallGroup) Context() context.Context {
+	return g.ctx
+}
+
+// Call performs a call with the given client as part of the group, like
+// Client.CallContext with the context of the group. It blocks until the
+// call completes.
+func (g *CallGroup) Call(c *Client, dest peer.ID, svcName, svcMethod string, args, reply interface{}, opts ...CallOption) error {
+	g.mu.Lock()
+	g.n++
+	g.mu.Unlock()
+	g.wg.Add(1)
+	defer func() {
+		g.mu.Lock()
+		g.n--
+		g.mu.Unlock()
+		g.wg.Done()
+	}()
+	return c.CallContext(g.ctx, dest, svcName, svcMethod, args, reply, opts...)
+}
+
+// Len returns the number of calls of the group in progress.
+func (g *CallGroup) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.n
+}
+
+// CancelAll aborts all the calls of the group, which fail with
+// context.Canceled, and resets their streams. Calls made afterwards fail
+// right away. The cause of the context of the group is
+// ErrGroupCancelled, unless the parent context was done before.
+func (g *CallGroup) CancelAll() {
+	g.cancel(ErrGroupCancelled)
+}
+
+// Wait waits for the calls of the group in progress to complete.
+func (g *CallGroup) Wait() {
+	g.wg.Wait()
+}
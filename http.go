@@ -0,0 +1,250 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Content types understood by the HTTP adapter. Requests without a
+// content type are taken to be JSON.
+const (
+	httpJSONType = "application/json"
+	httpGobType  = "application/x-gob"
+)
+
+// HTTPAuthFunc identifies the caller of an HTTP request handled by the
+// handler returned by NewHTTPHandler, typically from its Authorization
+// header. The identity returned is made available to the handler with
+// HTTPCallerFromContext. Requests for which it returns an error are
+// rejected with 401 Unauthorized.
+type HTTPAuthFunc func(r *http.Request) (string, error)
+
+// httpHandler is the http.Handler returned by NewHTTPHandler.
+type httpHandler struct {
+	server *Server
+	policy Policy
+	auth   HTTPAuthFunc
+}
+
+// NewHTTPHandler returns an http.Handler exposing the services registered
+// in the server to HTTP clients, as a bridge for those which cannot speak
+// libp2p. Calls are made with a POST request to /Service/Method, with the
+// arguments in the body, encoded with encoding/json or, when the content
+// type is application/x-gob, with encoding/gob. The reply is sent back in
+// the same encoding. The handler can be mounted under a prefix with
+// http.StripPrefix.
+//
+// Calls go through the same dispatch as those received over libp2p, so
+// the given policy applies to them, along with validators and other
+// server-wide settings. There is no peer ID for the caller though:
+// Authorize is consulted with an empty peer.ID, and CallerFromContext
+// returns it too. Instead, the caller is identified by auth, when not
+// nil, and its identity is returned by HTTPCallerFromContext, which
+// interceptors can use to authorize calls.
+//
+// The call context ends when the HTTP request is done. Errors returned by
+// methods are sent with 500 Internal Server Error and the error message
+// as plain text. Streaming and pipe methods are not supported, and
+// neither are the services the server provides itself, such as the one
+// used by ClockSync.
+//
+// Requests are subject to the server limits: the request line and
+// headers, which play the part of the request header, must fit in
+// WithMaxHeaderSize, or the request is rejected with 431 Request Header
+// Fields Too Large, and, with WithMemoryBudget, bodies larger than the
+// whole budget are rejected with 413 Request Entity Too Large, while the
+// others are charged like the arguments of any other call. Since HTTP
+// requests cannot be signed, encrypted or checksummed, all of them are
+// rejected with 403 Forbidden by servers using WithRequireSignatures,
+// WithPayloadEncryption or WithPayloadChecksum.
+func NewHTTPHandler(server *Server, policy Policy, auth HTTPAuthFunc) http.Handler {
+	return &httpHandler{server: server, policy: policy, auth: auth}
+}
+
+// HTTPCallerFromContext returns the identity of the HTTP caller, as
+// returned by the HTTPAuthFunc, of the call whose handler received the
+// given context. It returns false for calls which were not received over
+// HTTP or when no HTTPAuthFunc is used.
+func HTTPCallerFromContext(ctx context.Context) (string, bool) {
+	caller, ok := ctx.Value(httpCallerKey).(string)
+	return caller, ok
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	contentType := httpJSONType
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || (mediaType != httpJSONType && mediaType != httpGobType) {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		contentType = mediaType
+	}
+
+	server := h.server
+	if server.maxHeaderSize > 0 && httpHeaderSize(r) > server.maxHeaderSize {
+		http.Error(w, ErrHeaderTooLarge.Error(), http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+	if _, err := server.requestSealer("", RequestHeader{}); err != nil || server.requireSignatures {
+		http.Error(w, "signed, encrypted or checksummed calls are required", http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	if slash < 0 {
+		http.Error(w, "path must be of the form /Service/Method", http.StatusNotFound)
+		return
+	}
+	header := RequestHeader{
+		ServiceID: ServiceID{path[:slash], path[slash+1:]},
+	}
+
+	var caller string
+	if h.auth != nil {
+		var err error
+		caller, err = h.auth(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	svcID, err := server.admit("", header, &h.policy)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	if internalService(svcID.Name) {
+		http.Error(w, "rpc: can't find service "+svcID.Name, http.StatusNotFound)
+		return
+	}
+	service, mtype, err := server.getService(svcID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if mtype.streaming || mtype.pipe {
+		http.Error(w, "streaming and pipe methods are not supported over HTTP", http.StatusNotFound)
+		return
+	}
+
+	body := r.Body
+	if server.memory != nil {
+		body = http.MaxBytesReader(w, body, server.memory.max)
+	}
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The memory used by the arguments is charged while the call is
+	// handled, as for calls received over libp2p.
+	if server.memory != nil {
+		charged := int64(len(payload))
+		if !server.memory.admit(charged) {
+			http.Error(w, ErrOverloaded.Error(), httpStatus(ErrOverloaded))
+			return
+		}
+		defer server.memory.release(charged)
+	}
+
+	argv, err := decodeArgs(mtype, func(v interface{}) error {
+		var err error
+		if contentType == httpGobType {
+			err = gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+		} else {
+			err = json.NewDecoder(bytes.NewReader(payload)).Decode(v)
+		}
+		if err == io.EOF { // an empty body means zero arguments
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	replyv := reflect.New(mtype.ReplyType.Elem())
+
+	ctx, cancel := callContext("", header)
+	defer cancel()
+	stop := context.AfterFunc(r.Context(), cancel)
+	defer stop()
+	if h.auth != nil {
+		ctx = context.WithValue(ctx, httpCallerKey, caller)
+	}
+
+	info := CallInfo{
+		Service: svcID.Name,
+		Method:  svcID.Method,
+		Start:   time.Now(),
+	}
+	err = server.dispatch(ctx, info, &h.policy, service, mtype, argv, replyv)
+	if err != nil {
+		server.errLog.logError("HTTP method returned an error:", err)
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if contentType == httpGobType {
+		err = gob.NewEncoder(w).Encode(replyv.Interface())
+	} else {
+		err = json.NewEncoder(w).Encode(replyv.Interface())
+	}
+	if err != nil {
+		server.errLog.logError("error sending HTTP reply:", err)
+	}
+}
+
+// httpHeaderSize returns roughly the size of the request line and
+// headers of an HTTP request.
+func httpHeaderSize(r *http.Request) int64 {
+	n := len(r.Method) + len(r.URL.RequestURI()) + len(r.Proto)
+	for name, values := range r.Header {
+		for _, v := range values {
+			n += len(name) + len(v) + 4 // ": " and CRLF
+		}
+	}
+	return int64(n)
+}
+
+// internalService returns whether the named service is one of those the
+// server provides itself, which are not exposed over HTTP.
+func internalService(name string) bool {
+	return name == clockServiceName || name == reflectionServiceName
+}
+
+// httpStatus returns the HTTP status for a call failing with err.
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusForbidden
+	case errors.Is(err, ErrOverloaded), errors.Is(err, ErrShuttingDown),
+		errors.Is(err, ErrPaused), errors.Is(err, ErrQueueFull):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,92 @@
+package rpc
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// CallInfo describes an RPC call which is currently being executed.
+type CallInfo struct {
+	// Peer is the remote end of the call: the caller when the CallInfo
+	// is obtained from a Server and the destination when obtained
+	// from a Client.
+	Peer    peer.ID
+	Service string
+	Method  string
+	Start   time.Time
+	// RequestID is the ID of the logical operation the call is part
+	// of, if any (see WithRequestID).
+	RequestID string
+}
+
+// inFlight is a registry of active calls, keyed by an internal id.
+// The zero value is ready to use.
+type inFlight struct {
+	mu    sync.Mutex
+	next  uint64
+	calls map[uint64]CallInfo
+	empty chan struct{} // closed when there are no calls left
+}
+
+// add registers a call and returns the id which must be used
+// to remove it once it completes.
+func (f *inFlight) add(info CallInfo) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls == nil {
+		f.calls = make(map[uint64]CallInfo)
+	}
+	f.next++
+	f.calls[f.next] = info
+	return f.next
+}
+
+func (f *inFlight) remove(id uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.calls, id)
+	if len(f.calls) == 0 && f.empty != nil {
+		close(f.empty)
+		f.empty = nil
+	}
+}
+
+// wait blocks until there are no active calls or the context is done.
+func (f *inFlight) wait(ctx context.Context) error {
+	f.mu.Lock()
+	if len(f.calls) == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	if f.empty == nil {
+		f.empty = make(chan struct{})
+	}
+	empty := f.empty
+	f.mu.Unlock()
+
+	select {
+	case <-empty:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// snapshot returns the active calls, oldest first.
+func (f *inFlight) snapshot() []CallInfo {
+	f.mu.Lock()
+	calls := make([]CallInfo, 0, len(f.calls))
+	for _, info := range f.calls {
+		calls = append(calls, info)
+	}
+	f.mu.Unlock()
+
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].Start.Before(calls[j].Start)
+	})
+	return calls
+}
@@ -0,0 +1,279 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+)
+
+const jsonRPCVersion = "2.0"
+
+// JSON-RPC 2.0 error codes.
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCServerError    = -32000
+)
+
+// JSONRPCError is the error object included in JSON-RPC 2.0 responses.
+type JSONRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *JSONRPCError) Error() string {
+	return e.Message
+}
+
+type jsonRPCRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type jsonRPCResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// ServeJSONRPC makes the server handle requests for the given protocol
+// using JSON-RPC 2.0 framing, so that gateways and existing JSON-RPC
+// tooling can talk to the registered services. Every stream carries a
+// sequence of JSON-RPC requests (or batches) and the responses for them.
+//
+// The request method must be of the form "Service.Method". The params
+// can be the argument object itself or an array holding it as only
+// element. Arguments and replies are encoded with encoding/json.
+// Requests without id are notifications and get no response. Errors
+// are reported with the standard codes, and errors returned by methods,
+// as well as rejections due to the server Policy, use JSONRPCServerError.
+// JSON-RPC requests carry no signature, so servers created with
+// WithRequireSignatures reject all of them with ErrBadSignature.
+func (server *Server) ServeJSONRPC(p protocol.ID, policy Policy) {
+	if server.host == nil {
+		return
+	}
+	server.setStreamHandler(p, func(stream inet.Stream) {
+		defer stream.Close()
+		if !server.streams.acquire() {
+			server.errLog.logError("error handling JSON-RPC:", ErrTooManyStreams)
+			resp := jsonRPCErrorResponse(JSONRPCServerError, ErrTooManyStreams.Error())
+			json.NewEncoder(stream).Encode(resp)
+			return
+		}
+		defer server.streams.release()
+
+		id := server.hooks.opened(stream)
+		err := server.handleJSONRPC(stream, &policy)
+		if err != nil {
+			server.errLog.logError("error handling JSON-RPC:", err)
+		}
+		server.hooks.closed(stream, id, err)
+	})
+}
+
+func (server *Server) handleJSONRPC(stream inet.Stream, policy *Policy) error {
+	dec := json.NewDecoder(stream)
+	w := bufio.NewWriter(stream)
+	enc := json.NewEncoder(w)
+
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			resp := jsonRPCErrorResponse(JSONRPCParseError, err.Error())
+			enc.Encode(resp)
+			w.Flush()
+			return err
+		}
+
+		var out interface{}
+		raw = bytes.TrimSpace(raw)
+		if len(raw) > 0 && raw[0] == '[' {
+			var resps []*jsonRPCResponse
+			resps, err = server.jsonRPCBatch(stream, policy, raw)
+			if resps != nil {
+				out = resps
+			}
+		} else {
+			var resp *jsonRPCResponse
+			resp, err = server.jsonRPCCall(stream, policy, raw)
+			if resp != nil {
+				out = resp
+			}
+		}
+		if err != nil {
+			out = jsonRPCErrorResponse(JSONRPCInvalidRequest, err.Error())
+		}
+		if out == nil { // notifications only
+			continue
+		}
+		if err := enc.Encode(out); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// jsonRPCBatch processes a batch of requests and returns the responses
+// for those which are not notifications.
+func (server *Server) jsonRPCBatch(stream inet.Stream, policy *Policy, raw json.RawMessage) ([]*jsonRPCResponse, error) {
+	var batch []json.RawMessage
+	if err := json.Unmarshal(raw, &batch); err != nil {
+		return nil, err
+	}
+	if len(batch) == 0 {
+		return nil, errors.New("empty batch")
+	}
+
+	var resps []*jsonRPCResponse
+	for _, r := range batch {
+		resp, err := server.jsonRPCCall(stream, policy, r)
+		if err != nil {
+			resp = jsonRPCErrorResponse(JSONRPCInvalidRequest, err.Error())
+		}
+		if resp != nil {
+			resps = append(resps, resp)
+		}
+	}
+	if len(resps) == 0 {
+		return nil, nil
+	}
+	return resps, nil
+}
+
+// jsonRPCCall processes a single request. It returns a nil response for
+// notifications, and an error when the request is not valid.
+func (server *Server) jsonRPCCall(stream inet.Stream, policy *Policy, raw json.RawMessage) (*jsonRPCResponse, error) {
+	var req jsonRPCRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, err
+	}
+	if req.Version != jsonRPCVersion {
+		return nil, errors.New("jsonrpc version must be " + jsonRPCVersion)
+	}
+
+	resp := server.jsonRPCDispatch(stream, policy, &req)
+	if req.ID == nil {
+		return nil, nil
+	}
+	resp.ID = req.ID
+	return resp, nil
+}
+
+func (server *Server) jsonRPCDispatch(stream inet.Stream, policy *Policy, req *jsonRPCRequest) *jsonRPCResponse {
+	dot := strings.LastIndex(req.Method, ".")
+	if dot < 0 {
+		return jsonRPCErrorResponse(JSONRPCMethodNotFound,
+			"method must be of the form Service.Method")
+	}
+	header := RequestHeader{
+		ServiceID: ServiceID{req.Method[:dot], req.Method[dot+1:]},
+	}
+	// JSON-RPC requests cannot be signed.
+	if server.requireSignatures {
+		return jsonRPCErrorResponse(JSONRPCServerError, ErrBadSignature.Error())
+	}
+
+	remote := stream.Conn().RemotePeer()
+	svcID, err := server.admit(remote, header, policy)
+	if err != nil {
+		return jsonRPCErrorResponse(JSONRPCServerError, err.Error())
+	}
+
+	service, mtype, err := server.getService(svcID)
+	if err != nil {
+		return jsonRPCErrorResponse(JSONRPCMethodNotFound, err.Error())
+	}
+	if mtype.streaming {
+		return jsonRPCErrorResponse(JSONRPCMethodNotFound,
+			"streaming methods are not supported over JSON-RPC")
+	}
+	if mtype.pipe {
+		return jsonRPCErrorResponse(JSONRPCMethodNotFound,
+			"pipe methods are not supported over JSON-RPC")
+	}
+
+	argv, err := decodeArgs(mtype, func(v interface{}) error {
+		return decodeJSONRPCParams(req.Params, v)
+	})
+	if err != nil {
+		return jsonRPCErrorResponse(JSONRPCInvalidParams, err.Error())
+	}
+	replyv := reflect.New(mtype.ReplyType.Elem())
+
+	ctx, cancel := callContext(remote, header)
+	defer cancel()
+
+	info := CallInfo{
+		Peer:    remote,
+		Service: svcID.Name,
+		Method:  svcID.Method,
+		Start:   time.Now(),
+	}
+	err = server.dispatch(ctx, info, policy, service, mtype, argv, replyv)
+	if err != nil {
+		return jsonRPCErrorResponse(JSONRPCServerError, err.Error())
+	}
+
+	result, err := json.Marshal(replyv.Interface())
+	if err != nil {
+		return jsonRPCErrorResponse(JSONRPCServerError, err.Error())
+	}
+	return &jsonRPCResponse{
+		Version: jsonRPCVersion,
+		Result:  result,
+	}
+}
+
+// decodeJSONRPCParams decodes params, given by-name or as a single
+// positional parameter, into v.
+func decodeJSONRPCParams(params json.RawMessage, v interface{}) error {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 {
+		return nil
+	}
+	if params[0] == '[' {
+		var positional []json.RawMessage
+		if err := json.Unmarshal(params, &positional); err != nil {
+			return err
+		}
+		switch len(positional) {
+		case 0:
+			return nil
+		case 1:
+			return json.Unmarshal(positional[0], v)
+		default:
+			return errors.New("methods take a single parameter")
+		}
+	}
+	return json.Unmarshal(params, v)
+}
+
+func jsonRPCErrorResponse(code int, msg string) *jsonRPCResponse {
+	return &jsonRPCResponse{
+		Version: jsonRPCVersion,
+		Error: &JSONRPCError{
+			Code:    code,
+			Message: msg,
+		},
+	}
+}
@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// lazyService is a service registered with RegisterLazy which has not
+// been built yet.
+type lazyService struct {
+	factory func() (interface{}, error)
+	mu      sync.Mutex // held while building
+}
+
+// RegisterLazy publishes a service with the given name whose receiver is
+// built by factory when first called, which saves building services that
+// are expensive to set up and may never be called. The receiver must
+// satisfy the same conditions as those given to Register, which are only
+// checked once built. Concurrent first calls wait for the receiver to be
+// built once. If building it fails, the calls fail with the error and it
+// is built again on the next call. Until built, the service is listed by
+// Services without methods.
+func (server *Server) RegisterLazy(name string, factory func() (interface{}, error)) error {
+	if name == "" {
+		return errors.New("rpc.RegisterLazy: no service name")
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if _, present := server.serviceMap[name]; present {
+		return errors.New("rpc: service already defined: " + name)
+	}
+	if _, present := server.lazy[name]; present {
+		return errors.New("rpc: service already defined: " + name)
+	}
+	if server.lazy == nil {
+		server.lazy = make(map[string]*lazyService)
+	}
+	server.lazy[name] = &lazyService{factory: factory}
+	return nil
+}
+
+// buildLazy builds the lazy service with the given name and returns it.
+// It returns nil if there is no such service.
+func (server *Server) buildLazy(name string) (*service, error) {
+	server.mu.RLock()
+	l := server.lazy[name]
+	server.mu.RUnlock()
+	if l == nil {
+		return nil, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// It may have been built while waiting.
+	server.mu.RLock()
+	s := server.serviceMap[name]
+	server.mu.RUnlock()
+	if s != nil {
+		return s, nil
+	}
+
+	rcvr, err := l.factory()
+	if err != nil {
+		return nil, fmt.Errorf("rpc: cannot build service %s: %w", name, err)
+	}
+	s, err = newService(rcvr, name, true, false)
+	if err != nil {
+		return nil, err
+	}
+	server.mu.Lock()
+	if server.serviceMap == nil {
+		server.serviceMap = make(map[string]*service)
+	}
+	server.serviceMap[name] = s
+	delete(server.lazy, name)
+	server.mu.Unlock()
+	return s, nil
+}
@@ -0,0 +1,218 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// callContext derives the context for a call from the given one, so that
+// the call is aborted when the client is closed or when the returned
+// cancel function is called. The returned release function must be
+// called once the call is done.
+func (c *Client) callContext(ctx context.Context) (context.Context, context.CancelCauseFunc, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(c.closing, func() {
+		cancel(ErrClientClosed)
+	})
+	return ctx, cancel, func() {
+		stop()
+		cancel(context.Canceled)
+	}
+}
+
+// Close closes the client. Calls made afterwards fail with
+// ErrClientClosed, and the calls in progress are aborted, as if their
+// context was cancelled, and return ErrClientClosed as well. The idle
+// streams kept for reuse are closed, and sessions are ended.
+func (c *Client) Close() error {
+	c.close()
+	if c.pool != nil {
+		c.pool.close()
+	}
+	return nil
+}
+
+// Drain stops the client gracefully. New calls, including those made on
+// sessions, and new streams fail with ErrClientDraining, while Drain
+// waits for those in progress to finish normally, or for the context to
+// be done, in which case it returns the context error. Unlike Close, it
+// does not abort anything. The client cannot be used for new calls
+// afterwards, so it should be closed once drained.
+func (c *Client) Drain(ctx context.Context) error {
+	return c.outstanding.drain(ctx)
+}
+
+// outstanding counts the calls in progress in a client, so that Drain can
+// wait for them. The zero value is ready to use.
+type outstanding struct {
+	mu       sync.Mutex
+	n        int
+	draining bool
+	idle     chan struct{} // closed when there are no calls left
+}
+
+// begin accounts for a new call. It returns false when draining, in which
+// case the call must not be made.
+func (o *outstanding) begin() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.draining {
+		return false
+	}
+	o.n++
+	return true
+}
+
+func (o *outstanding) end() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.n--
+	if o.n == 0 && o.idle != nil {
+		close(o.idle)
+		o.idle = nil
+	}
+}
+
+func (o *outstanding) drain(ctx context.Context) error {
+	o.mu.Lock()
+	o.draining = true
+	if o.n == 0 {
+		o.mu.Unlock()
+		return nil
+	}
+	if o.idle == nil {
+		o.idle = make(chan struct{})
+	}
+	idle := o.idle
+	o.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops the server gracefully. Stream handlers are removed so
+// that no new streams are accepted, and new requests on the streams that
+// are open, as well as local calls, are rejected with ErrShuttingDown.
+// Shutdown then waits for the calls in progress to finish, or for the
+// context to be done, in which case it returns the context error. Once
+// they are done, the pinned workers, if any, are stopped.
+func (server *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&server.shuttingDown, 1)
+
+	if server.host != nil {
+		server.mu.RLock()
+		for _, p := range server.protocols {
+			server.host.RemoveStreamHandler(p)
+		}
+		server.mu.RUnlock()
+	}
+	if err := server.inflight.wait(ctx); err != nil {
+		return err
+	}
+	if server.workers != nil {
+		server.workers.stop()
+	}
+	return nil
+}
+
+func (server *Server) isShuttingDown() bool {
+	return atomic.LoadInt32(&server.shuttingDown) == 1
+}
+
+// Pause makes the server reject new calls, including local ones, with
+// ErrPaused, until Resume is called, for example during brief maintenance
+// or to relieve backpressure. Unlike Shutdown, streams are still accepted
+// and the calls in progress carry on. Clients waiting with WaitReady keep
+// waiting while the server is paused. Pausing a paused server does
+// nothing.
+func (server *Server) Pause() {
+	atomic.StoreInt32(&server.paused, 1)
+}
+
+// Resume makes a paused server accept new calls again.
+func (server *Server) Resume() {
+	atomic.StoreInt32(&server.paused, 0)
+}
+
+// Paused returns whether the server is paused (see Pause).
+func (server *Server) Paused() bool {
+	return atomic.LoadInt32(&server.paused) == 1
+}
+
+// Shutdown shuts down a server and a client sharing the same host in
+// the right order: the client is closed first, so that it stops making
+// calls, aborting those in progress, and then the server is shut down,
+// waiting for its calls in progress to finish, or for the context to be
+// done. Either of them may be nil.
+func Shutdown(ctx context.Context, server *Server, client *Client) error {
+	if client != nil {
+		client.Close()
+	}
+	if server != nil {
+		return server.Shutdown(ctx)
+	}
+	return nil
+}
+
+// readyPollInterval is how often readiness is checked, both by servers
+// waiting for their host to listen and by Client.WaitReady.
+const readyPollInterval = 50 * time.Millisecond
+
+// Ready returns a channel which is closed once the server is serving: its
+// stream handler is registered and the host is listening on some address.
+// Servers without a host, which only serve local calls, are ready right
+// away. The channel is never closed if the server is shut down before
+// being ready. It stays closed while the server is paused, which can be
+// checked with Paused.
+func (server *Server) Ready() <-chan struct{} {
+	return server.ready
+}
+
+// watchReady closes the ready channel once the host is listening, unless
+// the server is shut down first.
+func (server *Server) watchReady() {
+	t := time.NewTicker(readyPollInterval)
+	defer t.Stop()
+	for {
+		if server.isShuttingDown() {
+			return
+		}
+		if len(server.host.Network().ListenAddresses()) > 0 {
+			close(server.ready)
+			return
+		}
+		<-t.C
+	}
+}
+
+// WaitReady waits until the server in the given peer answers calls, which
+// is checked with the call used by ClockSync, retrying every so often
+// until it succeeds or the context is done, in which case it returns the
+// context error. It is meant to avoid sleeping while servers start up.
+// It requires the server to provide the clock service (see
+// WithClockService).
+func (c *Client) WaitReady(ctx context.Context, pid peer.ID) error {
+	t := time.NewTicker(readyPollInterval)
+	defer t.Stop()
+	for {
+		var times [2]int64
+		err := c.CallContext(ctx, pid, clockServiceName, "Now", struct{}{}, &times)
+		if err == nil {
+			return nil
+		}
+		logger.Debugf("%s not ready: %s", pid, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
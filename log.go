@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+
+	logging "github.com/ipfs/go-log"
+)
+
+// LoggerFromContext returns a logger for the call whose handler received
+// the given context. It logs through the logger of this package, and
+// every message is prefixed with the request ID, if any, the service and
+// method called and the caller. For contexts which do not belong to a call
+// handler, it returns the logger of this package as is.
+func LoggerFromContext(ctx context.Context) logging.StandardLogger {
+	if l, ok := ctx.Value(loggerKey).(logging.StandardLogger); ok {
+		return l
+	}
+	return logger
+}
+
+// withCallLogger returns a context carrying the logger for the given call.
+func withCallLogger(ctx context.Context, info CallInfo) context.Context {
+	prefix := fmt.Sprintf("%s%s.%s from %s: ",
+		requestLogPrefix(info.RequestID), info.Service, info.Method, info.Peer.Pretty())
+	return context.WithValue(ctx, loggerKey, &callLogger{prefix: prefix})
+}
+
+// callLogger prefixes the messages logged with the package logger.
+type callLogger struct {
+	prefix string
+}
+
+func (l *callLogger) msg(args []interface{}) string {
+	return l.prefix + fmt.Sprint(args...)
+}
+
+func (l *callLogger) msgf(format string, args []interface{}) string {
+	return l.prefix + fmt.Sprintf(format, args...)
+}
+
+func (l *callLogger) Debug(args ...interface{})   { logger.Debug(l.msg(args)) }
+func (l *callLogger) Error(args ...interface{})   { logger.Error(l.msg(args)) }
+func (l *callLogger) Fatal(args ...interface{})   { logger.Fatal(l.msg(args)) }
+func (l *callLogger) Info(args ...interface{})    { logger.Info(l.msg(args)) }
+func (l *callLogger) Panic(args ...interface{})   { logger.Panic(l.msg(args)) }
+func (l *callLogger) Warning(args ...interface{}) { logger.Warning(l.msg(args)) }
+
+func (l *callLogger) Debugf(format string, args ...interface{}) {
+	logger.Debug(l.msgf(format, args))
+}
+
+func (l *callLogger) Errorf(format string, args ...interface{}) {
+	logger.Error(l.msgf(format, args))
+}
+
+func (l *callLogger) Fatalf(format string, args ...interface{}) {
+	logger.Fatal(l.msgf(format, args))
+}
+
+func (l *callLogger) Infof(format string, args ...interface{}) {
+	logger.Info(l.msgf(format, args))
+}
+
+func (l *callLogger) Panicf(format string, args ...interface{}) {
+	logger.Panic(l.msgf(format, args))
+}
+
+func (l *callLogger) Warningf(format string, args ...interface{}) {
+	logger.Warning(l.msgf(format, args))
+}
@@ -0,0 +1,53 @@
+package rpc
+
+import "sync"
+
+// memoryBudget accounts for the memory used by the payloads of the calls
+// being handled (see WithMemoryBudget).
+type memoryBudget struct {
+	max int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+// admit charges n bytes for a new call, unless that would exceed the
+// budget. A call is always admitted when nothing else is charged, so that
+// payloads larger than the budget can still be handled one at a time.
+func (b *memoryBudget) admit(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used > 0 && b.used+n > b.max {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// charge charges n bytes for a call already admitted, even if that
+// exceeds the budget.
+func (b *memoryBudget) charge(n int64) {
+	b.mu.Lock()
+	b.used += n
+	b.mu.Unlock()
+}
+
+// release returns n bytes to the budget.
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+}
+
+// encodedBody is a response body encoded already, which is written as is.
+type encodedBody []byte
+
+// writeBody encodes the given response body, or writes it as is if it
+// was encoded already.
+func (sw *streamWrap) writeBody(body interface{}) error {
+	if encoded, ok := body.(encodedBody); ok {
+		_, err := sw.w.Write(encoded)
+		return err
+	}
+	return sw.enc.Encode(body)
+}
@@ -0,0 +1,932 @@
+package rpc
+
+import (
+	"context"
+	"hash"
+	"io"
+	"strings"
+	"time"
+
+	protocol "github.com/libp2p/go-libp2p-protocol"
+	codec "github.com/ugorji/go/codec"
+)
+
+// ServerOption allows to customize a Server. Options are passed
+// to NewServer().
+type ServerOption func(*Server)
+
+// ServiceContextFunc prepares the context for a method call. It returns
+// the context to be passed to the method and an optional cleanup function
+// to be called once the method returns. When it returns an error, the
+// method is not called and the error is sent back to the client.
+type ServiceContextFunc func(ctx context.Context) (context.Context, func(), error)
+
+// ValidatorFunc checks the arguments of a call before the method runs. It
+// receives them as the method does: a pointer or a value of its argument
+// type. When it returns an error, the method is not called and the client
+// receives a validation error.
+type ValidatorFunc func(args interface{}) error
+
+// ClientOption allows to customize a Client. Options are passed
+// to NewClient() and NewClientWithServer().
+type ClientOption func(*Client)
+
+// CallOption allows to customize a single call. Options are passed
+// to CallContext() and GoContext().
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	critical     bool
+	singleflight bool
+	trace        *CallTrace
+	sequence     *sequenceTag // see SequencedSession
+	fieldMask    FieldMask
+	local        bool        // see Client.CallLocal
+	protocol     protocol.ID // see WithProtocol
+}
+
+// DecodeErrorHandler translates the error decoding the arguments of the
+// request with the given header into the error sent back to the client.
+type DecodeErrorHandler func(header RequestHeader, err error) error
+
+// RequestParser extracts the name of the service and the method to be
+// called from the header of an incoming request.
+type RequestParser func(header RequestHeader) (service, method string, err error)
+
+// defaultRequestParser dispatches requests to the service and
+// method named in the header.
+func defaultRequestParser(header RequestHeader) (string, string, error) {
+	return header.Name, header.Method, nil
+}
+
+// WithRequestParser sets a function to derive the service and method
+// to dispatch an incoming request to from its header. It allows to
+// remap external names onto registered methods. By default, the service
+// and method named in the header are used. Returning an error aborts
+// the request and the error is sent back to the client.
+func WithRequestParser(parser RequestParser) ServerOption {
+	return func(s *Server) {
+		s.parseRequest = parser
+	}
+}
+
+// WithCompression enables gzip compression of replies whose encoded
+// size is larger than threshold bytes. Smaller replies are sent
+// uncompressed to avoid wasting CPU. Every response signals whether
+// its body was compressed and clients decompress it transparently.
+func WithCompression(threshold int) ServerOption {
+	return func(s *Server) {
+		s.compress = true
+		s.compressThreshold = threshold
+	}
+}
+
+// WithLoadShedder sets a function which is consulted before dispatching
+// every incoming request. When it returns true, the request is rejected
+// right away and the client receives ErrOverloaded, so that it can back
+// off or try with a different peer.
+func WithLoadShedder(overloaded func() bool) ServerOption {
+	return func(s *Server) {
+		s.shedLoad = overloaded
+	}
+}
+
+// WithPolicy sets the Policy applied to requests received on the
+// protocol given to NewServer. See also Server.ServeProtocol.
+func WithPolicy(policy Policy) ServerOption {
+	return func(s *Server) {
+		s.policy = policy
+	}
+}
+
+// WithOrderedCalls makes the client perform the calls to each peer one
+// at a time, in the order in which they were issued with Go() or Call().
+// A call to a peer is not sent until the previous one to the same peer has
+// completed, which guarantees that the server processes them in order.
+// Calls to different peers still run concurrently.
+//
+// This caps the throughput to every peer to one call per round-trip plus
+// handler time, so it should only be used when ordering is needed.
+func WithOrderedCalls() ClientOption {
+	return func(c *Client) {
+		c.ordered = true
+	}
+}
+
+// WithErrorLogSampling makes the server log identical errors at most once
+// per interval, along with the number of occurrences suppressed since the
+// last time. This keeps logs usable when many calls fail in the same way.
+// By default, every error is logged.
+func WithErrorLogSampling(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.errLog.interval = interval
+	}
+}
+
+// WithServiceContext sets a function which is run before every call to a
+// method of the service with the given name, to set up resources shared
+// by all of them (a database transaction bound to the request, for
+// example). Its cleanup function runs after the method returns. Only
+// methods taking a context.Context can make use of the context it returns.
+func WithServiceContext(name string, setup ServiceContextFunc) ServerOption {
+	return func(s *Server) {
+		if s.serviceContexts == nil {
+			s.serviceContexts = make(map[string]ServiceContextFunc)
+		}
+		s.serviceContexts[name] = setup
+	}
+}
+
+// WithStreamPool makes the client keep the streams used for remote calls
+// open after they complete, so that subsequent calls to the same peer can
+// reuse them instead of opening a new stream every time. Up to maxIdle
+// streams are kept per peer, and they are closed once they have been idle
+// for idleTimeout (zero means never). Streams are used by one call at a
+// time, and a stream, along with its encoder and decoder, is discarded as
+// soon as any error happens on it.
+//
+// When a pooled stream turns out to have been closed or reset by the
+// server, before the request was processed, the call is transparently
+// retried on a new stream.
+func WithStreamPool(maxIdle int, idleTimeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.pool = newStreamPool(maxIdle, idleTimeout)
+		c.pool.released = c.streamClosed
+	}
+}
+
+// WithPinnedWorkers makes the server execute all method calls, remote and
+// local, on a fixed set of n goroutines instead of on the goroutine
+// handling every stream. Each of them is locked to its own OS thread
+// for its whole life, which improves cache locality for CPU-heavy
+// methods. Calls wait for a free worker, or until their context is done,
+// so that at most n methods run at the same time. The workers run until
+// the server is shut down (see Server.Shutdown).
+func WithPinnedWorkers(n int) ServerOption {
+	return func(s *Server) {
+		s.workers = newWorkerPool(n)
+	}
+}
+
+// WithMaxOpenStreams limits the number of streams that the server keeps
+// open at the same time, across all peers and protocols. The first
+// request on any stream beyond the limit is rejected with
+// ErrTooManyStreams and the stream is closed. See Server.Stats for the
+// number of streams currently open.
+func WithMaxOpenStreams(n int) ServerOption {
+	return func(s *Server) {
+		s.streams.max = int64(n)
+	}
+}
+
+// WithClientMaxOpenStreams limits the number of streams that the client
+// keeps open at the same time, across all peers, including the idle ones
+// kept by WithStreamPool. Calls which would need to open a stream beyond
+// the limit fail with ErrTooManyStreams. See Client.Stats for the number
+// of streams currently open.
+func WithClientMaxOpenStreams(n int) ClientOption {
+	return func(c *Client) {
+		c.streams.max = int64(n)
+	}
+}
+
+// WithBufferPool makes the client reuse the buffers, encoders and decoders
+// of the streams used by calls, which reduces the garbage generated by
+// every call. They are recycled once a call has completed successfully
+// and its stream has been closed. Together with reusing the reply objects
+// passed to Call, this minimizes allocations for clients doing many calls.
+// It has no effect when WithClientMsgpackHandle is used.
+func WithBufferPool() ClientOption {
+	return func(c *Client) {
+		c.bufferPool = true
+	}
+}
+
+// WithCritical marks a call as critical: once the server has started
+// executing the method, it lets it run to completion even if the deadline
+// of the call expires. This prevents operations which must not be left
+// half-applied from being aborted by aggressive timeouts.
+//
+// The semantics are subtle. The deadline is still sent and calls arriving
+// after it are rejected without running the method, as usual. The context
+// given to the method carries no deadline and is not cancelled while the
+// method runs, though DeadlineFromContext still reports the deadline. The
+// client, on the other hand, still gives up once its context is done and
+// returns the context error, so a critical call which timed out in the
+// client may have been applied by the server anyway.
+func WithCritical() CallOption {
+	return func(o *callOptions) {
+		o.critical = true
+	}
+}
+
+// WithClientInterceptor adds an interceptor wrapping every call made by the
+// client with Call, Go and their variants. It can be given several times,
+// in which case the first interceptor is the outermost.
+func WithClientInterceptor(interceptor ClientInterceptor) ClientOption {
+	return func(c *Client) {
+		c.interceptors = append(c.interceptors, interceptor)
+	}
+}
+
+// WithPayloadEncryption makes the server encrypt the payloads it exchanges
+// with clients, on top of any transport security, using the AEADs returned
+// by the given KeyProvider for every peer. Arguments, replies and streamed
+// items are encrypted after being encoded, while the headers, which
+// include the names of the service and method called, are not. Every
+// payload is sealed with a new random nonce and bound to the method
+// called, so that it cannot be replayed as a different payload. Replies
+// are also bound to the error in their header, and items to their
+// position in the stream, whose end is sealed too, so that errors cannot
+// be forged and items cannot be dropped, reordered or replayed. Clients
+// do not trust errors which come unsealed, other than ErrDecryption and
+// ErrChecksum.
+//
+// The server rejects unencrypted requests, so clients must use
+// WithClientPayloadEncryption with matching keys. Payloads which fail to
+// decrypt, because they were tampered with or because the keys do not
+// match, cause ErrDecryption. Encrypted replies are never compressed, and
+// JSON-RPC requests are not affected.
+func WithPayloadEncryption(keys KeyProvider) ServerOption {
+	return func(s *Server) {
+		s.keys = keys
+	}
+}
+
+// WithClientPayloadEncryption makes the client encrypt the payloads of
+// remote calls with the AEADs returned by the given KeyProvider for every
+// peer. See WithPayloadEncryption.
+func WithClientPayloadEncryption(keys KeyProvider) ClientOption {
+	return func(c *Client) {
+		c.keys = keys
+	}
+}
+
+// WithOnStreamOpen sets a function to be called whenever the server
+// accepts a new stream, including JSON-RPC ones. See StreamOpenFunc.
+func WithOnStreamOpen(f StreamOpenFunc) ServerOption {
+	return func(s *Server) {
+		s.hooks.onOpen = f
+	}
+}
+
+// WithOnStreamClose sets a function to be called whenever a stream
+// accepted by the server is closed. See StreamCloseFunc.
+func WithOnStreamClose(f StreamCloseFunc) ServerOption {
+	return func(s *Server) {
+		s.hooks.onClose = f
+	}
+}
+
+// WithClientOnStreamOpen sets a function to be called whenever the client
+// opens a new stream, for calls, streaming calls or sessions. See
+// StreamOpenFunc.
+func WithClientOnStreamOpen(f StreamOpenFunc) ClientOption {
+	return func(c *Client) {
+		c.hooks.onOpen = f
+	}
+}
+
+// WithClientOnStreamClose sets a function to be called whenever a stream
+// opened by the client is closed. Streams kept by WithStreamPool are
+// closed when they are evicted or expire. See StreamCloseFunc.
+func WithClientOnStreamClose(f StreamCloseFunc) ClientOption {
+	return func(c *Client) {
+		c.hooks.onClose = f
+	}
+}
+
+// WithMsgpackHandle sets the msgpack handle used to encode and decode the
+// messages exchanged with clients, instead of the default one. Extensions
+// for custom types can be registered on the handle, which keeps them
+// local to the server rather than affecting the whole process. The handle
+// must not be modified once the server is running.
+func WithMsgpackHandle(h *codec.MsgpackHandle) ServerOption {
+	return func(s *Server) {
+		s.msgpackHandle = h
+	}
+}
+
+// WithClientMsgpackHandle sets the msgpack handle used to encode and
+// decode the messages exchanged with servers. It must be configured like
+// the one used by the servers. See WithMsgpackHandle.
+func WithClientMsgpackHandle(h *codec.MsgpackHandle) ClientOption {
+	return func(c *Client) {
+		c.msgpackHandle = h
+	}
+}
+
+// WithStreamKeepalive makes the server send a keepalive frame on the
+// streams of streaming calls whenever the method has sent nothing for the
+// given interval. This keeps long-lived, mostly silent streams from being
+// closed for being idle, and lets clients detect dead streams with
+// WithStreamIdleTimeout.
+func WithStreamKeepalive(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.streamKeepalive = interval
+	}
+}
+
+// WithStreamIdleTimeout makes ClientStream.Recv fail with ErrStreamIdle
+// when nothing, not even a keepalive, has been received for the given
+// timeout. It should be a few times larger than the keepalive interval
+// used by the servers (see WithStreamKeepalive).
+func WithStreamIdleTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.streamIdleTimeout = timeout
+	}
+}
+
+// WithReplyDecodeTimeout bounds the time spent reading and decoding a
+// response, header and reply, counted from the moment the server starts
+// sending it, regardless of the deadline of the call. Calls exceeding it
+// fail with ErrReplyDecodeTimeout, which protects clients against peers
+// sending replies very slowly. It also applies to calls made on
+// Sessions.
+func WithReplyDecodeTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.replyDecodeTimeout = timeout
+	}
+}
+
+// WithMaxConcurrentCalls limits the number of methods that the server runs
+// at the same time, across all peers and including local calls. Calls
+// beyond the limit are rejected with ErrOverloaded. When used along with
+// WithPinnedWorkers, calls waiting for a worker count towards the limit.
+func WithMaxConcurrentCalls(n int) ServerOption {
+	return func(s *Server) {
+		s.running.max = int64(n)
+	}
+}
+
+// WithRequestIDGenerator makes the client give a request ID, obtained
+// from the given function, to every call which does not carry one
+// already. See WithRequestID.
+func WithRequestIDGenerator(generate func() string) ClientOption {
+	return func(c *Client) {
+		c.requestIDs = generate
+	}
+}
+
+// WithValidator sets a function to check the arguments of every call to
+// the given method, once they have been decoded and before the method is
+// called. This applies to local calls too. See ValidatorFunc.
+func WithValidator(service, method string, validate ValidatorFunc) ServerOption {
+	return func(s *Server) {
+		if s.validators == nil {
+			s.validators = make(map[ServiceID]ValidatorFunc)
+		}
+		s.validators[ServiceID{service, method}] = validate
+	}
+}
+
+// WithStreamWindow enables flow control in streaming calls: servers send
+// at most the given number of items ahead of those consumed with
+// ClientStream.Recv, and wait for the client to grant more credits, which
+// it does once half of the window has been consumed. This bounds the
+// memory used by both ends regardless of the buffering done by the
+// transport.
+func WithStreamWindow(n int) ClientOption {
+	return func(c *Client) {
+		c.streamWindow = n
+	}
+}
+
+// WithStrictDecoding sets how the server decodes arguments holding fields
+// which the receiving types lack, as happens when struct types drift
+// between versions. When strict, decoding them fails and so does the
+// call. Otherwise, which is the default, unknown fields are ignored,
+// which keeps older servers compatible with newer clients. In both modes,
+// fields missing from the message are left with their zero value. Headers
+// always ignore unknown fields, so that peers can add new ones. Arguments
+// are decoded with a copy of the handle given with WithMsgpackHandle, if
+// any, with ErrorIfNoField set accordingly. JSON-RPC requests are not
+// affected.
+func WithStrictDecoding(strict bool) ServerOption {
+	return func(s *Server) {
+		s.strictDecoding = &strict
+	}
+}
+
+// WithClientStrictDecoding sets how the client decodes replies and
+// streamed items holding unknown fields. See WithStrictDecoding.
+func WithClientStrictDecoding(strict bool) ClientOption {
+	return func(c *Client) {
+		c.strictDecoding = &strict
+	}
+}
+
+// WithRecorder records the traffic of every stream handled by the server
+// to the given writer, which is useful to debug issues which are hard to
+// reproduce. The recording is versioned and self-describing: it holds
+// JSON values, one per line, with every chunk of bytes read or written
+// along with the stream, peer, protocol, direction and time. Recordings
+// can be read with ReadRecording and replayed to a server with
+// RecordedStream.Replay and Server.ServeConn. Writes to w are serialized.
+// Payloads are recorded as they go through the streams, so they are only
+// protected when encrypted (see WithPayloadEncryption).
+func WithRecorder(w io.Writer) ServerOption {
+	return func(s *Server) {
+		s.recorder = newRecorder(w)
+	}
+}
+
+// WithClientRecorder records the traffic of every stream opened by the
+// client. Replaying a recorded stream to Client.CallConn returns the
+// recorded responses. See WithRecorder.
+func WithClientRecorder(w io.Writer) ClientOption {
+	return func(c *Client) {
+		c.recorder = newRecorder(w)
+	}
+}
+
+// WithRequireAddresses makes calls to peers which the client is not
+// connected to fail right away with ErrNoAddresses when the peerstore
+// holds no addresses for them, instead of letting the dial fail after
+// a while. It should not be used with hosts which find the addresses of
+// peers when dialing them, for example through a routing system.
+func WithRequireAddresses() ClientOption {
+	return func(c *Client) {
+		c.requireAddrs = true
+	}
+}
+
+// WithResolver sets the function used by Client.CallName to resolve
+// logical names to peers, for example by looking them up in a DHT or in a
+// local registry.
+func WithResolver(f ResolverFunc) ClientOption {
+	return func(c *Client) {
+		c.resolver = f
+	}
+}
+
+// WithMaxHeaderSize limits the size of the headers of the requests
+// received by the server, which hold the service and method names and the
+// metadata, among others, and are read before anything else. Requests with
+// larger headers are rejected with ErrHeaderTooLarge without reading
+// any further and the stream is closed. The default is
+// DefaultMaxHeaderSize. Zero or less disables the limit. JSON-RPC requests
+// are not affected.
+func WithMaxHeaderSize(n int64) ServerOption {
+	return func(s *Server) {
+		s.maxHeaderSize = n
+	}
+}
+
+// WithMaxStreamAge makes the stream pool (see WithStreamPool) close the
+// idle streams which were opened longer than d ago, so that long-lived
+// clients open new streams, and possibly new connections, from time to
+// time instead of relying on the same ones forever. Streams in use are
+// closed when returned to the pool.
+func WithMaxStreamAge(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.maxStreamAge = d
+	}
+}
+
+// WithRequestSigning makes the client sign every request it sends to
+// remote peers with the private key of its host, as found in the
+// peerstore. The signature covers the service and method called and the
+// encoded arguments, and travels in the request header along with the
+// public key of the signer. Servers always verify the signatures they
+// receive, rejecting requests not signed by the caller with
+// ErrBadSignature, and pass them on to the handlers (see
+// SignedRequestFromContext), so that they can be stored and verified
+// again later, independently of the connection. See
+// WithRequireSignatures.
+func WithRequestSigning() ClientOption {
+	return func(c *Client) {
+		c.signRequests = true
+	}
+}
+
+// WithRequireSignatures makes the server reject unsigned requests with
+// ErrBadSignature, which includes all JSON-RPC requests. See
+// WithRequestSigning.
+func WithRequireSignatures() ServerOption {
+	return func(s *Server) {
+		s.requireSignatures = true
+	}
+}
+
+// WithMaxStreamsPerConn limits the number of streams that the client keeps
+// open to every peer, including the idle ones in the stream pool, to stay
+// within the limits of the stream multiplexers. Calls needing a new stream
+// beyond the limit wait for one to be closed, or for their context to be
+// cancelled. The host chooses the connection used by new streams, and
+// usually keeps a single one to every peer, so all the streams to a peer
+// are counted together.
+func WithMaxStreamsPerConn(n int) ClientOption {
+	return func(c *Client) {
+		c.peerSlots.max = n
+	}
+}
+
+// WithStreamOpenRetry makes the client try to open new streams up to the
+// given number of attempts, waiting for backoff before the first retry
+// and twice as long before every subsequent one. This helps when opening
+// a stream races with setting up the connection to the peer. Unlike
+// retrying whole calls, it is always safe, since nothing has been sent
+// yet. It applies to calls, sessions and streams alike.
+func WithStreamOpenRetry(attempts int, backoff time.Duration) ClientOption {
+	return func(c *Client) {
+		c.streamOpenAttempts = attempts
+		c.streamOpenBackoff = backoff
+	}
+}
+
+// WithState attaches the given application state to the server. Handlers,
+// and the interceptors of the policies in place, obtain it with
+// StateFromContext, which allows to inject dependencies into handlers, or
+// to register the same handler type in several servers with different
+// state, without keeping it in the receivers.
+func WithState(state interface{}) ServerOption {
+	return func(s *Server) {
+		s.state = state
+	}
+}
+
+// WithCancelReasons makes the client tell servers why it aborts calls, so
+// that the context of the method is cancelled with a CancelError as cause
+// (see context.Cause), which tells apart calls which timed out in the
+// client from those cancelled explicitly. Only calls made with Call,
+// CallContext, Go and Start, and not sessions or streams, report it. The
+// stream of an aborted call is then closed rather than reset, and is not
+// reused.
+func WithCancelReasons() ClientOption {
+	return func(c *Client) {
+		c.cancelReasons = true
+	}
+}
+
+// WithSingleflight makes a call made with CallContext, or the helpers
+// based on it, share the result of an identical call in progress, to the
+// same peer, service and method and with the same encoded arguments,
+// rather than sending a new request. Calls sending different metadata
+// (see WithMetadata), request IDs or options are not identical, and calls
+// with a trace (see WithCallTrace) are never shared. The first call is
+// performed on behalf of all of those joining it meanwhile, and its
+// context bounds them all, though every caller can still give up with its
+// own context. The reply is copied by encoding and decoding it. Only use
+// it for idempotent calls, since the method runs once for all of them.
+func WithSingleflight() CallOption {
+	return func(o *callOptions) {
+		o.singleflight = true
+	}
+}
+
+// WithCodec makes the server accept requests whose arguments are encoded
+// with the given codec, which clients select by name with
+// WithClientCodec. Replies are encoded with the codec used by the
+// request, so that a single server can bridge clients using different
+// formats. Requests using the default encoding are always accepted.
+// Codecs are not supported by streaming and pipe methods.
+func WithCodec(name string, payloadCodec Codec) ServerOption {
+	return func(s *Server) {
+		if s.codecs == nil {
+			s.codecs = make(map[string]Codec)
+		}
+		s.codecs[name] = payloadCodec
+	}
+}
+
+// WithClientCodec makes the client encode the arguments and replies of
+// calls made with Call, Go and their variants with the given codec, which
+// servers enable by name with WithCodec, as well as those made on
+// sessions. Streams and pipes still use the default encoding.
+func WithClientCodec(name string, payloadCodec Codec) ClientOption {
+	return func(c *Client) {
+		c.codecName = name
+		c.codec = payloadCodec
+	}
+}
+
+// WithDecodeErrorHandler sets a function translating errors decoding the
+// arguments of requests, which are otherwise sent to the client as they
+// are, into errors which make sense to it, such as telling that it may be
+// running an incompatible version. It may log them too. The stream of the
+// request is still closed afterwards, since it cannot be trusted anymore.
+func WithDecodeErrorHandler(h DecodeErrorHandler) ServerOption {
+	return func(s *Server) {
+		s.decodeErrorHandler = h
+	}
+}
+
+// WithStreamFlushInterval makes streaming methods buffer the items sent
+// and flush them at most after the given interval, or once the buffer
+// fills up, rather than on every ServerStream.Send. This trades latency
+// for throughput when methods send many small items: fewer, larger writes
+// are made, but an item may take up to the interval to reach the client,
+// unless the method calls ServerStream.Flush. By default, every item is
+// flushed as soon as it is sent.
+func WithStreamFlushInterval(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.streamFlushInterval = interval
+	}
+}
+
+// WithSlowConsumerTimeout makes streaming methods give up on clients
+// which do not keep up: when ServerStream.Send has waited for the given
+// time for the client to take more items, the stream is aborted. Send
+// fails with ErrSlowConsumer, and the context of the method is cancelled
+// with it as the cause, and the client receives ErrSlowConsumer after the
+// items sent before. It only applies to clients using flow control (see
+// WithStreamWindow), since the server cannot tell how far behind the
+// others are. Methods can set a different timeout for a stream with
+// ServerStream.SetSlowConsumerTimeout. By default, Send waits for as long
+// as the client keeps the stream open.
+func WithSlowConsumerTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.slowConsumerTimeout = timeout
+	}
+}
+
+// WithMemoryBudget limits the memory used by the encoded arguments and
+// replies of the calls handled by the server at the same time to roughly
+// the given number of bytes. The arguments of a call are charged once
+// read, and the call is rejected with ErrOverloaded, without running the
+// method, if they do not fit in what is left. Replies are charged while
+// they are sent, which requires encoding them beforehand. A call is
+// always admitted when nothing else is charged, so payloads larger than
+// the budget are still handled, one at a time. Unlike
+// WithMaxConcurrentCalls, this protects against running out of memory
+// with large payloads regardless of the number of calls.
+func WithMemoryBudget(bytes int64) ServerOption {
+	return func(s *Server) {
+		if bytes > 0 {
+			s.memory = &memoryBudget{max: bytes}
+		}
+	}
+}
+
+// WithCallTrace makes the call fill in the given trace with the time spent
+// in every phase of the call, including the timings measured by the
+// server, which it reports along with the response. The trace must not be
+// read until the call completes. Local calls, sessions and streams are
+// not traced.
+func WithCallTrace(trace *CallTrace) CallOption {
+	return func(o *callOptions) {
+		o.trace = trace
+	}
+}
+
+// WithReflection makes the server describe the signatures of its methods
+// to clients, which use it with Client.DescribeMethod and
+// Client.VerifyMethod to check that both sides agree on the types of the
+// arguments and replies before calling.
+func WithReflection() ServerOption {
+	return func(s *Server) {
+		s.reflection = true
+	}
+}
+
+// WithClockService sets whether the server provides the service answering
+// the calls made by Client.ClockSync and Client.WaitReady, which it does
+// by default. Servers which do not want to disclose their time can opt
+// out, in which case those calls fail and WaitReady never returns before
+// its context is done.
+func WithClockService(enabled bool) ServerOption {
+	return func(s *Server) {
+		s.noClockService = !enabled
+	}
+}
+
+// WithCompressionFor enables compression only for the replies of the given
+// methods, in "Service.Method" form, while other replies are always sent
+// uncompressed. It can be combined with WithCompression, in which case
+// only the replies of those methods larger than its threshold are
+// compressed. Otherwise, they are compressed regardless of their size.
+func WithCompressionFor(methods ...string) ServerOption {
+	return func(s *Server) {
+		s.compress = true
+		if s.compressMethods == nil {
+			s.compressMethods = make(map[ServiceID]bool)
+		}
+		for _, m := range methods {
+			name, method, _ := strings.Cut(m, ".")
+			s.compressMethods[ServiceID{name, method}] = true
+		}
+	}
+}
+
+// WithStreamService attributes the streams handled by the server for the
+// given protocol to the given service, so that they can be prioritized
+// and limited separately from other traffic, such as control plane calls
+// served on their own protocol which should not be starved by data plane
+// ones. The service is set with SetService, as soon as the stream is
+// received, on streams implementing StreamServiceSetter, and ignored
+// otherwise. Streams for which it fails are reset. The option can be
+// given once per protocol.
+func WithStreamService(p protocol.ID, name string) ServerOption {
+	return func(s *Server) {
+		if s.streamServices == nil {
+			s.streamServices = make(map[protocol.ID]string)
+		}
+		s.streamServices[p] = name
+	}
+}
+
+// WithClientStreamService attributes the streams opened by the client for
+// the given protocol to the given service. When setting it fails, the
+// stream is reset and the call fails with the error. See WithStreamService.
+func WithClientStreamService(p protocol.ID, name string) ClientOption {
+	return func(c *Client) {
+		if c.streamServices == nil {
+			c.streamServices = make(map[protocol.ID]string)
+		}
+		c.streamServices[p] = name
+	}
+}
+
+// WithCallStats makes the server call report with the statistics of every
+// call it handles, to feed metrics. Peers are classified with group, when
+// not nil, so that metrics can be broken down by group rather than by
+// peer, which would make their cardinality explode (see CallStats).
+func WithCallStats(report CallStatsFunc, group PeerGroupFunc) ServerOption {
+	return func(s *Server) {
+		s.callStats = callStatsHook{report: report, group: group}
+	}
+}
+
+// WithClientCallStats makes the client call report with the statistics of
+// every call it makes, including local ones. Streaming and pipe calls are
+// not reported. See WithCallStats.
+func WithClientCallStats(report CallStatsFunc, group PeerGroupFunc) ClientOption {
+	return func(c *Client) {
+		c.callStats = callStatsHook{report: report, group: group}
+	}
+}
+
+// WithSequencedSessions makes the server track the commands run in every
+// sequenced session (see SequencedSession), so that they run exactly once
+// and in order. Sessions are forgotten once idle for the given time, after
+// which their commands fail with ErrSequenceGap. Sessions are tracked in
+// memory, so they do not survive restarts.
+func WithSequencedSessions(idleTimeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.sequences = newSequenceTracker(idleTimeout)
+	}
+}
+
+// WithPayloadChecksum makes the server verify a checksum of the payloads
+// it exchanges with clients, computed with the hash returned by newHash,
+// such as sha256.New or a CRC. This guards against corruption happening
+// beyond the integrity provided by the transport, such as bugs buffering
+// or framing the data. The checksum of arguments, replies and
+// streamed items is appended to them once encoded, and before being
+// encrypted when using payload encryption too.
+//
+// The server rejects requests without a checksum, so clients must use
+// WithClientPayloadChecksum with the same hash. Payloads whose checksum
+// does not match cause ErrChecksum, and the stream they were read from is
+// not used again. Checksummed replies are never compressed, pipe calls are
+// not supported and JSON-RPC requests are not affected.
+func WithPayloadChecksum(newHash func() hash.Hash) ServerOption {
+	return func(s *Server) {
+		s.checksum = newHash
+	}
+}
+
+// WithClientPayloadChecksum makes the client add a checksum, computed
+// with the hash returned by newHash, to the payloads of remote calls and
+// verify those of the replies. See WithPayloadChecksum.
+func WithClientPayloadChecksum(newHash func() hash.Hash) ClientOption {
+	return func(c *Client) {
+		c.checksum = newHash
+	}
+}
+
+// WithMaxGoroutinesPerPeer limits the number of handler goroutines that
+// every peer can have running at a time (see Server.Goroutines), so that a
+// peer triggering handlers which never return cannot exhaust the server.
+// Calls beyond the limit fail with ErrOverloaded. Zero means no limit.
+func WithMaxGoroutinesPerPeer(max int) ServerOption {
+	return func(s *Server) {
+		s.goroutines.max = max
+	}
+}
+
+// WithAutoBatch makes the client accumulate the calls made to every peer
+// for up to the given window, or until there are maxBatch of them, and then
+// send them together, multiplexed on a single stream as in a Session, to
+// amortize the cost of every call when making many of them to the same
+// peer. This is transparent to callers, which get their own reply, at the
+// expense of up to the window of extra latency. Zero maxBatch means no
+// limit. Call options apply to batched calls as usual, but calls made with
+// WithCallTrace, and all of them when using WithCancelReasons, are sent
+// on their own.
+func WithAutoBatch(window time.Duration, maxBatch int) ClientOption {
+	return func(c *Client) {
+		c.batcher = newAutoBatcher(c, window, maxBatch)
+	}
+}
+
+// WithMethodQueueLimit limits the number of calls to the given method, in
+// "Service.Method" form, which can wait for a worker at a time when using
+// WithPinnedWorkers, so that the backlog of a slow method does not hold
+// up the calls to the other ones. Calls beyond the limit fail with
+// ErrQueueFull. See ServerStats.QueueDepths for the calls waiting for
+// every method.
+func WithMethodQueueLimit(method string, n int) ServerOption {
+	return func(s *Server) {
+		if s.queueLimits == nil {
+			s.queueLimits = make(map[ServiceID]int)
+		}
+		name, m, _ := strings.Cut(method, ".")
+		s.queueLimits[ServiceID{name, m}] = n
+	}
+}
+
+// WithDeadlinePropagationMargin sets the time by which the deadlines sent
+// to servers are brought forward with respect to those of the calls, which
+// is DefaultDeadlinePropagationMargin unless set. The reply takes some
+// time to travel back, and the clocks of both peers may be slightly off,
+// so a server working right up to the deadline of the client would often
+// reply once the client has given up already, wasting the work. Giving
+// the server an earlier deadline makes it time out, or finish, while the
+// client is still waiting. The deadline of the call itself is not
+// changed, and local calls are not affected. Zero propagates deadlines as
+// they are.
+func WithDeadlinePropagationMargin(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.deadlineMargin = d
+	}
+}
+
+// WithActivePeersWindow sets for how long after the last call to a peer
+// Client.ActivePeers still reports it, which is DefaultActivePeersWindow
+// unless set.
+func WithActivePeersWindow(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.activeWindow = d
+	}
+}
+
+// WithProtocol makes the call use the given protocol, overriding the one
+// negotiated for the peer (see Client.NegotiateVersion) and the one of the
+// client. Pooled streams are only reused for calls with the same
+// protocol, and the protocol fallback (see WithProtocolFallback) is not
+// tried for it.
+func WithProtocol(p protocol.ID) CallOption {
+	return func(o *callOptions) {
+		o.protocol = p
+	}
+}
+
+// WithProtocolFallback makes the client use the primary protocol, in
+// place of the one given to NewClient, with the peers supporting it, and
+// the fallback one with the others, to migrate smoothly from one version
+// of the protocol to the next during rolling upgrades. Both protocols are
+// offered when opening streams to a peer, until the peer is found not to
+// support the primary one. The fallback is used with it from then on,
+// which is logged, without trying the primary protocol again unless
+// NegotiateVersion is called for the peer.
+func WithProtocolFallback(primary, fallback protocol.ID) ClientOption {
+	return func(c *Client) {
+		c.protocol = primary
+		c.fallback = fallback
+	}
+}
+
+// WithClientCache makes the client cache the replies of the given methods,
+// in "Service.Method" form, for the given time, keyed by the peer called,
+// the arguments and the metadata sent (see WithMetadata), so that
+// identical calls made meanwhile return the cached reply without a round
+// trip. Only methods with no side effects whose replies can be somewhat
+// stale should be cached. Errors are not cached. At most maxEntries
+// replies are kept, evicting the least recently used ones first, and zero
+// means no limit. Cached replies can be dropped with
+// Client.InvalidateCache and Client.ClearCache. Calls served from the
+// cache go through the client interceptors and call stats, and fail once
+// the client is closed or draining, like the others.
+func WithClientCache(ttl time.Duration, maxEntries int, methods ...string) ClientOption {
+	return func(c *Client) {
+		svcIDs := make([]ServiceID, 0, len(methods))
+		for _, m := range methods {
+			name, method, _ := strings.Cut(m, ".")
+			svcIDs = append(svcIDs, ServiceID{name, method})
+		}
+		c.cache = newReplyCache(ttl, maxEntries, svcIDs)
+	}
+}
+
+// WithEmptyPeerIDLocal makes the client take calls to an empty peer ID
+// ("") as calls to the local server, as it used to, rather than failing
+// them with ErrEmptyPeerID. It is meant for applications relying on that
+// behaviour, which should move on to Client.CallLocal.
+func WithEmptyPeerIDLocal() ClientOption {
+	return func(c *Client) {
+		c.emptyPeerLocal = true
+	}
+}
+
+// WithMaxDecompressedSize limits the size of the compressed replies
+// received by the client (see WithCompression) once decompressed, so that
+// small replies from hostile servers cannot expand to exhaust memory.
+// Calls with larger replies fail with ErrReplyTooLarge. The default is
+// DefaultMaxDecompressedSize. Zero or less disables the limit.
+func WithMaxDecompressedSize(n int64) ClientOption {
+	return func(c *Client) {
+		c.maxDecompress = n
+	}
+}
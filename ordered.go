@@ -0,0 +1,43 @@
+package rpc
+
+import (
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// callQueue serializes calls to each peer, in the order in
+// which they were enqueued.
+type callQueue struct {
+	mu    sync.Mutex
+	tails map[peer.ID]chan struct{}
+}
+
+// enqueue takes a turn for a call to the given peer. The returned
+// channel is closed when the call can proceed and release must be
+// called once the call has completed, so that the next one can run.
+func (q *callQueue) enqueue(p peer.ID) (wait <-chan struct{}, release func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.tails == nil {
+		q.tails = make(map[peer.ID]chan struct{})
+	}
+
+	prev, ok := q.tails[p]
+	if !ok {
+		prev = make(chan struct{})
+		close(prev)
+	}
+	mine := make(chan struct{})
+	q.tails[p] = mine
+
+	release = func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		close(mine)
+		if q.tails[p] == mine {
+			delete(q.tails, p)
+		}
+	}
+	return prev, release
+}
@@ -0,0 +1,337 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// typeOfPipe is the type of the reply argument in pipe methods.
+var typeOfPipe = reflect.TypeOf((*Pipe)(nil))
+
+// pipeChunkSize is the largest chunk of bytes sent in a single frame.
+const pipeChunkSize = 32 << 10
+
+// errNoPipeEncryption is returned for pipe calls when using payload
+// encryption, since the bytes piped are sent as they are.
+var errNoPipeEncryption = errors.New("rpc: pipes do not support payload encryption")
+
+// errNoPipeChecksum is returned for pipe calls when using payload
+// checksums.
+var errNoPipeChecksum = errors.New("rpc: pipes do not support payload checksums")
+
+// Pipe is used by pipe methods to exchange raw bytes with the client,
+// which calls them with Client.Pipe. Pipe methods take a *Pipe in place of
+// the reply argument, read the body sent by the client with Read, until
+// io.EOF, and write the reply with Write. The bytes are sent as they are,
+// in frames made of their length followed by them, without encoding them
+// in any way, which makes pipes the most efficient way to move large
+// opaque payloads. The arguments of the method are sent before the body,
+// as usual. The error returned by the method is sent after the reply.
+//
+// A Pipe must not be used concurrently, nor once the method returns.
+type Pipe struct {
+	body frameReader
+	w    *bufio.Writer
+}
+
+// Read reads the body sent by the client. It returns io.EOF at its end.
+func (p *Pipe) Read(b []byte) (int, error) {
+	return p.body.Read(b)
+}
+
+// Write sends the given bytes to the client.
+func (p *Pipe) Write(b []byte) (int, error) {
+	if err := writeFrames(p.w, b); err != nil {
+		return 0, err
+	}
+	return len(b), p.w.Flush()
+}
+
+// end marks the end of the reply.
+func (p *Pipe) end() error {
+	if err := writeFrames(p.w, nil); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
+
+// writeFrames writes the given bytes in frames of up to pipeChunkSize.
+// An empty slice is written as the empty frame which marks the end.
+func writeFrames(w *bufio.Writer, b []byte) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	for {
+		chunk := b
+		if len(chunk) > pipeChunkSize {
+			chunk = chunk[:pipeChunkSize]
+		}
+		n := binary.PutUvarint(lenBuf[:], uint64(len(chunk)))
+		if _, err := w.Write(lenBuf[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		b = b[len(chunk):]
+		if len(b) == 0 {
+			return nil
+		}
+	}
+}
+
+// frameReader reads the bytes sent in frames until the empty frame.
+type frameReader struct {
+	r    *bufio.Reader
+	left uint64 // bytes left in the current frame
+	err  error  // set once the end is reached or on error
+}
+
+func (f *frameReader) Read(b []byte) (int, error) {
+	for f.left == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		n, err := binary.ReadUvarint(f.r)
+		switch {
+		case err == io.EOF:
+			f.err = io.ErrUnexpectedEOF
+		case err != nil:
+			f.err = err
+		case n == 0:
+			f.err = io.EOF
+		}
+		f.left = n
+	}
+	if uint64(len(b)) > f.left {
+		b = b[:f.left]
+	}
+	n, err := f.r.Read(b)
+	f.left -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// handlePipe runs a pipe method. The request is accepted with an empty
+// response, after which the method exchanges bytes with the client, and
+// the final response is sent once it returns.
+func (server *Server) handlePipe(ctx context.Context, s *streamWrap, header RequestHeader, svcID ServiceID, info CallInfo, policy *Policy, service *service, mtype *methodType, argv reflect.Value) error {
+	resp := &Response{Service: svcID, RequestID: header.RequestID}
+	if err := server.sendResponse(s, resp, nil); err != nil {
+		return err
+	}
+
+	pipe := &Pipe{body: frameReader{r: s.r}, w: s.w}
+	err := server.dispatch(ctx, info, policy, service, mtype, argv, reflect.ValueOf(pipe))
+	if err != nil {
+		server.errLog.logError("pipe method returned an error:", err)
+		resp.Error = err.Error()
+		resp.ServerError = isWireError(err)
+	}
+	if err := pipe.end(); err != nil {
+		return err
+	}
+	if err := server.sendResponse(s, resp, nil); err != nil {
+		return err
+	}
+	// The rest of the body, if any, is not read, so the stream cannot
+	// be used for further requests.
+	return io.EOF
+}
+
+// Pipe performs a call to a pipe method (see Pipe) in the given peer. The
+// body is read until io.EOF and sent to the method while it runs, and the
+// reply it writes is written to reply. It returns the error returned by
+// the method, if any, or any error reading the body, writing the reply or
+// affecting the stream. The context bounds the whole call.
+//
+// When the call ends before the body is read to the end, because the
+// method returned without reading all of it or on error, Pipe returns
+// without waiting for the read in progress, if any, and the body is not
+// read any further. The body is closed in that case if it is an
+// io.Closer, which should make that read return; otherwise it is left to
+// return on its own.
+//
+// Pipe calls to the local server, or when using payload encryption or
+// checksums, are not supported.
+func (c *Client) Pipe(ctx context.Context, dest peer.ID, svcName, svcMethod string, args interface{}, body io.Reader, reply io.Writer) error {
+	if c.isLocal(dest) {
+		return errors.New("rpc: cannot make local pipe calls")
+	}
+	if c.keys != nil {
+		return errNoPipeEncryption
+	}
+	if c.checksum != nil {
+		return errNoPipeChecksum
+	}
+	if !c.outstanding.begin() {
+		return ErrClientDraining
+	}
+	defer c.outstanding.end()
+
+	ctx, requestID := c.requestContext(ctx)
+	svcID := ServiceID{svcName, svcMethod}
+	sw, err := c.newStream(ctx, dest, c.protocolFor(dest))
+	if err != nil {
+		return err
+	}
+	id := c.inflight.add(CallInfo{
+		Peer:      dest,
+		Service:   svcName,
+		Method:    svcMethod,
+		Start:     time.Now(),
+		RequestID: requestID,
+	})
+	defer c.inflight.remove(id)
+
+	header := c.remoteHeader(ctx, svcID)
+	header.Pipe = true
+	logger.Debugf("starting pipe %s.%s to %s", svcName, svcMethod, dest)
+	err = c.writeRequest(sw, header, args, nil)
+	if err == nil {
+		err = sw.w.Flush()
+	}
+	if err != nil {
+		sw.stream.Reset()
+		c.streamClosed(sw, err)
+		return err
+	}
+
+	// Abort the call by resetting the stream when the context is
+	// cancelled.
+	stop := context.AfterFunc(ctx, func() { sw.stream.Reset() })
+	defer stop()
+
+	// The body is sent once the server accepts the call. Errors reading
+	// it are reported before the stream is reset, so that they are
+	// found whenever the reset is what made the call fail.
+	accepted := make(chan struct{})
+	rejected := make(chan struct{})
+	pumped := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-accepted:
+			if err := sendPipeBody(sw, body); err != nil {
+				pumped <- err
+				sw.stream.Reset()
+			}
+		case <-rejected:
+		}
+	}()
+
+	wasAccepted := false
+	callErr, err := receivePipe(sw, reply, func() {
+		wasAccepted = true
+		close(accepted)
+	})
+	if !wasAccepted {
+		close(rejected)
+		<-done
+	}
+	reset := err != nil
+	var bodyErr error
+	select {
+	case bodyErr = <-pumped:
+	default:
+	}
+	select {
+	case <-done:
+	default:
+		// The server does not need the rest of the body. The read in
+		// progress may block for a while, so it is not waited for.
+		sw.stream.Reset()
+		reset = true
+		if closer, ok := body.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case bodyErr != nil:
+		err = bodyErr
+	}
+	if reset || err != nil {
+		sw.stream.Reset()
+		c.streamClosed(sw, err)
+	} else {
+		sw.stream.Close()
+		c.streamClosed(sw, nil)
+	}
+	if err != nil {
+		return err
+	}
+	return callErr
+}
+
+// receivePipe reads the responses to a pipe call and copies the reply
+// to w. The accept function is called when the server accepts the call.
+// It returns the error of the call, set when it was rejected or the
+// method failed, and the error affecting the stream, if any.
+func receivePipe(sw *streamWrap, w io.Writer, accept func()) (callErr error, err error) {
+	var discard interface{}
+	var resp Response
+	if err := sw.dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+	if err := sw.dec.Decode(&discard); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return responseError(resp.Error, resp.ServerError), nil
+	}
+	accept()
+
+	if _, err := io.Copy(w, &frameReader{r: sw.r}); err != nil {
+		return nil, err
+	}
+
+	resp = Response{}
+	if err := sw.dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+	if err := sw.dec.Decode(&discard); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return responseError(resp.Error, resp.ServerError), nil
+	}
+	return nil, nil
+}
+
+// sendPipeBody sends the body of a pipe call. It returns the error
+// reading the body, if any, in which case the stream must be reset.
+// Errors writing to the stream are left for the reader to find.
+func sendPipeBody(sw *streamWrap, body io.Reader) error {
+	buf := make([]byte, pipeChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if werr := writeFrames(sw.w, buf[:n]); werr != nil {
+				return nil
+			}
+			if werr := sw.w.Flush(); werr != nil {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			if werr := writeFrames(sw.w, nil); werr == nil {
+				sw.w.Flush()
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package rpc
+
+import (
+	"context"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// AuthorizeFunc decides whether the given peer is allowed to call
+// the given service method.
+type AuthorizeFunc func(pid peer.ID, svcID ServiceID) bool
+
+// Interceptor wraps the execution of the method handling a request. It
+// must call handler to run the method, and may do work before and after
+// it, or return an error without calling it at all. The error returned is
+// sent back to the client.
+type Interceptor func(ctx context.Context, info CallInfo, handler func(context.Context) error) error
+
+// ClientInterceptor wraps the calls made by a Client, both remote and
+// local. It must call invoker to perform the call, and may do work before
+// and after it, call it several times (to retry, for example) or return
+// an error without calling it at all. The context passed to invoker is
+// the one used for the call, so metadata added to it with WithMetadata is
+// sent in the request header. The error returned is the one returned by
+// the call.
+type ClientInterceptor func(ctx context.Context, info CallInfo, invoker func(context.Context) error) error
+
+// Policy groups the safeguards which apply to the requests received on a
+// given protocol. The zero value allows every request.
+type Policy struct {
+	// Authorize, when set, is consulted before dispatching every
+	// request. Rejected requests fail with ErrUnauthorized.
+	Authorize AuthorizeFunc
+	// Interceptors wrap the method execution. The first one is
+	// the outermost.
+	Interceptors []Interceptor
+}
+
+func (p *Policy) authorize(pid peer.ID, svcID ServiceID) bool {
+	return p.Authorize == nil || p.Authorize(pid, svcID)
+}
+
+// intercept runs handler through the policy interceptors.
+func (p *Policy) intercept(ctx context.Context, info CallInfo, handler func(context.Context) error) error {
+	for i := len(p.Interceptors) - 1; i >= 0; i-- {
+		interceptor := p.Interceptors[i]
+		next := handler
+		handler = func(ctx context.Context) error {
+			return interceptor(ctx, info, next)
+		}
+	}
+	return handler(ctx)
+}
+
+// intercept runs invoker through the client interceptors.
+func (c *Client) intercept(ctx context.Context, info CallInfo, invoker func(context.Context) error) error {
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		interceptor := c.interceptors[i]
+		next := invoker
+		invoker = func(ctx context.Context) error {
+			return interceptor(ctx, info, next)
+		}
+	}
+	return invoker(ctx)
+}
@@ -0,0 +1,375 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+)
+
+// pooledStream is an idle stream kept for reuse. The stream is wrapped
+// along with its encoder and decoder, which are never used with any
+// other stream and are discarded together with it.
+type pooledStream struct {
+	sw       *streamWrap
+	proto    protocol.ID
+	lastUsed time.Time
+}
+
+// streamPool keeps idle streams to every peer so that they can be
+// reused by subsequent calls.
+type streamPool struct {
+	maxIdle     int           // per peer
+	idleTimeout time.Duration // idle streams are closed after this
+	maxAge      time.Duration // see WithMaxStreamAge
+
+	// released is called for every stream closed by the pool, with
+	// the error which caused it, if any.
+	released func(sw *streamWrap, err error)
+
+	mu        sync.Mutex
+	idle      map[peer.ID][]*pooledStream
+	cleanupOn bool // a cleanup is scheduled
+	closed    bool // see close
+}
+
+func newStreamPool(maxIdle int, idleTimeout time.Duration) *streamPool {
+	return &streamPool{
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		idle:        make(map[peer.ID][]*pooledStream),
+	}
+}
+
+// get returns an idle stream for the given peer and protocol, or nil
+// if there are none.
+func (p *streamPool) get(pid peer.ID, proto protocol.ID) *streamWrap {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	streams := p.idle[pid]
+	// Most recently used streams are at the end.
+	for i := len(streams) - 1; i >= 0; i-- {
+		ps := streams[i]
+		if ps.proto != proto || p.expired(ps, now) {
+			continue
+		}
+		p.idle[pid] = append(streams[:i], streams[i+1:]...)
+		if len(p.idle[pid]) == 0 {
+			delete(p.idle, pid)
+		}
+		return ps.sw
+	}
+	return nil
+}
+
+// put returns a stream to the pool after a successful call. If the pool
+// is full for that peer, or closed, the stream is closed instead.
+func (p *streamPool) put(pid peer.ID, sw *streamWrap) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.closed || len(p.idle[pid]) >= p.maxIdle || p.tooOld(sw, now) {
+		sw.stream.Close()
+		p.released(sw, nil)
+		sw.recycle()
+		return
+	}
+	p.idle[pid] = append(p.idle[pid], &pooledStream{
+		sw:       sw,
+		proto:    sw.stream.Protocol(),
+		lastUsed: now,
+	})
+
+	if interval := p.cleanupInterval(); !p.cleanupOn && interval > 0 {
+		p.cleanupOn = true
+		time.AfterFunc(interval, p.cleanup)
+	}
+}
+
+// close closes all the idle streams. Streams put afterwards, by the calls
+// which were in progress, are closed right away.
+func (p *streamPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for pid, streams := range p.idle {
+		for _, ps := range streams {
+			ps.sw.stream.Close()
+			p.released(ps.sw, nil)
+			ps.sw.recycle()
+		}
+		delete(p.idle, pid)
+	}
+}
+
+// evict discards a stream which failed with the given error. It is reset
+// rather than closed, since its state is unknown and it must not be used
+// anymore.
+func (p *streamPool) evict(sw *streamWrap, err error) {
+	sw.stream.Reset()
+	p.released(sw, err)
+}
+
+func (p *streamPool) expired(ps *pooledStream, now time.Time) bool {
+	return (p.idleTimeout > 0 && now.Sub(ps.lastUsed) >= p.idleTimeout) ||
+		p.tooOld(ps.sw, now)
+}
+
+func (p *streamPool) tooOld(sw *streamWrap, now time.Time) bool {
+	return p.maxAge > 0 && now.Sub(sw.opened) >= p.maxAge
+}
+
+// cleanupInterval returns how often idle streams are checked, or zero if
+// they never expire.
+func (p *streamPool) cleanupInterval() time.Duration {
+	if p.maxAge > 0 && (p.idleTimeout == 0 || p.maxAge < p.idleTimeout) {
+		return p.maxAge
+	}
+	return p.idleTimeout
+}
+
+// cleanup closes the streams which have been idle for too long, or which
+// are older than the maximum age, and
+// schedules itself again while there are idle streams left.
+func (p *streamPool) cleanup() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for pid, streams := range p.idle {
+		var keep []*pooledStream
+		for _, ps := range streams {
+			if p.expired(ps, now) {
+				ps.sw.stream.Close()
+				p.released(ps.sw, nil)
+				ps.sw.recycle()
+				continue
+			}
+			keep = append(keep, ps)
+		}
+		if len(keep) == 0 {
+			delete(p.idle, pid)
+			continue
+		}
+		p.idle[pid] = keep
+	}
+
+	if len(p.idle) > 0 {
+		time.AfterFunc(p.cleanupInterval(), p.cleanup)
+		return
+	}
+	p.cleanupOn = false
+}
+
+// oldest returns the age of the oldest idle stream, or zero if none.
+func (p *streamPool) oldest() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var age time.Duration
+	for _, streams := range p.idle {
+		for _, ps := range streams {
+			if a := now.Sub(ps.sw.opened); a > age {
+				age = a
+			}
+		}
+	}
+	return age
+}
+
+// peers returns the peers which have idle streams.
+func (p *streamPool) peers() []peer.ID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pids := make([]peer.ID, 0, len(p.idle))
+	for pid := range p.idle {
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+// idleCount returns the number of idle streams to the given peer.
+func (p *streamPool) idleCount(pid peer.ID) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle[pid])
+}
+
+// openStream returns a stream to perform a call to the given peer with
+// the given protocol, taking it from the pool when possible. It reports
+// whether the stream was reused.
+func (c *Client) openStream(ctx context.Context, pid peer.ID, proto protocol.ID) (*streamWrap, bool, error) {
+	if c.pool != nil {
+		if sw := c.pool.get(pid, proto); sw != nil {
+			return sw, true, nil
+		}
+	}
+	sw, err := c.newStream(ctx, pid, proto)
+	return sw, false, err
+}
+
+// newStream opens a new stream to the given peer, unless doing so would
+// exceed the limit set with WithClientMaxOpenStreams.
+func (c *Client) newStream(ctx context.Context, pid peer.ID, proto protocol.ID) (*streamWrap, error) {
+	if c.requireAddrs && !c.canDial(pid) {
+		return nil, ErrNoAddresses
+	}
+	if err := c.peerSlots.acquire(ctx, pid); err != nil {
+		return nil, err
+	}
+	if !c.streams.acquire() {
+		c.peerSlots.release(pid)
+		return nil, ErrTooManyStreams
+	}
+	s, err := c.dialStream(ctx, pid, proto)
+	if err != nil {
+		c.streams.release()
+		c.peerSlots.release(pid)
+		return nil, err
+	}
+	proto = s.Protocol() // it may be the fallback
+	if err := setStreamService(s, proto, c.streamServices); err != nil {
+		s.Reset()
+		c.streams.release()
+		c.peerSlots.release(pid)
+		return nil, err
+	}
+	if c.recorder != nil {
+		s = c.recorder.wrap(s)
+	}
+	var sw *streamWrap
+	if c.bufferPool && c.msgpackHandle == nil {
+		sw = wrapStreamPooled(s)
+	} else {
+		sw = wrapStream(s, c.msgpackHandle)
+	}
+	sw.usePayloadHandle(c.payloadHandle)
+	sw.id = c.hooks.opened(s)
+	sw.opened = time.Now()
+	sw.peer = pid
+	return sw, nil
+}
+
+// dialStream opens a stream with the host, retrying as configured with
+// WithStreamOpenRetry.
+func (c *Client) dialStream(ctx context.Context, pid peer.ID, proto protocol.ID) (inet.Stream, error) {
+	protos := []protocol.ID{proto}
+	if c.fallback != "" && proto == c.protocol {
+		protos = append(protos, c.fallback)
+	}
+	backoff := c.streamOpenBackoff
+	for attempt := 1; ; attempt++ {
+		s, err := c.host.NewStream(ctx, pid, protos...)
+		if err == nil && len(protos) > 1 && s.Protocol() == c.fallback {
+			c.fellBack(pid)
+		}
+		if err == nil || attempt >= c.streamOpenAttempts || ctx.Err() != nil {
+			return s, err
+		}
+		logger.Debugf("opening stream to %s failed, retrying: %s", pid.Pretty(), err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// canDial reports whether the client is connected to the given peer or
+// knows addresses to connect to it.
+func (c *Client) canDial(pid peer.ID) bool {
+	if c.host.Network().Connectedness(pid) == inet.Connected {
+		return true
+	}
+	return len(c.host.Peerstore().Addrs(pid)) > 0
+}
+
+// streamClosed accounts for a stream opened with newStream having been
+// closed, because of the given error if not nil.
+func (c *Client) streamClosed(sw *streamWrap, err error) {
+	c.hooks.closed(sw.stream, sw.id, err)
+	c.streams.release()
+	c.peerSlots.release(sw.peer)
+}
+
+// peerSlots limits the number of streams open to every peer. The zero
+// value, or a negative limit, does not limit them.
+type peerSlots struct {
+	max int
+
+	mu    sync.Mutex
+	used  map[peer.ID]int
+	freed chan struct{} // closed when a slot is released
+}
+
+// acquire takes a slot for a stream to the given peer, waiting for one
+// to be released if needed until the context is cancelled.
+func (p *peerSlots) acquire(ctx context.Context, pid peer.ID) error {
+	if p.max <= 0 {
+		return nil
+	}
+	for {
+		p.mu.Lock()
+		if p.used == nil {
+			p.used = make(map[peer.ID]int)
+			p.freed = make(chan struct{})
+		}
+		if p.used[pid] < p.max {
+			p.used[pid]++
+			p.mu.Unlock()
+			return nil
+		}
+		freed := p.freed
+		p.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (p *peerSlots) release(pid peer.ID) {
+	if p.max <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.used[pid]--; p.used[pid] <= 0 {
+		delete(p.used, pid)
+	}
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
+
+// releaseStream disposes of a stream after a call, which failed with the
+// given error, if not nil. Streams which saw errors are evicted, while
+// others are closed or returned to the pool.
+func (c *Client) releaseStream(pid peer.ID, sw *streamWrap, err error) {
+	switch {
+	case sw.cancelSent:
+		// Resetting the stream could discard the reason before
+		// the server reads it.
+		sw.stream.Close()
+		c.streamClosed(sw, err)
+	case c.pool == nil:
+		sw.stream.Close()
+		c.streamClosed(sw, err)
+		if err == nil {
+			sw.recycle()
+		}
+	case err != nil:
+		c.pool.evict(sw, err)
+	default:
+		c.pool.put(pid, sw)
+	}
+}
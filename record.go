@@ -0,0 +1,221 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+)
+
+// Recordings are made of JSON values, one per line. The first one is a
+// recordingHeader identifying the format and its version. Every other
+// line is a recordEntry holding a chunk of bytes read from or written to
+// a stream, exactly as they went through it.
+const (
+	recordingFormat  = "go-libp2p-gorpc/recording"
+	recordingVersion = 1
+)
+
+// Directions of the recorded chunks, as seen by the recording side.
+const (
+	recordIn  = "in"
+	recordOut = "out"
+)
+
+type recordingHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+type recordEntry struct {
+	Stream   uint64      `json:"stream"`
+	Peer     string      `json:"peer,omitempty"`
+	Protocol protocol.ID `json:"protocol,omitempty"`
+	Dir      string      `json:"dir"`
+	Time     time.Time   `json:"time"`
+	Data     []byte      `json:"data"`
+}
+
+// recorder writes the traffic of the streams it wraps to a recording.
+type recorder struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	err    error // first write error, after which nothing is recorded
+	next   uint64
+	header sync.Once
+}
+
+func newRecorder(w io.Writer) *recorder {
+	return &recorder{enc: json.NewEncoder(w)}
+}
+
+// wrap returns a stream which records everything read from and written
+// to the given one.
+func (r *recorder) wrap(s inet.Stream) inet.Stream {
+	return &recordingStream{
+		Stream: s,
+		rec:    r,
+		id:     atomic.AddUint64(&r.next, 1),
+	}
+}
+
+func (r *recorder) record(s *recordingStream, dir string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.header.Do(func() {
+		r.err = r.enc.Encode(recordingHeader{recordingFormat, recordingVersion})
+	})
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(recordEntry{
+		Stream:   s.id,
+		Peer:     peer.IDB58Encode(s.Conn().RemotePeer()),
+		Protocol: s.Protocol(),
+		Dir:      dir,
+		Time:     time.Now(),
+		Data:     data,
+	})
+	if r.err != nil {
+		logger.Error("recording stopped: ", r.err)
+	}
+}
+
+type recordingStream struct {
+	inet.Stream
+	rec *recorder
+	id  uint64
+}
+
+func (s *recordingStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if n > 0 {
+		s.rec.record(s, recordIn, p[:n])
+	}
+	return n, err
+}
+
+func (s *recordingStream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	if n > 0 {
+		s.rec.record(s, recordOut, p[:n])
+	}
+	return n, err
+}
+
+// RecordedStream is a stream read from a recording made with WithRecorder
+// or WithClientRecorder.
+type RecordedStream struct {
+	// ID identifies the stream in the recording.
+	ID uint64
+	// Peer is the remote peer of the stream.
+	Peer peer.ID
+	// Protocol is the protocol of the stream.
+	Protocol protocol.ID
+	// In holds the bytes received by the recording side, in order.
+	In []byte
+	// Out holds the bytes sent by the recording side, in order.
+	Out []byte
+}
+
+// ReadRecording reads a recording made with WithRecorder or
+// WithClientRecorder and returns its streams, in the order they were
+// first seen.
+func ReadRecording(r io.Reader) ([]*RecordedStream, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var header recordingHeader
+	if err := dec.Decode(&header); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if header.Format != recordingFormat {
+		return nil, errors.New("rpc: not a recording")
+	}
+	if header.Version != recordingVersion {
+		return nil, fmt.Errorf("rpc: unsupported recording version %d", header.Version)
+	}
+
+	var streams []*RecordedStream
+	byID := make(map[uint64]*RecordedStream)
+	for {
+		var e recordEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return streams, nil
+		}
+		if err != nil {
+			return streams, err
+		}
+		rs, ok := byID[e.Stream]
+		if !ok {
+			pid, err := peer.IDB58Decode(e.Peer)
+			if err != nil {
+				return streams, err
+			}
+			rs = &RecordedStream{ID: e.Stream, Peer: pid, Protocol: e.Protocol}
+			byID[e.Stream] = rs
+			streams = append(streams, rs)
+		}
+		switch e.Dir {
+		case recordIn:
+			rs.In = append(rs.In, e.Data...)
+		case recordOut:
+			rs.Out = append(rs.Out, e.Data...)
+		default:
+			return streams, fmt.Errorf("rpc: unknown direction %q in recording", e.Dir)
+		}
+	}
+}
+
+// Replay returns a connection which plays back the bytes received by the
+// recording side of the stream and collects whatever is written to it.
+// Replaying a stream recorded by a server to Server.ServeConn handles the
+// recorded requests again, while replaying one recorded by a client to
+// Client.CallConn returns the recorded responses. What was written can
+// then be compared with the recorded output using ReplayConn.Written.
+func (rs *RecordedStream) Replay() *ReplayConn {
+	return &ReplayConn{r: bytes.NewReader(rs.In)}
+}
+
+// ReplayConn is the io.ReadWriteCloser returned by RecordedStream.Replay.
+type ReplayConn struct {
+	r *bytes.Reader
+
+	mu sync.Mutex
+	w  bytes.Buffer
+}
+
+// Read reads the recorded input. It returns io.EOF at its end.
+func (c *ReplayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write collects the given bytes.
+func (c *ReplayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Write(p)
+}
+
+// Close does nothing.
+func (c *ReplayConn) Close() error {
+	return nil
+}
+
+// Written returns a copy of everything written to the connection.
+func (c *ReplayConn) Written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.w.Bytes()...)
+}
@@ -0,0 +1,31 @@
+package rpc
+
+import "context"
+
+// handlerScope is carried by the context of the methods running in a
+// server, so that local calls made from them with that context are
+// recognized as re-entrant. Scopes are chained when such calls are
+// nested.
+type handlerScope struct {
+	server  *Server
+	service *service
+	parent  *handlerScope
+}
+
+// within reports whether the given context belongs to a method of the
+// given server, or of the given service of it when service is not nil.
+func within(ctx context.Context, server *Server, service *service) bool {
+	scope, _ := ctx.Value(handlerScopeKey).(*handlerScope)
+	for ; scope != nil; scope = scope.parent {
+		if scope.server == server && (service == nil || scope.service == service) {
+			return true
+		}
+	}
+	return false
+}
+
+// enterHandler returns the context for a method of the given service.
+func enterHandler(ctx context.Context, server *Server, service *service) context.Context {
+	parent, _ := ctx.Value(handlerScopeKey).(*handlerScope)
+	return context.WithValue(ctx, handlerScopeKey, &handlerScope{server, service, parent})
+}
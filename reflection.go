@@ -0,0 +1,158 @@
+package rpc
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"reflect"
+	"strings"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// reflectionServiceName is the name of the service which servers created
+// with WithReflection provide to describe their methods.
+const reflectionServiceName = "gorpc.Reflection"
+
+// MethodSignature describes the arguments and reply of a method, as
+// returned by Client.DescribeMethod. Types are described by their shape
+// on the wire rather than by their name, so that types declared by each
+// side separately match as long as they are encoded alike (see
+// TypeSignature).
+type MethodSignature struct {
+	Args      string
+	Reply     string
+	Streaming bool
+	Pipe      bool
+}
+
+// reflectionService describes the methods registered in a server.
+type reflectionService struct {
+	server *Server
+}
+
+// Describe sets the reply to the signature of the given method.
+func (r *reflectionService) Describe(ctx context.Context, id ServiceID, reply *MethodSignature) error {
+	_, mtype, err := r.server.getService(id)
+	if err != nil {
+		return err
+	}
+	reply.Args = TypeSignature(mtype.ArgType)
+	reply.Streaming = mtype.streaming
+	reply.Pipe = mtype.pipe
+	if !mtype.streaming && !mtype.pipe {
+		reply.Reply = TypeSignature(mtype.ReplyType)
+	}
+	return nil
+}
+
+// DescribeMethod returns the signature of the given method in the given
+// peer, whose server must have been created with WithReflection.
+func (c *Client) DescribeMethod(ctx context.Context, dest peer.ID, svcName, svcMethod string) (MethodSignature, error) {
+	var sig MethodSignature
+	err := c.CallContext(ctx, dest, reflectionServiceName, "Describe", ServiceID{svcName, svcMethod}, &sig)
+	return sig, err
+}
+
+// VerifyMethod checks that the arguments and the reply of the given method
+// in the given peer have the same types as the given ones, which are those
+// that would be passed to Call, so that type skew between both sides is
+// caught as a clear error rather than as failed or wrong decodings. Nil
+// args or reply are not checked. The server must have been created with
+// WithReflection.
+func (c *Client) VerifyMethod(ctx context.Context, dest peer.ID, svcName, svcMethod string, args, reply interface{}) error {
+	sig, err := c.DescribeMethod(ctx, dest, svcName, svcMethod)
+	if err != nil {
+		return err
+	}
+	if args != nil {
+		if local := TypeSignature(reflect.TypeOf(args)); local != sig.Args {
+			return fmt.Errorf("rpc: argument type mismatch for %s.%s: the server expects %s, got %s",
+				svcName, svcMethod, sig.Args, local)
+		}
+	}
+	if reply != nil && !sig.Streaming && !sig.Pipe {
+		if local := TypeSignature(reflect.TypeOf(reply)); local != sig.Reply {
+			return fmt.Errorf("rpc: reply type mismatch for %s.%s: the server sends %s, got %s",
+				svcName, svcMethod, sig.Reply, local)
+		}
+	}
+	return nil
+}
+
+var (
+	typeOfBinaryMarshaler = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	typeOfTextMarshaler   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// TypeSignature describes the shape of the given type as encoded on the
+// wire: pointers are ignored, integers of any size are "int" or "uint",
+// floating point numbers "float", byte slices "bytes", and structs are
+// described by their exported fields, so that named types match the
+// types they are made of. Types marshalling themselves are described by
+// their name instead.
+func TypeSignature(t reflect.Type) string {
+	var b strings.Builder
+	writeSignature(&b, t, make(map[reflect.Type]bool))
+	return b.String()
+}
+
+func writeSignature(b *strings.Builder, t reflect.Type, seen map[reflect.Type]bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Implements(typeOfBinaryMarshaler) || t.Implements(typeOfTextMarshaler) ||
+		reflect.PtrTo(t).Implements(typeOfBinaryMarshaler) || reflect.PtrTo(t).Implements(typeOfTextMarshaler) {
+		b.WriteString(t.String())
+		return
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b.WriteString("int")
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		b.WriteString("uint")
+	case reflect.Float32, reflect.Float64:
+		b.WriteString("float")
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			b.WriteString("bytes")
+			return
+		}
+		b.WriteString("[]")
+		writeSignature(b, t.Elem(), seen)
+	case reflect.Map:
+		b.WriteString("map[")
+		writeSignature(b, t.Key(), seen)
+		b.WriteString("]")
+		writeSignature(b, t.Elem(), seen)
+	case reflect.Interface:
+		b.WriteString("any")
+	case reflect.Struct:
+		if seen[t] {
+			// Recursive types are described by name when
+			// found again.
+			b.WriteString(t.String())
+			return
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		b.WriteString("struct{")
+		first := true
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if !first {
+				b.WriteString("; ")
+			}
+			first = false
+			b.WriteString(f.Name)
+			b.WriteString(" ")
+			writeSignature(b, f.Type, seen)
+		}
+		b.WriteString("}")
+	default:
+		b.WriteString(t.Kind().String())
+	}
+}
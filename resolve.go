@@ -0,0 +1,33 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ResolverFunc resolves a logical name to the peers which serve it, in
+// order of preference. See WithResolver.
+type ResolverFunc func(ctx context.Context, name string) ([]peer.ID, error)
+
+// CallName resolves the given name with the resolver set with
+// WithResolver and performs the call to the resulting peers with
+// CallWithFailover, so that every peer is tried once, in order, until one
+// of them answers. The name is resolved on every call, which allows the
+// peers behind it to change over time.
+func (c *Client) CallName(ctx context.Context, name, svcName, svcMethod string, args, reply interface{}) error {
+	if c.resolver == nil {
+		return errors.New("rpc: no resolver set")
+	}
+	pids, err := c.resolver(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(pids) == 0 {
+		return fmt.Errorf("rpc: no peers for %q", name)
+	}
+	_, err = c.CallWithFailover(ctx, pids, FailoverPolicy{}, svcName, svcMethod, args, reply)
+	return err
+}
@@ -0,0 +1,69 @@
+package rpc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxSampledErrors bounds the number of distinct errors tracked
+// by an errorSampler.
+const maxSampledErrors = 1024
+
+// errorSampler logs errors, but logs identical errors at most once
+// per interval, reporting how many were suppressed in between. With
+// a zero interval every error is logged.
+type errorSampler struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+// logError logs msg followed by err, unless an identical error was
+// logged less than interval ago.
+func (s *errorSampler) logError(msg string, err error) {
+	if s.interval <= 0 {
+		logger.Error(msg, err)
+		return
+	}
+
+	kind := msg + err.Error()
+	now := time.Now()
+
+	s.mu.Lock()
+	if s.last == nil {
+		s.last = make(map[string]time.Time)
+		s.suppressed = make(map[string]int)
+	}
+	if last, ok := s.last[kind]; ok && now.Sub(last) < s.interval {
+		s.suppressed[kind]++
+		s.mu.Unlock()
+		return
+	}
+	if len(s.last) >= maxSampledErrors {
+		s.prune(now)
+	}
+	suppressed := s.suppressed[kind]
+	s.last[kind] = now
+	delete(s.suppressed, kind)
+	s.mu.Unlock()
+
+	if suppressed > 0 {
+		logger.Error(msg, err, fmt.Sprintf(" (%d identical errors suppressed)", suppressed))
+		return
+	}
+	logger.Error(msg, err)
+}
+
+// prune forgets about errors last logged more than interval ago. It must
+// be called with the lock held.
+func (s *errorSampler) prune(now time.Time) {
+	for kind, last := range s.last {
+		if now.Sub(last) >= s.interval {
+			delete(s.last, kind)
+			delete(s.suppressed, kind)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package rpc
+
+import (
+	inet "github.com/libp2p/go-libp2p-net"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+)
+
+// StreamServiceSetter is implemented by streams which can be attributed
+// to a service, so that the resource manager or the transport accounts
+// for them and prioritizes them separately. It mirrors the SetService
+// method of libp2p stream scopes, which is how the resource manager tags
+// streams with a service. The streams of the libp2p version used here do
+// not implement it, but hosts whose streams do (for example, by wrapping
+// them to forward the call to their scope, or to set socket options) get
+// the services set with WithStreamService and WithClientStreamService
+// applied. See WithStreamService.
+type StreamServiceSetter interface {
+	SetService(service string) error
+}
+
+// setStreamService attributes the stream to the service configured for
+// its protocol, if any and if the stream supports it. Errors setting the
+// service, which resource managers return when the service is over its
+// limits, mean that the stream must not be used.
+func setStreamService(s inet.Stream, proto protocol.ID, services map[protocol.ID]string) error {
+	name, ok := services[proto]
+	if !ok {
+		return nil
+	}
+	setter, ok := s.(StreamServiceSetter)
+	if !ok {
+		return nil
+	}
+	return setter.SetService(name)
+}
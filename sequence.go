@@ -0,0 +1,264 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// errNoSequencing is returned for sequenced calls to servers which do not
+// track sequenced sessions, so that they are not run without the
+// guarantees the client expects.
+var errNoSequencing = errors.New("rpc: server does not support sequenced sessions")
+
+// SequencedSession performs calls to a single peer which run exactly once
+// and in order, as needed to replicate a stream of commands. Commands are
+// numbered with consecutive sequence numbers within the session, which is
+// identified by a random ID. The server, which must track sessions (see
+// WithSequencedSessions), runs them in order and drops those it has run
+// already. Calls whose outcome is unknown, because the call failed in
+// transit, the server was unavailable or the context was cancelled, are
+// resent before the next command, and their reply is discarded then.
+// Calls on a SequencedSession do not share a stream and are made one at a
+// time, so they survive streams breaking and reconnections.
+//
+// Commands run at most once if the server loses track of the session,
+// which happens when it restarts or forgets it after being idle for too
+// long. Then, a command whose outcome was unknown may have run or not,
+// and the next call fails with ErrSequenceGap. The session cannot be used
+// afterwards: the application must find out what state the server is in
+// before starting a new one.
+type SequencedSession struct {
+	c   *Client
+	pid peer.ID
+	id  string
+
+	mu      sync.Mutex
+	next    uint64            // the sequence number of the next command
+	pending *sequencedCommand // whose outcome is unknown
+}
+
+// sequencedCommand is a call made on a SequencedSession.
+type sequencedCommand struct {
+	seq   uint64
+	svcID ServiceID
+	args  interface{}
+	reply interface{}
+}
+
+// SequencedSession returns a new SequencedSession to make calls to the
+// given peer. Nothing is sent until the first call. Sequenced sessions to
+// the local server are not supported.
+func (c *Client) SequencedSession(pid peer.ID) (*SequencedSession, error) {
+	if c.isLocal(pid) {
+		return nil, errors.New("rpc: cannot open sessions to the local server")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &SequencedSession{
+		c:    c,
+		pid:  pid,
+		id:   hex.EncodeToString(id),
+		next: 1,
+	}, nil
+}
+
+// ID returns the ID of the session.
+func (s *SequencedSession) ID() string {
+	return s.id
+}
+
+// Call runs a command in the session and waits for it to complete. The
+// command whose outcome was unknown, if any, is resent first, and Call
+// fails without sending the new command while that outcome remains
+// unknown. It returns ErrAlreadyApplied when the command had run already,
+// which is the case when it was resent after its reply was lost.
+func (s *SequencedSession) Call(ctx context.Context, svcName, svcMethod string, args, reply interface{}) error {
+	if err := checkReply(ServiceID{svcName, svcMethod}, reply); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(ctx); err != nil {
+		return err
+	}
+
+	cmd := &sequencedCommand{
+		seq:   s.next,
+		svcID: ServiceID{svcName, svcMethod},
+		args:  args,
+		reply: reply,
+	}
+	s.next++
+	known, err := s.send(ctx, cmd)
+	if !known {
+		// The reply is discarded when resending.
+		cmd.reply = privateReply(reply)
+		s.pending = cmd
+	}
+	return err
+}
+
+// Flush resends the command whose outcome is unknown, if any, until it
+// is known or the context is done. It returns the error which keeps the
+// outcome unknown, if any. The outcome of the command itself is not
+// reported, since it was reported already, as an error, by Call.
+func (s *SequencedSession) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush(ctx)
+}
+
+func (s *SequencedSession) flush(ctx context.Context) error {
+	if s.pending == nil {
+		return nil
+	}
+	known, err := s.send(ctx, s.pending)
+	if !known {
+		return err
+	}
+	if err == ErrSequenceGap {
+		return err
+	}
+	if err != nil {
+		logger.Debugf("resent command %d in session %s failed: %s", s.pending.seq, s.id, err)
+	}
+	s.pending = nil
+	return nil
+}
+
+// send performs the call for the given command. It returns whether its
+// outcome is known and its error.
+func (s *SequencedSession) send(ctx context.Context, cmd *sequencedCommand) (bool, error) {
+	call := s.c.Start(ctx, s.pid, cmd.svcID.Name, cmd.svcID.Method, cmd.args, cmd.reply, nil,
+		withSequence(s.id, cmd.seq))
+	<-call.Done
+	switch {
+	case call.Error == nil:
+		return true, nil
+	case isTransient(call), ctx.Err() != nil:
+		return false, call.Error
+	case call.Error == ErrClientClosed, call.Error == ErrClientDraining:
+		return false, call.Error
+	default:
+		return true, call.Error
+	}
+}
+
+// withSequence makes a call run as the given command in a sequenced
+// session.
+func withSequence(session string, seq uint64) CallOption {
+	return func(o *callOptions) {
+		o.sequence = &sequenceTag{session, seq}
+	}
+}
+
+// sequenceTag identifies a command in a sequenced session.
+type sequenceTag struct {
+	session string
+	seq     uint64
+}
+
+// sequenceTracker tracks the commands that a server has run in every
+// sequenced session.
+type sequenceTracker struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	sessions  map[string]*sequenceState
+	lastSweep time.Time
+}
+
+// sequenceState holds the last command run in a session. The mutex is
+// held while a command runs, so that they run one after the other.
+type sequenceState struct {
+	mu    sync.Mutex
+	acked uint64
+	seen  time.Time // protected by the tracker mutex
+}
+
+func newSequenceTracker(ttl time.Duration) *sequenceTracker {
+	return &sequenceTracker{
+		ttl:       ttl,
+		sessions:  make(map[string]*sequenceState),
+		lastSweep: time.Now(),
+	}
+}
+
+// begin waits until the given command can run. It returns
+// ErrAlreadyApplied when it has run already and ErrSequenceGap when the
+// previous command has not. Otherwise, end must be called once the
+// command has run.
+func (t *sequenceTracker) begin(tag *sequenceTag) (*sequenceState, error) {
+	now := time.Now()
+	t.mu.Lock()
+	if now.Sub(t.lastSweep) >= t.ttl {
+		for id, st := range t.sessions {
+			if now.Sub(st.seen) >= t.ttl {
+				delete(t.sessions, id)
+			}
+		}
+		t.lastSweep = now
+	}
+	st, ok := t.sessions[tag.session]
+	if !ok {
+		if tag.seq != 1 {
+			t.mu.Unlock()
+			return nil, ErrSequenceGap
+		}
+		st = &sequenceState{}
+		t.sessions[tag.session] = st
+	}
+	st.seen = now
+	t.mu.Unlock()
+
+	st.mu.Lock()
+	switch {
+	case tag.seq <= st.acked:
+		st.mu.Unlock()
+		return nil, ErrAlreadyApplied
+	case tag.seq > st.acked+1:
+		st.mu.Unlock()
+		return nil, ErrSequenceGap
+	}
+	return st, nil
+}
+
+// end records that the given command has run, or not.
+func (st *sequenceState) end(tag *sequenceTag, run bool) {
+	if run {
+		st.acked = tag.seq
+	}
+	st.mu.Unlock()
+}
+
+// dispatchSequenced dispatches a call which is a command in a sequenced
+// session as such, and any other call as usual. Commands count as run
+// once dispatched, whether the method fails or not, unless the client
+// gave up on them before.
+func (server *Server) dispatchSequenced(ctx context.Context, tag *sequenceTag, info CallInfo, policy *Policy, service *service, mtype *methodType, argv, replyv reflect.Value) error {
+	if tag == nil {
+		return server.dispatch(ctx, info, policy, service, mtype, argv, replyv)
+	}
+	if server.sequences == nil {
+		return errNoSequencing
+	}
+	st, err := server.sequences.begin(tag)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		st.end(tag, false)
+		return err
+	}
+	defer st.end(tag, true)
+	return server.dispatch(ctx, info, policy, service, mtype, argv, replyv)
+}
@@ -12,22 +12,41 @@ Only methods that satisfy these criteria will be made available for remote
 access; other methods will be ignored:
 	- the method's type is exported.
 	- the method is exported.
-	- the method has two arguments, both exported (or builtin) types.
-	- the method's second argument is a pointer.
+	- the method has two arguments, both exported (or builtin) types,
+	  optionally preceded by a context.Context.
+	- the method's last argument is a pointer.
 	- the method has return type error.
 
 In effect, the method must look schematically like
 
 	func (t *T) MethodName(argType T1, replyType *T2) error
 
+or
+
+	func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
+
 where T1 and T2 can be marshaled by encoding/gob.
 
-The method's first argument represents the arguments provided by the caller;
-the second argument represents the result parameters to be returned to the
+The method's args argument represents the arguments provided by the caller;
+the reply argument represents the result parameters to be returned to the
 caller.  The method's return value, if non-nil, is passed back as a string
 that the client sees as if created by errors.New.  If an error is returned,
 the reply parameter will not be sent back to the client.
 
+Methods taking a context.Context receive one which is cancelled when the
+method returns. When the client provided a deadline for the call (see
+Client.CallContext), the context carries it as well, and requests arriving
+after their deadline are rejected without invoking the method at all.
+
+Methods taking a *ServerStream in place of the reply argument are streaming
+methods. They send any number of items to the client, which receives them
+with Client.Stream, and their error, if any, is delivered after the last
+item. See ServerStream.
+
+Methods taking a *Pipe in place of the reply argument are pipe methods. They
+exchange raw bytes with the client, which calls them with Client.Pipe. See
+Pipe.
+
 In order to use this package, a ready-to-go LibP2P Host must be provided
 to clients and servers, along with a protocol.ID. rpc will add a stream
 handler for the given protocol. Hosts must be ready to speak to clients,
@@ -37,11 +56,16 @@ communication is required.
 package rpc
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"log"
 	"reflect"
 	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -50,6 +74,7 @@ import (
 	inet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
 	protocol "github.com/libp2p/go-libp2p-protocol"
+	codec "github.com/ugorji/go/codec"
 )
 
 var logger = logging.Logger("p2p-gorpc")
@@ -58,10 +83,20 @@ var logger = logging.Logger("p2p-gorpc")
 // because Typeof takes an empty interface value. This is annoying.
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 
+// Same for context.Context.
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 type methodType struct {
-	method    reflect.Method
-	ArgType   reflect.Type
-	ReplyType reflect.Type
+	method     reflect.Method
+	ArgType    reflect.Type
+	ReplyType  reflect.Type
+	hasContext bool // the first argument is a context.Context
+	streaming  bool // the reply argument is a *ServerStream
+	pipe       bool // the reply argument is a *Pipe
+	rawArgs    bool // the arguments are kept encoded, see fallbackMethod
+
+	// fn, when set, is called instead of the method. See RegisterMethod.
+	fn func(ctx context.Context, argv, replyv reflect.Value) error
 }
 
 // service stores information about a service (which is a pointer to a
@@ -71,6 +106,7 @@ type service struct {
 	rcvr   reflect.Value          // receiver of methods for the service
 	typ    reflect.Type           // type of the receiver
 	method map[string]*methodType // registered methods
+	serial chan struct{}          // held while running a call, see RegisterSerial
 }
 
 // ServiceID is a header sent when performing an RPC request
@@ -80,11 +116,97 @@ type ServiceID struct {
 	Method string
 }
 
+// RequestHeader is sent when performing an RPC request. It embeds the
+// ServiceID identifying the service and method being called, which
+// means that it is encoded on the wire exactly like a ServiceID.
+type RequestHeader struct {
+	ServiceID
+	// Deadline is the absolute time, in Unix nanoseconds, after
+	// which the client will not wait for a response anymore. Zero
+	// means no deadline.
+	Deadline int64
+	// ID identifies the request among those multiplexed on a
+	// stream. Zero means that requests on the stream are handled
+	// one after the other.
+	ID uint64
+	// Metadata holds the metadata sent along with the call (see
+	// WithMetadata).
+	Metadata Metadata
+	// Encrypted is set when the payload is encrypted (see
+	// WithPayloadEncryption).
+	Encrypted bool
+	// Checksummed is set when the payload carries a checksum (see
+	// WithPayloadChecksum).
+	Checksummed bool
+	// Critical is set for calls which must not be aborted once
+	// started, even if the deadline expires (see WithCritical).
+	Critical bool
+	// Stream is set when calling a streaming method, which must
+	// be the case for those methods only.
+	Stream bool
+	// RequestID identifies the logical operation that the call is
+	// part of, if set (see WithRequestID).
+	RequestID string
+	// Window is the number of items that the server may send in a
+	// streaming call before the client grants more credits. Zero
+	// means no flow control (see WithStreamWindow).
+	Window int
+	// Pipe is set when calling a pipe method, which must be the
+	// case for those methods only. The body follows the arguments.
+	Pipe bool
+	// Signature is the signature of the request by the caller, and
+	// SignerKey its marshalled public key (see WithRequestSigning).
+	// When set, the payload is sent as a byte string.
+	Signature []byte
+	SignerKey []byte
+	// Trace is set when the client asks for the timings of the call
+	// (see WithCallTrace).
+	Trace bool
+	// Codec names the codec used for the arguments and the reply, if
+	// not the default encoding (see WithCodec).
+	Codec string
+	// CancelReasons is set when the client reports why it aborts the
+	// call (see WithCancelReasons).
+	CancelReasons bool
+	// Cancel is only set in the header sent by the client, in place of
+	// a new request, to report why it aborted the call in progress.
+	Cancel *CancelError
+	// Cursor is set when resuming a streaming call, to the cursor of
+	// the last item received (see ServerStream.SendAt).
+	Cursor string
+	// SeqSession and Seq identify the command in a sequenced session
+	// (see SequencedSession).
+	SeqSession string
+	Seq        uint64
+	// FieldMask lists the fields of the reply needed by the client,
+	// if not all (see WithFieldMask).
+	FieldMask FieldMask
+}
+
 // Response is a header sent when responding to an RPC
 // request which includes any error that may have happened.
 type Response struct {
 	Service ServiceID
 	Error   string // error, if any.
+	// ServerError is set when Error is one of the errors of this
+	// package with a meaning of its own, such as ErrOverloaded,
+	// rather than an error returned by the method.
+	ServerError bool
+	// Compressed is set when the body following this header is
+	// a gzip-compressed blob holding the encoded reply.
+	Compressed bool
+	// ID is the ID of the request this responds to.
+	ID uint64
+	// Encrypted is set when the body following this header is
+	// encrypted (see WithPayloadEncryption).
+	Encrypted bool
+	// RequestID echoes the RequestID of the request.
+	RequestID string
+	// Checksummed is set when the body following this header
+	// carries a checksum (see WithPayloadChecksum).
+	Checksummed bool
+	// Trace holds the timings of the call, when requested.
+	Trace *ServerTrace
 }
 
 // Server is an LibP2P RPC server. It can register services which comply to the
@@ -98,33 +220,197 @@ type Server struct {
 	host     host.Host
 	protocol protocol.ID
 
-	mu         sync.RWMutex // protects the serviceMap
+	mu         sync.RWMutex // protects the serviceMap, lazy, disabled and fallback
 	serviceMap map[string]*service
+	lazy       map[string]*lazyService // see RegisterLazy
+	disabled   map[ServiceID]bool      // see SetMethodEnabled
+	fallback   FallbackFunc
+
+	inflight inFlight
+
+	parseRequest RequestParser
+
+	compress          bool
+	compressThreshold int
+	compressMethods   map[ServiceID]bool // see WithCompressionFor
+
+	shedLoad func() bool
+
+	policy Policy // for the main protocol
+
+	errLog errorSampler
+
+	serviceContexts map[string]ServiceContextFunc
+
+	validators map[ServiceID]ValidatorFunc
+
+	workers     *workerPool
+	queueLimits map[ServiceID]int // see WithMethodQueueLimit
+
+	streams limitCounter
+	running limitCounter // see WithMaxConcurrentCalls
+
+	goroutines peerGoroutines // see Goroutines
+
+	protocols    []protocol.ID // protected by mu
+	shuttingDown int32
+	paused       int32 // see Pause
+
+	keys     KeyProvider
+	checksum func() hash.Hash // see WithPayloadChecksum
+
+	hooks streamHooks
+
+	msgpackHandle  *codec.MsgpackHandle
+	strictDecoding *bool                // see WithStrictDecoding
+	payloadHandle  *codec.MsgpackHandle // for arguments, strict or not
+
+	streamKeepalive     time.Duration
+	streamFlushInterval time.Duration
+	slowConsumerTimeout time.Duration // see WithSlowConsumerTimeout
+
+	recorder *recorder
+
+	maxHeaderSize int64 // see WithMaxHeaderSize
+
+	requireSignatures bool
+
+	state interface{} // see WithState
+
+	codecs map[string]Codec // see WithCodec
+
+	decodeErrorHandler DecodeErrorHandler
+
+	memory *memoryBudget // see WithMemoryBudget
+
+	reflection bool // see WithReflection
+
+	noClockService bool // see WithClockService
+
+	streamServices map[protocol.ID]string // see WithStreamService
+
+	ready chan struct{} // see Ready
+
+	callStats callStatsHook // see WithCallStats
+
+	sequences *sequenceTracker // see WithSequencedSessions
 }
 
+// DefaultMaxHeaderSize is the default limit for the size of request
+// headers. See WithMaxHeaderSize.
+const DefaultMaxHeaderSize = 8 << 10
+
 // NewServer creates a Server object with the given LibP2P host
-// and protocol.
-func NewServer(h host.Host, p protocol.ID) *Server {
+// and protocol. The server behaviour can be customized with
+// the given options.
+func NewServer(h host.Host, p protocol.ID, opts ...ServerOption) *Server {
 	s := &Server{
-		host:     h,
-		protocol: p,
+		host:          h,
+		protocol:      p,
+		parseRequest:  defaultRequestParser,
+		maxHeaderSize: DefaultMaxHeaderSize,
+		ready:         make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.payloadHandle = strictHandle(s.msgpackHandle, s.strictDecoding)
+	if !s.noClockService {
+		s.RegisterName(clockServiceName, clockService{})
+	}
+	if s.reflection {
+		s.RegisterName(reflectionServiceName, &reflectionService{s})
 	}
 
 	if h != nil {
-		h.SetStreamHandler(p, func(stream inet.Stream) {
-			sWrap := wrapStream(stream)
-			defer stream.Close()
-			err := s.handle(sWrap)
-			if err != nil {
-				logger.Error("error handling RPC:", err)
-				resp := &Response{ServiceID{}, err.Error()}
-				sendResponse(sWrap, resp, nil)
-			}
-		})
+		s.setStreamHandler(p, s.streamHandler(s.policy))
+	}
+	if h == nil || len(h.Network().ListenAddresses()) > 0 {
+		close(s.ready)
+	} else {
+		go s.watchReady()
 	}
 	return s
 }
 
+// setStreamHandler sets the handler for a protocol and remembers it so
+// that it can be removed on Shutdown.
+func (server *Server) setStreamHandler(p protocol.ID, handler inet.StreamHandler) {
+	server.mu.Lock()
+	server.protocols = append(server.protocols, p)
+	server.mu.Unlock()
+	server.host.SetStreamHandler(p, handler)
+}
+
+// ServeProtocol makes the server handle requests for the given protocol
+// too, in addition to the one given to NewServer. Requests received on it
+// are subject to the given Policy instead of the one set with WithPolicy.
+// This allows, for example, to expose the same services to trusted peers
+// on an internal protocol and to anyone else on a restricted public one.
+// Clients choose which one to use with the protocol they are created with.
+func (server *Server) ServeProtocol(p protocol.ID, policy Policy) {
+	if server.host == nil {
+		return
+	}
+	server.setStreamHandler(p, server.streamHandler(policy))
+}
+
+// streamHandler returns a stream handler which handles the requests
+// with the given policy. Requests are handled one after the other until
+// the client closes the stream, which allows clients to reuse streams
+// (see WithStreamPool). Clients not doing so close the stream after the
+// first request.
+func (server *Server) streamHandler(policy Policy) inet.StreamHandler {
+	return func(stream inet.Stream) {
+		if err := setStreamService(stream, stream.Protocol(), server.streamServices); err != nil {
+			server.errLog.logError("error setting the stream service:", err)
+			stream.Reset()
+			return
+		}
+		if server.recorder != nil {
+			stream = server.recorder.wrap(stream)
+		}
+		sWrap := wrapStream(stream, server.msgpackHandle)
+		sWrap.usePayloadHandle(server.payloadHandle)
+		if server.maxHeaderSize > 0 || server.memory != nil {
+			sWrap.enableReadLimits()
+		}
+		defer stream.Close()
+		if !server.streams.acquire() {
+			server.rejectStream(sWrap, ErrTooManyStreams)
+			return
+		}
+		defer server.streams.release()
+
+		id := server.hooks.opened(stream)
+		err := server.handleRequests(sWrap, &policy)
+		// Let multiplexed requests finish before closing.
+		sWrap.pending.Wait()
+		server.hooks.closed(stream, id, err)
+	}
+}
+
+// handleRequests handles the requests on a stream until the client closes
+// it or an error happens, which is returned.
+func (server *Server) handleRequests(s *streamWrap, policy *Policy) error {
+	for {
+		err := server.handle(s, policy)
+		if err == io.EOF {
+			// The stream was closed before sending
+			// a new request.
+			return nil
+		}
+		if err != nil {
+			// The stream cannot be trusted anymore.
+			server.errLog.logError("error handling RPC:", err)
+			resp := &Response{Error: err.Error(), ServerError: isWireError(err)}
+			server.sendResponse(s, resp, nil)
+			return err
+		}
+	}
+}
+
 // ID returns the peer.ID of the host associated with this server.
 func (server *Server) ID() peer.ID {
 	if server.host == nil {
@@ -133,24 +419,342 @@ func (server *Server) ID() peer.ID {
 	return server.host.ID()
 }
 
-func (server *Server) handle(s *streamWrap) error {
-	logger.Debugf("%s: handling remote RPC", server.host.ID().Pretty())
-	var svcID ServiceID
-	var argv, replyv reflect.Value
-
-	err := s.dec.Decode(&svcID)
+func (server *Server) handle(s *streamWrap, policy *Policy) error {
+	logger.Debugf("%s: handling remote RPC", server.ID().Pretty())
+	header, err := server.nextHeader(s)
 	if err != nil {
 		return err
 	}
+	received := time.Now()
+	if header.Cancel != nil {
+		// The client aborted a call which had finished already
+		// and will not send anything else.
+		return io.EOF
+	}
 
-	logger.Debugf("RPC ServiceID is %s.%s", svcID.Name, svcID.Method)
+	remote := s.stream.Conn().RemotePeer()
+	svcID, err := server.admit(remote, header, policy)
+	if err != nil {
+		return server.reject(s, header, svcID, err)
+	}
+
+	logger.Debugf("%sRPC ServiceID is %s.%s", requestLogPrefix(header.RequestID),
+		svcID.Name, svcID.Method)
 
 	service, mtype, err := server.getService(svcID)
+	if err != nil && err != ErrMethodDisabled {
+		if fs, fm := server.fallbackMethod(header, svcID); fm != nil {
+			service, mtype, err = fs, fm, nil
+		}
+	}
+	if err != nil {
+		return server.reject(s, header, svcID, err)
+	}
+	if mtype.streaming != header.Stream || (header.Stream && header.ID != 0) {
+		err := fmt.Errorf("rpc: %s.%s called with the wrong streaming mode",
+			svcID.Name, svcID.Method)
+		return server.reject(s, header, svcID, err)
+	}
+	if mtype.pipe != header.Pipe || (header.Pipe && (header.ID != 0 || header.Stream)) {
+		err := fmt.Errorf("rpc: %s.%s called with the wrong pipe mode",
+			svcID.Name, svcID.Method)
+		return server.reject(s, header, svcID, err)
+	}
+	payloadCodec, err := server.codecFor(header.Codec)
+	if err == nil && payloadCodec != nil && (mtype.streaming || mtype.pipe) {
+		err = errors.New("rpc: codecs are not supported by streaming and pipe methods")
+	}
+	if err != nil {
+		return server.reject(s, header, svcID, err)
+	}
+
+	sl, err := server.requestSealer(remote, header)
+	if err != nil {
+		return server.reject(s, header, svcID, err)
+	}
+	if header.Pipe && sl.encrypts() {
+		return server.reject(s, header, svcID, errNoPipeEncryption)
+	}
+	if header.Pipe && sl.checksums() {
+		return server.reject(s, header, svcID, errNoPipeChecksum)
+	}
+	if header.Signature == nil && server.requireSignatures {
+		return server.reject(s, header, svcID, ErrBadSignature)
+	}
+	argsStart := s.bytesDecoded()
+	var signed *SignedRequest
+	if header.Signature != nil {
+		signed, err = server.readSigned(s, remote, header)
+		if err == ErrBadSignature {
+			return server.respondError(s, header, svcID, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	ad := additionalData(adRequest, header.ServiceID)
+	decode := func(v interface{}) error {
+		if signed != nil {
+			return unmarshalPayload(server.payloadHandle, sl, signed.Payload, v, ad)
+		}
+		return sl.decode(s.payloadDecoder(), v, ad)
+	}
+	argv, err := decodeArgs(mtype, func(v interface{}) error {
+		if mtype.rawArgs && payloadCodec != nil {
+			// The payload is kept as encoded by the codec.
+			return decode((*[]byte)(v.(*codec.Raw)))
+		}
+		return decodeWith(payloadCodec, decode, v)
+	})
 	if err != nil {
+		if server.decodeErrorHandler != nil {
+			err = server.decodeErrorHandler(header, err)
+		}
 		return err
 	}
+	// The memory used by the arguments is charged while the call is
+	// handled.
+	var charged int64
+	if server.memory != nil {
+		charged = s.bytesDecoded() - argsStart
+		if !server.memory.admit(charged) {
+			return server.respondError(s, header, svcID, ErrOverloaded)
+		}
+	}
 
-	// Decode the argument value.
+	ctx, cancel := callContext(remote, header)
+	if svcID.Name == clockServiceName {
+		ctx = context.WithValue(ctx, receivedKey, received)
+	}
+	var trace *ServerTrace
+	if header.Trace {
+		trace = &ServerTrace{Decode: time.Since(received), decoded: time.Now()}
+		ctx = context.WithValue(ctx, traceKey, trace)
+	}
+	if server.memory != nil {
+		// Calls cancel their context once handled.
+		cancelCtx := cancel
+		cancel = func() {
+			cancelCtx()
+			server.memory.release(charged)
+		}
+	}
+	if header.CancelReasons && header.ID == 0 && !mtype.streaming && !mtype.pipe {
+		var cancelCause context.CancelCauseFunc
+		ctx, cancelCause = context.WithCancelCause(ctx)
+		server.watchCancel(s, cancelCause)
+	}
+	if signed != nil {
+		ctx = context.WithValue(ctx, signedRequestKey, signed)
+	}
+
+	// Call service and respond
+	info := CallInfo{
+		Peer:      remote,
+		Service:   svcID.Name,
+		Method:    svcID.Method,
+		Start:     time.Now(),
+		RequestID: header.RequestID,
+	}
+	if mtype.streaming {
+		defer cancel()
+		// The method is told when the client goes away.
+		var abandon context.CancelCauseFunc
+		ctx, abandon = context.WithCancelCause(ctx)
+		stream := &ServerStream{
+			sw:     s,
+			sealer: sl,
+			svcID:  header.ServiceID,
+			ctx:    ctx,
+
+			flushInterval: server.streamFlushInterval,
+			slowTimeout:   server.slowConsumerTimeout,
+			cursor:        header.Cursor,
+		}
+		if header.Window > 0 {
+			stream.startFlowControl(header.Window, abandon)
+		} else {
+			go stream.watchClient(abandon)
+		}
+		return server.handleStream(ctx, stream, info, policy, service, mtype, argv)
+	}
+	if mtype.pipe {
+		defer cancel()
+		return server.handlePipe(ctx, s, header, svcID, info, policy, service, mtype, argv)
+	}
+
+	var seq *sequenceTag
+	if header.SeqSession != "" {
+		seq = &sequenceTag{header.SeqSession, header.Seq}
+	}
+	run := func() error {
+		defer cancel()
+		replyv := reflect.New(mtype.ReplyType.Elem())
+		err := server.dispatchSequenced(ctx, seq, info, policy, service, mtype, argv, replyv)
+		resp := &Response{Service: svcID, ID: header.ID, RequestID: header.RequestID}
+		if err != nil {
+			resp.Error = err.Error()
+			resp.ServerError = isWireError(err)
+		}
+		resp.Trace = trace
+		body := replyv.Interface()
+		stampSent(svcID, body)
+		if payloadCodec != nil {
+			payload, err := payloadCodec.Marshal(body)
+			if err != nil {
+				return err
+			}
+			body = payload
+		}
+		if sl != nil {
+			sealed, err := sl.seal(body, responseAD(header.ServiceID, header.ID, resp.Error))
+			if err != nil {
+				return err
+			}
+			resp.Encrypted = sl.encrypts()
+			resp.Checksummed = sl.checksums()
+			body = sealed
+		}
+		if server.memory != nil {
+			// Encode the reply beforehand to charge for it.
+			encoded, err := marshalPayload(server.msgpackHandle, nil, body, nil)
+			if err != nil {
+				return err
+			}
+			server.memory.charge(int64(len(encoded)))
+			defer server.memory.release(int64(len(encoded)))
+			body = encodedBody(encoded)
+		}
+		return server.sendResponse(s, resp, body)
+	}
+	if header.ID == 0 {
+		return run()
+	}
+
+	// Requests with an ID are multiplexed on the stream (see
+	// Client.Session), so they run concurrently and the response is
+	// sent whenever it is ready.
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		if err := run(); err != nil {
+			s.stream.Reset()
+		}
+	}()
+	return nil
+}
+
+// readHeader reads a request header from the stream, within the limit
+// set with WithMaxHeaderSize.
+func (server *Server) readHeader(s *streamWrap) (RequestHeader, error) {
+	var header RequestHeader
+	s.limitReads(server.maxHeaderSize)
+	err := s.dec.Decode(&header)
+	if s.limitReads(0) {
+		return header, ErrHeaderTooLarge
+	}
+	return header, err
+}
+
+// reject responds to a request with the given error without calling any
+// method. The arguments are read and discarded, so that further requests
+// can be read from the stream.
+func (server *Server) reject(s *streamWrap, header RequestHeader, svcID ServiceID, err error) error {
+	var discard interface{}
+	if derr := s.dec.Decode(&discard); derr != nil {
+		server.errLog.logError(requestLogPrefix(header.RequestID)+"error handling RPC:", err)
+		return derr
+	}
+	return server.respondError(s, header, svcID, err)
+}
+
+// respondError responds to a request, whose arguments have been read
+// already, with the given error without calling any method. The response
+// is sealed whenever the server can seal it, so that the client can trust
+// the error.
+func (server *Server) respondError(s *streamWrap, header RequestHeader, svcID ServiceID, err error) error {
+	server.errLog.logError(requestLogPrefix(header.RequestID)+"error handling RPC:", err)
+
+	var sl *sealer
+	if !header.Pipe { // pipe calls are never sealed
+		sl, _ = server.requestSealer(s.stream.Conn().RemotePeer(), header)
+	}
+	if header.Stream {
+		// Streaming calls are answered with a trailer.
+		stream := &ServerStream{sw: s, sealer: sl, svcID: header.ServiceID}
+		if err := stream.close(err); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+
+	resp := &Response{
+		Service:     svcID,
+		ID:          header.ID,
+		RequestID:   header.RequestID,
+		Error:       err.Error(),
+		ServerError: isWireError(err),
+	}
+	var body interface{}
+	if sl != nil {
+		sealed, err := sl.seal(nil, responseAD(header.ServiceID, header.ID, resp.Error))
+		if err != nil {
+			return err
+		}
+		resp.Encrypted = sl.encrypts()
+		resp.Checksummed = sl.checksums()
+		body = sealed
+	}
+	if err := server.sendResponse(s, resp, body); err != nil {
+		return err
+	}
+	if header.Pipe {
+		// The body may follow, which is not read.
+		return io.EOF
+	}
+	return nil
+}
+
+// rejectStream responds to the first request on a stream with the given
+// error. The stream is not used any further.
+func (server *Server) rejectStream(s *streamWrap, err error) {
+	var header RequestHeader
+	if derr := s.dec.Decode(&header); derr != nil {
+		return
+	}
+	server.reject(s, header, header.ServiceID, err)
+}
+
+// admit figures out the service and method for a request with the given
+// header and checks that the remote peer can call it.
+func (server *Server) admit(remote peer.ID, header RequestHeader, policy *Policy) (ServiceID, error) {
+	name, method, err := server.parseRequest(header)
+	if err != nil {
+		return ServiceID{}, err
+	}
+	svcID := ServiceID{name, method}
+
+	if server.isShuttingDown() {
+		return svcID, ErrShuttingDown
+	}
+	if server.Paused() {
+		return svcID, ErrPaused
+	}
+
+	if !policy.authorize(remote, svcID) {
+		return svcID, ErrUnauthorized
+	}
+
+	if server.shedLoad != nil && server.shedLoad() {
+		return svcID, ErrOverloaded
+	}
+	return svcID, nil
+}
+
+// decodeArgs uses the given decode function to obtain the argument
+// value for a method.
+func decodeArgs(mtype *methodType, decode func(interface{}) error) (reflect.Value, error) {
+	var argv reflect.Value
 	argIsValue := false // if true, need to indirect before calling.
 	if mtype.ArgType.Kind() == reflect.Ptr {
 		argv = reflect.New(mtype.ArgType.Elem())
@@ -159,42 +763,190 @@ func (server *Server) handle(s *streamWrap) error {
 		argIsValue = true
 	}
 	// argv guaranteed to be a pointer now.
-	if err = s.dec.Decode(argv.Interface()); err != nil {
-		return err
+	if err := decode(argv.Interface()); err != nil {
+		return argv, err
 	}
 	if argIsValue {
 		argv = argv.Elem()
 	}
+	return argv, nil
+}
 
-	replyv = reflect.New(mtype.ReplyType.Elem())
+// dispatch invokes the method through the policy interceptors and keeps
+// track of it while it runs.
+func (server *Server) dispatch(ctx context.Context, info CallInfo, policy *Policy, service *service, mtype *methodType, argv, replyv reflect.Value) error {
+	// Do not start work that the client has given up on already.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := server.validate(service, mtype, argv); err != nil {
+		return err
+	}
+	// Re-entrant calls run in the goroutine of their caller.
+	if !within(ctx, server, nil) {
+		if !server.goroutines.acquire(info.Peer) {
+			return ErrOverloaded
+		}
+		defer server.goroutines.release(info.Peer)
+	}
 
-	// Call service and respond
-	return service.svcCall(s, mtype, svcID, argv, replyv)
+	id := server.inflight.add(info)
+	defer server.inflight.remove(id)
+
+	ctx = withCallLogger(ctx, info)
+	if server.state != nil {
+		ctx = context.WithValue(ctx, stateKey, server.state)
+	}
+	err := policy.intercept(ctx, info, func(ctx context.Context) error {
+		return server.call(ctx, service, mtype, argv, replyv)
+	})
+	server.callStats.record(info, err)
+	return err
 }
 
-// svcCall calls the actual method associated
-func (s *service) svcCall(sWrap *streamWrap, mtype *methodType, svcID ServiceID, argv, replyv reflect.Value) error {
+// validate runs the validator set for the method, if any, with the given
+// arguments.
+func (server *Server) validate(service *service, mtype *methodType, argv reflect.Value) error {
+	validator, ok := server.validators[ServiceID{service.name, mtype.method.Name}]
+	if !ok {
+		return nil
+	}
+	if err := validator(argv.Interface()); err != nil {
+		return fmt.Errorf("rpc: invalid arguments for %s.%s: %s",
+			service.name, mtype.method.Name, err)
+	}
+	return nil
+}
+
+// call invokes the method within the context set up for its
+// service, if any. Calls beyond the limit set with WithMaxConcurrentCalls
+// fail with ErrOverloaded. Calls to serial services wait for their turn
+// first (see RegisterSerial). Re-entrant calls skip all of that (see
+// NewClientWithServer), since they would deadlock otherwise.
+func (server *Server) call(ctx context.Context, service *service, mtype *methodType, argv, replyv reflect.Value) error {
+	reentrant := within(ctx, server, nil)
+	if service.serial != nil && !within(ctx, server, service) {
+		select {
+		case service.serial <- struct{}{}:
+			defer func() { <-service.serial }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if !reentrant {
+		if !server.running.acquire() {
+			return ErrOverloaded
+		}
+		defer server.running.release()
+	}
+	ctx = enterHandler(ctx, server, service)
+
+	if setup, ok := server.serviceContexts[service.name]; ok {
+		svcCtx, cleanup, err := setup(ctx)
+		if err != nil {
+			return err
+		}
+		if cleanup != nil {
+			defer cleanup()
+		}
+		ctx = svcCtx
+	}
+	if server.workers == nil || reentrant {
+		return traced(ctx, func() error {
+			return service.call(ctx, mtype, argv, replyv)
+		})
+	}
+
+	var err error
+	svcID := ServiceID{service.name, mtype.method.Name}
+	werr := server.workers.run(ctx, svcID, server.queueLimits[svcID], func() {
+		err = traced(ctx, func() error {
+			return service.call(ctx, mtype, argv, replyv)
+		})
+	})
+	if werr != nil {
+		return werr
+	}
+	return err
+}
+
+// requestHeader returns the header for a request to the given service
+// performed with the given context, which carries its deadline and
+// metadata, if any.
+func requestHeader(ctx context.Context, svcID ServiceID) RequestHeader {
+	header := RequestHeader{
+		ServiceID: svcID,
+		Metadata:  outgoingMetadata(ctx),
+		RequestID: RequestIDFromContext(ctx),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		header.Deadline = deadline.UnixNano()
+	}
+	return header
+}
+
+// callContext returns the context for a call from the given peer with the
+// given header, which carries the deadline set by the client, if any. The
+// context of critical calls only expires if the deadline has passed
+// already, so that they are not started.
+func callContext(remote peer.ID, header RequestHeader) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), callerKey, remote)
+	if len(header.Metadata) > 0 {
+		ctx = context.WithValue(ctx, metadataKey, header.Metadata)
+	}
+	if header.RequestID != "" {
+		ctx = WithRequestID(ctx, header.RequestID)
+	}
+	if header.FieldMask != nil {
+		ctx = context.WithValue(ctx, fieldMaskKey, header.FieldMask)
+	}
+	if header.Deadline == 0 {
+		return context.WithCancel(ctx)
+	}
+	deadline := time.Unix(0, header.Deadline)
+	ctx = context.WithValue(ctx, deadlineKey, deadline)
+	if header.Critical && time.Now().Before(deadline) {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// call invokes the method with the given arguments and returns
+// its error.
+func (s *service) call(ctx context.Context, mtype *methodType, argv, replyv reflect.Value) error {
+	if mtype.fn != nil {
+		return mtype.fn(ctx, argv, replyv)
+	}
 	function := mtype.method.Func
 	// Invoke the method, providing a new value for the reply.
-	returnValues := function.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	if mtype.hasContext {
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+	returnValues := function.Call(in)
 	// The return value for the method is an error.
 	errInter := returnValues[0].Interface()
-	errmsg := ""
 	if errInter != nil {
-		errmsg = errInter.(error).Error()
+		return errInter.(error)
 	}
-	resp := &Response{svcID, errmsg}
-
-	return sendResponse(sWrap, resp, replyv.Interface())
+	return nil
 }
 
-func sendResponse(s *streamWrap, resp *Response, body interface{}) error {
+func (server *Server) sendResponse(s *streamWrap, resp *Response, body interface{}) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	// Sealed bodies cannot be compressed.
+	if server.compresses(resp.Service) && !resp.Encrypted && !resp.Checksummed {
+		return server.sendCompressedResponse(s, resp, body)
+	}
+
 	if err := s.enc.Encode(resp); err != nil {
-		logger.Error("error encoding response:", err)
+		server.errLog.logError("error encoding response:", err)
 		return err
 	}
-	if err := s.enc.Encode(body); err != nil {
-		logger.Error("error encoding body:", err)
+	if err := s.writeBody(body); err != nil {
+		server.errLog.logError("error encoding body:", err)
 		return err
 	}
 	if err := s.w.Flush(); err != nil {
@@ -204,20 +956,103 @@ func sendResponse(s *streamWrap, resp *Response, body interface{}) error {
 	return nil
 }
 
+// compresses reports whether replies of the given method are compressed.
+func (server *Server) compresses(svcID ServiceID) bool {
+	return server.compress && (server.compressMethods == nil || server.compressMethods[svcID])
+}
+
+// sendCompressedResponse encodes the body first and compresses it
+// when its size is above the configured threshold.
+func (server *Server) sendCompressedResponse(s *streamWrap, resp *Response, body interface{}) error {
+	encBody, ok := body.(encodedBody)
+	if !ok {
+		var buf bytes.Buffer
+		if err := newEncoder(server.msgpackHandle, &buf).Encode(body); err != nil {
+			server.errLog.logError("error encoding body:", err)
+			return err
+		}
+		encBody = buf.Bytes()
+	}
+	if len(encBody) > server.compressThreshold {
+		compressed, err := compress(encBody)
+		if err != nil {
+			server.errLog.logError("error compressing body:", err)
+			return err
+		}
+		resp.Compressed = true
+		if err := s.enc.Encode(resp); err != nil {
+			server.errLog.logError("error encoding response:", err)
+			return err
+		}
+		if err := s.enc.Encode(compressed); err != nil {
+			server.errLog.logError("error encoding body:", err)
+			return err
+		}
+	} else {
+		if err := s.enc.Encode(resp); err != nil {
+			server.errLog.logError("error encoding response:", err)
+			return err
+		}
+		// The encoded body can be written as is.
+		if _, err := s.w.Write(encBody); err != nil {
+			server.errLog.logError("error writing body:", err)
+			return err
+		}
+	}
+
+	if err := s.w.Flush(); err != nil {
+		logger.Debug("error flushing response:", err)
+		return err
+	}
+	return nil
+}
+
 // Call allows a server to process a Call directly and act like a client
 // to itself. This is mostly useful because LibP2P does not allow to
 // create streams between a server and a client which share the same
 // host. See NewClientWithServer() for more info.
+//
+// Local calls go through the same steps as remote ones, except for the
+// encoding of the arguments and the reply: the request parser, the
+// Policy given to NewServer, the load shedder, validators, deadlines and
+// limits all apply. The caller is the server's own peer ID.
 func (server *Server) Call(call *Call) error {
 	var argv, replyv reflect.Value
-	service, mtype, err := server.getService(call.SvcID)
+
+	ctx := call.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	header := requestHeader(ctx, call.SvcID)
+	svcID, err := server.admit(server.ID(), header, &server.policy)
+	if err != nil {
+		return err
+	}
+
+	service, mtype, err := server.getService(svcID)
 	if err != nil {
 		return err
 	}
+	if mtype.streaming {
+		return fmt.Errorf("%s.%s is a streaming method",
+			call.SvcID.Name, call.SvcID.Method)
+	}
+	if mtype.pipe {
+		return fmt.Errorf("%s.%s is a pipe method",
+			call.SvcID.Name, call.SvcID.Method)
+	}
 
 	// Decode the argument value.
 	argIsValue := false // if true, need to indirect before calling.
-	if mtype.ArgType.Kind() == reflect.Ptr {
+	if call.Args == nil {
+		// The method gets the zero value.
+		if mtype.ArgType.Kind() == reflect.Ptr {
+			argv = reflect.New(mtype.ArgType.Elem())
+		} else {
+			argv = reflect.New(mtype.ArgType)
+			argIsValue = true
+		}
+	} else if mtype.ArgType.Kind() == reflect.Ptr {
 		if reflect.TypeOf(call.Args).Kind() != reflect.Ptr {
 			return fmt.Errorf(
 				"%s.%s is being called with the wrong arg type",
@@ -243,30 +1078,61 @@ func (server *Server) Call(call *Call) error {
 
 	replyv = reflect.New(mtype.ReplyType.Elem())
 
-	// Call service and respond
-	function := mtype.method.Func
-	// Invoke the method, providing a new value for the reply.
-	returnValues := function.Call([]reflect.Value{
-		service.rcvr,
-		argv,
-		replyv})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if call.opts.critical {
+		ctx = context.WithoutCancel(ctx)
+	}
+	if md := outgoingMetadata(ctx); len(md) > 0 {
+		ctx = context.WithValue(ctx, metadataKey, md)
+	}
+	ctx = context.WithValue(ctx, callerKey, server.ID())
+	if call.opts.fieldMask != nil {
+		ctx = context.WithValue(ctx, fieldMaskKey, call.opts.fieldMask)
+	}
 
-	creplyv := reflect.ValueOf(call.Reply)
-	creplyv.Elem().Set(replyv.Elem())
+	// Call service and respond
+	info := CallInfo{
+		Peer:      server.ID(),
+		Service:   svcID.Name,
+		Method:    svcID.Method,
+		Start:     time.Now(),
+		RequestID: header.RequestID,
+	}
+	err = server.dispatch(ctx, info, &server.policy, service, mtype, argv, replyv)
 
-	// The return value for the method is an error.
-	errInter := returnValues[0].Interface()
-	if errInter != nil {
-		return errInter.(error)
+	if call.Reply != nil {
+		creplyv := reflect.ValueOf(call.Reply).Elem()
+		if !replyv.Elem().Type().AssignableTo(creplyv.Type()) {
+			return fmt.Errorf("rpc: a reply of type %T cannot hold the %s replied by %s.%s",
+				call.Reply, replyv.Elem().Type(), svcID.Name, svcID.Method)
+		}
+		creplyv.Set(replyv.Elem())
 	}
-	return nil
+	return err
+}
+
+// InFlight returns a snapshot of the calls which are currently being
+// executed by this server, oldest first. It includes both remote calls
+// and local calls made through Call().
+func (server *Server) InFlight() []CallInfo {
+	return server.inflight.snapshot()
 }
 
 func (server *Server) getService(id ServiceID) (*service, *methodType, error) {
 	// Look up the request.
 	server.mu.RLock()
 	service := server.serviceMap[id.Name]
+	disabled := server.disabled[id]
 	server.mu.RUnlock()
+	if service == nil {
+		var err error
+		service, err = server.buildLazy(id.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	if service == nil {
 		err := errors.New("rpc: can't find service " + id.Name)
 		return nil, nil, err
@@ -276,6 +1142,9 @@ func (server *Server) getService(id ServiceID) (*service, *methodType, error) {
 		err := errors.New("rpc: can't find method " + id.Method)
 		return nil, nil, err
 	}
+	if disabled {
+		return nil, nil, ErrMethodDisabled
+	}
 	return service, mtype, nil
 }
 
@@ -302,29 +1171,56 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 // Register publishes in the server the set of methods of the
 // receiver value that satisfy the following conditions:
 //	- exported method of exported type
-//	- two arguments, both of exported type
-//	- the second argument is a pointer
+//	- two arguments, both of exported type, optionally preceded
+//	  by a context.Context
+//	- the last argument is a pointer
 //	- one return value, of type error
 // It returns an error if the receiver is not an exported type or has
 // no suitable methods. It also logs the error using package log.
 // The client accesses each method using a string of the form "Type.Method",
 // where Type is the receiver's concrete type.
 func (server *Server) Register(rcvr interface{}) error {
-	return server.register(rcvr, "", false)
+	return server.register(rcvr, "", false, false)
 }
 
 // RegisterName is like Register but uses the provided name for the type
 // instead of the receiver's concrete type.
 func (server *Server) RegisterName(name string, rcvr interface{}) error {
-	return server.register(rcvr, name, true)
+	return server.register(rcvr, name, true, false)
 }
 
-func (server *Server) register(rcvr interface{}, name string, useName bool) error {
+// RegisterSerial is like RegisterName but the server runs at most one call
+// to the methods of the service at a time, which protects receivers which
+// are not safe for concurrent use. Other calls to the service wait for
+// their turn, or until their context is done, so its throughput drops to
+// what a single call at a time achieves, and slow calls delay all the
+// others. Calls to other services are not affected.
+func (server *Server) RegisterSerial(name string, rcvr interface{}) error {
+	return server.register(rcvr, name, true, true)
+}
+
+func (server *Server) register(rcvr interface{}, name string, useName, serial bool) error {
+	s, err := newService(rcvr, name, useName, serial)
+	if err != nil {
+		return err
+	}
 	server.mu.Lock()
 	defer server.mu.Unlock()
 	if server.serviceMap == nil {
 		server.serviceMap = make(map[string]*service)
 	}
+	if _, present := server.serviceMap[s.name]; present {
+		return errors.New("rpc: service already defined: " + s.name)
+	}
+	if _, present := server.lazy[s.name]; present {
+		return errors.New("rpc: service already defined: " + s.name)
+	}
+	server.serviceMap[s.name] = s
+	return nil
+}
+
+// newService returns the service for the given receiver.
+func newService(rcvr interface{}, name string, useName, serial bool) (*service, error) {
 	s := new(service)
 	s.typ = reflect.TypeOf(rcvr)
 	s.rcvr = reflect.ValueOf(rcvr)
@@ -335,17 +1231,17 @@ func (server *Server) register(rcvr interface{}, name string, useName bool) erro
 	if sname == "" {
 		s := "rpc.Register: no service name for type " + s.typ.String()
 		log.Print(s)
-		return errors.New(s)
+		return nil, errors.New(s)
 	}
 	if !isExported(sname) && !useName {
 		s := "rpc.Register: type " + sname + " is not exported"
 		log.Print(s)
-		return errors.New(s)
-	}
-	if _, present := server.serviceMap[sname]; present {
-		return errors.New("rpc: service already defined: " + sname)
+		return nil, errors.New(s)
 	}
 	s.name = sname
+	if serial {
+		s.serial = make(chan struct{}, 1)
+	}
 
 	// Install the methods
 	s.method = suitableMethods(s.typ, true)
@@ -361,10 +1257,9 @@ func (server *Server) register(rcvr interface{}, name string, useName bool) erro
 			str = "rpc.Register: type " + sname + " has no exported methods of suitable type"
 		}
 		log.Print(str)
-		return errors.New(str)
+		return nil, errors.New(str)
 	}
-	server.serviceMap[s.name] = s
-	return nil
+	return s, nil
 }
 
 // suitableMethods returns suitable Rpc methods of typ, it will report
@@ -379,23 +1274,35 @@ func suitableMethods(typ reflect.Type, reportErr bool) map[string]*methodType {
 		if method.PkgPath != "" {
 			continue
 		}
-		// Method needs three ins: receiver, *args, *reply.
-		if mtype.NumIn() != 3 {
+		// Method needs three ins: receiver, *args, *reply, plus
+		// an optional context before *args.
+		if mtype.NumIn() != 3 && mtype.NumIn() != 4 {
 			if reportErr {
 				log.Println("method", mname, "has wrong number of ins:", mtype.NumIn())
 			}
 			continue
 		}
-		// First arg need not be a pointer.
-		argType := mtype.In(1)
+		hasContext := mtype.NumIn() == 4
+		firstArg := 1
+		if hasContext {
+			if ctxType := mtype.In(1); ctxType != typeOfContext {
+				if reportErr {
+					log.Println("method", mname, "first argument is", ctxType, "not context.Context")
+				}
+				continue
+			}
+			firstArg = 2
+		}
+		// Args need not be a pointer.
+		argType := mtype.In(firstArg)
 		if !isExportedOrBuiltinType(argType) {
 			if reportErr {
 				log.Println(mname, "argument type not exported:", argType)
 			}
 			continue
 		}
-		// Second arg must be a pointer.
-		replyType := mtype.In(2)
+		// Reply must be a pointer.
+		replyType := mtype.In(firstArg + 1)
 		if replyType.Kind() != reflect.Ptr {
 			if reportErr {
 				log.Println("method", mname, "reply type not a pointer:", replyType)
@@ -423,7 +1330,14 @@ func suitableMethods(typ reflect.Type, reportErr bool) map[string]*methodType {
 			}
 			continue
 		}
-		methods[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType}
+		methods[mname] = &methodType{
+			method:     method,
+			ArgType:    argType,
+			ReplyType:  replyType,
+			hasContext: hasContext,
+			streaming:  replyType == typeOfServerStream,
+			pipe:       replyType == typeOfPipe,
+		}
 	}
 	return methods
 }
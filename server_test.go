@@ -1,19 +1,40 @@
 package rpc
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	logging "github.com/ipfs/go-log"
 	crypto "github.com/libp2p/go-libp2p-crypto"
 	host "github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
 	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	protocol "github.com/libp2p/go-libp2p-protocol"
 	swarm "github.com/libp2p/go-libp2p-swarm"
 	basic "github.com/libp2p/go-libp2p/p2p/host/basic"
 	multiaddr "github.com/multiformats/go-multiaddr"
+	codec "github.com/ugorji/go/codec"
 )
 
 func init() {
@@ -169,7 +190,7 @@ func TestLocal(t *testing.T) {
 	s.Register(&arith)
 
 	var r int
-	err := c.Call("", "Arith", "Multiply", &Args{2, 3}, &r)
+	err := c.CallLocal("Arith", "Multiply", &Args{2, 3}, &r)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -178,7 +199,7 @@ func TestLocal(t *testing.T) {
 	}
 
 	var a int
-	err = c.Call("", "Arith", "Add", Args{2, 3}, &a)
+	err = c.CallLocal("Arith", "Add", Args{2, 3}, &a)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -186,6 +207,16 @@ func TestLocal(t *testing.T) {
 		t.Error("result is:", a)
 	}
 
+	// The empty peer ID means the local server only when asked to.
+	if err := c.Call("", "Arith", "Add", Args{2, 3}, &a); err != ErrEmptyPeerID {
+		t.Error("expected ErrEmptyPeerID:", err)
+	}
+	legacy := NewClientWithServer(h1, "rpc", s, WithEmptyPeerIDLocal())
+	a = 0
+	if err := legacy.Call("", "Arith", "Add", Args{2, 3}, &a); err != nil || a != 5 {
+		t.Error("expected a local call:", a, err)
+	}
+
 	var q Quotient
 	err = c.Call(h1.ID(), "Arith", "Divide", &Args{20, 6}, &q)
 	if err != nil {
@@ -226,3 +257,5140 @@ func TestErrorResponse(t *testing.T) {
 		t.Error("response should be set even on error")
 	}
 }
+
+type Blocker struct {
+	release chan struct{}
+}
+
+func (b *Blocker) Wait(args int, reply *int) error {
+	<-b.release
+	*reply = args
+	return nil
+}
+
+func TestInFlight(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClient(h2, "rpc")
+	b := &Blocker{release: make(chan struct{})}
+	s.Register(b)
+
+	var r int
+	done := make(chan *Call, 1)
+	c.Go(h1.ID(), "Blocker", "Wait", 3, &r, done)
+
+	waitFor := func(f func() bool) {
+		for i := 0; i < 100; i++ {
+			if f() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("timed out waiting for condition")
+	}
+
+	waitFor(func() bool { return len(s.InFlight()) == 1 })
+	info := s.InFlight()[0]
+	if info.Peer != h2.ID() || info.Service != "Blocker" || info.Method != "Wait" {
+		t.Errorf("unexpected server call info: %+v", info)
+	}
+	if info.Start.IsZero() {
+		t.Error("start time should be set")
+	}
+
+	cinfo := c.InFlight()
+	if len(cinfo) != 1 || cinfo[0].Peer != h1.ID() {
+		t.Errorf("unexpected client call info: %+v", cinfo)
+	}
+
+	close(b.release)
+	call := <-done
+	if call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	waitFor(func() bool { return len(s.InFlight()) == 0 && len(c.InFlight()) == 0 })
+}
+
+func TestRequestParser(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	parser := func(header RequestHeader) (string, string, error) {
+		if header.Name == "Legacy" {
+			return "Arith", header.Method, nil
+		}
+		if header.Name == "Forbidden" {
+			return "", "", errors.New("forbidden")
+		}
+		return header.Name, header.Method, nil
+	}
+
+	s := NewServer(h1, "rpc", WithRequestParser(parser))
+	c := NewClient(h2, "rpc")
+	var arith Arith
+	s.Register(&arith)
+
+	var r int
+	err := c.Call(h1.ID(), "Legacy", "Multiply", &Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+
+	err = c.Call(h1.ID(), "Forbidden", "Multiply", &Args{2, 3}, &r)
+	if err == nil || err.Error() != "forbidden" {
+		t.Error("expected parser error:", err)
+	}
+}
+
+type Echo struct{}
+
+func (e *Echo) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func TestCompression(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithCompression(100))
+	var rec bytes.Buffer
+	c := NewClient(h2, "rpc", WithClientRecorder(&rec))
+	s.Register(&Echo{})
+
+	sizes := []int{10, 10000}
+	for _, size := range sizes {
+		msg := strings.Repeat("a", size)
+		var r string
+		err := c.Call(h1.ID(), "Echo", "Echo", msg, &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != msg {
+			t.Errorf("bad reply for size %d", size)
+		}
+	}
+
+	// Only the reply above the threshold is compressed on the wire.
+	streams, err := ReadRecording(&rec)
+	if err != nil || len(streams) != len(sizes) {
+		t.Fatal("unexpected recording:", len(streams), err)
+	}
+	for i, size := range sizes {
+		req, err := NewFrameReader(bytes.NewReader(streams[i].Out), FromClient).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr := NewFrameReader(bytes.NewReader(streams[i].In), FromServer)
+		sr.Answer(*req.Request)
+		f, err := sr.Next()
+		if err != nil || f.Kind != ResponseFrame {
+			t.Fatal("expected a response:", f.Kind, err)
+		}
+		if compressed := size > 100; f.Response.Compressed != compressed {
+			t.Errorf("size %d: compressed is %t", size, f.Response.Compressed)
+		}
+		if size > 100 && len(streams[i].In) > size/2 {
+			t.Error("the reply should be smaller on the wire:", len(streams[i].In))
+		}
+	}
+
+	// Replies expanding beyond the limit of the client are refused.
+	small := NewClient(h2, "rpc", WithMaxDecompressedSize(1000))
+	var big string
+	err = small.Call(h1.ID(), "Echo", "Echo", strings.Repeat("a", 10000), &big)
+	if err != ErrReplyTooLarge || big != "" {
+		t.Error("expected ErrReplyTooLarge:", err)
+	}
+	if err := small.Call(h1.ID(), "Echo", "Echo", strings.Repeat("a", 500), &big); err != nil {
+		t.Error("replies within the limit should be decoded:", err)
+	}
+
+	var arith Arith
+	s.Register(&arith)
+	var r int
+	err = c.Call(h1.ID(), "Arith", "GimmeError", &Args{1, 2}, &r)
+	if err == nil || err.Error() != "an error" {
+		t.Error("expected different error")
+	}
+}
+
+type Waiter struct {
+	deadlines chan time.Time
+}
+
+func (w *Waiter) Wait(ctx context.Context, args int, reply *int) error {
+	deadline, ok := DeadlineFromContext(ctx)
+	if !ok {
+		return errors.New("no deadline")
+	}
+	<-ctx.Done()
+	w.deadlines <- deadline
+	return ctx.Err()
+}
+
+func TestCallContextDeadline(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClient(h2, "rpc")
+	w := &Waiter{deadlines: make(chan time.Time, 1)}
+	err := s.Register(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	clientDeadline, _ := ctx.Deadline()
+
+	var r int
+	err = c.CallContext(ctx, h1.ID(), "Waiter", "Wait", 1, &r)
+	if err == nil || err.Error() != context.DeadlineExceeded.Error() {
+		t.Error("expected deadline exceeded:", err)
+	}
+
+	select {
+	case d := <-w.deadlines:
+		if want := clientDeadline.Add(-DefaultDeadlinePropagationMargin); !d.Equal(want) {
+			t.Errorf("server saw deadline %s, expected %s", d, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler context was not cancelled")
+	}
+
+	// A request whose deadline has passed by the time it arrives is
+	// answered right away without running the method.
+	late := NewClient(h2, "rpc", WithDeadlinePropagationMargin(time.Hour))
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	err = late.CallContext(ctx, h1.ID(), "Waiter", "Wait", 1, &r)
+	if err == nil || err.Error() != context.DeadlineExceeded.Error() {
+		t.Error("expected deadline exceeded:", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("the expired request should have been answered right away:", elapsed)
+	}
+	select {
+	case d := <-w.deadlines:
+		t.Error("the method should not have run:", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLoadShedder(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	overloaded := int32(1)
+	s := NewServer(h1, "rpc", WithLoadShedder(func() bool {
+		return atomic.LoadInt32(&overloaded) == 1
+	}))
+	c := NewClient(h2, "rpc")
+	var arith Arith
+	s.Register(&arith)
+
+	var r int
+	err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != ErrOverloaded {
+		t.Error("expected ErrOverloaded:", err)
+	}
+
+	atomic.StoreInt32(&overloaded, 0)
+	err = c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+}
+
+func TestServeProtocol(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	intercepted := make(chan string, 10)
+	public := Policy{
+		Authorize: func(pid peer.ID, svcID ServiceID) bool {
+			return svcID.Method != "Divide"
+		},
+		Interceptors: []Interceptor{
+			func(ctx context.Context, info CallInfo, handler func(context.Context) error) error {
+				intercepted <- "outer"
+				return handler(ctx)
+			},
+			func(ctx context.Context, info CallInfo, handler func(context.Context) error) error {
+				intercepted <- "inner:" + info.Method
+				return handler(ctx)
+			},
+		},
+	}
+
+	s := NewServer(h1, "rpc", WithPolicy(public))
+	s.ServeProtocol("rpc-internal", Policy{})
+	var arith Arith
+	s.Register(&arith)
+
+	publicClient := NewClient(h2, "rpc")
+	internalClient := NewClient(h2, "rpc-internal")
+
+	var q Quotient
+	err := publicClient.Call(h1.ID(), "Arith", "Divide", &Args{20, 6}, &q)
+	if err != ErrUnauthorized {
+		t.Error("expected ErrUnauthorized:", err)
+	}
+	err = internalClient.Call(h1.ID(), "Arith", "Divide", &Args{20, 6}, &q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intercepted) != 0 {
+		t.Error("interceptors should not have run:", <-intercepted)
+	}
+
+	var r int
+	err = publicClient.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+	close(intercepted)
+	var run []string
+	for name := range intercepted {
+		run = append(run, name)
+	}
+	if len(run) != 2 || run[0] != "outer" || run[1] != "inner:Multiply" {
+		t.Error("unexpected interceptor run:", run)
+	}
+}
+
+func TestJSONRPC(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.ServeJSONRPC("jsonrpc", Policy{})
+	var arith Arith
+	s.Register(&arith)
+
+	stream, err := h2.NewStream(context.Background(), h1.ID(), "jsonrpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	dec := json.NewDecoder(stream)
+
+	type response struct {
+		Version string          `json:"jsonrpc"`
+		Result  json.RawMessage `json:"result"`
+		Error   *JSONRPCError   `json:"error"`
+		ID      json.RawMessage `json:"id"`
+	}
+
+	roundTrip := func(req string) response {
+		if _, err := stream.Write([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		var resp response
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Version != "2.0" {
+			t.Error("bad version:", resp.Version)
+		}
+		return resp
+	}
+
+	resp := roundTrip(`{"jsonrpc":"2.0","method":"Arith.Multiply","params":[{"A":2,"B":3}],"id":1}`)
+	if resp.Error != nil || string(resp.Result) != "6" || string(resp.ID) != "1" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	resp = roundTrip(`{"jsonrpc":"2.0","method":"Arith.Add","params":{"A":2,"B":3},"id":"a"}`)
+	if resp.Error != nil || string(resp.Result) != "5" || string(resp.ID) != `"a"` {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	resp = roundTrip(`{"jsonrpc":"2.0","method":"Arith.Nope","id":2}`)
+	if resp.Error == nil || resp.Error.Code != JSONRPCMethodNotFound {
+		t.Errorf("expected method not found: %+v", resp)
+	}
+
+	// A notification gets no response, so the next thing read
+	// is the response to the error call.
+	stream.Write([]byte(`{"jsonrpc":"2.0","method":"Arith.Multiply","params":[{"A":2,"B":3}]}`))
+	resp = roundTrip(`{"jsonrpc":"2.0","method":"Arith.GimmeError","params":[{"A":2,"B":3}],"id":3}`)
+	if resp.Error == nil || resp.Error.Code != JSONRPCServerError || resp.Error.Message != "an error" {
+		t.Errorf("expected server error: %+v", resp)
+	}
+	if resp.Result != nil {
+		t.Error("error responses should not include a result")
+	}
+
+	// Servers requiring signatures reject JSON-RPC requests.
+	signed := NewServer(h1, "rpc-signed", WithRequireSignatures())
+	signed.ServeJSONRPC("jsonrpc-signed", Policy{})
+	signed.Register(&arith)
+	stream, err = h2.NewStream(context.Background(), h1.ID(), "jsonrpc-signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	dec = json.NewDecoder(stream)
+	resp = roundTrip(`{"jsonrpc":"2.0","method":"Arith.Multiply","params":[{"A":2,"B":3}],"id":4}`)
+	if resp.Error == nil || resp.Error.Message != ErrBadSignature.Error() || resp.Result != nil {
+		t.Errorf("expected a bad signature error: %+v", resp)
+	}
+}
+
+type Recorder struct {
+	mu    sync.Mutex
+	order []int
+}
+
+func (r *Recorder) Record(args int, reply *int) error {
+	// Give later calls a chance to overtake this one.
+	time.Sleep(time.Duration(10-args) * time.Millisecond)
+	r.mu.Lock()
+	r.order = append(r.order, args)
+	r.mu.Unlock()
+	return nil
+}
+
+func TestOrderedCalls(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClient(h2, "rpc", WithOrderedCalls())
+	rec := &Recorder{}
+	s.Register(rec)
+
+	var calls []chan *Call
+	for i := 0; i < 10; i++ {
+		done := make(chan *Call, 1)
+		var r int
+		c.Go(h1.ID(), "Recorder", "Record", i, &r, done)
+		calls = append(calls, done)
+	}
+	for _, done := range calls {
+		call := <-done
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+	}
+
+	for i, v := range rec.order {
+		if i != v {
+			t.Fatal("calls were not processed in order:", rec.order)
+		}
+	}
+}
+
+func TestWaitForProtocol(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	c := NewClient(h2, "rpc")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := c.WaitForProtocol(ctx, h1.ID())
+	if err != context.DeadlineExceeded {
+		t.Fatal("expected a timeout:", err)
+	}
+
+	s := NewServer(h1, "rpc-other")
+	var arith Arith
+	s.Register(&arith)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.ServeProtocol("rpc", Policy{})
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = c.WaitForProtocol(ctx, h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r int
+	err = c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorLogSampling(t *testing.T) {
+	s := &errorSampler{interval: time.Hour}
+	err := errors.New("boom")
+	for i := 0; i < 3; i++ {
+		s.logError("error handling RPC:", err)
+	}
+	s.logError("error handling RPC:", errors.New("other"))
+
+	if len(s.last) != 2 {
+		t.Error("expected two error kinds, got", len(s.last))
+	}
+	if n := s.suppressed["error handling RPC:boom"]; n != 2 {
+		t.Error("expected two suppressed errors, got", n)
+	}
+
+	s.interval = 0
+	s.logError("error handling RPC:", err)
+	if n := s.suppressed["error handling RPC:boom"]; n != 2 {
+		t.Error("sampling should be off with a zero interval")
+	}
+}
+
+type txKey struct{}
+
+type Tx struct{}
+
+func (tx *Tx) Get(ctx context.Context, args int, reply *string) error {
+	*reply, _ = ctx.Value(txKey{}).(string)
+	return nil
+}
+
+func TestServiceContext(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	cleanups := make(chan struct{}, 2)
+	setup := func(ctx context.Context) (context.Context, func(), error) {
+		return context.WithValue(ctx, txKey{}, "tx"), func() {
+			cleanups <- struct{}{}
+		}, nil
+	}
+	s := NewServer(h1, "rpc", WithServiceContext("Tx", setup))
+	s.Register(&Tx{})
+
+	for _, c := range []*Client{NewClient(h2, "rpc"), NewClientWithServer(h1, "rpc", s)} {
+		var r string
+		err := c.Call(h1.ID(), "Tx", "Get", 1, &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != "tx" {
+			t.Error("method did not get the service context")
+		}
+		select {
+		case <-cleanups:
+		case <-time.After(time.Second):
+			t.Error("cleanup was not called")
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc/1.0.0")
+	s.ServeProtocol("rpc/2.0.0", Policy{
+		Authorize: func(pid peer.ID, svcID ServiceID) bool {
+			return svcID.Method != "Add"
+		},
+	})
+	var arith Arith
+	s.Register(&arith)
+
+	c := NewClient(h2, "rpc/1.0.0")
+	proto, err := c.NegotiateVersion(context.Background(), h1.ID(),
+		[]protocol.ID{"rpc/3.0.0", "rpc/2.0.0", "rpc/1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != "rpc/2.0.0" {
+		t.Fatal("negotiated the wrong protocol:", proto)
+	}
+
+	// Add is not allowed on the 2.0.0 protocol. That tells
+	// us the negotiated one is used.
+	var r int
+	err = c.Call(h1.ID(), "Arith", "Add", Args{2, 3}, &r)
+	if err != ErrUnauthorized {
+		t.Error("expected the negotiated protocol to be used:", err)
+	}
+	// Single calls can override it.
+	err = c.CallContext(context.Background(), h1.ID(), "Arith", "Add", Args{2, 3}, &r, WithProtocol("rpc/1.0.0"))
+	if err != nil || r != 5 {
+		t.Error("expected the protocol of the call to be used:", r, err)
+	}
+	if c.protocolFor(h1.ID()) != "rpc/2.0.0" {
+		t.Error("overriding the protocol should not change the negotiated one")
+	}
+
+	_, err = c.NegotiateVersion(context.Background(), h1.ID(),
+		[]protocol.ID{"rpc/3.0.0"})
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestStreamPool(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+
+	c := NewClient(h2, "rpc", WithStreamPool(2, 200*time.Millisecond))
+	call := func(e int) {
+		var r int
+		err := c.Call(h1.ID(), "Arith", "Multiply", Args{2, 3}, &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != 6 {
+			t.Fatal("wrong result:", r)
+		}
+		if n := c.pool.idleCount(h1.ID()); n != e {
+			t.Fatalf("expected %d idle streams, got %d", e, n)
+		}
+	}
+
+	idleStream := func() *streamWrap {
+		c.pool.mu.Lock()
+		defer c.pool.mu.Unlock()
+		return c.pool.idle[h1.ID()][0].sw
+	}
+
+	call(1)
+	first := idleStream()
+	call(1)
+	if idleStream() != first {
+		t.Error("the stream should have been reused")
+	}
+
+	// Application errors do not affect the stream.
+	var r int
+	err := c.Call(h1.ID(), "Arith", "GimmeError", &Args{1, 2}, &r)
+	if err == nil || err.Error() != "an error" {
+		t.Fatal("expected an error:", err)
+	}
+	if idleStream() != first {
+		t.Error("the stream should have been reused after an error")
+	}
+
+	// A stream broken while idle is evicted and the call is
+	// retried on a new one.
+	first.stream.Reset()
+	call(1)
+	if idleStream() == first {
+		t.Error("the broken stream should have been evicted")
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if n := c.pool.idleCount(h1.ID()); n != 0 {
+		t.Error("idle streams should have been closed:", n)
+	}
+
+	// Closing the client closes the idle streams, as well as those
+	// returned to the pool afterwards.
+	call(1)
+	call(1)
+	sw := c.pool.get(h1.ID(), c.protocolFor(h1.ID()))
+	if sw == nil {
+		t.Fatal("expected an idle stream")
+	}
+	c.Close()
+	if n := c.pool.idleCount(h1.ID()); n != 0 {
+		t.Error("idle streams should be closed with the client:", n)
+	}
+	c.pool.put(h1.ID(), sw)
+	if n := c.pool.idleCount(h1.ID()); n != 0 {
+		t.Error("streams put after Close should be closed:", n)
+	}
+}
+
+type Counter struct{}
+
+// Count sends the numbers from 0 to args-1 and fails if args is
+// above 5, once 5 numbers have been sent.
+func (c *Counter) Count(ctx context.Context, args int, stream *ServerStream) error {
+	for i := 0; i < args; i++ {
+		if i == 5 {
+			return errors.New("too many")
+		}
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Counter{})
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc")
+
+	recvAll := func(n int) ([]int, error) {
+		stream, err := c.Stream(context.Background(), h1.ID(), "Counter", "Count", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		var items []int
+		for {
+			var i int
+			err := stream.Recv(&i)
+			if err != nil {
+				return items, err
+			}
+			items = append(items, i)
+		}
+	}
+
+	items, err := recvAll(3)
+	if err != io.EOF {
+		t.Fatal("expected a clean end:", err)
+	}
+	if len(items) != 3 || items[2] != 2 {
+		t.Error("wrong items:", items)
+	}
+
+	items, err = recvAll(10)
+	if err == nil || err.Error() != "too many" {
+		t.Fatal("expected the method error:", err)
+	}
+	if len(items) != 5 {
+		t.Error("expected the items sent before the error:", items)
+	}
+
+	// Mismatched streaming modes are rejected.
+	stream, err := c.Stream(context.Background(), h1.ID(), "Arith", "Multiply", &Args{2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var i int
+	if err := stream.Recv(&i); err == nil || err == io.EOF {
+		t.Error("expected an error streaming from a normal method:", err)
+	}
+	var r int
+	if err := c.Call(h1.ID(), "Counter", "Count", 3, &r); err == nil {
+		t.Error("expected an error calling a streaming method")
+	}
+	if len(c.InFlight()) != 0 {
+		t.Error("streams should have been removed from the in-flight calls")
+	}
+}
+
+func TestPinnedWorkers(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithPinnedWorkers(1))
+	b := &Blocker{release: make(chan struct{})}
+	s.Register(b)
+	c := NewClient(h2, "rpc")
+
+	done := make(chan *Call, 1)
+	var r1 int
+	c.Go(h1.ID(), "Blocker", "Wait", 1, &r1, done)
+	for len(s.InFlight()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The only worker is busy.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var r2 int
+	err := c.CallContext(ctx, h1.ID(), "Blocker", "Wait", 2, &r2)
+	if err == nil {
+		t.Fatal("expected an error waiting for a worker")
+	}
+
+	close(b.release)
+	if call := <-done; call.Error != nil || r1 != 1 {
+		t.Fatal("unexpected result:", call.Error, r1)
+	}
+	if err := c.Call(h1.ID(), "Blocker", "Wait", 3, &r2); err != nil || r2 != 3 {
+		t.Fatal("unexpected result:", err, r2)
+	}
+}
+
+func TestMaxOpenStreams(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithMaxOpenStreams(1))
+	b := &Blocker{release: make(chan struct{})}
+	s.Register(b)
+	c := NewClient(h2, "rpc")
+
+	done := make(chan *Call, 1)
+	var r1 int
+	c.Go(h1.ID(), "Blocker", "Wait", 1, &r1, done)
+	for len(s.InFlight()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.Stats().OpenStreams; n != 1 {
+		t.Error("expected 1 open stream, got", n)
+	}
+	if n := c.Stats().OpenStreams; n != 1 {
+		t.Error("expected 1 open stream in the client, got", n)
+	}
+
+	var r2 int
+	err := c.Call(h1.ID(), "Blocker", "Wait", 2, &r2)
+	if err != ErrTooManyStreams {
+		t.Error("expected ErrTooManyStreams:", err)
+	}
+
+	close(b.release)
+	if call := <-done; call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	if n := c.Stats().OpenStreams; n != 0 {
+		t.Error("expected no open streams in the client, got", n)
+	}
+
+	// Wait for the server to see the stream closed.
+	waitClosed := func() {
+		for s.Stats().OpenStreams != 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitClosed()
+	if err := c.Call(h1.ID(), "Blocker", "Wait", 3, &r2); err != nil {
+		t.Fatal(err)
+	}
+	waitClosed()
+
+	// Idle streams in the pool count towards the client limit.
+	c2 := NewClient(h2, "rpc", WithClientMaxOpenStreams(1), WithStreamPool(1, 0))
+	if err := c2.Call(h1.ID(), "Blocker", "Wait", 4, &r2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.Stream(context.Background(), h1.ID(), "Blocker", "Wait", 5); err != ErrTooManyStreams {
+		t.Error("expected ErrTooManyStreams:", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+	b := &Blocker{release: make(chan struct{})}
+	s.Register(b)
+	c := NewClient(h2, "rpc")
+
+	sess, err := c.Session(context.Background(), h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// A blocked call does not hold the others.
+	blocked := make(chan error, 1)
+	go func() {
+		var r int
+		blocked <- sess.Call(context.Background(), "Blocker", "Wait", 1, &r)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var r int
+			err := sess.Call(context.Background(), "Arith", "Multiply", &Args{i, 2}, &r)
+			if err != nil {
+				t.Error(err)
+			}
+			if r != i*2 {
+				t.Errorf("wrong result for %d: %d", i, r)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var q Quotient
+	err = sess.Call(context.Background(), "Arith", "Divide", &Args{1, 0}, &q)
+	if err == nil || err.Error() != "divide by zero" {
+		t.Error("expected divide by zero error:", err)
+	}
+	var r int
+	err = sess.Call(context.Background(), "Arith", "GimmeError", &Args{1, 2}, &r)
+	if err == nil || err.Error() != "an error" || r != 42 {
+		t.Error("the reply should be set even on error:", r, err)
+	}
+	err = sess.Call(context.Background(), "Arith", "Nope", &Args{1, 0}, &q)
+	if err == nil {
+		t.Error("expected an error")
+	}
+
+	close(b.release)
+	if err := <-blocked; err != nil {
+		t.Error(err)
+	}
+	if c.Stats().OpenStreams != 1 {
+		t.Error("the session should use a single stream")
+	}
+
+	sess.Close()
+	if err := sess.Call(context.Background(), "Arith", "Multiply", &Args{1, 2}, new(int)); err != ErrSessionClosed {
+		t.Error("expected ErrSessionClosed:", err)
+	}
+	if c.Stats().OpenStreams != 0 {
+		t.Error("the session stream should be closed")
+	}
+
+	// Replies arriving after the caller gave up are discarded, and
+	// Close does not wait for the calls being handled.
+	b2 := &Blocker{release: make(chan struct{})}
+	s.RegisterName("Blocker2", b2)
+	sess, err = c.Session(context.Background(), h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var late int
+	if err := sess.Call(ctx, "Blocker2", "Wait", 5, &late); err != context.DeadlineExceeded {
+		t.Error("expected context.DeadlineExceeded:", err)
+	}
+	go func() {
+		var r int
+		blocked <- sess.Call(context.Background(), "Blocker2", "Wait", 6, &r)
+	}()
+	for len(s.InFlight()) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	closed := make(chan struct{})
+	go func() {
+		sess.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close should not wait for the pending calls")
+	}
+	if err := <-blocked; err != ErrSessionClosed {
+		t.Error("expected ErrSessionClosed:", err)
+	}
+	close(b2.release)
+	time.Sleep(100 * time.Millisecond)
+	if late != 0 {
+		t.Error("a late reply should be discarded:", late)
+	}
+
+	// Closing the client ends its sessions.
+	b3 := &Blocker{release: make(chan struct{})}
+	defer close(b3.release)
+	s.RegisterName("Blocker3", b3)
+	sess, err = c.Session(context.Background(), h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var r int
+		blocked <- sess.Call(context.Background(), "Blocker3", "Wait", 7, &r)
+	}()
+	for len(s.InFlight()) < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Close()
+	if err := <-blocked; err != ErrClientClosed {
+		t.Error("expected ErrClientClosed:", err)
+	}
+	if err := sess.Call(context.Background(), "Arith", "Multiply", &Args{1, 2}, new(int)); err != ErrClientClosed {
+		t.Error("expected ErrClientClosed:", err)
+	}
+	if _, err := c.Session(context.Background(), h1.ID()); err != ErrClientClosed {
+		t.Error("expected ErrClientClosed:", err)
+	}
+}
+
+func benchmarkCall(b *testing.B, opts ...ClientOption) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc", opts...)
+
+	var r int
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCall(b *testing.B) {
+	benchmarkCall(b)
+}
+
+func BenchmarkCallBufferPool(b *testing.B) {
+	benchmarkCall(b, WithBufferPool())
+}
+
+type Committer struct {
+	committed chan error
+}
+
+func (cm *Committer) Commit(ctx context.Context, args time.Duration, reply *int) error {
+	select {
+	case <-time.After(args):
+	case <-ctx.Done():
+	}
+	cm.committed <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestCritical(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	cm := &Committer{committed: make(chan error, 1)}
+	s.Register(cm)
+	c := NewClient(h2, "rpc")
+
+	commit := func(opts ...CallOption) (error, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		var r int
+		err := c.CallContext(ctx, h1.ID(), "Committer", "Commit", 300*time.Millisecond, &r, opts...)
+		return err, <-cm.committed
+	}
+
+	err, herr := commit()
+	if err == nil || err.Error() != context.DeadlineExceeded.Error() || herr == nil {
+		t.Error("a normal call should be aborted:", err, herr)
+	}
+
+	err, herr = commit(WithCritical())
+	if err != context.DeadlineExceeded {
+		t.Error("the client should still time out:", err)
+	}
+	if herr != nil {
+		t.Error("a critical call should not be aborted:", herr)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	b := &Blocker{release: make(chan struct{})}
+	s.Register(b)
+	local := NewClientWithServer(h1, "rpc", s)
+	c := NewClient(h2, "rpc")
+
+	done := make(chan *Call, 1)
+	var r1 int
+	c.Go(h1.ID(), "Blocker", "Wait", 1, &r1, done)
+	for len(s.InFlight()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- Shutdown(context.Background(), s, local)
+	}()
+	for !s.isShuttingDown() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var r2 int
+	if err := local.CallLocal("Blocker", "Wait", 2, &r2); err != ErrClientClosed {
+		t.Error("expected ErrClientClosed:", err)
+	}
+	if err := c.Call(h1.ID(), "Blocker", "Wait", 3, &r2); err == nil {
+		t.Error("expected an error calling a server shutting down")
+	}
+	if err := s.Call(&Call{SvcID: ServiceID{"Blocker", "Wait"}, Args: 4, Reply: &r2}); err != ErrShuttingDown {
+		t.Error("expected ErrShuttingDown:", err)
+	}
+
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown should wait for the calls in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(b.release)
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+	if call := <-done; call.Error != nil || r1 != 1 {
+		t.Error("the call in progress should complete:", call.Error)
+	}
+}
+
+type Meta struct{}
+
+func (m *Meta) Get(ctx context.Context, key string, reply *string) error {
+	*reply = MetadataFromContext(ctx)[key]
+	return nil
+}
+
+func TestClientInterceptor(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Meta{})
+	var arith Arith
+	s.Register(&arith)
+
+	var calls []string
+	record := func(ctx context.Context, info CallInfo, invoker func(context.Context) error) error {
+		calls = append(calls, info.Service+"."+info.Method)
+		return invoker(ctx)
+	}
+	retries := 0
+	auth := func(ctx context.Context, info CallInfo, invoker func(context.Context) error) error {
+		ctx = WithMetadata(ctx, Metadata{"token": "secret"})
+		err := invoker(ctx)
+		if err != nil && retries == 0 {
+			retries++
+			return invoker(ctx)
+		}
+		return err
+	}
+
+	for _, c := range []*Client{
+		NewClient(h2, "rpc", WithClientInterceptor(record), WithClientInterceptor(auth)),
+		NewClientWithServer(h1, "rpc", s, WithClientInterceptor(record), WithClientInterceptor(auth)),
+	} {
+		calls = nil
+		retries = 0
+		var token string
+		err := c.Call(h1.ID(), "Meta", "Get", "token", &token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "secret" {
+			t.Error("the metadata was not sent:", token)
+		}
+
+		ctx := WithMetadata(context.Background(), Metadata{"other": "value"})
+		var other string
+		if err := c.CallContext(ctx, h1.ID(), "Meta", "Get", "other", &other); err != nil {
+			t.Fatal(err)
+		}
+		if other != "value" {
+			t.Error("the context metadata was not sent:", other)
+		}
+
+		var r int
+		err = c.Call(h1.ID(), "Arith", "GimmeError", &Args{1, 2}, &r)
+		if err == nil || err.Error() != "an error" {
+			t.Error("expected an error:", err)
+		}
+		if retries != 1 {
+			t.Error("the call should have been retried")
+		}
+		if len(calls) != 3 || calls[0] != "Meta.Get" {
+			t.Error("unexpected calls:", calls)
+		}
+	}
+}
+
+func TestNilArgsAndReply(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithCompression(0))
+	var arith Arith
+	s.Register(&arith)
+
+	for _, c := range []*Client{
+		NewClient(h2, "rpc"),
+		NewClientWithServer(h1, "rpc", s),
+	} {
+		var r int
+		if err := c.Call(h1.ID(), "Arith", "Add", nil, &r); err != nil || r != 0 {
+			t.Error("unexpected result:", err, r)
+		}
+		if err := c.Call(h1.ID(), "Arith", "Multiply", nil, &r); err != nil || r != 0 {
+			t.Error("unexpected result:", err, r)
+		}
+		if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, nil); err != nil {
+			t.Error(err)
+		}
+		if err := c.Call(h1.ID(), "Arith", "Divide", nil, nil); err == nil {
+			t.Error("expected divide by zero error")
+		}
+	}
+}
+
+func testKeys(key byte) KeyProvider {
+	return func(pid peer.ID) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(bytes.Repeat([]byte{key}, 32))
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+}
+
+func TestPayloadEncryption(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithPayloadEncryption(testKeys(1)))
+	var arith Arith
+	s.Register(&arith)
+	s.Register(&Counter{})
+
+	c := NewClient(h2, "rpc", WithClientPayloadEncryption(testKeys(1)))
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Fatal("unexpected result:", err, r)
+	}
+	stream, err := c.Stream(context.Background(), h1.ID(), "Counter", "Count", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []int
+	for {
+		var i int
+		if err := stream.Recv(&i); err != nil {
+			if err != io.EOF {
+				t.Error(err)
+			}
+			break
+		}
+		items = append(items, i)
+	}
+	if len(items) != 3 {
+		t.Error("wrong items:", items)
+	}
+
+	// Errors for rejected calls are sealed too.
+	if err := c.Call(h1.ID(), "Arith", "Missing", &Args{2, 3}, &r); err == nil || strings.Contains(err.Error(), "unauthenticated") {
+		t.Error("expected a sealed error:", err)
+	}
+	stream, err = c.Stream(context.Background(), h1.ID(), "Counter", "Missing", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Recv(new(int)); err == nil || err == io.EOF || strings.Contains(err.Error(), "unauthenticated") {
+		t.Error("expected a sealed error:", err)
+	}
+	stream.Close()
+
+	wrongKey := NewClient(h2, "rpc", WithClientPayloadEncryption(testKeys(2)))
+	if err := wrongKey.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != ErrDecryption {
+		t.Error("expected ErrDecryption:", err)
+	}
+	plain := NewClient(h2, "rpc")
+	if err := plain.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err == nil {
+		t.Error("expected unencrypted requests to be rejected")
+	}
+}
+
+func TestPayloadTampering(t *testing.T) {
+	aead, _ := testKeys(1)("")
+	sl := &sealer{aead: aead}
+	ad := additionalData(adRequest, ServiceID{"Arith", "Multiply"})
+	sealed, err := sl.seal(&Args{2, 3}, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decode := func(blob []byte, ad []byte) error {
+		var buf bytes.Buffer
+		newEncoder(nil, &buf).Encode(blob)
+		var args Args
+		return sl.decode(newDecoder(nil, &buf), &args, ad)
+	}
+	if err := decode(sealed, ad); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, len(sealed) / 2, len(sealed) - 1} {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 1
+		if err := decode(tampered, ad); err != ErrDecryption {
+			t.Error("tampering not detected at", i, err)
+		}
+	}
+	if err := decode(sealed[:4], ad); err != ErrDecryption {
+		t.Error("truncation not detected:", err)
+	}
+	other := additionalData(adResponse, ServiceID{"Arith", "Multiply"})
+	if err := decode(sealed, other); err != ErrDecryption {
+		t.Error("a request payload should not pass as a response:", err)
+	}
+}
+
+func crc32Hash() hash.Hash { return crc32.NewIEEE() }
+
+func TestPayloadEncryptionForgery(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	// A relay tampering with what an encrypting server sends.
+	sl, err := newSealer(testKeys(1), nil, h2.ID(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1.SetStreamHandler("forged", func(stream inet.Stream) {
+		defer stream.Close()
+		sw := wrapStream(stream, nil)
+		var header RequestHeader
+		var args []byte
+		if sw.dec.Decode(&header) != nil || sw.dec.Decode(&args) != nil {
+			return
+		}
+		svcID := header.ServiceID
+		switch header.Cursor {
+		case "error":
+			sw.enc.Encode(&Response{Service: svcID, Error: "forged"})
+			sw.enc.Encode(nil)
+		case "reorder":
+			sw.enc.Encode(streamFrame{Type: frameItem})
+			sl.encode(sw.enc, 2, itemAD(svcID, 2, ""))
+		case "truncate":
+			sw.enc.Encode(streamFrame{Type: frameItem})
+			sl.encode(sw.enc, 1, itemAD(svcID, 1, ""))
+			sw.enc.Encode(streamFrame{Type: frameTrailer})
+		}
+		sw.w.Flush()
+	})
+	c := NewClient(h2, "forged", WithClientPayloadEncryption(testKeys(1)))
+
+	sw, err := c.newStream(context.Background(), h1.ID(), "forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := &Call{SvcID: ServiceID{"Arith", "Multiply"}, Args: &Args{2, 3}, Reply: new(int)}
+	header := RequestHeader{ServiceID: call.SvcID, Encrypted: true, Cursor: "error"}
+	if err := c.writeRequest(sw, header, call.Args, sl); err != nil || sw.w.Flush() != nil {
+		t.Fatal(err)
+	}
+	c.receiveResponse(sw, call, sl)
+	if call.Error == nil || call.Error.Error() == "forged" {
+		t.Error("forged errors should not be trusted:", call.Error)
+	}
+
+	recv := func(cursor string) []error {
+		cs, err := c.stream(context.Background(), h1.ID(), "Counter", "Count", 3, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cs.Close()
+		var errs []error
+		for {
+			var i int
+			err := cs.Recv(&i)
+			errs = append(errs, err)
+			if err != nil {
+				return errs
+			}
+		}
+	}
+	if errs := recv("reorder"); errs[0] != ErrDecryption {
+		t.Error("expected reordered items to be detected:", errs)
+	}
+	errs := recv("truncate")
+	if len(errs) != 2 || errs[0] != nil || errs[1] == io.EOF {
+		t.Error("expected a truncated stream to be detected:", errs)
+	}
+}
+
+func TestPayloadChecksum(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithPayloadChecksum(crc32Hash))
+	s.Register(new(Arith))
+	s.Register(&Counter{})
+
+	c := NewClient(h2, "rpc", WithClientPayloadChecksum(crc32Hash))
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Fatal("unexpected result:", err, r)
+	}
+	stream, err := c.Stream(context.Background(), h1.ID(), "Counter", "Count", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []int
+	for {
+		var i int
+		if err := stream.Recv(&i); err != nil {
+			if err != io.EOF {
+				t.Error(err)
+			}
+			break
+		}
+		items = append(items, i)
+	}
+	if len(items) != 3 {
+		t.Error("wrong items:", items)
+	}
+
+	otherHash := NewClient(h2, "rpc", WithClientPayloadChecksum(func() hash.Hash { return adler32.New() }))
+	if err := otherHash.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != ErrChecksum {
+		t.Error("expected ErrChecksum:", err)
+	}
+	plain := NewClient(h2, "rpc")
+	if err := plain.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err == nil {
+		t.Error("expected requests without a checksum to be rejected")
+	}
+
+	// Checksums layer with encryption.
+	s2 := NewServer(h1, "rpc-sealed", WithPayloadChecksum(crc32Hash), WithPayloadEncryption(testKeys(1)))
+	s2.Register(new(Arith))
+	both := NewClient(h2, "rpc-sealed", WithClientPayloadChecksum(crc32Hash), WithClientPayloadEncryption(testKeys(1)))
+	if err := both.Call(h1.ID(), "Arith", "Multiply", &Args{3, 3}, &r); err != nil || r != 9 {
+		t.Error("unexpected result:", err, r)
+	}
+
+	sl := &sealer{sum: crc32Hash}
+	sealed, err := sl.seal(&Args{2, 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, len(sealed) / 2, len(sealed) - 1} {
+		corrupted := append([]byte{}, sealed...)
+		corrupted[i] ^= 1
+		var args Args
+		if err := sl.open(corrupted, &args, nil); err != ErrChecksum {
+			t.Error("corruption not detected at", i, err)
+		}
+	}
+	var args Args
+	if err := sl.open(sealed[:2], &args, nil); err != ErrChecksum {
+		t.Error("truncation not detected:", err)
+	}
+}
+
+type streamEvents struct {
+	mu     sync.Mutex
+	open   map[uint64]peer.ID
+	closed map[uint64]error
+}
+
+func newStreamEvents() *streamEvents {
+	return &streamEvents{
+		open:   make(map[uint64]peer.ID),
+		closed: make(map[uint64]error),
+	}
+}
+
+func (e *streamEvents) onOpen(pid peer.ID, id uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.open[id] = pid
+}
+
+func (e *streamEvents) onClose(pid peer.ID, id uint64, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed[id] = err
+}
+
+func (e *streamEvents) counts() (int, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.open), len(e.closed)
+}
+
+func TestStreamHooks(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	se := newStreamEvents()
+	s := NewServer(h1, "rpc", WithOnStreamOpen(se.onOpen), WithOnStreamClose(se.onClose))
+	var arith Arith
+	s.Register(&arith)
+	b := &Blocker{release: make(chan struct{})}
+	s.Register(b)
+
+	ce := newStreamEvents()
+	c := NewClient(h2, "rpc", WithClientOnStreamOpen(ce.onOpen), WithClientOnStreamClose(ce.onClose))
+
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.CallContext(ctx, h1.ID(), "Blocker", "Wait", 1, &r); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	close(b.release)
+
+	for {
+		open, closed := se.counts()
+		if open == 2 && closed == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if open, closed := ce.counts(); open != 2 || closed != 2 {
+		t.Fatal("unexpected client stream events:", open, closed)
+	}
+	if ce.open[1] != h1.ID() || se.open[1] != h2.ID() {
+		t.Error("wrong peers for the streams")
+	}
+	if ce.closed[1] != nil {
+		t.Error("the first stream should have been closed normally:", ce.closed[1])
+	}
+	if ce.closed[2] != context.DeadlineExceeded {
+		t.Error("the second stream should have been closed by the deadline:", ce.closed[2])
+	}
+}
+
+func TestBatchRetryFailed(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var mu sync.Mutex
+	shed := true
+	executed := 0
+	count := func(ctx context.Context, info CallInfo, handler func(context.Context) error) error {
+		mu.Lock()
+		executed++
+		mu.Unlock()
+		return handler(ctx)
+	}
+	s := NewServer(h1, "rpc",
+		WithLoadShedder(func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return shed
+		}),
+		WithPolicy(Policy{Interceptors: []Interceptor{count}}),
+	)
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc")
+
+	var r1, r2, r3 int
+	b := c.NewBatch()
+	b.Add(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r1)
+	b.Add(h1.ID(), "Arith", "GimmeError", &Args{2, 3}, &r2)
+	b.Add(peer.ID("unreachable"), "Arith", "Multiply", &Args{2, 3}, &r3)
+
+	res := b.Run(context.Background())
+	for i, r := range res {
+		if r.Error == nil || !r.Transient {
+			t.Error(i, "should have failed transiently:", r.Error)
+		}
+	}
+	if res[0].Error != ErrOverloaded {
+		t.Error("expected ErrOverloaded:", res[0].Error)
+	}
+
+	mu.Lock()
+	shed = false
+	mu.Unlock()
+	res = b.RetryFailed(context.Background())
+	if res[0].Error != nil || r1 != 6 {
+		t.Error("the call should have succeeded:", res[0].Error)
+	}
+	if res[1].Error == nil || res[1].Transient {
+		t.Error("application errors are not transient:", res[1])
+	}
+	if !res[2].Transient {
+		t.Error("the unreachable peer should fail transiently:", res[2].Error)
+	}
+	if f := b.Failed(); len(f) != 1 || f[0] != 2 {
+		t.Error("unexpected failed calls:", f)
+	}
+
+	b.RetryFailed(context.Background())
+	mu.Lock()
+	defer mu.Unlock()
+	if executed != 2 {
+		t.Error("only transient failures should be retried:", executed)
+	}
+}
+
+// Impostor returns errors with the same message as those of the server.
+type Impostor struct{}
+
+func (i *Impostor) Overloaded(args int, reply *int) error {
+	return errors.New(ErrOverloaded.Error())
+}
+
+func TestMethodErrorsLikeServerErrors(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Impostor{})
+	c := NewClient(h2, "rpc")
+
+	var r int
+	err := c.Call(h1.ID(), "Impostor", "Overloaded", 1, &r)
+	if err == nil || err == ErrOverloaded || err.Error() != ErrOverloaded.Error() {
+		t.Error("method errors should not be taken for server errors:", err)
+	}
+
+	b := c.NewBatch()
+	b.Add(h1.ID(), "Impostor", "Overloaded", 1, &r)
+	if res := b.Run(context.Background()); res[0].Error == nil || res[0].Transient {
+		t.Error("method errors are not transient:", res[0])
+	}
+}
+
+func TestMsgpackHandle(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	strict := &codec.MsgpackHandle{}
+	strict.ErrorIfNoField = true
+	s := NewServer(h1, "rpc", WithMsgpackHandle(strict))
+	lax := NewServer(h1, "rpc-lax")
+	var arith Arith
+	s.Register(&arith)
+	lax.Register(&arith)
+
+	type extendedArgs struct {
+		A, B, C int
+	}
+
+	c := NewClient(h2, "rpc", WithClientMsgpackHandle(strict))
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+	err := c.Call(h1.ID(), "Arith", "Multiply", &extendedArgs{2, 3, 4}, &r)
+	if err == nil {
+		t.Error("the server handle should reject unknown fields")
+	}
+
+	c = NewClient(h2, "rpc-lax")
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &extendedArgs{2, 4, 4}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != 8 {
+		t.Error("result is:", r)
+	}
+}
+
+type Ticker struct{}
+
+// Tick sends a single item after waiting for the given milliseconds.
+func (t *Ticker) Tick(ctx context.Context, ms int, stream *ServerStream) error {
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return stream.Send(ms)
+}
+
+func TestStreamKeepalive(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithStreamKeepalive(50*time.Millisecond))
+	s.Register(&Ticker{})
+	silent := NewServer(h1, "rpc-silent")
+	silent.Register(&Ticker{})
+
+	recv := func(proto protocol.ID) error {
+		c := NewClient(h2, proto, WithStreamIdleTimeout(200*time.Millisecond))
+		stream, err := c.Stream(context.Background(), h1.ID(), "Ticker", "Tick", 500)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		var ms int
+		if err := stream.Recv(&ms); err != nil {
+			return err
+		}
+		if ms != 500 {
+			t.Error("wrong item:", ms)
+		}
+		return stream.Recv(&ms)
+	}
+
+	if err := recv("rpc"); err != io.EOF {
+		t.Error("keepalives should have kept the stream alive:", err)
+	}
+	if err := recv("rpc-silent"); err != ErrStreamIdle {
+		t.Error("expected ErrStreamIdle:", err)
+	}
+}
+
+func TestReplyDecodeTimeout(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	// A server which takes its time to send the reply body.
+	h1.SetStreamHandler("slow", func(stream inet.Stream) {
+		defer stream.Close()
+		sw := wrapStream(stream, nil)
+		var header RequestHeader
+		var args Args
+		if sw.dec.Decode(&header) != nil || sw.dec.Decode(&args) != nil {
+			return
+		}
+		sw.enc.Encode(&Response{Service: header.ServiceID})
+		sw.w.Flush()
+		time.Sleep(300 * time.Millisecond)
+		sw.enc.Encode(args.A * args.B)
+		sw.w.Flush()
+	})
+
+	var r int
+	c := NewClient(h2, "slow", WithReplyDecodeTimeout(100*time.Millisecond))
+	err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != ErrReplyDecodeTimeout {
+		t.Error("expected ErrReplyDecodeTimeout:", err)
+	}
+
+	c = NewClient(h2, "slow")
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+
+	// The response header is bounded too, once it starts arriving.
+	h1.SetStreamHandler("slowheader", func(stream inet.Stream) {
+		defer stream.Close()
+		sw := wrapStream(stream, nil)
+		var header RequestHeader
+		var args Args
+		if sw.dec.Decode(&header) != nil || sw.dec.Decode(&args) != nil {
+			return
+		}
+		time.Sleep(200 * time.Millisecond) // not counted
+		var buf bytes.Buffer
+		newEncoder(nil, &buf).Encode(&Response{Service: header.ServiceID})
+		newEncoder(nil, &buf).Encode(args.A * args.B)
+		stream.Write(buf.Bytes()[:1])
+		time.Sleep(300 * time.Millisecond)
+		stream.Write(buf.Bytes()[1:])
+	})
+	c = NewClient(h2, "slowheader", WithReplyDecodeTimeout(100*time.Millisecond))
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != ErrReplyDecodeTimeout {
+		t.Error("expected ErrReplyDecodeTimeout reading the header:", err)
+	}
+	c = NewClient(h2, "slowheader", WithReplyDecodeTimeout(400*time.Millisecond))
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 4}, &r); err != nil || r != 8 {
+		t.Error("the time before the response should not count:", r, err)
+	}
+}
+
+// Asker answers calls by calling back the caller.
+type Asker struct {
+	p *Peer
+}
+
+func (a *Asker) Ask(ctx context.Context, args Args, reply *int) error {
+	return a.p.Callback(ctx, "Arith", "Multiply", &args, reply)
+}
+
+func TestPeerCallback(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	p1 := NewPeer(NewServer(h1, "rpc"))
+	p1.Server.Register(&Asker{p1})
+	p2 := NewPeer(NewServer(h2, "rpc"))
+	var arith Arith
+	p2.Server.Register(&arith)
+
+	var r int
+	err := p2.Client.Call(h1.ID(), "Asker", "Ask", &Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+
+	err = p1.Callback(context.Background(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err == nil {
+		t.Error("callbacks should fail outside handlers")
+	}
+
+	if err := p1.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := p2.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaxConcurrentCalls(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithMaxConcurrentCalls(2))
+	b := &Blocker{release: make(chan struct{})}
+	s.Register(b)
+	c := NewClientWithServer(h2, "rpc", nil)
+	local := NewClientWithServer(h1, "rpc", s)
+
+	done := make(chan *Call, 2)
+	var r1, r2 int
+	c.Go(h1.ID(), "Blocker", "Wait", 1, &r1, done)
+	local.Go(h1.ID(), "Blocker", "Wait", 2, &r2, done)
+	for s.Stats().RunningCalls != 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var r int
+	if err := c.Call(h1.ID(), "Blocker", "Wait", 3, &r); err != ErrOverloaded {
+		t.Error("expected ErrOverloaded:", err)
+	}
+	if err := local.CallLocal("Blocker", "Wait", 3, &r); err != ErrOverloaded {
+		t.Error("expected ErrOverloaded in local calls:", err)
+	}
+
+	close(b.release)
+	for i := 0; i < 2; i++ {
+		if call := <-done; call.Error != nil {
+			t.Error(call.Error)
+		}
+	}
+	if n := s.Stats().RunningCalls; n != 0 {
+		t.Error("no calls should be running:", n)
+	}
+}
+
+func TestClockSync(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	NewServer(h1, "rpc")
+	c := NewClient(h2, "rpc")
+
+	start := time.Now()
+	rtt, offset, err := c.ClockSync(context.Background(), h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if rtt <= 0 || rtt > elapsed {
+		t.Error("wrong round-trip time:", rtt, elapsed)
+	}
+	// Both peers share the clock.
+	if offset < -rtt || offset > rtt {
+		t.Error("offset is outside the error bounds:", offset, rtt)
+	}
+
+	// The server times are taken when the request header is read and
+	// when the response is sent.
+	var times [2]int64
+	sent := time.Now().UnixNano()
+	if err := c.Call(h1.ID(), clockServiceName, "Now", struct{}{}, &times); err != nil {
+		t.Fatal(err)
+	}
+	if times[0] < sent || times[1] < times[0] || times[1] > time.Now().UnixNano() {
+		t.Error("wrong server times:", sent, times)
+	}
+
+	// Servers may opt out of the clock service.
+	NewServer(h1, "noclock", WithClockService(false))
+	c = NewClient(h2, "noclock")
+	if _, _, err := c.ClockSync(context.Background(), h1.ID()); err == nil {
+		t.Error("expected an error without the clock service")
+	}
+}
+
+func TestDumpFrame(t *testing.T) {
+	var client, server bytes.Buffer
+	cenc := newEncoder(nil, &client)
+	senc := newEncoder(nil, &server)
+	svcID := ServiceID{"Arith", "Multiply"}
+	cenc.Encode(RequestHeader{ServiceID: svcID, ID: 3, Metadata: Metadata{"k": "v"}})
+	cenc.Encode(&Args{2, 3})
+	senc.Encode(ResponseHeader{Service: svcID, Error: "failed", ID: 3})
+	senc.Encode(0)
+	// A streaming call.
+	counter := ServiceID{"Counter", "Count"}
+	cenc.Encode(RequestHeader{ServiceID: counter, Stream: true, Window: 2})
+	cenc.Encode(2)
+	cenc.Encode(streamCredit{Credits: 3})
+	senc.Encode(streamFrame{Type: frameItem})
+	senc.Encode(5)
+	senc.Encode(streamFrame{Type: frameKeepalive})
+	senc.Encode(streamFrame{Type: frameTrailer, Error: "too many"})
+
+	// DumpFrame reads the first request only.
+	f, err := DumpFrame(bytes.NewReader(client.Bytes()))
+	if err != nil || f.Kind != RequestFrame || f.Request.ID != 3 {
+		t.Fatal("expected the first request:", f, err)
+	}
+
+	r := NewFrameReader(bufio.NewReader(&client), FromClient)
+	sr := NewFrameReader(bufio.NewReader(&server), FromServer)
+	next := func(r *FrameReader, kind FrameKind) Frame {
+		t.Helper()
+		f, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Kind != kind {
+			t.Fatal("wrong frame kind:", f.Kind, kind)
+		}
+		return f
+	}
+
+	f = next(r, RequestFrame)
+	if f.Request.ServiceID != svcID || f.Request.ID != 3 || f.Request.Metadata["k"] != "v" {
+		t.Error("wrong request header:", f.Request)
+	}
+	if f.Body == nil {
+		t.Error("the arguments should have been read")
+	}
+	sr.Answer(*f.Request)
+	f = next(sr, ResponseFrame)
+	if f.Response.Service != svcID || f.Response.Error != "failed" || f.Response.ID != 3 {
+		t.Error("wrong response header:", f.Response)
+	}
+
+	f = next(r, RequestFrame)
+	sr.Answer(*f.Request)
+	if f = next(r, StreamCreditFrame); f.Credits != 3 {
+		t.Error("wrong credits:", f.Credits)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Error("expected io.EOF:", err)
+	}
+	if f = next(sr, StreamItemFrame); f.Body == nil {
+		t.Error("the item should have been read")
+	}
+	next(sr, StreamKeepaliveFrame)
+	if f = next(sr, StreamTrailerFrame); f.Error != "too many" {
+		t.Error("wrong trailer error:", f.Error)
+	}
+	if _, err := sr.Next(); err != io.EOF {
+		t.Error("expected io.EOF:", err)
+	}
+
+	// A pipe call, whose chunks are not encoded, and a cancellation.
+	client.Reset()
+	server.Reset()
+	cw, sw := bufio.NewWriter(&client), bufio.NewWriter(&server)
+	cenc, senc = newEncoder(nil, cw), newEncoder(nil, sw)
+	cenc.Encode(RequestHeader{ServiceID: ServiceID{"Piper", "Upper"}, Pipe: true})
+	cenc.Encode(1)
+	writeFrames(cw, []byte("abc"))
+	writeFrames(cw, nil)
+	cw.Flush()
+	senc.Encode(ResponseHeader{})
+	senc.Encode(nil)
+	writeFrames(sw, []byte("ABC"))
+	writeFrames(sw, nil)
+	senc.Encode(ResponseHeader{Error: "pipe failed"})
+	senc.Encode(nil)
+	sw.Flush()
+
+	r = NewFrameReader(&client, FromClient)
+	if f = next(r, RequestFrame); !f.Request.Pipe {
+		t.Error("expected the pipe request:", f.Request)
+	}
+	if f = next(r, PipeChunkFrame); string(f.Body.([]byte)) != "abc" {
+		t.Error("wrong chunk:", f.Body)
+	}
+	if f = next(r, PipeChunkFrame); len(f.Body.([]byte)) != 0 {
+		t.Error("expected the last chunk:", f.Body)
+	}
+
+	sr = NewFrameReader(&server, FromServer)
+	sr.Answer(RequestHeader{Pipe: true})
+	if f = next(sr, ResponseFrame); f.Response.Error != "" {
+		t.Error("the pipe should be accepted:", f.Response)
+	}
+	if f = next(sr, PipeChunkFrame); string(f.Body.([]byte)) != "ABC" {
+		t.Error("wrong chunk:", f.Body)
+	}
+	next(sr, PipeChunkFrame)
+	if f = next(sr, ResponseFrame); f.Response.Error != "pipe failed" {
+		t.Error("wrong final response:", f.Response)
+	}
+
+	client.Reset()
+	cenc = newEncoder(nil, &client)
+	cenc.Encode(RequestHeader{Cancel: &CancelError{Reason: "gave up"}})
+	r = NewFrameReader(&client, FromClient)
+	if f = next(r, CancelFrame); f.Request.Cancel.Reason != "gave up" {
+		t.Error("wrong cancel reason:", f.Request.Cancel)
+	}
+}
+
+type Tracer struct {
+	c    *Client
+	next peer.ID // if set, calls are forwarded to this peer
+}
+
+func (tr *Tracer) RequestID(ctx context.Context, args int, reply *string) error {
+	if tr.next != "" {
+		return tr.c.CallContext(ctx, tr.next, "Tracer", "RequestID", args, reply)
+	}
+	*reply = RequestIDFromContext(ctx)
+	return nil
+}
+
+func TestRequestID(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var mu sync.Mutex
+	var seen []string
+	record := func(ctx context.Context, info CallInfo, handler func(context.Context) error) error {
+		mu.Lock()
+		seen = append(seen, info.RequestID)
+		mu.Unlock()
+		return handler(ctx)
+	}
+
+	// h2 forwards calls to h1, which answers with the request ID.
+	s1 := NewServer(h1, "rpc", WithPolicy(Policy{Interceptors: []Interceptor{record}}))
+	s1.Register(&Tracer{})
+	s2 := NewServer(h2, "rpc")
+	s2.Register(&Tracer{c: NewClient(h2, "rpc"), next: h1.ID()})
+
+	n := 0
+	c := NewClient(h1, "rpc", WithRequestIDGenerator(func() string {
+		n++
+		return fmt.Sprintf("req-%d", n)
+	}))
+
+	var id string
+	if err := c.Call(h2.ID(), "Tracer", "RequestID", 0, &id); err != nil {
+		t.Fatal(err)
+	}
+	if id != "req-1" {
+		t.Error("the request ID should have been propagated:", id)
+	}
+
+	ctx := WithRequestID(context.Background(), "mine")
+	if err := c.CallContext(ctx, h2.ID(), "Tracer", "RequestID", 0, &id); err != nil {
+		t.Fatal(err)
+	}
+	if id != "mine" {
+		t.Error("the given request ID should have been used:", id)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 || seen[0] != "req-1" || seen[1] != "mine" {
+		t.Error("interceptors should see the request IDs:", seen)
+	}
+}
+
+func TestCallCancel(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	b := &Blocker{release: make(chan struct{})}
+	defer close(b.release)
+	s.Register(b)
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc")
+
+	var r int
+	call := c.Start(context.Background(), h1.ID(), "Blocker", "Wait", 1, &r, nil)
+	for len(s.InFlight()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	call.Cancel()
+	select {
+	case <-call.Done:
+		if call.Error != context.Canceled {
+			t.Error("expected context.Canceled:", call.Error)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the call should have been aborted")
+	}
+	call = c.Start(context.Background(), h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, nil)
+	<-call.Done
+	if call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	// Cancelling a completed call is a no-op.
+	call.Cancel()
+	if call.Error != nil || r != 6 {
+		t.Error("the completed call should not change:", call.Error, r)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	s := NewServer(nil, "rpc")
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(nil, "rpc")
+
+	cliEnd, srvEnd := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		s.ServeConn(srvEnd)
+		close(served)
+	}()
+
+	var r int
+	ctx := context.Background()
+	for i := 1; i < 4; i++ {
+		if err := c.CallConn(ctx, cliEnd, "Arith", "Multiply", &Args{2, i}, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r != 2*i {
+			t.Error("result is:", r)
+		}
+	}
+	err := c.CallConn(ctx, cliEnd, "Arith", "GimmeError", &Args{2, 3}, &r)
+	if err == nil || err.Error() != "an error" {
+		t.Error("expected the method error:", err)
+	}
+
+	cliEnd.Close()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeConn should return when the client closes")
+	}
+}
+
+func TestValidator(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var mu sync.Mutex
+	var validated []*Args
+	positive := func(args interface{}) error {
+		a := args.(*Args)
+		mu.Lock()
+		validated = append(validated, a)
+		mu.Unlock()
+		if a.A <= 0 || a.B <= 0 {
+			return errors.New("arguments must be positive")
+		}
+		return nil
+	}
+	s := NewServer(h1, "rpc", WithValidator("Arith", "Multiply", positive))
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc")
+	local := NewClientWithServer(h1, "rpc", s)
+
+	for _, cl := range []*Client{c, local} {
+		var r int
+		if err := cl.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r != 6 {
+			t.Error("result is:", r)
+		}
+		r = 0
+		err := cl.Call(h1.ID(), "Arith", "Multiply", &Args{2, 0}, &r)
+		if err == nil || !strings.Contains(err.Error(), "arguments must be positive") {
+			t.Error("expected a validation error:", err)
+		}
+		if r != 0 {
+			t.Error("the method should not have run")
+		}
+		// Other methods are not validated.
+		if err := cl.Call(h1.ID(), "Arith", "Add", Args{2, 0}, &r); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(validated) != 4 {
+		t.Error("the validator should have run for every Multiply call:", len(validated))
+	}
+}
+
+func TestPeerStatus(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc")
+
+	if _, ok := c.PeerStatus(h1.ID()); ok {
+		t.Error("no calls have been made yet")
+	}
+
+	var r int
+	before := time.Now()
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	st, ok := c.PeerStatus(h1.ID())
+	if !ok {
+		t.Fatal("the status should be known")
+	}
+	if st.LastError != nil || st.LastLatency <= 0 || st.LastCall.Before(before) {
+		t.Error("wrong status:", st)
+	}
+	if st.LastContact != st.LastCall {
+		t.Error("the peer answered the last call")
+	}
+
+	c.Call(h1.ID(), "Arith", "GimmeError", &Args{2, 3}, &r)
+	st, _ = c.PeerStatus(h1.ID())
+	if st.LastError == nil || st.LastContact != st.LastCall {
+		t.Error("application errors mean the peer answered:", st)
+	}
+
+	h1.Close()
+	lastContact := st.LastContact
+	c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	st, _ = c.PeerStatus(h1.ID())
+	if st.LastError == nil || st.LastContact != lastContact {
+		t.Error("the peer should not have answered:", st)
+	}
+}
+
+type Producer struct {
+	sent int32
+}
+
+// Produce sends the given number of items.
+func (p *Producer) Produce(ctx context.Context, n int, stream *ServerStream) error {
+	for i := 0; i < n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+		atomic.AddInt32(&p.sent, 1)
+	}
+	return nil
+}
+
+func TestStreamWindow(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	p := &Producer{}
+	s.Register(p)
+	c := NewClient(h2, "rpc", WithStreamWindow(4))
+
+	stream, err := c.Stream(context.Background(), h1.ID(), "Producer", "Produce", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	waitSent := func(n int32) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for atomic.LoadInt32(&p.sent) != n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if sent := atomic.LoadInt32(&p.sent); sent != n {
+			t.Fatal("wrong number of items sent:", sent, n)
+		}
+	}
+
+	var item int
+	waitSent(4)
+	if err := stream.Recv(&item); err != nil {
+		t.Fatal(err)
+	}
+	waitSent(4)
+	// Half of the window has been consumed.
+	if err := stream.Recv(&item); err != nil {
+		t.Fatal(err)
+	}
+	waitSent(6)
+
+	received := 2
+	for {
+		if err := stream.Recv(&item); err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+		if item != received {
+			t.Error("wrong item:", item, received)
+		}
+		received++
+	}
+	if received != 20 {
+		t.Error("wrong number of items received:", received)
+	}
+}
+
+func TestCallWithFailover(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var mu sync.Mutex
+	executed := 0
+	count := func(ctx context.Context, info CallInfo, handler func(context.Context) error) error {
+		mu.Lock()
+		executed++
+		mu.Unlock()
+		return handler(ctx)
+	}
+	s := NewServer(h1, "rpc", WithPolicy(Policy{Interceptors: []Interceptor{count}}))
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc")
+
+	bad := peer.ID("unreachable")
+	pids := []peer.ID{bad, h1.ID()}
+	ctx := context.Background()
+
+	var r int
+	policy := FailoverPolicy{Rotate: true, Backoff: 10 * time.Millisecond}
+	pid, err := c.CallWithFailover(ctx, pids, policy, "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil || pid != h1.ID() || r != 6 {
+		t.Error("the second peer should have answered:", pid, err, r)
+	}
+
+	// The attempts are split among the peers.
+	policy = FailoverPolicy{Attempts: 3}
+	pid, err = c.CallWithFailover(ctx, pids, policy, "Arith", "Multiply", &Args{2, 4}, &r)
+	if err != nil || pid != h1.ID() || r != 8 {
+		t.Error("the second peer should have answered:", pid, err, r)
+	}
+
+	// Application errors are not retried.
+	pids = []peer.ID{h1.ID(), h1.ID()}
+	pid, err = c.CallWithFailover(ctx, pids, policy, "Arith", "GimmeError", &Args{2, 3}, &r)
+	if err == nil || pid != h1.ID() {
+		t.Error("expected the method error:", pid, err)
+	}
+
+	pid, err = c.CallWithFailover(ctx, []peer.ID{bad}, policy, "Arith", "Multiply", &Args{2, 3}, &r)
+	if err == nil || pid != "" {
+		t.Error("all the attempts should have failed:", pid, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if executed != 3 {
+		t.Error("wrong number of calls executed:", executed)
+	}
+}
+
+func TestStrictDecoding(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var arith Arith
+	strict := NewServer(h1, "rpc-strict", WithStrictDecoding(true))
+	strict.Register(&arith)
+	lenient := NewServer(h1, "rpc")
+	lenient.Register(&arith)
+
+	type newArgs struct {
+		A, B, C int
+	}
+	type oldQuotient struct {
+		Quo int
+	}
+
+	var r int
+	c := NewClient(h2, "rpc-strict", WithClientStrictDecoding(true))
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Fatal("known fields should decode:", err, r)
+	}
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &newArgs{2, 3, 4}, &r); err == nil {
+		t.Error("the strict server should reject unknown fields")
+	}
+	var q oldQuotient
+	if err := c.Call(h1.ID(), "Arith", "Divide", &Args{7, 2}, &q); err == nil {
+		t.Error("the strict client should reject unknown fields")
+	}
+
+	c = NewClient(h2, "rpc")
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &newArgs{2, 4, 4}, &r); err != nil || r != 8 {
+		t.Error("the lenient server should ignore unknown fields:", err, r)
+	}
+	if err := c.Call(h1.ID(), "Arith", "Divide", &Args{7, 2}, &q); err != nil || q.Quo != 3 {
+		t.Error("the lenient client should ignore unknown fields:", err, q)
+	}
+
+	// Handles given by the application are left alone.
+	shared := &codec.MsgpackHandle{}
+	NewServer(h1, "rpc-shared", WithMsgpackHandle(shared), WithStrictDecoding(true))
+	c = NewClient(h2, "rpc-strict", WithClientMsgpackHandle(shared), WithClientStrictDecoding(true))
+	if shared.ErrorIfNoField {
+		t.Error("the shared handle should not be modified")
+	}
+	if c := NewClient(h2, "rpc", WithBufferPool(), WithClientStrictDecoding(false)); c.msgpackHandle != nil {
+		t.Error("strict decoding should not prevent pooling buffers")
+	}
+
+	// Headers are not decoded strictly: a rejected streaming call
+	// still reports why.
+	strict.Register(&Counter{})
+	strict.Pause()
+	cs, err := c.Stream(context.Background(), h1.ID(), "Counter", "Count", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Recv(new(int)); err != ErrPaused {
+		t.Error("expected ErrPaused:", err)
+	}
+}
+
+func TestLocalCallPolicy(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var mu sync.Mutex
+	var intercepted []CallInfo
+	record := func(ctx context.Context, info CallInfo, handler func(context.Context) error) error {
+		mu.Lock()
+		intercepted = append(intercepted, info)
+		mu.Unlock()
+		return handler(ctx)
+	}
+	s := NewServer(h1, "rpc", WithPolicy(Policy{
+		Authorize: func(pid peer.ID, svcID ServiceID) bool {
+			return svcID.Method != "Divide"
+		},
+		Interceptors: []Interceptor{record},
+	}))
+	var arith Arith
+	s.Register(&arith)
+	c := NewClientWithServer(h1, "rpc", s)
+
+	var r int
+	if err := c.CallLocal("Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Fatal(err, r)
+	}
+	var q Quotient
+	if err := c.CallLocal("Arith", "Divide", &Args{6, 3}, &q); err != ErrUnauthorized {
+		t.Error("expected ErrUnauthorized:", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(intercepted) != 1 || intercepted[0].Peer != h1.ID() || intercepted[0].Method != "Multiply" {
+		t.Error("the local call should have been intercepted:", intercepted)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var recording, cliRecording bytes.Buffer
+	s := NewServer(h1, "rpc", WithRecorder(&recording))
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc", WithClientRecorder(&cliRecording))
+
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{6, 7}, &r); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond) // let the server finish the stream
+
+	streams, err := ReadRecording(&recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 {
+		t.Fatal("expected one recorded stream:", len(streams))
+	}
+	rs := streams[0]
+	if rs.Peer != h2.ID() || rs.Protocol != "rpc" {
+		t.Error("unexpected stream metadata:", rs.Peer, rs.Protocol)
+	}
+
+	// Replaying the requests to a server gives the same responses.
+	s2 := NewServer(nil, "rpc")
+	s2.Register(&arith)
+	conn := rs.Replay()
+	s2.ServeConn(conn)
+	if !bytes.Equal(conn.Written(), rs.Out) {
+		t.Error("replayed responses differ from the recorded ones")
+	}
+
+	// Replaying the responses to a client gives the recorded reply.
+	cliStreams, err := ReadRecording(&cliRecording)
+	if err != nil || len(cliStreams) != 1 {
+		t.Fatal("expected one client stream:", err)
+	}
+	if !bytes.Equal(cliStreams[0].In, rs.Out) {
+		t.Error("the client should have received what the server sent")
+	}
+	r = 0
+	c2 := NewClient(nil, "rpc")
+	err = c2.CallConn(context.Background(), cliStreams[0].Replay(), "Arith", "Multiply", &Args{6, 7}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 42 {
+		t.Error("replayed reply is:", r)
+	}
+
+	if _, err := ReadRecording(strings.NewReader(`{"format":"other","version":1}`)); err == nil {
+		t.Error("expected an error for other formats")
+	}
+}
+
+func TestCallResult(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc")
+	ctx := context.Background()
+
+	r, err := CallInt(ctx, c, h1.ID(), "Arith", "Multiply", &Args{6, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 42 {
+		t.Error("result is:", r)
+	}
+
+	q, err := CallResult[Quotient](ctx, c, h1.ID(), "Arith", "Divide", &Args{7, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Quo != 3 || q.Rem != 1 {
+		t.Error("unexpected quotient:", q)
+	}
+
+	q, err = CallResult[Quotient](ctx, c, h1.ID(), "Arith", "Divide", &Args{7, 0})
+	if err == nil || q != (Quotient{}) {
+		t.Error("expected an error and the zero value:", err, q)
+	}
+}
+
+func TestRequireAddresses(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc", WithRequireAddresses())
+
+	var r int
+	err := c.Call(peer.ID("unreachable"), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != ErrNoAddresses {
+		t.Error("expected ErrNoAddresses:", err)
+	}
+
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+}
+
+func TestCallName(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+
+	resolver := func(ctx context.Context, name string) ([]peer.ID, error) {
+		if name != "arith" {
+			return nil, nil
+		}
+		return []peer.ID{peer.ID("unreachable"), h1.ID()}, nil
+	}
+	c := NewClient(h2, "rpc", WithResolver(resolver))
+
+	var r int
+	if err := c.CallName(context.Background(), "arith", "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+	if err := c.CallName(context.Background(), "other", "Arith", "Multiply", &Args{2, 3}, &r); err == nil {
+		t.Error("expected an error for names without peers")
+	}
+}
+
+type Logged struct{}
+
+func (Logged) Prefix(ctx context.Context, args int, reply *string) error {
+	l, ok := LoggerFromContext(ctx).(*callLogger)
+	if !ok {
+		return errors.New("no call logger")
+	}
+	l.Debugf("called with %d", args)
+	*reply = l.prefix
+	return nil
+}
+
+func TestLoggerFromContext(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(Logged{})
+	c := NewClient(h2, "rpc")
+
+	var prefix string
+	ctx := WithRequestID(context.Background(), "req-1")
+	if err := c.CallContext(ctx, h1.ID(), "Logged", "Prefix", 1, &prefix); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[req-1] Logged.Prefix from " + h2.ID().Pretty() + ": "
+	if prefix != expected {
+		t.Errorf("prefix is %q, expected %q", prefix, expected)
+	}
+
+	if LoggerFromContext(context.Background()) != logger {
+		t.Error("expected the package logger outside of handlers")
+	}
+}
+
+func TestRegisterMethod(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	err := RegisterMethod(s, "Typed", "Double", func(ctx context.Context, n int) (int, error) {
+		return 2 * n, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RegisterMethod(s, "Typed", "Divide", func(ctx context.Context, args *Args) (Quotient, error) {
+		if args.B == 0 {
+			return Quotient{}, errors.New("divide by zero")
+		}
+		return Quotient{args.A / args.B, args.A % args.B}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RegisterMethod(s, "Typed", "Double", func(ctx context.Context, n int) (int, error) {
+		return n, nil
+	})
+	if err == nil {
+		t.Error("expected an error registering the same method twice")
+	}
+	var arith Arith
+	s.Register(&arith)
+	err = RegisterMethod(s, "Arith", "Double", func(ctx context.Context, n int) (int, error) {
+		return n, nil
+	})
+	if err == nil {
+		t.Error("expected an error adding methods to a registered type")
+	}
+
+	c := NewClient(h2, "rpc")
+	var r int
+	if err := c.Call(h1.ID(), "Typed", "Double", 21, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != 42 {
+		t.Error("result is:", r)
+	}
+	var q Quotient
+	if err := c.Call(h1.ID(), "Typed", "Divide", &Args{7, 2}, &q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Quo != 3 || q.Rem != 1 {
+		t.Error("unexpected quotient:", q)
+	}
+	if err := c.Call(h1.ID(), "Typed", "Divide", &Args{7, 0}, &q); err == nil || err.Error() != "divide by zero" {
+		t.Error("expected the method error:", err)
+	}
+
+	// Local calls too.
+	local := NewClientWithServer(h1, "rpc", s)
+	if err := local.Call(h1.ID(), "Typed", "Double", 4, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != 8 {
+		t.Error("result is:", r)
+	}
+}
+
+func TestMaxHeaderSize(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithMaxHeaderSize(512))
+	var arith Arith
+	s.Register(&arith)
+	RegisterMethod(s, "Echo", "Echo", func(ctx context.Context, msg string) (string, error) {
+		return msg, nil
+	})
+	c := NewClient(h2, "rpc")
+
+	var r int
+	ctx := WithMetadata(context.Background(), Metadata{"small": "value"})
+	if err := c.CallContext(ctx, h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx = WithMetadata(context.Background(), Metadata{"big": strings.Repeat("x", 1024)})
+	err := c.CallContext(ctx, h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != ErrHeaderTooLarge {
+		t.Error("expected ErrHeaderTooLarge:", err)
+	}
+
+	// Large arguments are fine.
+	var echo string
+	if err := c.Call(h1.ID(), "Echo", "Echo", strings.Repeat("x", 1024), &echo); err != nil {
+		t.Error("the limit should not apply to arguments:", err)
+	}
+}
+
+func TestStreamItems(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Producer{})
+	c := NewClient(h2, "rpc")
+	ctx := context.Background()
+
+	cs, err := c.Stream(ctx, h1.ID(), "Producer", "Produce", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for item, err := range StreamItems[int](cs) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, item)
+	}
+	if len(got) != 5 || got[4] != 4 {
+		t.Error("unexpected items:", got)
+	}
+
+	// Leaving the loop early closes the stream.
+	cs, err = c.Stream(ctx, h1.ID(), "Producer", "Produce", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for item := range StreamItems[int](cs) {
+		if item == 2 {
+			break
+		}
+	}
+	if err := cs.Recv(new(int)); err == nil || err == io.EOF {
+		t.Error("the stream should have been closed:", err)
+	}
+}
+
+func TestMaxStreamAge(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc", WithStreamPool(2, 0), WithMaxStreamAge(300*time.Millisecond))
+
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	stats := c.Stats()
+	if stats.OpenStreams != 1 || stats.OldestIdleStream <= 0 {
+		t.Error("expected an idle stream:", stats)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	stats = c.Stats()
+	if stats.OpenStreams != 0 || stats.OldestIdleStream != 0 {
+		t.Error("the old stream should have been closed:", stats)
+	}
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamMany(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Producer{})
+	c := NewClient(h2, "rpc")
+
+	pids := []peer.ID{h1.ID(), h1.ID(), peer.ID("unreachable")}
+	items := make(map[int]int)
+	var errs int
+	for pi := range StreamMany[int](context.Background(), c, pids, "Producer", "Produce", 3) {
+		if pi.Err != nil {
+			if pi.Peer != "unreachable" {
+				t.Error("unexpected error:", pi.Peer, pi.Err)
+			}
+			errs++
+			continue
+		}
+		items[pi.Item]++
+	}
+	if errs != 1 {
+		t.Error("expected one error:", errs)
+	}
+	for i := 0; i < 3; i++ {
+		if items[i] != 2 {
+			t.Errorf("item %d received %d times", i, items[i])
+		}
+	}
+}
+
+type Auditor struct {
+	mu     sync.Mutex
+	signed []*SignedRequest
+}
+
+func (a *Auditor) Record(ctx context.Context, args *Args, reply *int) error {
+	signed, ok := SignedRequestFromContext(ctx)
+	if !ok {
+		return errors.New("request not signed")
+	}
+	a.mu.Lock()
+	a.signed = append(a.signed, signed)
+	a.mu.Unlock()
+	*reply = args.A + args.B
+	return nil
+}
+
+func TestRequestSigning(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithRequireSignatures())
+	auditor := &Auditor{}
+	s.Register(auditor)
+
+	c := NewClient(h2, "rpc", WithRequestSigning())
+	var r int
+	if err := c.Call(h1.ID(), "Auditor", "Record", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != 5 {
+		t.Error("result is:", r)
+	}
+
+	unsigned := NewClient(h2, "rpc")
+	if err := unsigned.Call(h1.ID(), "Auditor", "Record", &Args{2, 3}, &r); err != ErrBadSignature {
+		t.Error("expected ErrBadSignature:", err)
+	}
+
+	// Recorded requests can be verified later.
+	signed := auditor.signed[0]
+	signer, err := signed.Verify()
+	if err != nil || signer != h2.ID() {
+		t.Error("expected a valid signature by the client:", signer, err)
+	}
+	tampered := *signed
+	tampered.Payload = append([]byte(nil), signed.Payload...)
+	tampered.Payload[len(tampered.Payload)-1] ^= 0xff
+	if _, err := tampered.Verify(); err != ErrBadSignature {
+		t.Error("expected tampered requests to fail verification:", err)
+	}
+}
+
+func TestMaxStreamsPerConn(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	blocker := &Blocker{release: make(chan struct{})}
+	s.Register(blocker)
+	c := NewClient(h2, "rpc", WithMaxStreamsPerConn(1))
+
+	done := make(chan *Call, 2)
+	c.Go(h1.ID(), "Blocker", "Wait", 1, new(int), done)
+	time.Sleep(200 * time.Millisecond)
+
+	// The second call cannot get a stream while the first one runs.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := c.CallContext(ctx, h1.ID(), "Blocker", "Wait", 1, new(int))
+	if err != context.DeadlineExceeded {
+		t.Error("expected the call to wait for a stream:", err)
+	}
+
+	c.Go(h1.ID(), "Blocker", "Wait", 1, new(int), done)
+	close(blocker.release)
+	for i := 0; i < 2; i++ {
+		if call := <-done; call.Error != nil {
+			t.Error(call.Error)
+		}
+	}
+}
+
+func TestClientDrain(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	blocker := &Blocker{release: make(chan struct{})}
+	s.Register(blocker)
+	c := NewClient(h2, "rpc")
+
+	done := make(chan *Call, 1)
+	var r int
+	c.Go(h1.ID(), "Blocker", "Wait", 7, &r, done)
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := c.Drain(ctx); err != context.DeadlineExceeded {
+		t.Error("Drain should wait for the call in progress:", err)
+	}
+	if err := c.Call(h1.ID(), "Blocker", "Wait", 1, &r); err != ErrClientDraining {
+		t.Error("expected ErrClientDraining:", err)
+	}
+
+	close(blocker.release)
+	if err := c.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if call := <-done; call.Error != nil || r != 7 {
+		t.Error("the call should have finished normally:", call.Error, r)
+	}
+}
+
+// flakyHost fails to open the first streams.
+type flakyHost struct {
+	host.Host
+	failures int32
+}
+
+func (h *flakyHost) NewStream(ctx context.Context, pid peer.ID, protos ...protocol.ID) (inet.Stream, error) {
+	if atomic.AddInt32(&h.failures, -1) >= 0 {
+		return nil, errors.New("stream reset during handshake")
+	}
+	return h.Host.NewStream(ctx, pid, protos...)
+}
+
+func TestStreamOpenRetry(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+
+	var r int
+	c := NewClient(&flakyHost{Host: h2, failures: 2}, "rpc", WithStreamOpenRetry(3, 10*time.Millisecond))
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+
+	c = NewClient(&flakyHost{Host: h2, failures: 2}, "rpc", WithStreamOpenRetry(2, 10*time.Millisecond))
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err == nil {
+		t.Error("expected the call to fail after two attempts")
+	}
+}
+
+// makeNode creates a node which knows the given ones, and is known by
+// them, in addition to those made with makeRandomNodes.
+func makeNode(addr string, known ...host.Host) host.Host {
+	priv, pub, _ := crypto.GenerateKeyPair(crypto.RSA, 2048)
+	pid, _ := peer.IDFromPublicKey(pub)
+	maddr, _ := multiaddr.NewMultiaddr(addr)
+
+	ps := peerstore.NewPeerstore()
+	ps.AddPubKey(pid, pub)
+	ps.AddPrivKey(pid, priv)
+	for _, h := range known {
+		ps.AddPubKey(h.ID(), h.Peerstore().PubKey(h.ID()))
+		ps.AddAddrs(h.ID(), h.Addrs(), peerstore.PermanentAddrTTL)
+		h.Peerstore().AddPubKey(pid, pub)
+		h.Peerstore().AddAddrs(pid, []multiaddr.Multiaddr{maddr}, peerstore.PermanentAddrTTL)
+	}
+	n, _ := swarm.NewNetwork(context.Background(), []multiaddr.Multiaddr{maddr}, pid, ps, nil)
+	return basic.New(n)
+}
+
+type Relay struct {
+	c    *Client
+	next peer.ID // if set, calls are forwarded to this peer
+}
+
+// Remaining returns the time left until the deadline at the end of the
+// chain, in milliseconds.
+func (r *Relay) Remaining(ctx context.Context, args int, reply *int64) error {
+	if r.next != "" {
+		return r.c.CallContext(ctx, r.next, "Relay", "Remaining", args, reply)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.New("no deadline")
+	}
+	*reply = int64(time.Until(deadline) / time.Millisecond)
+	return nil
+}
+
+// Sleep waits for the given milliseconds at the end of the chain.
+func (r *Relay) Sleep(ctx context.Context, ms int, reply *int64) error {
+	if r.next != "" {
+		return r.c.CallContext(ctx, r.next, "Relay", "Sleep", ms, reply)
+	}
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestDeadlineInheritance(t *testing.T) {
+	hA, hB := makeRandomNodes()
+	defer hA.Close()
+	defer hB.Close()
+	hC := makeNode("/ip4/127.0.0.1/tcp/19997", hA, hB)
+	defer hC.Close()
+
+	sB := NewServer(hB, "rpc")
+	sB.Register(&Relay{c: NewClient(hB, "rpc"), next: hC.ID()})
+	sC := NewServer(hC, "rpc")
+	sC.Register(&Relay{})
+	cA := NewClient(hA, "rpc")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var remaining int64
+	if err := cA.CallContext(ctx, hB.ID(), "Relay", "Remaining", 0, &remaining); err != nil {
+		t.Fatal(err)
+	}
+	if remaining <= 0 || remaining > 1000 {
+		t.Error("C should see the deadline set by A:", remaining)
+	}
+
+	// A's deadline aborts the whole chain.
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := cA.CallContext(ctx, hB.ID(), "Relay", "Sleep", 5000, &remaining)
+	if err == nil {
+		t.Fatal("expected the chain to time out")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("the chain should have been aborted at the deadline")
+	}
+}
+
+type Stateful struct{}
+
+func (Stateful) Greeting(ctx context.Context, name string, reply *string) error {
+	greeting, _ := StateFromContext(ctx).(string)
+	*reply = greeting + " " + name
+	return nil
+}
+
+func TestServerState(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	NewServer(h1, "rpc", WithState("hello")).Register(Stateful{})
+	NewServer(h2, "rpc", WithState("bye")).Register(Stateful{})
+	c := NewClient(h2, "rpc")
+
+	var reply string
+	if err := c.Call(h1.ID(), "Stateful", "Greeting", "alice", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "hello alice" {
+		t.Error("reply is:", reply)
+	}
+	if err := NewClient(h1, "rpc").Call(h2.ID(), "Stateful", "Greeting", "bob", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "bye bob" {
+		t.Error("reply is:", reply)
+	}
+	if StateFromContext(context.Background()) != nil {
+		t.Error("expected no state outside handlers")
+	}
+}
+
+type Piper struct{}
+
+func (Piper) Upper(ctx context.Context, times int, pipe *Pipe) error {
+	body, err := io.ReadAll(pipe)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < times; i++ {
+		if _, err := pipe.Write(bytes.ToUpper(body)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (Piper) Fail(ctx context.Context, args int, pipe *Pipe) error {
+	pipe.Write([]byte("partial"))
+	return errors.New("pipe failed")
+}
+
+func TestPipe(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	NewServer(h1, "rpc").Register(Piper{})
+	c := NewClient(h2, "rpc")
+	ctx := context.Background()
+
+	body := bytes.Repeat([]byte("abcdefgh"), 10000)
+	var reply bytes.Buffer
+	if err := c.Pipe(ctx, h1.ID(), "Piper", "Upper", 2, bytes.NewReader(body), &reply); err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat(bytes.ToUpper(body), 2)
+	if !bytes.Equal(reply.Bytes(), want) {
+		t.Error("unexpected reply of length", reply.Len())
+	}
+
+	reply.Reset()
+	err := c.Pipe(ctx, h1.ID(), "Piper", "Fail", 0, strings.NewReader("x"), &reply)
+	if err == nil || err.Error() != "pipe failed" {
+		t.Error("expected the method error:", err)
+	}
+	if reply.String() != "partial" {
+		t.Error("reply is:", reply.String())
+	}
+
+	// Pipe does not wait for a body blocked in Read once the method
+	// is done, and closes it.
+	pr, pw := io.Pipe()
+	piped := make(chan error, 1)
+	go func() {
+		piped <- c.Pipe(ctx, h1.ID(), "Piper", "Fail", 0, pr, io.Discard)
+	}()
+	select {
+	case err := <-piped:
+		if err == nil || err.Error() != "pipe failed" {
+			t.Error("expected the method error:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Pipe should not wait for a blocked body")
+	}
+	if _, err := pw.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Error("the body should have been closed:", err)
+	}
+
+	// Regular calls to pipe methods, and pipe calls to regular
+	// methods, are rejected.
+	var n int
+	if err := c.Call(h1.ID(), "Piper", "Upper", 1, &n); err == nil {
+		t.Error("expected an error calling a pipe method")
+	}
+	NewServer(h1, "rpc2").Register(new(Arith))
+	c2 := NewClient(h2, "rpc2")
+	err = c2.Pipe(ctx, h1.ID(), "Arith", "Add", &Args{1, 2}, strings.NewReader("x"), &reply)
+	if err == nil {
+		t.Error("expected an error piping to a regular method")
+	}
+	var sum int
+	if err := c2.Call(h1.ID(), "Arith", "Add", Args{1, 2}, &sum); err != nil || sum != 3 {
+		t.Error("regular calls should work after a rejected pipe:", sum, err)
+	}
+}
+
+func TestSetMethodEnabled(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(new(Arith))
+	c := NewClient(h2, "rpc")
+
+	if err := s.SetMethodEnabled("Arith", "Add", false); err != nil {
+		t.Fatal(err)
+	}
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Add", Args{1, 2}, &r); err != ErrMethodDisabled {
+		t.Error("expected ErrMethodDisabled:", err)
+	}
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Error("other methods should keep working:", r, err)
+	}
+
+	for _, svc := range s.Services() {
+		if svc.Name != "Arith" {
+			continue
+		}
+		for _, m := range svc.Methods {
+			if m.Enabled == (m.Name == "Add") {
+				t.Errorf("%s has the wrong enabled state", m.Name)
+			}
+		}
+	}
+
+	s.SetMethodEnabled("Arith", "Add", true)
+	if err := c.Call(h1.ID(), "Arith", "Add", Args{1, 2}, &r); err != nil || r != 3 {
+		t.Error("the method should be enabled again:", r, err)
+	}
+	if err := s.SetMethodEnabled("Arith", "Nope", false); err == nil {
+		t.Error("expected an error for unknown methods")
+	}
+}
+
+type Canceller struct {
+	causes chan error
+}
+
+func (c *Canceller) Wait(ctx context.Context, args int, reply *int) error {
+	<-ctx.Done()
+	c.causes <- context.Cause(ctx)
+	return ctx.Err()
+}
+
+func TestCancelReasons(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	canceller := &Canceller{causes: make(chan error, 1)}
+	s := NewServer(h1, "rpc")
+	s.Register(canceller)
+	s.Register(new(Arith))
+	c := NewClient(h2, "rpc", WithCancelReasons())
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(100*time.Millisecond, func() {
+		cancel(errors.New("user gave up"))
+	})
+	var r int
+	if err := c.CallContext(ctx, h1.ID(), "Canceller", "Wait", 0, &r); err != context.Canceled {
+		t.Error("expected context.Canceled:", err)
+	}
+	var cerr *CancelError
+	select {
+	case cause := <-canceller.causes:
+		if !errors.As(cause, &cerr) || cerr.Reason != "user gave up" || cerr.DeadlineExceeded {
+			t.Error("unexpected cause:", cause)
+		}
+		if !errors.Is(cause, context.Canceled) {
+			t.Error("the cause should match context.Canceled")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the method was not cancelled")
+	}
+
+	call := c.Start(context.Background(), h1.ID(), "Canceller", "Wait", 0, &r, nil)
+	time.Sleep(100 * time.Millisecond)
+	call.Cancel()
+	<-call.Done
+	select {
+	case cause := <-canceller.causes:
+		if !errors.As(cause, &cerr) || cerr.Reason != context.Canceled.Error() {
+			t.Error("unexpected cause:", cause)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the method was not cancelled")
+	}
+
+	if err := c.Call(h1.ID(), "Arith", "Add", Args{1, 2}, &r); err != nil || r != 3 {
+		t.Error("calls should work after cancelling:", r, err)
+	}
+}
+
+func TestSingleflight(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClient(h2, "rpc")
+	b := &Blocker{release: make(chan struct{})}
+	s.Register(b)
+
+	var wg sync.WaitGroup
+	replies := make([]int, 5)
+	errs := make([]error, 5)
+	for i := range replies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.CallContext(context.Background(), h1.ID(), "Blocker", "Wait", 7, &replies[i], WithSingleflight())
+		}(i)
+	}
+	// Give all the calls time to start.
+	time.Sleep(200 * time.Millisecond)
+	if n := len(s.InFlight()); n != 1 {
+		t.Error("expected a single call in the server:", n)
+	}
+	close(b.release)
+	wg.Wait()
+	for i := range replies {
+		if errs[i] != nil || replies[i] != 7 {
+			t.Error("unexpected result:", replies[i], errs[i])
+		}
+	}
+
+	// Calls sending different metadata are not shared.
+	b.release = make(chan struct{})
+	for i, token := range []string{"alice", "bob"} {
+		wg.Add(1)
+		ctx := WithMetadata(context.Background(), Metadata{"token": token})
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.CallContext(ctx, h1.ID(), "Blocker", "Wait", 7, &replies[i], WithSingleflight())
+		}(i)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := len(s.InFlight()); n != 2 {
+		t.Error("expected a call per metadata in the server:", n)
+	}
+	close(b.release)
+	wg.Wait()
+}
+
+func TestFallback(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithCodec("json", JSONCodec))
+	s.Register(new(Arith))
+	var seen []string
+	received := make(chan []byte, 1)
+	s.SetFallback(func(ctx context.Context, header RequestHeader, args []byte) ([]byte, error) {
+		seen = append(seen, header.Name+"."+header.Method)
+		if header.Method == "Echo" {
+			received <- args
+		}
+		if header.Method == "Fail" {
+			return nil, errors.New("no route")
+		}
+		return args, nil
+	})
+	c := NewClient(h2, "rpc")
+
+	var echo []int
+	if err := c.Call(h1.ID(), "Anything", "Echo", []int{1, 2, 3}, &echo); err != nil {
+		t.Fatal(err)
+	}
+	if len(echo) != 3 || echo[2] != 3 {
+		t.Error("unexpected reply:", echo)
+	}
+	// The arguments are passed as sent, not decoded and encoded again.
+	sent, err := marshalPayload(nil, nil, []int{1, 2, 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := <-received; !bytes.Equal(args, sent) {
+		t.Errorf("the arguments should be passed as sent: %q, %q", args, sent)
+	}
+	var jsonEcho Args
+	jsonClient := NewClient(h2, "rpc", WithClientCodec("json", JSONCodec))
+	if err := jsonClient.Call(h1.ID(), "Anything", "Echo", Args{4, 5}, &jsonEcho); err != nil || jsonEcho.B != 5 {
+		t.Error("unexpected reply with a codec:", jsonEcho, err)
+	}
+	if args := <-received; string(args) != `{"A":4,"B":5}` {
+		t.Errorf("the arguments should be passed as encoded by the codec: %q", args)
+	}
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Fail", Args{}, &r); err == nil || err.Error() != "no route" {
+		t.Error("expected the fallback error:", err)
+	}
+	if err := c.Call(h1.ID(), "Arith", "Add", Args{1, 2}, &r); err != nil || r != 3 {
+		t.Error("registered methods should take precedence:", r, err)
+	}
+	if len(seen) != 3 || seen[0] != "Anything.Echo" || seen[2] != "Arith.Fail" {
+		t.Error("unexpected fallback calls:", seen)
+	}
+
+	s.SetFallback(nil)
+	if err := c.Call(h1.ID(), "Anything", "Echo", 1, &r); err == nil {
+		t.Error("expected an error without fallback")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithCodec("json", JSONCodec))
+	s.Register(new(Arith))
+	jsonClient := NewClient(h2, "rpc", WithClientCodec("json", JSONCodec))
+	msgpackClient := NewClient(h2, "rpc")
+
+	var r int
+	if err := jsonClient.Call(h1.ID(), "Arith", "Multiply", &Args{3, 4}, &r); err != nil || r != 12 {
+		t.Error("json call failed:", r, err)
+	}
+	var q Quotient
+	if err := jsonClient.Call(h1.ID(), "Arith", "Divide", &Args{7, 2}, &q); err != nil || q.Quo != 3 || q.Rem != 1 {
+		t.Error("json call failed:", q, err)
+	}
+	if err := jsonClient.Call(h1.ID(), "Arith", "GimmeError", &Args{}, &r); err == nil || err.Error() != "an error" {
+		t.Error("expected the method error:", err)
+	}
+	if err := msgpackClient.Call(h1.ID(), "Arith", "Multiply", &Args{5, 4}, &r); err != nil || r != 20 {
+		t.Error("default call failed:", r, err)
+	}
+
+	gobClient := NewClient(h2, "rpc", WithClientCodec("gob", JSONCodec))
+	if err := gobClient.Call(h1.ID(), "Arith", "Multiply", &Args{3, 4}, &r); err == nil {
+		t.Error("expected an error for unsupported codecs")
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	NewServer(h1, "rpc").Register(new(Arith))
+	c := NewClient(h2, "rpc")
+
+	res := c.Benchmark(context.Background(), h1.ID(), "Arith", "Add", Args{1, 2}, BenchmarkOptions{
+		Concurrency: 4,
+		Calls:       100,
+	})
+	if res.Calls != 100 || res.Errors != 0 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if res.Throughput <= 0 || res.P50 > res.P99 || res.P99 > res.Max {
+		t.Errorf("unexpected measurements: %+v", res)
+	}
+
+	res = c.Benchmark(context.Background(), h1.ID(), "Arith", "GimmeError", &Args{}, BenchmarkOptions{
+		Concurrency: 2,
+		Duration:    100 * time.Millisecond,
+	})
+	if res.Calls == 0 || res.ErrorRate != 1 {
+		t.Errorf("expected all calls to fail: %+v", res)
+	}
+}
+
+func TestDecodeErrorHandler(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var seen error
+	s := NewServer(h1, "rpc", WithDecodeErrorHandler(func(header RequestHeader, err error) error {
+		seen = err
+		return fmt.Errorf("bad arguments for %s.%s: upgrade your client", header.Name, header.Method)
+	}))
+	s.Register(new(Arith))
+	c := NewClient(h2, "rpc")
+
+	var r int
+	err := c.Call(h1.ID(), "Arith", "Multiply", "not args", &r)
+	if err == nil || err.Error() != "bad arguments for Arith.Multiply: upgrade your client" {
+		t.Error("expected the translated error:", err)
+	}
+	if seen == nil {
+		t.Error("the handler should have seen the decode error")
+	}
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Error("calls should work afterwards:", r, err)
+	}
+}
+
+type Events struct{}
+
+func (Events) Emit(ctx context.Context, flush bool, stream *ServerStream) error {
+	if err := stream.Send(1); err != nil {
+		return err
+	}
+	if flush {
+		stream.Flush()
+	}
+	time.Sleep(500 * time.Millisecond)
+	return nil
+}
+
+func TestStreamFlushInterval(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	NewServer(h1, "rpc", WithStreamFlushInterval(200*time.Millisecond)).Register(Events{})
+	c := NewClient(h2, "rpc")
+
+	firstItem := func(flush bool) time.Duration {
+		start := time.Now()
+		cs, err := c.Stream(context.Background(), h1.ID(), "Events", "Emit", flush)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cs.Close()
+		var item int
+		if err := cs.Recv(&item); err != nil || item != 1 {
+			t.Fatal("unexpected item:", item, err)
+		}
+		elapsed := time.Since(start)
+		if err := cs.Recv(&item); err != io.EOF {
+			t.Error("expected the end of the stream:", err)
+		}
+		return elapsed
+	}
+
+	if d := firstItem(false); d < 150*time.Millisecond || d > 450*time.Millisecond {
+		t.Error("the item should be flushed after the interval:", d)
+	}
+	if d := firstItem(true); d > 150*time.Millisecond {
+		t.Error("the item should be flushed right away:", d)
+	}
+}
+
+type Hog struct {
+	release chan struct{}
+}
+
+func (h *Hog) Hold(data []byte, reply *int) error {
+	<-h.release
+	*reply = len(data)
+	return nil
+}
+
+func TestMemoryBudget(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	hog := &Hog{release: make(chan struct{})}
+	s := NewServer(h1, "rpc", WithMemoryBudget(1500))
+	s.Register(hog)
+	c := NewClient(h2, "rpc")
+
+	var r1 int
+	done := make(chan *Call, 1)
+	c.Go(h1.ID(), "Hog", "Hold", make([]byte, 1000), &r1, done)
+	for i := 0; i < 100 && len(s.InFlight()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var r2 int
+	if err := c.Call(h1.ID(), "Hog", "Hold", make([]byte, 1000), &r2); err != ErrOverloaded {
+		t.Error("expected ErrOverloaded:", err)
+	}
+	small := make(chan *Call, 1)
+	c.Go(h1.ID(), "Hog", "Hold", make([]byte, 10), &r2, small)
+	for i := 0; i < 100 && len(s.InFlight()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(s.InFlight()); n != 2 {
+		t.Error("small calls should fit in the budget:", n)
+	}
+
+	close(hog.release)
+	if call := <-done; call.Error != nil || r1 != 1000 {
+		t.Error("unexpected result:", r1, call.Error)
+	}
+	if call := <-small; call.Error != nil || r2 != 10 {
+		t.Error("unexpected result:", r2, call.Error)
+	}
+	if err := c.Call(h1.ID(), "Hog", "Hold", make([]byte, 1000), &r2); err != nil {
+		t.Error("the budget should be released:", err)
+	}
+}
+
+func TestCallTrace(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	NewServer(h1, "rpc").Register(&Relay{})
+	c := NewClient(h2, "rpc")
+
+	var trace CallTrace
+	var r int64
+	err := c.CallContext(context.Background(), h1.ID(), "Relay", "Sleep", 100, &r, WithCallTrace(&trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.Server.Handler < 100*time.Millisecond || trace.Server.Handler > time.Second {
+		t.Error("unexpected handler time:", trace.Server.Handler)
+	}
+	if trace.ReadResponse < trace.Server.Handler {
+		t.Error("the response cannot arrive before the handler finishes:", trace.ReadResponse)
+	}
+	if trace.StreamOpen <= 0 || trace.WriteRequest <= 0 || trace.Decode <= 0 {
+		t.Errorf("missing client timings: %+v", trace)
+	}
+	if trace.Conn.Protocol != "rpc" || trace.Conn.RemoteAddr == nil || trace.Conn.LocalAddr == nil {
+		t.Errorf("missing connection info: %+v", trace.Conn)
+	}
+}
+
+type Unsafe struct {
+	active, maxActive int32
+}
+
+func (u *Unsafe) Touch(args int, reply *int) error {
+	n := atomic.AddInt32(&u.active, 1)
+	defer atomic.AddInt32(&u.active, -1)
+	for {
+		max := atomic.LoadInt32(&u.maxActive)
+		if n <= max || atomic.CompareAndSwapInt32(&u.maxActive, max, n) {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	return nil
+}
+
+func TestRegisterSerial(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	serial, concurrent := &Unsafe{}, &Unsafe{}
+	if err := s.RegisterSerial("Serial", serial); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterName("Concurrent", concurrent)
+	c := NewClient(h2, "rpc")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		for _, svc := range []string{"Serial", "Concurrent"} {
+			wg.Add(1)
+			go func(svc string) {
+				defer wg.Done()
+				var r int
+				if err := c.Call(h1.ID(), svc, "Touch", 0, &r); err != nil {
+					t.Error(err)
+				}
+			}(svc)
+		}
+	}
+	wg.Wait()
+	if serial.maxActive != 1 {
+		t.Error("serial calls overlapped:", serial.maxActive)
+	}
+	if concurrent.maxActive < 2 {
+		t.Error("concurrent calls should overlap:", concurrent.maxActive)
+	}
+	for _, info := range s.Services() {
+		if info.Serial != (info.Name == "Serial") {
+			t.Errorf("unexpected service info: %+v", info)
+		}
+	}
+}
+
+func TestVerifyMethod(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithReflection())
+	s.Register(new(Arith))
+	s.Register(&Producer{})
+	c := NewClient(h2, "rpc")
+	ctx := context.Background()
+
+	// Types declared apart match as long as they have the same shape.
+	type myQuotient struct {
+		Quo int64
+		Rem int32
+	}
+	if err := c.VerifyMethod(ctx, h1.ID(), "Arith", "Divide", Args{}, &myQuotient{}); err != nil {
+		t.Error(err)
+	}
+	var r int
+	err := c.VerifyMethod(ctx, h1.ID(), "Arith", "Divide", &Args{}, &r)
+	if err == nil || !strings.Contains(err.Error(), "reply type mismatch") {
+		t.Error("expected a reply type mismatch:", err)
+	}
+	err = c.VerifyMethod(ctx, h1.ID(), "Arith", "Divide", "args", nil)
+	if err == nil || !strings.Contains(err.Error(), "argument type mismatch") {
+		t.Error("expected an argument type mismatch:", err)
+	}
+	sig, err := c.DescribeMethod(ctx, h1.ID(), "Producer", "Produce")
+	if err != nil || !sig.Streaming || sig.Args != "int" {
+		t.Errorf("unexpected signature: %+v %s", sig, err)
+	}
+	if _, err := c.DescribeMethod(ctx, h1.ID(), "Arith", "Nope"); err == nil {
+		t.Error("expected an error for unknown methods")
+	}
+
+	NewServer(h2, "rpc").Register(new(Arith))
+	if err := NewClient(h1, "rpc").VerifyMethod(ctx, h2.ID(), "Arith", "Add", Args{}, &r); err == nil {
+		t.Error("expected an error without reflection")
+	}
+}
+
+func TestBadReply(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(new(Arith))
+	c := NewClient(h2, "rpc")
+	local := NewClientWithServer(h1, "rpc", s)
+
+	var r int
+	var nilReply *int
+	for _, client := range []*Client{c, local} {
+		err := client.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, r)
+		if err == nil || !strings.Contains(err.Error(), "must be a pointer") {
+			t.Error("expected an error for non-pointer replies:", err)
+		}
+		err = client.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, nilReply)
+		if err == nil || !strings.Contains(err.Error(), "nil *int") {
+			t.Error("expected an error for nil pointer replies:", err)
+		}
+		if err := client.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, nil); err != nil {
+			t.Error("nil replies should be discarded:", err)
+		}
+	}
+
+	var wrong string
+	err := local.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &wrong)
+	if err == nil || !strings.Contains(err.Error(), "cannot hold") {
+		t.Error("expected an error for mismatched local replies:", err)
+	}
+}
+
+func TestCompressionFor(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithCompressionFor("Echo.Echo"))
+	s.Register(&Echo{})
+	s.RegisterName("Plain", &Echo{})
+	var rec bytes.Buffer
+	c := NewClient(h2, "rpc", WithClientRecorder(&rec))
+
+	msg := strings.Repeat("a", 10000)
+	for _, svc := range []string{"Echo", "Plain"} {
+		var r string
+		if err := c.Call(h1.ID(), svc, "Echo", msg, &r); err != nil || r != msg {
+			t.Fatal("bad reply:", err)
+		}
+	}
+
+	streams, err := ReadRecording(&rec)
+	if err != nil || len(streams) != 2 {
+		t.Fatal("unexpected recording:", len(streams), err)
+	}
+	if n := len(streams[0].In); n > len(msg)/2 {
+		t.Error("the reply should have been compressed:", n)
+	}
+	if n := len(streams[1].In); n < len(msg) {
+		t.Error("the reply should not have been compressed:", n)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(new(Arith))
+	var callers []string
+	policy := Policy{Interceptors: []Interceptor{
+		func(ctx context.Context, info CallInfo, handler func(context.Context) error) error {
+			caller, _ := HTTPCallerFromContext(ctx)
+			if caller != "alice" {
+				return ErrUnauthorized
+			}
+			callers = append(callers, caller)
+			return handler(ctx)
+		},
+	}}
+	auth := func(r *http.Request) (string, error) {
+		user, _, ok := r.BasicAuth()
+		if !ok {
+			return "", errors.New("no credentials")
+		}
+		return user, nil
+	}
+	ts := httptest.NewServer(http.StripPrefix("/rpc", NewHTTPHandler(s, policy, auth)))
+	defer ts.Close()
+
+	post := func(user, path, contentType string, body []byte) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := post("alice", "/rpc/Arith/Multiply", "application/json", []byte(`{"A":3,"B":4}`))
+	var r int
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || r != 12 {
+		t.Error("bad JSON reply:", resp.Status, r, err)
+	}
+	resp.Body.Close()
+
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(Args{A: 10, B: 3})
+	resp = post("alice", "/rpc/Arith/Divide", "application/x-gob", buf.Bytes())
+	var q Quotient
+	if err := gob.NewDecoder(resp.Body).Decode(&q); err != nil || q.Quo != 3 || q.Rem != 1 {
+		t.Error("bad gob reply:", resp.Status, q, err)
+	}
+	resp.Body.Close()
+
+	for _, tc := range []struct {
+		user, path string
+		status     int
+	}{
+		{"", "/rpc/Arith/Multiply", http.StatusUnauthorized},
+		{"bob", "/rpc/Arith/Multiply", http.StatusForbidden},
+		{"alice", "/rpc/Arith/Nope", http.StatusNotFound},
+		{"alice", "/rpc/Arith/GimmeError", http.StatusInternalServerError},
+		{"alice", "/rpc/gorpc.Clock/Now", http.StatusNotFound},
+	} {
+		resp := post(tc.user, tc.path, "application/json", []byte(`{"A":1,"B":1}`))
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s as %q: expected status %d, got %d", tc.path, tc.user, tc.status, resp.StatusCode)
+		}
+	}
+	if len(callers) != 3 {
+		t.Error("unexpected calls:", callers)
+	}
+
+	// Server limits and requirements apply to HTTP requests too.
+	status := func(s *Server, header string, body []byte) int {
+		ts := httptest.NewServer(NewHTTPHandler(s, Policy{}, nil))
+		defer ts.Close()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/Arith/Multiply", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Padding", header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	args := []byte(`{"A":1,"B":1}`)
+	for _, tc := range []struct {
+		name   string
+		opts   []ServerOption
+		header string
+		body   []byte
+		status int
+	}{
+		{"header size", []ServerOption{WithMaxHeaderSize(512)}, strings.Repeat("x", 1024), args, http.StatusRequestHeaderFieldsTooLarge},
+		{"memory budget", []ServerOption{WithMemoryBudget(8)}, "", args, http.StatusRequestEntityTooLarge},
+		{"within budget", []ServerOption{WithMemoryBudget(64)}, "", args, http.StatusOK},
+		{"signatures", []ServerOption{WithRequireSignatures()}, "", args, http.StatusForbidden},
+		{"encryption", []ServerOption{WithPayloadEncryption(testKeys(1))}, "", args, http.StatusForbidden},
+	} {
+		s := NewServer(nil, "rpc", tc.opts...)
+		s.Register(new(Arith))
+		if st := status(s, tc.header, tc.body); st != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, st)
+		}
+	}
+}
+
+type serviceStream struct {
+	inet.Stream
+	service string
+	err     error
+}
+
+func (s *serviceStream) SetService(name string) error {
+	s.service = name
+	return s.err
+}
+
+func TestStreamService(t *testing.T) {
+	services := map[protocol.ID]string{"rpc": "control"}
+
+	s := &serviceStream{}
+	if err := setStreamService(s, "rpc", services); err != nil || s.service != "control" {
+		t.Error("the service should have been set:", s.service, err)
+	}
+	s = &serviceStream{}
+	if err := setStreamService(s, "other", services); err != nil || s.service != "" {
+		t.Error("no service should have been set:", s.service, err)
+	}
+	s = &serviceStream{err: errors.New("over limits")}
+	if err := setStreamService(s, "rpc", services); err == nil {
+		t.Error("expected an error")
+	}
+	// Streams not supporting services are left alone.
+	var plain inet.Stream
+	if err := setStreamService(plain, "rpc", services); err != nil {
+		t.Error(err)
+	}
+
+	// Calls keep working with the option set.
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+	server := NewServer(h1, "rpc", WithStreamService("rpc", "control"))
+	server.Register(new(Arith))
+	c := NewClient(h2, "rpc", WithClientStreamService("rpc", "control"))
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Error("bad reply:", r, err)
+	}
+}
+
+// Feed sends the numbers from the cursor, if any, up to n. The first time
+// it is called, it stops after three items until released.
+type Feed struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (f *Feed) Numbers(ctx context.Context, n int, stream *ServerStream) error {
+	from := 0
+	if c := stream.Cursor(); c != "" {
+		from, _ = strconv.Atoi(c)
+	}
+	first := atomic.AddInt32(&f.calls, 1) == 1
+	for i := from; i < n; i++ {
+		if first && i == 3 {
+			select {
+			case <-f.release:
+			case <-ctx.Done():
+			}
+			return nil
+		}
+		if err := stream.SendAt(i, strconv.Itoa(i+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSubscribe(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	feed := &Feed{release: make(chan struct{})}
+	defer close(feed.release)
+	s := NewServer(h1, "rpc")
+	s.Register(feed)
+	c := NewClient(h2, "rpc")
+
+	var reconnects []error
+	sub, err := c.Subscribe(context.Background(), h1.ID(), "Feed", "Numbers", 6, SubscribeOptions{
+		Backoff:     10 * time.Millisecond,
+		OnReconnect: func(err error) { reconnects = append(reconnects, err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	var got []int
+	for {
+		if len(got) == 3 && len(reconnects) == 0 {
+			// Simulate a network blip.
+			sub.cs.sw.stream.Reset()
+		}
+		var n int
+		err := sub.Recv(&n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, n)
+	}
+	if fmt.Sprint(got) != "[0 1 2 3 4 5]" {
+		t.Error("unexpected items:", got)
+	}
+	if len(reconnects) != 1 {
+		t.Error("expected a reconnection:", reconnects)
+	}
+	if sub.Cursor() != "6" {
+		t.Error("unexpected cursor:", sub.Cursor())
+	}
+}
+
+// Dropper sends an item on the first call and then drops the stream.
+// Later calls drop it right away.
+type Dropper struct {
+	calls int32
+}
+
+func (d *Dropper) Drop(ctx context.Context, args int, stream *ServerStream) error {
+	if atomic.AddInt32(&d.calls, 1) == 1 {
+		if err := stream.Send(1); err != nil {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	stream.sw.stream.Reset()
+	return nil
+}
+
+func TestSubscribeDropsWithoutItems(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	d := &Dropper{}
+	s := NewServer(h1, "rpc")
+	s.Register(d)
+	c := NewClient(h2, "rpc")
+
+	sub, err := c.Subscribe(context.Background(), h1.ID(), "Dropper", "Drop", 0, SubscribeOptions{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	var n int
+	if err := sub.Recv(&n); err != nil || n != 1 {
+		t.Fatal("bad item:", n, err)
+	}
+	// Reopened streams dropping before sending anything do not reset
+	// the attempts.
+	done := make(chan error, 1)
+	go func() {
+		done <- sub.Recv(&n)
+	}()
+	select {
+	case err := <-done:
+		if err == nil || err == io.EOF {
+			t.Error("expected the error which dropped the stream:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the subscription should have given up")
+	}
+	if calls := atomic.LoadInt32(&d.calls); calls != 4 {
+		t.Error("expected three attempts after the first call:", calls)
+	}
+}
+
+func TestReady(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	c := NewClient(h2, "rpc")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.WaitReady(ctx, h1.ID()); err != context.DeadlineExceeded {
+		t.Error("expected a timeout without server:", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s := NewServer(h1, "rpc")
+		select {
+		case <-s.Ready():
+		case <-time.After(time.Second):
+			t.Error("the server should be ready")
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.WaitReady(ctx, h1.ID()); err != nil {
+		t.Error("the server should have become ready:", err)
+	}
+
+	<-NewServer(nil, "rpc").Ready()
+}
+
+func TestCallStats(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var mu sync.Mutex
+	var serverStats, clientStats []CallStats
+	group := func(pid peer.ID) string {
+		if pid == h2.ID() {
+			return "trusted"
+		}
+		return "public"
+	}
+	s := NewServer(h1, "rpc", WithCallStats(func(st CallStats) {
+		mu.Lock()
+		defer mu.Unlock()
+		serverStats = append(serverStats, st)
+	}, group))
+	s.Register(new(Arith))
+	c := NewClient(h2, "rpc", WithClientCallStats(func(st CallStats) {
+		mu.Lock()
+		defer mu.Unlock()
+		clientStats = append(clientStats, st)
+	}, nil))
+
+	var r int
+	ctx := WithRequestID(context.Background(), "op-1")
+	if err := c.CallContext(ctx, h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call(h1.ID(), "Arith", "GimmeError", &Args{2, 3}, &r); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(serverStats) != 2 || len(clientStats) != 2 {
+		t.Fatal("unexpected stats:", serverStats, clientStats)
+	}
+	for i, st := range serverStats {
+		if st.Service != "Arith" || st.Peer != h2.ID() || st.Group != "trusted" || st.Duration <= 0 {
+			t.Error("bad server stats:", st)
+		}
+		if (i == 1) != (st.Err != nil) {
+			t.Error("bad server stats error:", st.Err)
+		}
+	}
+	if serverStats[0].RequestID != "op-1" {
+		t.Error("missing request ID:", serverStats[0])
+	}
+	if st := clientStats[0]; st.Method != "Multiply" || st.Peer != h1.ID() || st.Group != "" || st.Err != nil || st.RequestID != "op-1" {
+		t.Error("bad client stats:", st)
+	}
+	if st := clientStats[1]; st.Method != "GimmeError" || st.Err == nil {
+		t.Error("bad client stats:", st)
+	}
+}
+
+// Tally counts the increments received. Increments take the given
+// milliseconds to run, regardless of the context.
+type Tally struct {
+	n int64
+}
+
+func (c *Tally) Inc(ms int, reply *int64) error {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*reply = atomic.AddInt64(&c.n, 1)
+	return nil
+}
+
+func TestSequencedSession(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	counter := &Tally{}
+	s := NewServer(h1, "rpc", WithSequencedSessions(time.Minute))
+	s.Register(counter)
+	c := NewClient(h2, "rpc")
+
+	sess, err := c.SequencedSession(h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r int64
+	if err := sess.Call(context.Background(), "Tally", "Inc", 0, &r); err != nil || r != 1 {
+		t.Fatal("bad reply:", r, err)
+	}
+
+	// The client gives up on the command, but it runs.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sess.Call(ctx, "Tally", "Inc", 200, &r); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	// It is resent before the next one, and not run again.
+	if err := sess.Call(context.Background(), "Tally", "Inc", 0, &r); err != nil || r != 3 {
+		t.Fatal("bad reply:", r, err)
+	}
+	if n := atomic.LoadInt64(&counter.n); n != 3 {
+		t.Error("commands should have run once:", n)
+	}
+
+	// Commands without a reply are resent as well.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sess.Call(ctx, "Tally", "Inc", 200, nil); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if err := sess.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&counter.n); n != 4 {
+		t.Error("the command should have run once:", n)
+	}
+
+	// Servers not tracking sessions refuse to run commands.
+	h3, h4 := makeRandomNodes()
+	defer h3.Close()
+	defer h4.Close()
+	NewServer(h3, "rpc").Register(&Tally{})
+	other, err := NewClient(h4, "rpc").SequencedSession(h3.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Call(context.Background(), "Tally", "Inc", 0, &r); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestSetConcurrency(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	b := &Blocker{release: make(chan struct{})}
+	s := NewServer(h1, "rpc", WithPinnedWorkers(1))
+	s.Register(b)
+	c := NewClient(h2, "rpc")
+
+	start := func(n int) chan *Call {
+		done := make(chan *Call, n)
+		for i := 0; i < n; i++ {
+			var r int
+			c.Go(h1.ID(), "Blocker", "Wait", i, &r, done)
+		}
+		return done
+	}
+	waitRunning := func(n int) {
+		for i := 0; i < 100 && len(s.InFlight()) != n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	s.SetConcurrency(3)
+	done := start(4)
+	waitRunning(4)
+	if n := s.Stats().Workers; n != 3 {
+		t.Error("expected 3 workers:", n)
+	}
+
+	// Busy workers finish their calls before exiting.
+	s.SetConcurrency(1)
+	if n := s.Stats().Workers; n != 3 {
+		t.Error("busy workers should not have exited:", n)
+	}
+	close(b.release)
+	for i := 0; i < 4; i++ {
+		if call := <-done; call.Error != nil {
+			t.Error(call.Error)
+		}
+	}
+	for i := 0; i < 100 && s.Stats().Workers != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.Stats().Workers; n != 1 {
+		t.Error("expected 1 worker:", n)
+	}
+
+	// Shutting down stops all the workers.
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && s.Stats().Workers != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.Stats().Workers; n != 0 {
+		t.Error("the workers should have stopped:", n)
+	}
+	s.SetConcurrency(2)
+	if n := s.Stats().Workers; n != 0 {
+		t.Error("no workers should start after Shutdown:", n)
+	}
+}
+
+func TestCallGroup(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	b := &Blocker{release: make(chan struct{})}
+	defer close(b.release)
+	s := NewServer(h1, "rpc")
+	s.Register(b)
+	s.Register(new(Arith))
+	c := NewClient(h2, "rpc")
+
+	g := NewCallGroup(context.Background())
+	var r int
+	if err := g.Call(c, h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Fatal("bad reply:", r, err)
+	}
+
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			var r int
+			errs <- g.Call(c, h1.ID(), "Blocker", "Wait", i, &r)
+		}(i)
+	}
+	for i := 0; i < 100 && len(s.InFlight()) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := g.Len(); n != 3 {
+		t.Error("expected 3 calls in progress:", n)
+	}
+
+	g.CancelAll()
+	g.Wait()
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != context.Canceled {
+			t.Error("expected the call to be cancelled:", err)
+		}
+	}
+	if context.Cause(g.Context()) != ErrGroupCancelled {
+		t.Error("unexpected cause:", context.Cause(g.Context()))
+	}
+	if err := g.Call(c, h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != context.Canceled {
+		t.Error("calls should fail once cancelled:", err)
+	}
+}
+
+type Profile struct {
+	Name    string
+	History []string
+}
+
+type Profiles struct{}
+
+func (p *Profiles) Get(ctx context.Context, name string, reply *Profile) error {
+	mask := FieldMaskFromContext(ctx)
+	if mask.Has("Name") {
+		reply.Name = name
+	}
+	if mask.Has("History") {
+		reply.History = []string{"expensive"}
+	}
+	return nil
+}
+
+func TestFieldMask(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Profiles{})
+	c := NewClient(h2, "rpc")
+	local := NewClientWithServer(h1, "rpc", s)
+
+	for _, cl := range []*Client{c, local} {
+		var p Profile
+		err := cl.CallContext(context.Background(), h1.ID(), "Profiles", "Get", "ann", &p, WithFieldMask("Name"))
+		if err != nil || p.Name != "ann" || p.History != nil {
+			t.Error("only the name should have been set:", p, err)
+		}
+		p = Profile{}
+		err = cl.CallContext(context.Background(), h1.ID(), "Profiles", "Get", "ann", &p)
+		if err != nil || p.Name != "ann" || len(p.History) != 1 {
+			t.Error("all the fields should have been set:", p, err)
+		}
+	}
+
+	mask := FieldMask{"Stats.Latency"}
+	if !mask.Has("Stats") || !mask.Has("Stats.Latency.P99") || mask.Has("Stats.Size") {
+		t.Error("bad nested field matching")
+	}
+	if !FieldMask(nil).Has("anything") {
+		t.Error("the nil mask should have every field")
+	}
+}
+
+// Nested calls itself through the local client until the depth is 0.
+type Nested struct {
+	c *Client
+}
+
+func (n *Nested) Depth(ctx context.Context, depth int, reply *int) error {
+	if depth == 0 {
+		return nil
+	}
+	var r int
+	if err := n.c.CallLocalContext(ctx, "Nested", "Depth", depth-1, &r); err != nil {
+		return err
+	}
+	*reply = r + 1
+	return nil
+}
+
+func TestReentrantLocalCalls(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithPinnedWorkers(1), WithMaxConcurrentCalls(1))
+	s.RegisterSerial("Nested", &Nested{c: NewClientWithServer(h1, "rpc", s)})
+	c := NewClient(h2, "rpc")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var r int
+	if err := c.CallContext(ctx, h1.ID(), "Nested", "Depth", 3, &r); err != nil || r != 3 {
+		t.Fatal("re-entrant calls should not deadlock:", r, err)
+	}
+}
+
+func TestRegisterLazy(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var built int32
+	err := s.RegisterLazy("Arith", func() (interface{}, error) {
+		atomic.AddInt32(&built, 1)
+		time.Sleep(50 * time.Millisecond)
+		return new(Arith), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.RegisterLazy("Arith", nil) == nil || s.Register(new(Arith)) == nil {
+		t.Error("the service should be defined already")
+	}
+	failing := true
+	s.RegisterLazy("Flaky", func() (interface{}, error) {
+		if failing {
+			failing = false
+			return nil, errors.New("not yet")
+		}
+		return new(Arith), nil
+	})
+	if info := s.Services(); !info[0].Lazy {
+		t.Error("the service should be listed as lazy:", info)
+	}
+	c := NewClient(h2, "rpc")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var r int
+			if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+				t.Error("bad reply:", r, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&built); n != 1 {
+		t.Error("the service should have been built once:", n)
+	}
+
+	var r int
+	if err := c.Call(h1.ID(), "Flaky", "Multiply", &Args{2, 3}, &r); err == nil || !strings.Contains(err.Error(), "not yet") {
+		t.Error("expected the build error:", err)
+	}
+	if err := c.Call(h1.ID(), "Flaky", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Error("the service should have been built:", r, err)
+	}
+}
+
+func TestPause(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(new(Arith))
+	b := &Blocker{release: make(chan struct{})}
+	s.Register(b)
+	c := NewClient(h2, "rpc")
+
+	var waited int
+	done := make(chan *Call, 1)
+	c.Go(h1.ID(), "Blocker", "Wait", 3, &waited, done)
+	for i := 0; i < 100 && len(s.InFlight()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Pause()
+	if !s.Paused() {
+		t.Fatal("the server should be paused")
+	}
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != ErrPaused {
+		t.Error("expected ErrPaused:", err)
+	}
+	local := NewClientWithServer(h1, "rpc", s)
+	if err := local.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != ErrPaused {
+		t.Error("expected ErrPaused for local calls:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := c.WaitReady(ctx, h1.ID()); err != context.DeadlineExceeded {
+		t.Error("a paused server should not be ready:", err)
+	}
+
+	// The call in progress carries on.
+	close(b.release)
+	if call := <-done; call.Error != nil || waited != 3 {
+		t.Error("unexpected result:", call.Error, waited)
+	}
+
+	s.Resume()
+	if s.Paused() {
+		t.Fatal("the server should not be paused")
+	}
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Error("unexpected result:", err, r)
+	}
+}
+
+func TestGoroutinesPerPeer(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithMaxGoroutinesPerPeer(2))
+	s.Register(new(Arith))
+	b := &Blocker{release: make(chan struct{})}
+	s.Register(b)
+	c := NewClient(h2, "rpc")
+
+	done := make(chan *Call, 2)
+	var r1, r2 int
+	c.Go(h1.ID(), "Blocker", "Wait", 1, &r1, done)
+	c.Go(h1.ID(), "Blocker", "Wait", 2, &r2, done)
+	for i := 0; i < 100 && s.Goroutines(h2.ID()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.Goroutines(h2.ID()); n != 2 {
+		t.Fatal("expected 2 goroutines for the peer:", n)
+	}
+	top := s.Stats().TopGoroutinePeers
+	if len(top) != 1 || top[0] != (PeerGoroutines{h2.ID(), 2}) {
+		t.Error("unexpected top peers:", top)
+	}
+
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != ErrOverloaded {
+		t.Error("expected ErrOverloaded:", err)
+	}
+	// Other peers are not affected.
+	local := NewClientWithServer(h1, "rpc", s)
+	if err := local.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Error("unexpected result:", err, r)
+	}
+
+	close(b.release)
+	for i := 0; i < 2; i++ {
+		if call := <-done; call.Error != nil {
+			t.Error(call.Error)
+		}
+	}
+	for i := 0; i < 100 && s.Goroutines(h2.ID()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.Goroutines(h2.ID()); n != 0 {
+		t.Error("expected no goroutines left:", n)
+	}
+	if top := s.Stats().TopGoroutinePeers; len(top) != 0 {
+		t.Error("unexpected top peers:", top)
+	}
+}
+
+func TestRegisterStream(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	err := RegisterStream(s, "Typed", "Multiples", func(ctx context.Context, args Args, stream Stream[Quotient]) error {
+		if args.B == 0 {
+			return errors.New("no multiples of zero")
+		}
+		for i := 1; i <= args.A; i++ {
+			if err := stream.Send(Quotient{Quo: i * args.B}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(h2, "rpc")
+
+	ctx := context.Background()
+	items, err := CallStream[Args, Quotient](ctx, c, h1.ID(), "Typed", "Multiples", Args{3, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for q, err := range items {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, q.Quo)
+	}
+	if len(got) != 3 || got[0] != 5 || got[2] != 15 {
+		t.Error("unexpected items:", got)
+	}
+
+	items, err = CallStream[Args, Quotient](ctx, c, h1.ID(), "Typed", "Multiples", Args{3, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range items {
+		if err == nil || err.Error() != "no multiples of zero" {
+			t.Error("expected the method error:", err)
+		}
+	}
+	var r int
+	if err := c.Call(h1.ID(), "Typed", "Multiples", Args{3, 5}, &r); err == nil {
+		t.Error("regular calls to streaming methods should fail")
+	}
+}
+
+func TestAutoBatch(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var opened int32
+	s := NewServer(h1, "rpc", WithOnStreamOpen(func(peer.ID, uint64) {
+		atomic.AddInt32(&opened, 1)
+	}))
+	s.Register(new(Arith))
+	c := NewClient(h2, "rpc", WithAutoBatch(50*time.Millisecond, 5))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var r int
+			if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{i, 2}, &r); err != nil || r != 2*i {
+				t.Error("unexpected result:", r, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&opened); n != 2 {
+		t.Error("expected the calls to be sent in 2 batches:", n)
+	}
+
+	var q Quotient
+	if err := c.Call(h1.ID(), "Arith", "Divide", &Args{1, 0}, &q); err == nil || err.Error() != "divide by zero" {
+		t.Error("expected the method error:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var r int
+	if err := c.CallContext(ctx, h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != context.DeadlineExceeded {
+		t.Error("expected the call to time out while waiting:", err)
+	}
+	if r != 0 {
+		t.Error("the reply should be left alone once given up on:", r)
+	}
+
+	// Call options apply to batched calls.
+	s.Register(&Profiles{})
+	var p Profile
+	err := c.CallContext(context.Background(), h1.ID(), "Profiles", "Get", "ann", &p, WithFieldMask("Name"))
+	if err != nil || p.Name != "ann" || p.History != nil {
+		t.Error("only the name should have been set:", p, err)
+	}
+}
+
+func TestMethodQueueLimit(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithPinnedWorkers(1), WithMethodQueueLimit("Arith.Multiply", 1))
+	s.Register(new(Arith))
+	b := &Blocker{release: make(chan struct{})}
+	s.Register(b)
+	c := NewClient(h2, "rpc")
+
+	// Hold the only worker.
+	done := make(chan *Call, 3)
+	var waited, queued int
+	c.Go(h1.ID(), "Blocker", "Wait", 1, &waited, done)
+	for i := 0; i < 100 && s.Stats().RunningCalls == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Go(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &queued, done)
+	multiply := ServiceID{"Arith", "Multiply"}
+	for i := 0; i < 100 && s.Stats().QueueDepths[multiply] == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depths := s.Stats().QueueDepths; depths[multiply] != 1 {
+		t.Fatal("expected a queued call:", depths)
+	}
+
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != ErrQueueFull {
+		t.Error("expected ErrQueueFull:", err)
+	}
+	// Other methods can still queue.
+	var waited2 int
+	c.Go(h1.ID(), "Blocker", "Wait", 2, &waited2, done)
+
+	close(b.release)
+	for i := 0; i < 3; i++ {
+		if call := <-done; call.Error != nil {
+			t.Error(call.Error)
+		}
+	}
+	if queued != 6 || waited2 != 2 {
+		t.Error("unexpected results:", queued, waited2)
+	}
+	if depths := s.Stats().QueueDepths; len(depths) != 0 {
+		t.Error("expected empty queues:", depths)
+	}
+}
+
+func TestDeadlinePropagationMargin(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	w := &Waiter{deadlines: make(chan time.Time, 1)}
+	s.Register(w)
+	c := NewClient(h2, "rpc", WithDeadlinePropagationMargin(100*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	clientDeadline, _ := ctx.Deadline()
+	var r int
+	err := c.CallContext(ctx, h1.ID(), "Waiter", "Wait", 1, &r)
+	// The server times out first and its reply makes it back.
+	if err == nil || err.Error() != context.DeadlineExceeded.Error() || ctx.Err() != nil {
+		t.Error("expected the server to time out before the client:", err)
+	}
+	if d := <-w.deadlines; !d.Equal(clientDeadline.Add(-100 * time.Millisecond)) {
+		t.Errorf("server saw deadline %s, expected %s", d, clientDeadline.Add(-100*time.Millisecond))
+	}
+}
+
+func TestProtocolFallback(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc/1.0.0")
+	s.Register(new(Arith))
+	c := NewClient(h2, "rpc", WithProtocolFallback("rpc/2.0.0", "rpc/1.0.0"))
+
+	var r int
+	var trace CallTrace
+	if err := c.CallContext(context.Background(), h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithCallTrace(&trace)); err != nil || r != 6 {
+		t.Fatal("unexpected result:", err, r)
+	}
+	if trace.Conn.Protocol != "rpc/1.0.0" || c.protocolFor(h1.ID()) != "rpc/1.0.0" {
+		t.Error("the client should have fallen back:", trace.Conn.Protocol)
+	}
+
+	// Once upgraded, the peer is called with the primary protocol after
+	// negotiating again.
+	s.ServeProtocol("rpc/2.0.0", Policy{})
+	if _, err := c.NegotiateVersion(context.Background(), h1.ID(), []protocol.ID{"rpc/2.0.0", "rpc/1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CallContext(context.Background(), h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithCallTrace(&trace)); err != nil {
+		t.Fatal(err)
+	}
+	if trace.Conn.Protocol != "rpc/2.0.0" {
+		t.Error("the client should use the primary protocol:", trace.Conn.Protocol)
+	}
+}
+
+type Catalog struct {
+	reads int32
+}
+
+func (c *Catalog) Get(name string, reply *string) error {
+	atomic.AddInt32(&c.reads, 1)
+	*reply = "item " + name
+	return nil
+}
+
+func TestClientCache(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	catalog := &Catalog{}
+	s.Register(catalog)
+	s.Register(new(Arith))
+	c := NewClient(h2, "rpc", WithClientCache(200*time.Millisecond, 2, "Catalog.Get"))
+
+	get := func(name string) {
+		var r string
+		if err := c.Call(h1.ID(), "Catalog", "Get", name, &r); err != nil || r != "item "+name {
+			t.Fatal("unexpected result:", err, r)
+		}
+	}
+	reads := func() int32 { return atomic.LoadInt32(&catalog.reads) }
+
+	get("a")
+	get("a")
+	if n := reads(); n != 1 {
+		t.Error("the second call should have been cached:", n)
+	}
+	get("b")
+	get("c") // evicts a
+	get("a")
+	if n := reads(); n != 4 {
+		t.Error("a should have been evicted:", n)
+	}
+
+	c.InvalidateCache(h1.ID(), "Catalog", "Get")
+	get("a")
+	if n := reads(); n != 5 {
+		t.Error("the cache should have been invalidated:", n)
+	}
+	time.Sleep(250 * time.Millisecond)
+	get("a")
+	if n := reads(); n != 6 {
+		t.Error("the entry should have expired:", n)
+	}
+
+	// Replies are not shared by callers sending different metadata.
+	var r string
+	ctx := WithMetadata(context.Background(), Metadata{"token": "alice"})
+	if err := c.CallContext(ctx, h1.ID(), "Catalog", "Get", "a", &r); err != nil {
+		t.Fatal(err)
+	}
+	if n := reads(); n != 7 {
+		t.Error("the reply for other metadata should not be used:", n)
+	}
+	if err := c.CallContext(ctx, h1.ID(), "Catalog", "Get", "a", &r); err != nil {
+		t.Fatal(err)
+	}
+	if n := reads(); n != 7 {
+		t.Error("the reply for the same metadata should have been cached:", n)
+	}
+
+	// Other methods are never cached.
+	var q Quotient
+	for i := 0; i < 2; i++ {
+		if err := c.Call(h1.ID(), "Arith", "Divide", &Args{1, 0}, &q); err == nil {
+			t.Error("expected the method error")
+		}
+	}
+
+	// Cached calls go through the interceptors and stats, and fail
+	// once the client is draining or closed.
+	var intercepted, reported int32
+	hooked := NewClient(h2, "rpc", WithClientCache(time.Minute, 0, "Catalog.Get"),
+		WithClientInterceptor(func(ctx context.Context, info CallInfo, invoker func(context.Context) error) error {
+			atomic.AddInt32(&intercepted, 1)
+			return invoker(ctx)
+		}),
+		WithClientCallStats(func(CallStats) { atomic.AddInt32(&reported, 1) }, nil))
+	for i := 0; i < 2; i++ {
+		if err := hooked.Call(h1.ID(), "Catalog", "Get", "d", &r); err != nil || r != "item d" {
+			t.Fatal("unexpected result:", err, r)
+		}
+	}
+	if n := reads(); n != 8 {
+		t.Error("the second call should have been cached:", n)
+	}
+	if atomic.LoadInt32(&intercepted) != 2 || atomic.LoadInt32(&reported) != 2 {
+		t.Error("cached calls should be intercepted and reported:", intercepted, reported)
+	}
+	if err := hooked.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := hooked.Call(h1.ID(), "Catalog", "Get", "d", &r); err != ErrClientDraining {
+		t.Error("expected ErrClientDraining:", err)
+	}
+	hooked.Close()
+	if err := hooked.Call(h1.ID(), "Catalog", "Get", "d", &r); err != ErrClientClosed {
+		t.Error("expected ErrClientClosed:", err)
+	}
+}
+
+func TestActivePeers(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(new(Arith))
+	local := NewServer(h2, "rpc")
+	local.Register(new(Arith))
+	c := NewClientWithServer(h2, "rpc", local, WithActivePeersWindow(200*time.Millisecond))
+	if peers := c.ActivePeers(); len(peers) != 0 {
+		t.Error("expected no active peers:", peers)
+	}
+
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call(h2.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if peers := c.ActivePeers(); len(peers) != 1 || peers[0] != h1.ID() {
+		t.Error("expected the remote peer only:", peers)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if peers := c.ActivePeers(); len(peers) != 0 {
+		t.Error("the peer should not be active anymore:", peers)
+	}
+
+	// Idle streams keep peers active.
+	pooled := NewClient(h2, "rpc", WithStreamPool(1, time.Minute), WithActivePeersWindow(10*time.Millisecond))
+	if err := pooled.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if peers := pooled.ActivePeers(); len(peers) != 1 || peers[0] != h1.ID() {
+		t.Error("the peer with idle streams should be active:", peers)
+	}
+}
+
+func TestStreamClientGone(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	returned := make(chan error, 1)
+	RegisterStream(s, "Producer", "Forever", func(ctx context.Context, n int, stream Stream[int]) error {
+		for i := 0; ; i++ {
+			if err := stream.Send(i); err != nil {
+				// Send may fail writing to the reset stream
+				// before the context is cancelled.
+				<-ctx.Done()
+				returned <- context.Cause(ctx)
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	RegisterStream(s, "Producer", "Idle", func(ctx context.Context, n int, stream Stream[int]) error {
+		stream.Send(0)
+		select {
+		case <-ctx.Done():
+			returned <- context.Cause(ctx)
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+			returned <- nil
+			return nil
+		}
+	})
+	c := NewClient(h2, "rpc")
+
+	waitReturn := func() {
+		select {
+		case err := <-returned:
+			if err != errStreamAbandoned {
+				t.Error("expected the stream to be abandoned:", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the handler should have returned")
+		}
+	}
+
+	// Send fails, and the context is cancelled, once the client closes
+	// the stream.
+	cs, err := c.Stream(context.Background(), h1.ID(), "Producer", "Forever", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var item int
+	for i := 0; i < 3; i++ {
+		if err := cs.Recv(&item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cs.Close()
+	waitReturn()
+
+	// The context of the handler is cancelled when the client cancels.
+	ctx, cancel := context.WithCancel(context.Background())
+	cs, err = c.Stream(ctx, h1.ID(), "Producer", "Idle", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Recv(&item); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	waitReturn()
+}
+
+// Firehose sends items until Send fails.
+type Firehose struct {
+	returned chan error
+}
+
+// Send sets the slow consumer timeout given, if any, and sends items.
+func (f *Firehose) Send(ctx context.Context, timeout time.Duration, stream *ServerStream) error {
+	if timeout > 0 {
+		stream.SetSlowConsumerTimeout(timeout)
+	}
+	for i := 0; ; i++ {
+		if err := stream.Send(i); err != nil {
+			if err == ErrSlowConsumer && context.Cause(ctx) != err {
+				t := fmt.Errorf("the context should be cancelled with %v: %v", err, context.Cause(ctx))
+				f.returned <- t
+				return t
+			}
+			f.returned <- err
+			return err
+		}
+	}
+}
+
+func TestSlowConsumerTimeout(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithSlowConsumerTimeout(time.Hour))
+	f := &Firehose{returned: make(chan error, 1)}
+	s.Register(f)
+	c := NewClient(h2, "rpc", WithStreamWindow(4))
+
+	cs, err := c.Stream(context.Background(), h1.ID(), "Firehose", "Send", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	var item int
+	if err := cs.Recv(&item); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-f.returned:
+		if err != ErrSlowConsumer {
+			t.Fatal("expected ErrSlowConsumer:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the stream should have been aborted")
+	}
+
+	// The items sent before are received, and then the error.
+	n := 1
+	for {
+		err = cs.Recv(&item)
+		if err != nil {
+			break
+		}
+		n++
+	}
+	if err != ErrSlowConsumer {
+		t.Error("expected ErrSlowConsumer:", err)
+	}
+	if n != 4 {
+		t.Error("expected the items in the window:", n)
+	}
+
+	// Clients keeping up are not affected.
+	ctx, cancel := context.WithCancel(context.Background())
+	cs, err = c.Stream(ctx, h1.ID(), "Firehose", "Send", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := cs.Recv(&item); err != nil || item != i {
+			t.Fatal("unexpected item:", item, err)
+		}
+	}
+	cancel()
+	if err := <-f.returned; err == ErrSlowConsumer {
+		t.Error("the stream should not be aborted:", err)
+	}
+}
@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"errors"
+	"sort"
+)
+
+// ServiceInfo describes a service registered in a Server.
+type ServiceInfo struct {
+	// Name is the name of the service.
+	Name string
+	// Methods describes the methods of the service, sorted by name.
+	Methods []MethodInfo
+	// Serial is set for services registered with RegisterSerial.
+	Serial bool
+	// Lazy is set for services registered with RegisterLazy which
+	// have not been built yet, whose methods are unknown until then.
+	Lazy bool
+}
+
+// MethodInfo describes a method of a registered service.
+type MethodInfo struct {
+	// Name is the name of the method.
+	Name string
+	// Streaming is set for streaming methods (see ServerStream).
+	Streaming bool
+	// Pipe is set for pipe methods (see Pipe).
+	Pipe bool
+	// Enabled is false when the method has been disabled with
+	// Server.SetMethodEnabled.
+	Enabled bool
+}
+
+// Services returns the services registered in the server, sorted by
+// name, including the ones provided by the server itself.
+func (server *Server) Services() []ServiceInfo {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	services := make([]ServiceInfo, 0, len(server.serviceMap)+len(server.lazy))
+	for name := range server.lazy {
+		services = append(services, ServiceInfo{Name: name, Lazy: true})
+	}
+	for name, s := range server.serviceMap {
+		info := ServiceInfo{Name: name, Serial: s.serial != nil}
+		for mname, mtype := range s.method {
+			info.Methods = append(info.Methods, MethodInfo{
+				Name:      mname,
+				Streaming: mtype.streaming,
+				Pipe:      mtype.pipe,
+				Enabled:   !server.disabled[ServiceID{name, mname}],
+			})
+		}
+		sort.Slice(info.Methods, func(i, j int) bool {
+			return info.Methods[i].Name < info.Methods[j].Name
+		})
+		services = append(services, info)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
+
+// SetMethodEnabled enables or disables the given method at runtime.
+// Calls to disabled methods are rejected with ErrMethodDisabled before
+// reaching them, while the rest of the service keeps working. Methods are
+// enabled when registered. It returns an error if the method does not
+// exist.
+func (server *Server) SetMethodEnabled(svcName, method string, enabled bool) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	s := server.serviceMap[svcName]
+	if s == nil {
+		return errors.New("rpc: can't find service " + svcName)
+	}
+	if s.method[method] == nil {
+		return errors.New("rpc: can't find method " + method)
+	}
+	id := ServiceID{svcName, method}
+	if enabled {
+		delete(server.disabled, id)
+		return nil
+	}
+	if server.disabled == nil {
+		server.disabled = make(map[ServiceID]bool)
+	}
+	server.disabled[id] = true
+	return nil
+}
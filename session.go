@@ -0,0 +1,268 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Session performs calls to a single peer over one dedicated stream.
+// Calls made on a Session are multiplexed on the stream: every request
+// carries an ID and the server sends the responses as soon as they are
+// ready, which are then matched to the right caller. Calls can be made
+// concurrently. Streaming methods cannot be called on a Session.
+//
+// If the stream breaks, the pending calls and any calls made afterwards
+// fail with the error. A new Session must be obtained then. Closing the
+// client ends its sessions, and their calls fail with ErrClientClosed.
+type Session struct {
+	c      *Client
+	pid    peer.ID
+	sw     *streamWrap
+	sealer *sealer
+
+	wmu sync.Mutex // serializes writing requests
+
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]*Call
+	err     error       // set when the session is over
+	stop    func() bool // stops ending the session on Client.Close
+}
+
+// Session opens a stream to the given peer and returns a Session to make
+// calls over it. The context bounds opening the stream only. Sessions to
+// the local server are not supported.
+//
+// The Session must be closed when no longer needed.
+func (c *Client) Session(ctx context.Context, pid peer.ID) (*Session, error) {
+	if c.isLocal(pid) {
+		return nil, errors.New("rpc: cannot open sessions to the local server")
+	}
+	if c.closing.Err() != nil {
+		return nil, ErrClientClosed
+	}
+	sl, err := c.sealer(pid)
+	if err != nil {
+		return nil, err
+	}
+	sw, err := c.newStream(ctx, pid, c.protocolFor(pid))
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		c:       c,
+		pid:     pid,
+		sw:      sw,
+		sealer:  sl,
+		pending: make(map[uint64]*Call),
+	}
+	s.mu.Lock()
+	s.stop = context.AfterFunc(c.closing, func() {
+		s.fail(ErrClientClosed)
+	})
+	s.mu.Unlock()
+	go s.readResponses()
+	return s, nil
+}
+
+// Call performs a call over the session and blocks until it completes.
+// When the context is cancelled, the call returns the context error right
+// away and the response, if it ever arrives, is discarded. The session
+// remains usable.
+func (s *Session) Call(ctx context.Context, svcName, svcMethod string, args, reply interface{}) error {
+	if err := checkReply(ServiceID{svcName, svcMethod}, reply); err != nil {
+		return err
+	}
+	if !s.c.outstanding.begin() {
+		return ErrClientDraining
+	}
+	defer s.c.outstanding.end()
+
+	ctx, requestID := s.c.requestContext(ctx)
+	call := &Call{
+		Dest:  s.pid,
+		SvcID: ServiceID{svcName, svcMethod},
+		Args:  args,
+		Reply: reply,
+		Done:  make(chan *Call, 1),
+		ctx:   ctx,
+	}
+
+	id, err := s.add(call)
+	if err != nil {
+		return err
+	}
+
+	info := CallInfo{
+		Peer:      s.pid,
+		Service:   svcName,
+		Method:    svcMethod,
+		Start:     time.Now(),
+		RequestID: requestID,
+	}
+	inflightID := s.c.inflight.add(info)
+	defer s.c.inflight.remove(inflightID)
+
+	err = s.wait(ctx, id, call)
+	s.c.callStats.record(info, err)
+	return err
+}
+
+// add registers the given call as pending and returns its ID, or the
+// error which ended the session.
+func (s *Session) add(call *Call) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.next++
+	s.pending[s.next] = call
+	return s.next, nil
+}
+
+// wait sends the request for the given call and waits for the response.
+func (s *Session) wait(ctx context.Context, id uint64, call *Call) error {
+	if err := s.sendRequest(id, call); err != nil {
+		s.fail(err)
+		return err
+	}
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *Session) sendRequest(id uint64, call *Call) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.writeRequest(id, call); err != nil {
+		return err
+	}
+	return s.sw.w.Flush()
+}
+
+// writeRequest writes the request for the given call without flushing
+// it. The write lock must be held.
+func (s *Session) writeRequest(id uint64, call *Call) error {
+	header := s.c.callHeader(call, s.sealer)
+	header.ID = id
+	// Only calls with a stream of their own report why they are
+	// cancelled.
+	header.CancelReasons = false
+
+	logger.Debugf("sending RPC %s.%s to %s in session", call.SvcID.Name,
+		call.SvcID.Method, call.Dest)
+	return s.c.writeRequest(s.sw, header, call.Args, s.sealer)
+}
+
+// readResponses reads the responses from the stream and delivers them to
+// the pending calls until the session is over.
+func (s *Session) readResponses() {
+	for {
+		timer, err := awaitResponse(s.sw, s.c.replyDecodeTimeout)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		var resp Response
+		if err := s.sw.dec.Decode(&resp); err != nil {
+			s.fail(timer.stop(err))
+			return
+		}
+		if resp.ID == 0 {
+			// The server gave up on the stream.
+			timer.stop(nil)
+			s.fail(responseError(resp.Error, resp.ServerError))
+			return
+		}
+
+		s.mu.Lock()
+		call := s.pending[resp.ID]
+		s.mu.Unlock()
+
+		if call == nil {
+			// The body must be read even when the call
+			// is gone.
+			var discard interface{}
+			if err := timer.stop(s.sw.dec.Decode(&discard)); err != nil {
+				s.fail(err)
+				return
+			}
+			continue
+		}
+
+		// The call stays pending while the reply is decoded, into a
+		// value of its own since the caller may give up meanwhile.
+		// It is only delivered if the caller is still waiting then.
+		private := privateReply(call.Reply)
+		err = timer.stop(decodeWith(s.c.codec, func(v interface{}) error {
+			return s.c.decodeReply(s.sw, &resp, v, s.sealer, call.SvcID)
+		}, replyTarget(private)))
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		s.mu.Lock()
+		if s.pending[resp.ID] == call {
+			delete(s.pending, resp.ID)
+			if resp.Error != "" {
+				call.Error = responseError(resp.Error, resp.ServerError)
+			}
+			setReply(call.Reply, private)
+			call.done()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// fail ends the session because of the given error, which is returned by
+// all the pending calls.
+func (s *Session) fail(err error) {
+	s.finish(err, true)
+}
+
+// finish ends the session with the given error. The stream is reset or
+// closed gracefully, in which case the server finishes handling the
+// pending requests before closing its end.
+func (s *Session) finish(err error, reset bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	s.stop()
+	for id, call := range s.pending {
+		call.Error = err
+		call.transport = reset
+		call.done()
+		delete(s.pending, id)
+	}
+	if reset {
+		s.sw.stream.Reset()
+		s.c.streamClosed(s.sw, err)
+	} else {
+		s.sw.stream.Close()
+		s.c.streamClosed(s.sw, nil)
+	}
+}
+
+// Close ends the session. Pending calls fail with ErrSessionClosed right
+// away. Close does not wait for the server to finish handling them, and
+// their responses, if any, are discarded.
+func (s *Session) Close() error {
+	s.finish(ErrSessionClosed, false)
+	return nil
+}
@@ -0,0 +1,143 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	ic "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+	codec "github.com/ugorji/go/codec"
+)
+
+// SignedRequest is a request signed by the peer which made it (see
+// WithRequestSigning). It holds everything needed to verify the
+// signature later, so that it can be stored or forwarded and checked
+// independently of the connection it was received on.
+type SignedRequest struct {
+	// Service is the service and method called, as requested.
+	Service ServiceID
+	// Payload holds the encoded arguments, encrypted when using
+	// payload encryption (see WithPayloadEncryption).
+	Payload []byte
+	// Signature is the signature of the service, method and payload.
+	Signature []byte
+	// SignerKey is the marshalled public key of the signer.
+	SignerKey []byte
+}
+
+// signedData returns the data covered by the signature.
+func (r *SignedRequest) signedData() []byte {
+	return append(additionalData(adRequest, r.Service), r.Payload...)
+}
+
+// Verify checks the signature of the request and returns the peer which
+// signed it. It returns ErrBadSignature when the signature is not valid.
+func (r *SignedRequest) Verify() (peer.ID, error) {
+	pk, err := ic.UnmarshalPublicKey(r.SignerKey)
+	if err != nil {
+		return "", ErrBadSignature
+	}
+	ok, err := pk.Verify(r.signedData(), r.Signature)
+	if err != nil || !ok {
+		return "", ErrBadSignature
+	}
+	return peer.IDFromPublicKey(pk)
+}
+
+// SignedRequestFromContext returns the signed request whose handler
+// received the given context. It returns false if the request was not
+// signed.
+func SignedRequestFromContext(ctx context.Context) (*SignedRequest, bool) {
+	r, ok := ctx.Value(signedRequestKey).(*SignedRequest)
+	return r, ok
+}
+
+// marshalPayload encodes v, sealed when sl is not nil, as sent in the
+// body of a request.
+func marshalPayload(h *codec.MsgpackHandle, sl *sealer, v interface{}, ad []byte) ([]byte, error) {
+	if sl != nil {
+		return sl.seal(v, ad)
+	}
+	var buf bytes.Buffer
+	if err := newEncoder(h, &buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalPayload decodes into v a payload made with marshalPayload.
+func unmarshalPayload(h *codec.MsgpackHandle, sl *sealer, payload []byte, v interface{}, ad []byte) error {
+	if sl != nil {
+		return sl.open(payload, v, ad)
+	}
+	return newDecoder(h, bytes.NewReader(payload)).Decode(v)
+}
+
+// writeRequest encodes the given request header followed by the
+// arguments, with the codec named in the header, if any, and sealed when
+// sl is not nil. The request is signed when the
+// client signs requests.
+func (c *Client) writeRequest(sw *streamWrap, header RequestHeader, args interface{}, sl *sealer) error {
+	ad := additionalData(adRequest, header.ServiceID)
+	if header.Codec != "" {
+		payload, err := c.codec.Marshal(args)
+		if err != nil {
+			return err
+		}
+		args = payload
+	}
+	if !c.signRequests {
+		if err := sw.enc.Encode(header); err != nil {
+			return err
+		}
+		return sl.encode(sw.enc, args, ad)
+	}
+
+	if c.host == nil {
+		return errors.New("rpc: cannot sign requests without a host")
+	}
+	key := c.host.Peerstore().PrivKey(c.host.ID())
+	if key == nil {
+		return errors.New("rpc: no private key to sign requests")
+	}
+	payload, err := marshalPayload(c.msgpackHandle, sl, args, ad)
+	if err != nil {
+		return err
+	}
+	signed := SignedRequest{Service: header.ServiceID, Payload: payload}
+	header.Signature, err = key.Sign(signed.signedData())
+	if err != nil {
+		return err
+	}
+	header.SignerKey, err = ic.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return err
+	}
+	if err := sw.enc.Encode(header); err != nil {
+		return err
+	}
+	return sw.enc.Encode(payload)
+}
+
+// readSigned reads the payload of a signed request and verifies that it
+// was signed by the remote peer, if known. It returns ErrBadSignature
+// when it was not, in which case the stream is still usable.
+func (server *Server) readSigned(s *streamWrap, remote peer.ID, header RequestHeader) (*SignedRequest, error) {
+	signed := &SignedRequest{
+		Service:   header.ServiceID,
+		Signature: header.Signature,
+		SignerKey: header.SignerKey,
+	}
+	if err := s.dec.Decode(&signed.Payload); err != nil {
+		return nil, err
+	}
+	signer, err := signed.Verify()
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	if remote != "" && signer != remote {
+		return nil, ErrBadSignature
+	}
+	return signed, nil
+}
@@ -0,0 +1,129 @@
+package rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"sort"
+	"strconv"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// flightGroup tracks the calls made with WithSingleflight which are in
+// progress, by the hash of their parameters.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[[sha256.Size]byte]*flight
+}
+
+// flight is a call shared by all the identical calls made meanwhile.
+type flight struct {
+	done  chan struct{} // closed when the call finishes
+	reply []byte        // the encoded reply
+	err   error
+}
+
+// join returns the flight for the given key, and whether it was created,
+// in which case the caller must perform the call and land the flight.
+func (g *flightGroup) join(key [sha256.Size]byte) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+	if g.flights == nil {
+		g.flights = make(map[[sha256.Size]byte]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// land removes the flight, so that new calls start a new one, and wakes
+// up the calls waiting for it.
+func (g *flightGroup) land(key [sha256.Size]byte, f *flight) {
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+}
+
+// flightKey hashes the parameters identifying a call: the peer, method,
+// arguments and field mask, along with the metadata sent, since replies
+// may depend on it, as with credentials, and any other given tags.
+func (c *Client) flightKey(dest peer.ID, svcID ServiceID, args interface{}, mask FieldMask, md Metadata, tags ...string) ([sha256.Size]byte, error) {
+	encArgs, err := marshalPayload(c.msgpackHandle, nil, args, nil)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	h := sha256.New()
+	write := func(fields ...string) {
+		for _, f := range fields {
+			h.Write([]byte(f))
+			h.Write([]byte{0})
+		}
+	}
+	write(string(dest), svcID.Name, svcID.Method)
+	h.Write(encArgs)
+	if mask != nil {
+		h.Write([]byte{1})
+		write(mask...)
+	}
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h.Write([]byte{2})
+	for _, k := range keys {
+		write(k, md[k])
+	}
+	h.Write([]byte{3})
+	write(tags...)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key, nil
+}
+
+// callShared performs a call made with WithSingleflight, joining the
+// identical call in progress, if any. The reply is shared by encoding it
+// once the call finishes and decoding it into the reply of every call
+// which joined it.
+func (c *Client) callShared(ctx context.Context, dest peer.ID, svcID ServiceID, args, reply interface{}, opts []CallOption) error {
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	// Calls differing in anything sent to the server are not shared.
+	key, err := c.flightKey(dest, svcID, args, o.fieldMask, outgoingMetadata(ctx),
+		RequestIDFromContext(ctx), strconv.FormatBool(o.critical), string(o.protocol))
+	if err != nil {
+		return err
+	}
+	f, leader := c.flights.join(key)
+	if leader {
+		target := reply
+		if target == nil {
+			// Others may be interested in it.
+			var discard interface{}
+			target = &discard
+		}
+		f.err = c.call(ctx, dest, svcID, args, target, opts)
+		if f.err == nil {
+			f.reply, f.err = marshalPayload(c.msgpackHandle, nil, target, nil)
+		}
+		c.flights.land(key, f)
+		return f.err
+	}
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if f.err != nil || reply == nil {
+		return f.err
+	}
+	return unmarshalPayload(c.msgpackHandle, nil, f.reply, reply, nil)
+}
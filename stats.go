@@ -0,0 +1,275 @@
+package rpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ServerStats holds statistics about a Server.
+type ServerStats struct {
+	// OpenStreams is the number of streams currently open.
+	OpenStreams int
+	// RunningCalls is the number of methods currently running,
+	// including those waiting for a pinned worker.
+	RunningCalls int
+	// Workers is the number of pinned workers running, including
+	// those about to exit after Server.SetConcurrency (see
+	// WithPinnedWorkers).
+	Workers int
+	// QueueDepths holds the number of calls waiting for a pinned
+	// worker for every method which has some (see
+	// WithMethodQueueLimit).
+	QueueDepths map[ServiceID]int
+	// TopGoroutinePeers lists the peers with the most handler
+	// goroutines running, most first, up to 10 (see
+	// Server.Goroutines).
+	TopGoroutinePeers []PeerGoroutines
+}
+
+// ClientStats holds statistics about a Client.
+type ClientStats struct {
+	// OpenStreams is the number of streams currently open, including
+	// the idle ones in the stream pool.
+	OpenStreams int
+	// OldestIdleStream is the age of the oldest idle stream in the
+	// stream pool, or zero if there are none.
+	OldestIdleStream time.Duration
+}
+
+// Stats returns the current statistics of the server.
+func (server *Server) Stats() ServerStats {
+	stats := ServerStats{
+		OpenStreams:  server.streams.count(),
+		RunningCalls: server.running.count(),
+
+		TopGoroutinePeers: server.goroutines.top(topGoroutinePeers),
+	}
+	if server.workers != nil {
+		stats.Workers = server.workers.count()
+		stats.QueueDepths = server.workers.queueDepths()
+	}
+	return stats
+}
+
+// Stats returns the current statistics of the client.
+func (c *Client) Stats() ClientStats {
+	stats := ClientStats{
+		OpenStreams: c.streams.count(),
+	}
+	if c.pool != nil {
+		stats.OldestIdleStream = c.pool.oldest()
+	}
+	return stats
+}
+
+// PeerStatus describes the last call made by a Client to a peer.
+type PeerStatus struct {
+	// LastCall is when the last call completed.
+	LastCall time.Time
+	// LastError is the error returned by the last call, if any.
+	LastError error
+	// LastLatency is how long the last call took.
+	LastLatency time.Duration
+	// LastContact is when the peer last answered a call, whether
+	// the method succeeded or not. It is zero if it never did.
+	LastContact time.Time
+}
+
+// PeerStatus returns the status of the last call made to the given peer
+// with Call or Go, and their variants. It returns false if no calls have
+// been made to the peer.
+func (c *Client) PeerStatus(pid peer.ID) (PeerStatus, bool) {
+	return c.peers.get(pid)
+}
+
+// ActivePeers returns the peers which the client has made calls to
+// recently (see WithActivePeersWindow), as recorded by PeerStatus, along
+// with those it is calling right now and those it keeps idle streams to
+// (see WithStreamPool), in no particular order. Local calls do not count.
+// Unlike the peers connected to the host, it reflects RPC activity, which
+// helps deciding which connections to keep.
+func (c *Client) ActivePeers() []peer.ID {
+	active := make(map[peer.ID]bool)
+	since := time.Now().Add(-c.activeWindow)
+	c.peers.mu.Lock()
+	for pid, st := range c.peers.statuses {
+		if st.LastCall.After(since) {
+			active[pid] = true
+		}
+	}
+	c.peers.mu.Unlock()
+	for _, info := range c.inflight.snapshot() {
+		active[info.Peer] = true
+	}
+	if c.pool != nil {
+		for _, pid := range c.pool.peers() {
+			active[pid] = true
+		}
+	}
+	// Local calls do not count.
+	delete(active, "")
+	if c.host != nil {
+		delete(active, c.host.ID())
+	}
+
+	pids := make([]peer.ID, 0, len(active))
+	for pid := range active {
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+// peerStatuses holds the PeerStatus of every peer called.
+type peerStatuses struct {
+	mu       sync.Mutex
+	statuses map[peer.ID]PeerStatus
+}
+
+// update records the outcome of a call started at the given time. The
+// peer answered the call unless it failed in the transport.
+func (p *peerStatuses) update(pid peer.ID, start time.Time, err error, transport bool) {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.statuses == nil {
+		p.statuses = make(map[peer.ID]PeerStatus)
+	}
+	st := p.statuses[pid]
+	st.LastCall = now
+	st.LastError = err
+	st.LastLatency = now.Sub(start)
+	if !transport {
+		st.LastContact = now
+	}
+	p.statuses[pid] = st
+}
+
+func (p *peerStatuses) get(pid peer.ID) (PeerStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.statuses[pid]
+	return st, ok
+}
+
+// limitCounter counts resources in use, such as open streams or running
+// calls, and optionally limits them. The zero value counts without limit.
+type limitCounter struct {
+	max  int64 // zero means no limit
+	used int64
+}
+
+// acquire accounts for a new resource. It returns false when the limit
+// has been reached, in which case the resource must not be used.
+func (c *limitCounter) acquire() bool {
+	n := atomic.AddInt64(&c.used, 1)
+	if c.max > 0 && n > c.max {
+		atomic.AddInt64(&c.used, -1)
+		return false
+	}
+	return true
+}
+
+func (c *limitCounter) release() {
+	atomic.AddInt64(&c.used, -1)
+}
+
+func (c *limitCounter) count() int {
+	return int(atomic.LoadInt64(&c.used))
+}
+
+// StreamOpenFunc is called when a stream is opened. The stream ID is
+// assigned by the Server or the Client, is unique among the streams it
+// handles and matches the one passed to the StreamCloseFunc. The function
+// is called synchronously, so it should return quickly.
+type StreamOpenFunc func(pid peer.ID, streamID uint64)
+
+// StreamCloseFunc is called when a stream is closed. The error is the one
+// which caused it, or nil when the stream finished normally.
+type StreamCloseFunc func(pid peer.ID, streamID uint64, err error)
+
+// streamHooks assigns IDs to streams and calls the configured functions
+// when they are opened and closed.
+type streamHooks struct {
+	next    uint64
+	onOpen  StreamOpenFunc
+	onClose StreamCloseFunc
+}
+
+// opened assigns an ID to the given stream and calls onOpen.
+func (h *streamHooks) opened(stream inet.Stream) uint64 {
+	id := atomic.AddUint64(&h.next, 1)
+	if h.onOpen != nil {
+		h.onOpen(stream.Conn().RemotePeer(), id)
+	}
+	return id
+}
+
+func (h *streamHooks) closed(stream inet.Stream, id uint64, err error) {
+	if h.onClose != nil {
+		h.onClose(stream.Conn().RemotePeer(), id, err)
+	}
+}
+
+// CallStats describes a completed call, for metrics. Service and Method
+// are meant to be used as metric labels, since they take a bounded number
+// of values. Peer is provided for logs and sampling only: using it as a
+// label creates a time series per peer, which makes the cardinality of
+// the metrics grow without bound. Group, which classifies peers into a
+// bounded number of groups (see WithCallStats), is meant to be used
+// instead for per-peer dimensions.
+type CallStats struct {
+	Service string
+	Method  string
+	// Group is the group of the peer, or empty when not grouping
+	// peers.
+	Group string
+	// Peer is the caller for servers and the destination for clients.
+	Peer peer.ID
+	// RequestID is the ID of the logical operation that the call is
+	// part of, if any (see WithRequestID). Like Peer, it must not be
+	// used as a label, but it can be attached to the observations as an
+	// exemplar, to link the metrics to the logs and traces of the calls
+	// behind them, such as those of slow calls.
+	RequestID string
+	Duration  time.Duration
+	// Err is the error returned by the call, if any.
+	Err error
+}
+
+// CallStatsFunc is called with the statistics of every completed call.
+// It is called synchronously, so it should return quickly.
+type CallStatsFunc func(CallStats)
+
+// PeerGroupFunc returns the group of the given peer, such as "trusted"
+// or "public", for CallStats. It must return a bounded number of
+// different values.
+type PeerGroupFunc func(pid peer.ID) string
+
+// callStatsHook reports the statistics of calls, if configured.
+type callStatsHook struct {
+	report CallStatsFunc
+	group  PeerGroupFunc
+}
+
+// record reports the call described by info, which fails with err.
+func (h *callStatsHook) record(info CallInfo, err error) {
+	if h.report == nil {
+		return
+	}
+	stats := CallStats{
+		Service:   info.Service,
+		Method:    info.Method,
+		Peer:      info.Peer,
+		RequestID: info.RequestID,
+		Duration:  time.Since(info.Start),
+		Err:       err,
+	}
+	if h.group != nil {
+		stats.Group = h.group(info.Peer)
+	}
+	h.report(stats)
+}
@@ -0,0 +1,528 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Precompute the reflect type for *ServerStream, which replaces the reply
+// argument in streaming methods.
+var typeOfServerStream = reflect.TypeOf((*ServerStream)(nil))
+
+// frameType identifies the frames sent by the server during a streaming
+// call.
+type frameType int
+
+const (
+	// frameTrailer ends the stream. It carries the error returned by
+	// the method, if any. It is the zero value so that an error
+	// Response, sent when a call is rejected before the method
+	// starts, reads as a trailer too.
+	frameTrailer frameType = iota
+	// frameItem is followed by an item.
+	frameItem
+	// frameKeepalive is sent while the method sends nothing, so that
+	// the stream is not considered idle (see WithStreamKeepalive).
+	frameKeepalive
+)
+
+// streamFrame precedes every message sent by the server in a streaming
+// call. Items are sent as a frameItem followed by the item itself, and
+// the stream ends with a frameTrailer. A stream without a trailer was
+// interrupted, and the items received may not be all that the method
+// produced.
+type streamFrame struct {
+	Type  frameType
+	Error string
+	// ServerError is set on trailers whose error has a meaning of
+	// its own, as in Response.
+	ServerError bool
+	// Cursor is set on items sent with ServerStream.SendAt.
+	Cursor string
+	// Sealed is set on trailers followed by a sealed body, which
+	// authenticates them when using payload encryption.
+	Sealed bool
+}
+
+// ServerStream is used by streaming methods to send items to the client.
+// Streaming methods take a *ServerStream in place of the reply argument:
+//
+//	func (t *T) MethodName(ctx context.Context, argType T1, stream *ServerStream) error
+//
+// The error returned by the method is delivered to the client after all
+// the items sent. When the client goes away before, by closing or
+// resetting the stream, the context of the method is cancelled and Send
+// fails, so that the method can stop producing items. A ServerStream must
+// not be used once the method has returned.
+type ServerStream struct {
+	sw     *streamWrap
+	sealer *sealer   // nil unless items are encrypted
+	svcID  ServiceID // as requested, to seal the items
+	ctx    context.Context
+
+	lastSent time.Time // protected by sw.wmu
+	sent     uint64    // items sent, protected by sw.wmu
+
+	credits *credits // nil without flow control
+
+	// See WithStreamFlushInterval. The timer, protected by sw.wmu, is
+	// set while items are waiting to be flushed.
+	flushInterval time.Duration
+	flushTimer    *time.Timer
+
+	slowTimeout time.Duration // see SetSlowConsumerTimeout
+
+	cursor string // see Cursor
+}
+
+// Send sends an item to the client. Items are flushed immediately, so that
+// they reach the client without delay, unless the server was created with
+// WithStreamFlushInterval, in which case they are buffered for up to that
+// interval, or until the buffer fills up, to save on writes. When the
+// client uses flow control (see WithStreamWindow), Send blocks until the
+// client is ready to receive more items, or until the slow consumer
+// timeout, if any, expires (see WithSlowConsumerTimeout).
+func (s *ServerStream) Send(item interface{}) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	if err := s.acquireCredit(s.ctx); err != nil {
+		return err
+	}
+	s.sw.wmu.Lock()
+	defer s.sw.wmu.Unlock()
+	return s.send(streamFrame{Type: frameItem}, item)
+}
+
+// SendAt sends an item like Send, along with a cursor identifying the
+// position in the stream right after it. The cursor is opaque to the
+// client, which sends back the last one received when resuming the
+// stream with a Subscription, so that the method can carry on from there
+// (see Cursor).
+func (s *ServerStream) SendAt(item interface{}, cursor string) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	if err := s.acquireCredit(s.ctx); err != nil {
+		return err
+	}
+	s.sw.wmu.Lock()
+	defer s.sw.wmu.Unlock()
+	return s.send(streamFrame{Type: frameItem, Cursor: cursor}, item)
+}
+
+// err returns the error which prevents sending items once the context of
+// the method is done: errStreamAbandoned when the client went away, or the
+// context error.
+func (s *ServerStream) err() error {
+	if s.ctx.Err() == nil {
+		return nil
+	}
+	return context.Cause(s.ctx)
+}
+
+// watchClient reads from the stream, on which the client sends nothing
+// else, until the client closes or resets it, and then calls abandon, so
+// that the method stops producing items.
+func (s *ServerStream) watchClient(abandon context.CancelCauseFunc) {
+	var discard interface{}
+	for s.sw.dec.Decode(&discard) == nil {
+	}
+	abandon(errStreamAbandoned)
+}
+
+// SetSlowConsumerTimeout sets how long Send waits for the client to take
+// more items before aborting the stream, in place of the timeout set with
+// WithSlowConsumerTimeout, for this stream. Zero means no timeout. It must
+// not be called concurrently with Send.
+func (s *ServerStream) SetSlowConsumerTimeout(timeout time.Duration) {
+	s.slowTimeout = timeout
+}
+
+// Cursor returns the cursor which the client resumes the stream from,
+// which is the one sent with the last item it received (see SendAt). It is
+// empty when the stream is not being resumed.
+func (s *ServerStream) Cursor() string {
+	return s.cursor
+}
+
+// send encodes a frame and the given body, if any.
+func (s *ServerStream) send(frame streamFrame, body interface{}) error {
+	s.lastSent = time.Now()
+	if err := s.sw.enc.Encode(frame); err != nil {
+		return err
+	}
+	if frame.Sealed {
+		if err := s.sealer.encode(s.sw.enc, nil, trailerAD(s.svcID, s.sent, frame.Error)); err != nil {
+			return err
+		}
+	}
+	if frame.Type == frameItem {
+		s.sent++
+		if err := s.sealer.encode(s.sw.enc, body, itemAD(s.svcID, s.sent, frame.Cursor)); err != nil {
+			return err
+		}
+		if s.flushInterval > 0 {
+			if s.flushTimer == nil {
+				s.flushTimer = time.AfterFunc(s.flushInterval, s.flushScheduled)
+			}
+			return nil
+		}
+	}
+	return s.flush()
+}
+
+// Flush sends the items buffered right away. It is only needed when using
+// WithStreamFlushInterval, to deliver an item without waiting, since that
+// is done on every Send otherwise. Items are always flushed when the
+// method returns.
+func (s *ServerStream) Flush() error {
+	s.sw.wmu.Lock()
+	defer s.sw.wmu.Unlock()
+	return s.flush()
+}
+
+// flushScheduled flushes the items buffered once the flush interval has
+// passed, unless they were flushed meanwhile.
+func (s *ServerStream) flushScheduled() {
+	s.sw.wmu.Lock()
+	defer s.sw.wmu.Unlock()
+	if s.flushTimer != nil {
+		s.flush()
+	}
+}
+
+// flush flushes the stream and cancels any scheduled flush.
+func (s *ServerStream) flush() error {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	return s.sw.w.Flush()
+}
+
+// close sends the trailer with the error returned by the method.
+func (s *ServerStream) close(err error) error {
+	s.sw.wmu.Lock()
+	defer s.sw.wmu.Unlock()
+	frame := streamFrame{Type: frameTrailer, Sealed: s.sealer != nil}
+	if err != nil {
+		frame.Error = err.Error()
+		frame.ServerError = isWireError(err)
+	}
+	return s.send(frame, nil)
+}
+
+// keepalive sends a keepalive frame whenever nothing has been sent for
+// the given interval, until the returned function is called.
+func (s *ServerStream) keepalive(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		t := time.NewTimer(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			s.sw.wmu.Lock()
+			idle := time.Since(s.lastSent)
+			var err error
+			if idle >= interval {
+				err = s.send(streamFrame{Type: frameKeepalive}, nil)
+				idle = 0
+			}
+			s.sw.wmu.Unlock()
+			if err != nil {
+				// The method will fail to send too.
+				return
+			}
+			t.Reset(interval - idle)
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// handleStream runs a streaming method and sends the trailer once it
+// returns.
+func (server *Server) handleStream(ctx context.Context, stream *ServerStream, info CallInfo, policy *Policy, service *service, mtype *methodType, argv reflect.Value) error {
+	stream.lastSent = time.Now()
+	stop := func() {}
+	if server.streamKeepalive > 0 {
+		stop = stream.keepalive(server.streamKeepalive)
+	}
+	err := server.dispatch(ctx, info, policy, service, mtype, argv, reflect.ValueOf(stream))
+	stop()
+	if context.Cause(ctx) == ErrSlowConsumer {
+		// The client is told why, whatever the method returned.
+		err = ErrSlowConsumer
+	}
+	if err != nil {
+		server.errLog.logError("streaming method returned an error:", err)
+	}
+	if err := stream.close(err); err != nil {
+		return err
+	}
+	// The stream is not used for further requests.
+	return io.EOF
+}
+
+// ClientStream receives the items sent by a streaming method. It is
+// obtained with Client.Stream.
+type ClientStream struct {
+	sw       *streamWrap
+	sealer   *sealer
+	svcID    ServiceID
+	ctx      context.Context
+	finished chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+	done     func(err error) // called with the error which broke the stream
+
+	// idleTimeout is set with WithStreamIdleTimeout. waitingSince is
+	// the time, in Unix nanoseconds, since which Recv has been waiting
+	// for a frame, or 0. timedOut is set when the stream is reset
+	// because nothing arrived in time.
+	idleTimeout  time.Duration
+	waitingSince int64
+	timedOut     int32
+
+	// window is set with WithStreamWindow. pending counts the items
+	// received since credits were last granted.
+	window  int
+	pending int
+
+	received uint64 // the number of items received
+	cursor   string // the cursor of the last item received
+	clean    bool   // set when the server ended the stream properly
+	err      error  // set when the stream ends
+}
+
+// Stream performs a call to a streaming method (see ServerStream) in the
+// given peer. Items are read with Recv. The context bounds the whole
+// stream: when it is cancelled, the stream is aborted and Recv returns
+// the context error. See WithStreamIdleTimeout to detect streams which
+// have died silently.
+//
+// Streaming calls to the local server are not supported.
+func (c *Client) Stream(ctx context.Context, dest peer.ID, svcName, svcMethod string, args interface{}) (*ClientStream, error) {
+	return c.stream(ctx, dest, svcName, svcMethod, args, "")
+}
+
+// stream starts a streaming call which resumes from the given cursor, if
+// any.
+func (c *Client) stream(ctx context.Context, dest peer.ID, svcName, svcMethod string, args interface{}, cursor string) (*ClientStream, error) {
+	if c.isLocal(dest) {
+		return nil, errors.New("rpc: cannot make local streaming calls")
+	}
+
+	if !c.outstanding.begin() {
+		return nil, ErrClientDraining
+	}
+	ctx, requestID := c.requestContext(ctx)
+	svcID := ServiceID{svcName, svcMethod}
+	sl, err := c.sealer(dest)
+	if err != nil {
+		c.outstanding.end()
+		return nil, err
+	}
+	sWrap, err := c.newStream(ctx, dest, c.protocolFor(dest))
+	if err != nil {
+		c.outstanding.end()
+		return nil, err
+	}
+
+	header := c.remoteHeader(ctx, svcID)
+	header.Stream = true
+	header.Encrypted = sl.encrypts()
+	header.Checksummed = sl.checksums()
+	header.Window = c.streamWindow
+	header.Cursor = cursor
+
+	logger.Debugf("starting stream %s.%s to %s", svcName, svcMethod, dest)
+	err = c.writeRequest(sWrap, header, args, sl)
+	if err == nil {
+		err = sWrap.w.Flush()
+	}
+	if err != nil {
+		sWrap.stream.Reset()
+		c.streamClosed(sWrap, err)
+		c.outstanding.end()
+		return nil, err
+	}
+
+	id := c.inflight.add(CallInfo{
+		Peer:      dest,
+		Service:   svcName,
+		Method:    svcMethod,
+		Start:     time.Now(),
+		RequestID: requestID,
+	})
+	cs := &ClientStream{
+		sw:       sWrap,
+		sealer:   sl,
+		svcID:    svcID,
+		ctx:      ctx,
+		finished: make(chan struct{}),
+		stopped:  make(chan struct{}),
+		done: func(err error) {
+			c.inflight.remove(id)
+			c.streamClosed(sWrap, err)
+			c.outstanding.end()
+		},
+		idleTimeout: c.streamIdleTimeout,
+		window:      c.streamWindow,
+	}
+	go cs.watch()
+	return cs, nil
+}
+
+// watch aborts the stream when the context is cancelled, or when Recv
+// waits for longer than the idle timeout.
+func (cs *ClientStream) watch() {
+	defer close(cs.stopped)
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if cs.idleTimeout > 0 {
+		timer = time.NewTimer(cs.idleTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case <-cs.ctx.Done():
+			cs.sw.stream.Reset()
+			return
+		case <-cs.finished:
+			return
+		case <-timeout:
+		}
+		waited := cs.waited()
+		if waited >= cs.idleTimeout {
+			atomic.StoreInt32(&cs.timedOut, 1)
+			cs.sw.stream.Reset()
+			return
+		}
+		timer.Reset(cs.idleTimeout - waited)
+	}
+}
+
+// waited returns for how long Recv has been waiting for a frame.
+func (cs *ClientStream) waited() time.Duration {
+	since := atomic.LoadInt64(&cs.waitingSince)
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+// Recv reads the next item into the given pointer. It returns io.EOF when
+// the method finished without error after sending all its items. If the
+// method returned an error, Recv returns that error once all the items
+// sent before it have been received. Any other error means that the
+// stream was interrupted. Once Recv returns an error, it keeps returning
+// it.
+func (cs *ClientStream) Recv(item interface{}) error {
+	if cs.err != nil {
+		return cs.err
+	}
+
+	var frame streamFrame
+	for {
+		atomic.StoreInt64(&cs.waitingSince, time.Now().UnixNano())
+		err := cs.sw.dec.Decode(&frame)
+		atomic.StoreInt64(&cs.waitingSince, 0)
+		if err != nil {
+			if err == io.EOF {
+				// No trailer: do not let it look like a
+				// clean end.
+				err = io.ErrUnexpectedEOF
+			}
+			return cs.end(err, false)
+		}
+		if frame.Type != frameKeepalive {
+			break
+		}
+	}
+
+	switch frame.Type {
+	case frameItem:
+		cs.received++
+		ad := itemAD(cs.svcID, cs.received, frame.Cursor)
+		if err := cs.sealer.decode(cs.sw.payloadDecoder(), item, ad); err != nil {
+			return cs.end(err, false)
+		}
+		if err := cs.consumed(); err != nil {
+			return cs.end(err, false)
+		}
+		if frame.Cursor != "" {
+			cs.cursor = frame.Cursor
+		}
+		return nil
+	case frameTrailer:
+		if cs.sealer != nil {
+			if !frame.Sealed {
+				return cs.end(unauthenticated(frame.Error), false)
+			}
+			var discard interface{}
+			ad := trailerAD(cs.svcID, cs.received, frame.Error)
+			if err := cs.sealer.decode(cs.sw.dec, &discard, ad); err != nil {
+				return cs.end(err, false)
+			}
+		}
+		if frame.Error != "" {
+			return cs.end(responseError(frame.Error, frame.ServerError), true)
+		}
+		return cs.end(io.EOF, true)
+	default:
+		return cs.end(errors.New("rpc: unknown stream frame type"), false)
+	}
+}
+
+// end finishes the stream with the given error. The underlying stream is
+// closed when the server ended it properly and reset otherwise.
+func (cs *ClientStream) end(err error, clean bool) error {
+	cs.once.Do(func() {
+		close(cs.finished)
+		<-cs.stopped
+		switch {
+		case clean:
+		case cs.ctx.Err() != nil:
+			// Any error is likely a consequence of the
+			// stream reset.
+			err = cs.ctx.Err()
+		case atomic.LoadInt32(&cs.timedOut) == 1:
+			err = ErrStreamIdle
+		}
+		cs.clean = clean
+		if clean {
+			cs.sw.stream.Close()
+			cs.done(nil)
+		} else {
+			cs.sw.stream.Reset()
+			cs.done(err)
+		}
+		cs.err = err
+	})
+	return cs.err
+}
+
+// Close aborts the stream, if it has not ended yet. It should always be
+// called when the stream is not read until Recv returns an error.
+func (cs *ClientStream) Close() error {
+	cs.end(errors.New("rpc: stream closed"), false)
+	return nil
+}
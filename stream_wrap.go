@@ -2,10 +2,15 @@ package rpc
 
 import (
 	"bufio"
+	"io"
+	"sync"
+	"time"
 
 	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
 	multicodec "github.com/multiformats/go-multicodec"
 	msgpack "github.com/multiformats/go-multicodec/msgpack"
+	codec "github.com/ugorji/go/codec"
 )
 
 // streamWrap wraps a libp2p stream. We encode/decode whenever we
@@ -17,24 +22,231 @@ type streamWrap struct {
 	dec    multicodec.Decoder
 	w      *bufio.Writer
 	r      *bufio.Reader
+
+	// Used by servers when handling requests multiplexed on the
+	// stream: wmu serializes writes and pending tracks the requests
+	// being handled. Clients use wmu too, see requestSent.
+	wmu     sync.Mutex
+	pending sync.WaitGroup
+
+	pooled bool // taken from wrapPool
+
+	handle *codec.MsgpackHandle // nil for the default one
+
+	// pdec decodes payloads with phandle, when set to a handle other
+	// than the one for headers (see usePayloadHandle).
+	pdec    multicodec.Decoder
+	phandle *codec.MsgpackHandle
+
+	limiter *readLimiter // see limitReads
+
+	id     uint64    // see streamHooks
+	opened time.Time // set by clients only
+	peer   peer.ID   // set by clients only
+
+	// Used by clients reporting cancellation reasons: wmu is held
+	// while writing the request, requestSent is set once written and
+	// cancelSent once the reason has been sent (see sendCancelReason).
+	requestSent bool
+	cancelSent  bool
+
+	ahead chan headerAhead // set by servers, see watchCancel
 }
 
 // wrapStream takes a stream and complements it with r/w bufios and
 // decoder/encoder. In order to write to the stream we can use
 // wrap.w.Write(). To encode something into it we can wrap.enc.Encode().
 // Finally, we should wrap.w.Flush() to actually send the data. Similar
-// for receiving.
-func wrapStream(s inet.Stream) *streamWrap {
+// for receiving. Messages are encoded with the given msgpack handle, or
+// with the default one if nil.
+func wrapStream(s inet.Stream, h *codec.MsgpackHandle) *streamWrap {
 	reader := bufio.NewReader(s)
 	writer := bufio.NewWriter(s)
-	dec := msgpack.Multicodec(msgpack.DefaultMsgpackHandle()).Decoder(reader)
-	enc := msgpack.Multicodec(msgpack.DefaultMsgpackHandle()).Encoder(writer)
 	return &streamWrap{
 		stream: s,
 		r:      reader,
 		w:      writer,
-		enc:    enc,
-		dec:    dec,
+		enc:    newEncoder(h, writer),
+		dec:    newDecoder(h, reader),
+		handle: h,
+	}
+
+}
+
+// wrapPool holds stream wraps, with their buffers, encoder and decoder,
+// for reuse (see WithBufferPool).
+var wrapPool = sync.Pool{
+	New: func() interface{} {
+		reader := bufio.NewReader(nil)
+		writer := bufio.NewWriter(nil)
+		return &streamWrap{
+			r:   reader,
+			w:   writer,
+			enc: newEncoder(nil, writer),
+			dec: newDecoder(nil, reader),
+		}
+	},
+}
+
+// wrapStreamPooled is like wrapStream but reuses a wrap from wrapPool.
+// Pooled wraps always use the default msgpack handle.
+func wrapStreamPooled(s inet.Stream) *streamWrap {
+	sw := wrapPool.Get().(*streamWrap)
+	sw.stream = s
+	sw.r.Reset(s)
+	sw.w.Reset(s)
+	sw.pooled = true
+	return sw
+}
+
+// recycle puts the wrap back in wrapPool, if taken from it. It must only
+// be called once the stream has been closed after being fully read and
+// written, since otherwise the encoder or decoder may be left in a bad
+// state. The wrap must not be used afterwards.
+func (sw *streamWrap) recycle() {
+	if !sw.pooled {
+		return
+	}
+	sw.stream = nil
+	sw.pdec, sw.phandle = nil, nil
+	sw.r.Reset(nil)
+	sw.w.Reset(nil)
+	wrapPool.Put(sw)
+}
+
+// newEncoder returns an Encoder writing to w with the codec used
+// for RPC messages, configured with the given handle.
+func newEncoder(h *codec.MsgpackHandle, w io.Writer) multicodec.Encoder {
+	return msgpackCodec(h).Encoder(w)
+}
+
+// newDecoder returns a Decoder reading from r with the codec used
+// for RPC messages, configured with the given handle.
+func newDecoder(h *codec.MsgpackHandle, r io.Reader) multicodec.Decoder {
+	return msgpackCodec(h).Decoder(r)
+}
+
+// strictHandle returns the handle to decode arguments and replies with,
+// given the one set with WithMsgpackHandle, if any, and the decoding mode
+// set with WithStrictDecoding, if any. The given handle, which may be
+// shared, is copied rather than modified.
+func strictHandle(h *codec.MsgpackHandle, strict *bool) *codec.MsgpackHandle {
+	if strict == nil {
+		return h
+	}
+	var sh codec.MsgpackHandle
+	if h != nil {
+		sh = *h
+	} else {
+		sh = *msgpack.DefaultMsgpackHandle()
+	}
+	sh.ErrorIfNoField = *strict
+	return &sh
+}
+
+// usePayloadHandle makes arguments, replies and items be decoded with the
+// given handle, when it is not the one used for headers, which keep
+// ignoring unknown fields so that peers can add new ones.
+func (sw *streamWrap) usePayloadHandle(h *codec.MsgpackHandle) {
+	if h == sw.handle {
+		return
 	}
+	sw.phandle = h
+	sw.pdec = newDecoder(h, sw.reader())
+}
+
+// payloadDecoder returns the decoder for arguments, replies and items.
+func (sw *streamWrap) payloadDecoder() multicodec.Decoder {
+	if sw.pdec != nil {
+		return sw.pdec
+	}
+	return sw.dec
+}
+
+// payloadHandle returns the handle for arguments, replies and items.
+func (sw *streamWrap) payloadHandle() *codec.MsgpackHandle {
+	if sw.pdec != nil {
+		return sw.phandle
+	}
+	return sw.handle
+}
 
+// reader returns what the decoders read from.
+func (sw *streamWrap) reader() io.Reader {
+	if sw.limiter != nil {
+		return sw.limiter
+	}
+	return sw.r
+}
+
+// msgpackCodec returns the msgpack codec using the given handle, or the
+// default handle if nil (see WithMsgpackHandle).
+func msgpackCodec(h *codec.MsgpackHandle) multicodec.Multicodec {
+	if h == nil {
+		h = msgpack.DefaultMsgpackHandle()
+	}
+	return msgpack.Multicodec(h)
+}
+
+// readLimiter makes reads fail once a number of bytes has been read,
+// while a limit is set. It counts the bytes read too.
+type readLimiter struct {
+	r        io.Reader
+	limited  bool
+	left     int64
+	exceeded bool
+	count    int64
+}
+
+func (l *readLimiter) Read(p []byte) (int, error) {
+	if !l.limited {
+		n, err := l.r.Read(p)
+		l.count += int64(n)
+		return n, err
+	}
+	if l.left <= 0 {
+		l.exceeded = true
+		return 0, ErrHeaderTooLarge
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	l.count += int64(n)
+	return n, err
+}
+
+// enableReadLimits makes the decoder read through a readLimiter, so that
+// limitReads and bytesDecoded can be used.
+func (sw *streamWrap) enableReadLimits() {
+	sw.limiter = &readLimiter{r: sw.r}
+	sw.dec = newDecoder(sw.handle, sw.limiter)
+	if sw.pdec != nil {
+		sw.pdec = newDecoder(sw.phandle, sw.limiter)
+	}
+}
+
+// limitReads makes decoding fail with ErrHeaderTooLarge once n more bytes
+// have been read, or removes the limit when n is zero. It reports whether
+// the previous limit, if any, was exceeded. It does nothing unless
+// enableReadLimits was called.
+func (sw *streamWrap) limitReads(n int64) bool {
+	if sw.limiter == nil {
+		return false
+	}
+	exceeded := sw.limiter.exceeded
+	sw.limiter.limited = n > 0
+	sw.limiter.left = n
+	sw.limiter.exceeded = false
+	return exceeded
+}
+
+// bytesDecoded returns the number of bytes read by the decoder so far, or
+// zero unless enableReadLimits was called.
+func (sw *streamWrap) bytesDecoded() int64 {
+	if sw.limiter == nil {
+		return 0
+	}
+	return sw.limiter.count
 }
@@ -0,0 +1,169 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// DefaultSubscribeAttempts is the default number of consecutive attempts
+// made to reopen a subscription. See SubscribeOptions.
+const DefaultSubscribeAttempts = 3
+
+var errSubscriptionClosed = errors.New("rpc: subscription closed")
+
+// SubscribeOptions configures how a Subscription reconnects.
+type SubscribeOptions struct {
+	// MaxAttempts is the number of consecutive attempts to reopen the
+	// stream after it drops, after which Recv returns the error which
+	// dropped it. Attempts only stop counting as consecutive once an
+	// item is received, so streams dropping again before sending any
+	// items count as failed attempts. Zero means
+	// DefaultSubscribeAttempts.
+	MaxAttempts int
+	// Backoff is how long to wait before the first attempt. It is
+	// doubled after every failed attempt.
+	Backoff time.Duration
+	// OnReconnect, when set, is called every time the stream is
+	// reopened, with the error which dropped it.
+	OnReconnect func(err error)
+}
+
+// Subscription is a streaming call which is resumed when the stream drops
+// because of a transport error. It is obtained with Client.Subscribe.
+type Subscription struct {
+	c         *Client
+	ctx       context.Context
+	dest      peer.ID
+	svcName   string
+	svcMethod string
+	args      interface{}
+	opts      SubscribeOptions
+	attempts  int // consecutive attempts since the last item
+
+	mu     sync.Mutex
+	cs     *ClientStream // protected by mu
+	closed bool          // protected by mu
+}
+
+// Subscribe performs a call to a streaming method like Stream, but the
+// stream is reopened transparently when it is interrupted, for example by
+// a brief disconnection, instead of making Recv fail. The call is made
+// again with the same arguments, resuming from the cursor of the last
+// item received, so that methods sending items with ServerStream.SendAt
+// can carry on from there rather than starting over (see
+// ServerStream.Cursor). Methods which do not use cursors are simply
+// called again. How cursors map to positions in the stream is up to the
+// method.
+//
+// Errors returned by the method, as well as cancelling the context, end
+// the subscription as usual.
+func (c *Client) Subscribe(ctx context.Context, dest peer.ID, svcName, svcMethod string, args interface{}, opts SubscribeOptions) (*Subscription, error) {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultSubscribeAttempts
+	}
+	cs, err := c.Stream(ctx, dest, svcName, svcMethod, args)
+	if err != nil {
+		return nil, err
+	}
+	return &Subscription{
+		c:         c,
+		ctx:       ctx,
+		dest:      dest,
+		svcName:   svcName,
+		svcMethod: svcMethod,
+		args:      args,
+		opts:      opts,
+		cs:        cs,
+	}, nil
+}
+
+// Recv reads the next item into the given pointer, reopening the stream
+// as needed. It returns io.EOF when the method finishes without error,
+// the error returned by the method, or the error which dropped the
+// stream when it could not be reopened. Like ClientStream.Recv, it must
+// not be called concurrently.
+func (s *Subscription) Recv(item interface{}) error {
+	for {
+		s.mu.Lock()
+		cs := s.cs
+		s.mu.Unlock()
+		err := cs.Recv(item)
+		if err == nil {
+			s.attempts = 0
+			return nil
+		}
+		if cs.clean || s.ctx.Err() != nil || s.isClosed() {
+			return err
+		}
+		if err := s.reconnect(cs, err); err != nil {
+			return err
+		}
+	}
+}
+
+// reconnect replaces the given stream, which dropped with the given
+// error, by a new one resuming from its last cursor. It returns the
+// error which dropped the stream when all the attempts fail.
+func (s *Subscription) reconnect(dropped *ClientStream, dropErr error) error {
+	for s.attempts < s.opts.MaxAttempts {
+		if backoff := s.opts.Backoff << s.attempts; backoff > 0 {
+			t := time.NewTimer(backoff)
+			select {
+			case <-s.ctx.Done():
+				t.Stop()
+				return s.ctx.Err()
+			case <-t.C:
+			}
+		}
+		s.attempts++
+		cs, err := s.c.stream(s.ctx, s.dest, s.svcName, s.svcMethod, s.args, dropped.cursor)
+		if err != nil {
+			logger.Debugf("error resuming stream %s.%s to %s: %s", s.svcName, s.svcMethod, s.dest, err)
+			continue
+		}
+		// The new stream keeps the cursor until it receives items.
+		cs.cursor = dropped.cursor
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			cs.Close()
+			return errSubscriptionClosed
+		}
+		s.cs = cs
+		s.mu.Unlock()
+		if s.opts.OnReconnect != nil {
+			s.opts.OnReconnect(dropErr)
+		}
+		return nil
+	}
+	return dropErr
+}
+
+// Cursor returns the cursor of the last item received, from which the
+// stream is resumed. It must not be called concurrently with Recv.
+func (s *Subscription) Cursor() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cs.cursor
+}
+
+func (s *Subscription) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close ends the subscription. It should always be called when Recv is
+// not called until it returns an error.
+func (s *Subscription) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	cs := s.cs
+	s.mu.Unlock()
+	return cs.Close()
+}
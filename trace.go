@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// CallTrace holds the time spent in every phase of a call made with
+// WithCallTrace, as measured by the client, along with the timings
+// reported by the server. Comparing them tells apart the time spent in
+// the network from the time spent in the server queuing or running the
+// method: the network, and writing the response in the server, account
+// for ReadResponse minus the server timings.
+type CallTrace struct {
+	// StreamOpen is the time spent obtaining a stream, which includes
+	// dialing the peer and negotiating the protocol, unless a pooled
+	// stream was reused.
+	StreamOpen time.Duration
+	// Reused is set when a pooled stream was reused.
+	Reused bool
+	// WriteRequest is the time spent encoding and sending the request.
+	WriteRequest time.Duration
+	// ReadResponse is the time from the request being sent until the
+	// response header was received.
+	ReadResponse time.Duration
+	// Decode is the time spent reading and decoding the reply.
+	Decode time.Duration
+	// Server holds the timings reported by the server. It is the zero
+	// value if the server did not report them.
+	Server ServerTrace
+	// Conn describes the connection which the call was made on.
+	Conn ConnInfo
+}
+
+// ConnInfo describes the connection and the stream used by a call, to
+// tell apart calls made over different transports. The transport is
+// given by the addresses, such as /ip4/.../tcp/... or /ip4/.../udp/.../quic.
+// The libp2p version used here does not expose the security protocol
+// and the stream multiplexer negotiated for the connection.
+type ConnInfo struct {
+	// Protocol is the protocol negotiated for the stream.
+	Protocol protocol.ID
+	// LocalAddr and RemoteAddr are the addresses of both ends of the
+	// connection.
+	LocalAddr  ma.Multiaddr
+	RemoteAddr ma.Multiaddr
+}
+
+// streamConnInfo returns the ConnInfo for the given stream.
+func streamConnInfo(s inet.Stream) ConnInfo {
+	info := ConnInfo{Protocol: s.Protocol()}
+	if conn := s.Conn(); conn != nil {
+		info.LocalAddr = conn.LocalMultiaddr()
+		info.RemoteAddr = conn.RemoteMultiaddr()
+	}
+	return info
+}
+
+// ServerTrace holds the timings of a call measured by the server, which
+// reports them when the client uses WithCallTrace.
+type ServerTrace struct {
+	// Decode is the time spent reading and decoding the arguments.
+	Decode time.Duration
+	// Queue is the time from the arguments being decoded until the
+	// method started, which includes the interceptors of the policy
+	// in place and waiting for a worker (see WithPinnedWorkers).
+	Queue time.Duration
+	// Handler is the time spent running the method.
+	Handler time.Duration
+
+	decoded time.Time
+}
+
+// serverTrace returns the trace of the call whose handler will receive
+// the given context, if the client asked for it.
+func serverTrace(ctx context.Context) *ServerTrace {
+	tr, _ := ctx.Value(traceKey).(*ServerTrace)
+	return tr
+}
+
+// traced runs the method of a call, timing it when the client asked for
+// it.
+func traced(ctx context.Context, method func() error) error {
+	tr := serverTrace(ctx)
+	if tr == nil {
+		return method()
+	}
+	start := time.Now()
+	tr.Queue = start.Sub(tr.decoded)
+	defer func() {
+		tr.Handler = time.Since(start)
+	}()
+	return method()
+}
@@ -0,0 +1,283 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"reflect"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// CallResult performs a call with Client.CallContext and returns the
+// reply, which is decoded into a new value of type T. It saves declaring
+// a reply variable for methods returning a single value:
+//
+//	sum, err := rpc.CallResult[int](ctx, c, pid, "Arith", "Add", args)
+//
+// On error, the zero value of T is returned.
+func CallResult[T any](ctx context.Context, c *Client, dest peer.ID, svcName, svcMethod string, args interface{}, opts ...CallOption) (T, error) {
+	var reply T
+	if err := c.CallContext(ctx, dest, svcName, svcMethod, args, &reply, opts...); err != nil {
+		var zero T
+		return zero, err
+	}
+	return reply, nil
+}
+
+// CallInt performs a call whose reply is an int. See CallResult.
+func CallInt(ctx context.Context, c *Client, dest peer.ID, svcName, svcMethod string, args interface{}, opts ...CallOption) (int, error) {
+	return CallResult[int](ctx, c, dest, svcName, svcMethod, args, opts...)
+}
+
+// CallInt64 performs a call whose reply is an int64. See CallResult.
+func CallInt64(ctx context.Context, c *Client, dest peer.ID, svcName, svcMethod string, args interface{}, opts ...CallOption) (int64, error) {
+	return CallResult[int64](ctx, c, dest, svcName, svcMethod, args, opts...)
+}
+
+// CallUint64 performs a call whose reply is a uint64. See CallResult.
+func CallUint64(ctx context.Context, c *Client, dest peer.ID, svcName, svcMethod string, args interface{}, opts ...CallOption) (uint64, error) {
+	return CallResult[uint64](ctx, c, dest, svcName, svcMethod, args, opts...)
+}
+
+// CallFloat64 performs a call whose reply is a float64. See CallResult.
+func CallFloat64(ctx context.Context, c *Client, dest peer.ID, svcName, svcMethod string, args interface{}, opts ...CallOption) (float64, error) {
+	return CallResult[float64](ctx, c, dest, svcName, svcMethod, args, opts...)
+}
+
+// CallString performs a call whose reply is a string. See CallResult.
+func CallString(ctx context.Context, c *Client, dest peer.ID, svcName, svcMethod string, args interface{}, opts ...CallOption) (string, error) {
+	return CallResult[string](ctx, c, dest, svcName, svcMethod, args, opts...)
+}
+
+// CallBool performs a call whose reply is a bool. See CallResult.
+func CallBool(ctx context.Context, c *Client, dest peer.ID, svcName, svcMethod string, args interface{}, opts ...CallOption) (bool, error) {
+	return CallResult[bool](ctx, c, dest, svcName, svcMethod, args, opts...)
+}
+
+// CallBytes performs a call whose reply is a byte slice. See CallResult.
+func CallBytes(ctx context.Context, c *Client, dest peer.ID, svcName, svcMethod string, args interface{}, opts ...CallOption) ([]byte, error) {
+	return CallResult[[]byte](ctx, c, dest, svcName, svcMethod, args, opts...)
+}
+
+// StreamItems returns an iterator over the items received on the given
+// stream, which are decoded into values of type T:
+//
+//	for item, err := range rpc.StreamItems[int](cs) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// The iteration ends after the last item when the method finishes without
+// error. Otherwise, the error returned by ClientStream.Recv is yielded
+// along with the zero value as the last element. The stream is closed when
+// the loop is left before the end. The stream can only be iterated over
+// once and must not be read with Recv meanwhile.
+func StreamItems[T any](cs *ClientStream) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for {
+			var item T
+			err := cs.Recv(&item)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+			if !yield(item, nil) {
+				cs.Close()
+				return
+			}
+		}
+	}
+}
+
+// PeerItem is an item received by StreamMany, along with the peer which
+// sent it. When Err is set, the stream to the peer failed and Item is the
+// zero value.
+type PeerItem[T any] struct {
+	Peer peer.ID
+	Item T
+	Err  error
+}
+
+// StreamMany calls the given streaming method in all the given peers
+// concurrently, with the same arguments, and merges the items received
+// into the returned channel, in the order they arrive. Streams which fail
+// to open or end with an error produce a last PeerItem holding the error.
+// The channel is closed once all the streams have ended. Cancelling the
+// context aborts all the streams, after which the remaining items are
+// discarded. The channel must be drained until closed, or the context
+// cancelled, for the streams to be released.
+func StreamMany[T any](ctx context.Context, c *Client, pids []peer.ID, svcName, svcMethod string, args interface{}) <-chan PeerItem[T] {
+	out := make(chan PeerItem[T], len(pids))
+	send := func(pi PeerItem[T]) bool {
+		select {
+		case out <- pi:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(pids))
+	for _, pid := range pids {
+		go func(pid peer.ID) {
+			defer wg.Done()
+			cs, err := c.Stream(ctx, pid, svcName, svcMethod, args)
+			if err != nil {
+				send(PeerItem[T]{Peer: pid, Err: err})
+				return
+			}
+			defer cs.Close()
+			for item, err := range StreamItems[T](cs) {
+				if !send(PeerItem[T]{Peer: pid, Item: item, Err: err}) {
+					return
+				}
+			}
+		}(pid)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// RegisterMethod publishes the given function in the server as the method
+// of the given service, which is created if needed. Several methods can be
+// registered for a service this way, but not for services registered with
+// Register or RegisterName. The function is called directly with the
+// decoded arguments, without reflection, and the reply it returns is sent
+// back to the client. Arguments and replies are encoded just like for
+// methods published with Register, so both kinds are interchangeable for
+// clients. Pipe methods cannot be registered this way, and streaming ones
+// are registered with RegisterStream.
+func RegisterMethod[Arg, Reply any](server *Server, svcName, method string, fn func(context.Context, Arg) (Reply, error)) error {
+	mtype := &methodType{
+		method:     reflect.Method{Name: method},
+		ArgType:    reflect.TypeOf((*Arg)(nil)).Elem(),
+		ReplyType:  reflect.TypeOf((*Reply)(nil)),
+		hasContext: true,
+		fn: func(ctx context.Context, argv, replyv reflect.Value) error {
+			reply, err := fn(ctx, argv.Interface().(Arg))
+			if err != nil {
+				return err
+			}
+			*replyv.Interface().(*Reply) = reply
+			return nil
+		},
+	}
+	if mtype.ReplyType == typeOfServerStream || mtype.ReplyType == typeOfPipe {
+		return errors.New("rpc.RegisterMethod: streaming and pipe methods are not supported")
+	}
+	return server.registerMethod(svcName, mtype)
+}
+
+// Stream is a ServerStream sending items of type T, used by streaming
+// methods registered with RegisterStream.
+type Stream[T any] struct {
+	s *ServerStream
+}
+
+// Send sends an item to the client. See ServerStream.Send.
+func (s Stream[T]) Send(item T) error {
+	return s.s.Send(item)
+}
+
+// SendAt sends an item along with a cursor. See ServerStream.SendAt.
+func (s Stream[T]) SendAt(item T, cursor string) error {
+	return s.s.SendAt(item, cursor)
+}
+
+// Cursor returns the cursor which the client resumes the stream from. See
+// ServerStream.Cursor.
+func (s Stream[T]) Cursor() string {
+	return s.s.Cursor()
+}
+
+// Flush sends the items buffered right away. See ServerStream.Flush.
+func (s Stream[T]) Flush() error {
+	return s.s.Flush()
+}
+
+// RegisterStream publishes the given function in the server as a
+// streaming method of the given service, like RegisterMethod does for
+// regular methods. The function is called with the decoded arguments and
+// a Stream to send the items, which are received by clients like those of
+// any streaming method, with CallStream for example.
+func RegisterStream[Arg, Item any](server *Server, svcName, method string, fn func(context.Context, Arg, Stream[Item]) error) error {
+	mtype := &methodType{
+		method:     reflect.Method{Name: method},
+		ArgType:    reflect.TypeOf((*Arg)(nil)).Elem(),
+		ReplyType:  typeOfServerStream,
+		hasContext: true,
+		streaming:  true,
+		fn: func(ctx context.Context, argv, replyv reflect.Value) error {
+			stream := replyv.Interface().(*ServerStream)
+			return fn(ctx, argv.Interface().(Arg), Stream[Item]{stream})
+		},
+	}
+	return server.registerMethod(svcName, mtype)
+}
+
+// CallStream performs a call to a streaming method with Client.Stream and
+// returns an iterator over the items received, which are decoded into
+// values of type Item (see StreamItems):
+//
+//	items, err := rpc.CallStream[Query, Result](ctx, c, pid, "Search", "Find", q)
+//	if err != nil {
+//		return err
+//	}
+//	for result, err := range items {
+//		...
+//	}
+//
+// The error is that of opening the stream. The stream is released once
+// the iteration ends, so the iterator must be used, and only once.
+func CallStream[Arg, Item any](ctx context.Context, c *Client, dest peer.ID, svcName, svcMethod string, args Arg) (iter.Seq2[Item, error], error) {
+	cs, err := c.Stream(ctx, dest, svcName, svcMethod, args)
+	if err != nil {
+		return nil, err
+	}
+	return StreamItems[Item](cs), nil
+}
+
+// registerMethod adds the given method to a service holding only methods
+// registered with RegisterMethod. Services are replaced rather than
+// modified, since they are used without holding the lock.
+func (server *Server) registerMethod(svcName string, mtype *methodType) error {
+	if svcName == "" || mtype.method.Name == "" {
+		return errors.New("rpc.RegisterMethod: empty service or method name")
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.serviceMap == nil {
+		server.serviceMap = make(map[string]*service)
+	}
+	if _, ok := server.lazy[svcName]; ok {
+		return errors.New("rpc: service already defined: " + svcName)
+	}
+	s := &service{name: svcName, method: make(map[string]*methodType)}
+	if old, ok := server.serviceMap[svcName]; ok {
+		if old.rcvr.IsValid() {
+			return errors.New("rpc: service already defined: " + svcName)
+		}
+		if _, ok := old.method[mtype.method.Name]; ok {
+			return errors.New("rpc: method already defined: " + svcName + "." + mtype.method.Name)
+		}
+		for name, m := range old.method {
+			s.method[name] = m
+		}
+	}
+	s.method[mtype.method.Name] = mtype
+	server.serviceMap[svcName] = s
+	return nil
+}
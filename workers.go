@@ -0,0 +1,159 @@
+package rpc
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// workerPool runs method calls on a set of goroutines, each locked to its
+// own OS thread. The set can be resized.
+type workerPool struct {
+	tasks chan func()
+
+	mu      sync.Mutex
+	size    int               // the number of workers wanted
+	running int               // the number of workers running
+	shrunk  chan struct{}     // closed when the pool shrinks
+	queued  map[ServiceID]int // the calls waiting for a worker
+	stopped bool              // see stop
+}
+
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{
+		tasks:  make(chan func()),
+		shrunk: make(chan struct{}),
+		queued: make(map[ServiceID]int),
+	}
+	p.resize(n)
+	return p
+}
+
+// resize starts or stops workers so that n of them run. Workers which
+// are stopped finish the call they are running first.
+func (p *workerPool) resize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	if n < p.size {
+		// Wake the idle workers up so that they check whether
+		// they must exit.
+		close(p.shrunk)
+		p.shrunk = make(chan struct{})
+	}
+	p.size = n
+	for ; p.running < n; p.running++ {
+		go p.work()
+	}
+}
+
+// stop makes all the workers exit once they finish the call they are
+// running, if any. The pool cannot be used afterwards: resizing it does
+// nothing and calls fail with ErrShuttingDown.
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	p.size = 0
+	close(p.shrunk)
+	p.shrunk = make(chan struct{})
+}
+
+func (p *workerPool) work() {
+	runtime.LockOSThread()
+	for {
+		p.mu.Lock()
+		if p.running > p.size {
+			p.running--
+			p.mu.Unlock()
+			return
+		}
+		shrunk := p.shrunk
+		p.mu.Unlock()
+
+		select {
+		case task := <-p.tasks:
+			task()
+		case <-shrunk:
+		}
+	}
+}
+
+func (p *workerPool) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+// queueDepths returns the number of calls waiting for a worker for every
+// method which has some.
+func (p *workerPool) queueDepths() map[ServiceID]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	depths := make(map[ServiceID]int, len(p.queued))
+	for svcID, n := range p.queued {
+		depths[svcID] = n
+	}
+	return depths
+}
+
+// run executes f, a call to the given method, in one of the workers and
+// waits for it to finish. It gives up and returns the context error if the
+// context is done before a worker becomes available, and ErrQueueFull
+// if limit calls to the method are waiting already, unless limit is zero.
+// Once the pool is stopped, it returns ErrShuttingDown.
+func (p *workerPool) run(ctx context.Context, svcID ServiceID, limit int, f func()) error {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return ErrShuttingDown
+	}
+	if limit > 0 && p.queued[svcID] >= limit {
+		p.mu.Unlock()
+		return ErrQueueFull
+	}
+	p.queued[svcID]++
+	p.mu.Unlock()
+	dequeue := func() {
+		p.mu.Lock()
+		if p.queued[svcID]--; p.queued[svcID] == 0 {
+			delete(p.queued, svcID)
+		}
+		p.mu.Unlock()
+	}
+
+	done := make(chan struct{})
+	task := func() {
+		defer close(done)
+		f()
+	}
+	select {
+	case p.tasks <- task:
+		dequeue()
+	case <-ctx.Done():
+		dequeue()
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// SetConcurrency changes the number of workers of a server created with
+// WithPinnedWorkers to n, which must be at least 1. New workers start
+// right away, while those in excess exit once they finish the call they
+// are running, if any. It can be called at any time, while calls are
+// being handled. It has no effect on servers without pinned workers, nor
+// once the server is shut down, which stops all the workers.
+func (server *Server) SetConcurrency(n int) {
+	if server.workers != nil {
+		server.workers.resize(n)
+	}
+}